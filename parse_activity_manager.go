@@ -0,0 +1,139 @@
+package cpuprof
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type ActivityManagerProcState int
+
+const (
+	AM_PROC_START ActivityManagerProcState = iota
+	AM_PROC_DIED  ActivityManagerProcState = iota
+)
+
+const (
+	// Linux truncates a task's comm to this many characters. Android names
+	// the main thread of an app after the last characters of its process name.
+	COMM_LENGTH = 15
+
+	// Uids of apps and isolated processes of user 0. Every other user's
+	// uids are offset by PER_USER_RANGE.
+	FIRST_APPLICATION_UID = 10000
+	FIRST_ISOLATED_UID    = 99000
+	PER_USER_RANGE        = 100000
+
+	UID_UNKNOWN = -1
+)
+
+// ActivityManagerProc is an ActivityManager logline about a process starting
+// or going away. Process is the full process name, such as
+// com.google.android.gms:persistent.
+type ActivityManagerProc struct {
+	Logline *Logline
+	State   ActivityManagerProcState
+	Pid     int
+	Uid     int
+	Process string
+}
+
+// Package is the process name without the suffix of a named process
+func (amp *ActivityManagerProc) Package() string {
+	return ProcessPackage(amp.Process)
+}
+
+func ProcessPackage(process string) string {
+	if idx := strings.Index(process, ":"); idx >= 0 {
+		return process[:idx]
+	}
+	return process
+}
+
+/* Formats:
+Start proc com.android.dialer for activity com.android.dialer/.DialtactsActivity: pid=1234 uid=10012 gids={50012, 3003}
+Start proc 1234:com.android.dialer/u0a12 for activity com.android.dialer/.DialtactsActivity
+Process com.android.dialer (pid 1234) has died
+Killing 1234:com.android.dialer/u0a12 (adj 15): empty
+*/
+var AM_START_PROC_PATTERN = regexp.MustCompile(`` +
+	`^Start proc (?P<process>\S+) for .*?: pid=(?P<pid>\d+) uid=(?P<uid>\d+)`)
+var AM_START_PROC_USER_PATTERN = regexp.MustCompile(`` +
+	`^Start proc (?P<pid>\d+):(?P<process>[^/\s]+)/(?P<uid>\S+) for `)
+var AM_PROC_DIED_PATTERN = regexp.MustCompile(`` +
+	`^Process (?P<process>\S+) \(pid (?P<pid>\d+)\) has died`)
+var AM_KILLING_PATTERN = regexp.MustCompile(`` +
+	`^Killing (?P<pid>\d+):(?P<process>[^/\s]+)/(?P<uid>\S+) `)
+
+var USER_UID_PATTERN = regexp.MustCompile(`^u(?P<user>\d+)(?P<kind>[ai]?)(?P<id>\d*)$`)
+
+// ParseUid parses a uid as printed by ActivityManager: either a number or a
+// user id like u0a12. It returns UID_UNKNOWN if uid is neither.
+func ParseUid(uid string) int {
+	if v, err := strconv.Atoi(uid); err == nil {
+		return v
+	}
+	values := USER_UID_PATTERN.FindStringSubmatch(uid)
+	if values == nil {
+		return UID_UNKNOWN
+	}
+	user, _ := strconv.Atoi(values[1])
+	id, err := strconv.Atoi(values[3])
+	if err != nil {
+		return UID_UNKNOWN
+	}
+	switch values[2] {
+	case "a":
+		return user*PER_USER_RANGE + FIRST_APPLICATION_UID + id
+	case "i":
+		return user*PER_USER_RANGE + FIRST_ISOLATED_UID + id
+	default:
+		return user*PER_USER_RANGE + id
+	}
+}
+
+func ParseActivityManagerProc(logline *Logline) *ActivityManagerProc {
+	if logline == nil || strings.Compare(logline.Tag, "ActivityManager") != 0 {
+		return nil
+	}
+	payload := strings.TrimSpace(logline.Payload)
+
+	patterns := []struct {
+		pattern *regexp.Regexp
+		state   ActivityManagerProcState
+	}{
+		{AM_START_PROC_PATTERN, AM_PROC_START},
+		{AM_START_PROC_USER_PATTERN, AM_PROC_START},
+		{AM_PROC_DIED_PATTERN, AM_PROC_DIED},
+		{AM_KILLING_PATTERN, AM_PROC_DIED},
+	}
+	for _, p := range patterns {
+		values := p.pattern.FindStringSubmatch(payload)
+		if values == nil {
+			continue
+		}
+		kv_map := map[string]string{}
+		for i, name := range p.pattern.SubexpNames() {
+			kv_map[name] = values[i]
+		}
+		pid, err := strconv.Atoi(kv_map["pid"])
+		if err != nil {
+			return nil
+		}
+		uid := UID_UNKNOWN
+		if v, ok := kv_map["uid"]; ok {
+			uid = ParseUid(v)
+		}
+		return &ActivityManagerProc{logline, p.state, pid, uid, kv_map["process"]}
+	}
+	return nil
+}
+
+// CommMatches is true if comm is what Linux would name the main thread of
+// process
+func CommMatches(comm string, process string) bool {
+	if len(process) <= COMM_LENGTH {
+		return strings.Compare(comm, process) == 0
+	}
+	return strings.Compare(comm, process[len(process)-COMM_LENGTH:]) == 0
+}
@@ -0,0 +1,51 @@
+package cpuprof
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseActivityManagerProc(t *testing.T) {
+	assert := assert.New(t)
+
+	prefix := "6b793913-7cd9-477a-bbfa-62f07fbac87b 2016-04-21 09:59:01.199025638 11553177 [29981.752359]   790   806 I ActivityManager: "
+	tests := []struct {
+		payload string
+		state   ActivityManagerProcState
+		pid     int
+		uid     int
+		process string
+		pkg     string
+	}{
+		{"Start proc com.android.dialer for activity com.android.dialer/.DialtactsActivity: pid=1234 uid=10012 gids={50012, 3003}", AM_PROC_START, 1234, 10012, "com.android.dialer", "com.android.dialer"},
+		{"Start proc 2345:com.google.android.gms:persistent/u0a15 for service com.google.android.gms/.Service", AM_PROC_START, 2345, 10015, "com.google.android.gms:persistent", "com.google.android.gms"},
+		{"Start proc 3456:com.android.chrome:sandboxed_process0/u10i3 for service com.android.chrome/.Sandbox", AM_PROC_START, 3456, 1099003, "com.android.chrome:sandboxed_process0", "com.android.chrome"},
+		{"Process com.android.dialer (pid 1234) has died", AM_PROC_DIED, 1234, UID_UNKNOWN, "com.android.dialer", "com.android.dialer"},
+		{"Killing 2345:com.google.android.gms:persistent/u0a15 (adj 15): empty #17", AM_PROC_DIED, 2345, 10015, "com.google.android.gms:persistent", "com.google.android.gms"},
+	}
+	for _, test := range tests {
+		logline := ParseLogline(prefix + test.payload)
+		assert.NotNil(logline, test.payload)
+		amp := ParseActivityManagerProc(logline)
+		if !assert.NotNil(amp, test.payload) {
+			continue
+		}
+		assert.Equal(test.state, amp.State, test.payload)
+		assert.Equal(test.pid, amp.Pid, test.payload)
+		assert.Equal(test.uid, amp.Uid, test.payload)
+		assert.Equal(test.process, amp.Process, test.payload)
+		assert.Equal(test.pkg, amp.Package(), test.payload)
+	}
+
+	assert.Nil(ParseActivityManagerProc(ParseLogline(prefix + "Displayed com.android.dialer/.DialtactsActivity: +312ms")))
+	other := "6b793913-7cd9-477a-bbfa-62f07fbac87b 2016-04-21 09:59:01.199025638 11553177 [29981.752359]   790   806 I Other: Process com.android.dialer (pid 1234) has died"
+	assert.Nil(ParseActivityManagerProc(ParseLogline(other)))
+
+	assert.Equal(1000, ParseUid("1000"))
+	assert.Equal(UID_UNKNOWN, ParseUid("system"))
+
+	assert.True(CommMatches(".android.dialer", "com.android.dialer"))
+	assert.True(CommMatches("surfaceflinger", "surfaceflinger"))
+	assert.False(CommMatches("Binder_1", "com.android.dialer"))
+}
@@ -83,6 +83,49 @@ func ParseMsmThermalPrintk(logline *Logline) *MsmThermalPrintk {
 	return mtp
 }
 
+// MSM_THERMAL_NO_LIMIT is the frequency limit msm_thermal logs when it lifts
+// its limit on a CPU
+const MSM_THERMAL_NO_LIMIT = 4294967295
+
+type MsmThermalFreqLimitPrintk struct {
+	Logline *Logline
+	Cpu     int
+	// Highest frequency the CPU may run at, in kHz, or MSM_THERMAL_NO_LIMIT
+	MaxFrequency int64
+}
+
+/* Printk pattern example: <6>[  512.237802] msm_thermal: Limiting cpu0 max frequency to 1728000 */
+var MSM_THERMAL_FREQ_LIMIT_PRINTK_PATTERN = regexp.MustCompile(PRINTK_PATTERN_STRING +
+	`\s*msm_thermal: Limiting cpu(?P<cpu>\d+) max frequency to (?P<max_freq>\d+)`)
+
+func ParseMsmThermalFreqLimitPrintk(logline *Logline) *MsmThermalFreqLimitPrintk {
+	names := MSM_THERMAL_FREQ_LIMIT_PRINTK_PATTERN.SubexpNames()
+	values_raw := MSM_THERMAL_FREQ_LIMIT_PRINTK_PATTERN.FindAllStringSubmatch(logline.Payload, -1)
+	if values_raw == nil {
+		return nil
+	}
+
+	values := values_raw[0]
+
+	kv_map := map[string]string{}
+
+	for i, value := range values {
+		kv_map[names[i]] = value
+	}
+
+	mtflp := new(MsmThermalFreqLimitPrintk)
+	mtflp.Logline = logline
+	cpu, err := strconv.ParseInt(kv_map["cpu"], 0, 32)
+	if err != nil {
+		return nil
+	}
+	mtflp.Cpu = int(cpu)
+	if mtflp.MaxFrequency, err = strconv.ParseInt(kv_map["max_freq"], 0, 64); err != nil {
+		return nil
+	}
+	return mtflp
+}
+
 type PowerManagementPrintk struct {
 	Logline  *Logline
 	State    PowerManagementState
@@ -151,12 +194,13 @@ type Healthd struct {
 	Chg       string
 }
 
+// ParseHealthdPrintk returns nil if logline is not a healthd battery printk
 func ParseHealthdPrintk(logline *Logline) *Healthd {
 	names := HEALTHD_PATTERN.SubexpNames()
 	values_raw := HEALTHD_PATTERN.FindAllStringSubmatch(logline.Payload, -1)
 	if len(values_raw) == 0 {
 		fmt.Fprintln(os.Stderr, "Failed to parse:", logline.Line)
-		os.Exit(-1)
+		return nil
 	}
 	values := values_raw[0]
 
@@ -5,7 +5,6 @@ import (
 	"os"
 	"regexp"
 	"strconv"
-	"strings"
 	"time"
 )
 
@@ -134,6 +133,10 @@ func ParseTraceFromLoglinePayload(logline *Logline) (ti TraceInterface) {
 		ti = thermal_temp(kv_map["text"], trace)
 	case "cpu_frequency":
 		ti = cpu_frequency(kv_map["text"], trace)
+	case "cpu_frequency_switch_start":
+		ti = cpu_frequency_switch_start(kv_map["text"], trace)
+	case "cpu_frequency_switch_end":
+		ti = cpu_frequency_switch_end(kv_map["text"], trace)
 	case "phonelab_proc_foreground":
 		ti = phonelab_proc_foreground(kv_map["text"], trace)
 	case "phonelab_periodic_ctx_switch_info":
@@ -157,6 +160,10 @@ func common_parse(text string, constant int, trace *Trace) (ti TraceInterface) {
 		regex = THERMAL_TEMP_PATTERN
 	case CPU_FREQUENCY_CONST:
 		regex = CPU_FREQUENCY_PATTERN
+	case CPU_FREQUENCY_SWITCH_START_CONST:
+		regex = CPU_FREQUENCY_SWITCH_START_PATTERN
+	case CPU_FREQUENCY_SWITCH_END_CONST:
+		regex = CPU_FREQUENCY_SWITCH_END_PATTERN
 	case PHONELAB_NUM_ONLINE_CPUS_CONST:
 		regex = PHONELAB_NUM_ONLINE_CPUS_PATTERN
 	case PHONELAB_PROC_FOREGROUND_CONST:
@@ -231,6 +238,36 @@ func common_parse(text string, constant int, trace *Trace) (ti TraceInterface) {
 		cf.State = int(state)
 		cf.CpuId = int(cpu_id)
 		ti = cf
+	case CPU_FREQUENCY_SWITCH_START_CONST:
+		cfss := new(CpuFrequencySwitchStart)
+		cfss.Trace = trace
+		var tmp int64
+		if tmp, err = strconv.ParseInt(dict["start"], 0, 32); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to parse start")
+			return nil
+		}
+		cfss.Start = int(tmp)
+		if tmp, err = strconv.ParseInt(dict["end"], 0, 32); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to parse end")
+			return nil
+		}
+		cfss.End = int(tmp)
+		if tmp, err = strconv.ParseInt(dict["cpu_id"], 0, 32); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to parse cpu_id")
+			return nil
+		}
+		cfss.CpuId = int(tmp)
+		ti = cfss
+	case CPU_FREQUENCY_SWITCH_END_CONST:
+		cfse := new(CpuFrequencySwitchEnd)
+		cfse.Trace = trace
+		var cpu_id int64
+		if cpu_id, err = strconv.ParseInt(dict["cpu_id"], 0, 32); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to parse cpu_id")
+			return nil
+		}
+		cfse.CpuId = int(cpu_id)
+		ti = cfse
 	case PHONELAB_NUM_ONLINE_CPUS_CONST:
 		pnoc := new(PhonelabNumOnlineCpus)
 		pnoc.Trace = trace
@@ -369,6 +406,50 @@ func cpu_frequency(text string, trace *Trace) TraceInterface {
 	return obj
 }
 
+/* Format: cpu_frequency_switch_start: start=300000 end=1958400 cpu_id=0 */
+var CPU_FREQUENCY_SWITCH_START_PATTERN = regexp.MustCompile(`` +
+	`\s*start=(?P<start>\d+)` +
+	`\s+end=(?P<end>\d+)` +
+	`\s+cpu_id=(?P<cpu_id>\d+)`)
+
+// CpuFrequencySwitchStart is logged by the cpufreq driver before it asks the
+// clock driver to move a CPU from Start to End
+type CpuFrequencySwitchStart struct {
+	Trace *Trace
+	Start int
+	End   int
+	CpuId int
+}
+
+func (cfss *CpuFrequencySwitchStart) Tag() string {
+	return cfss.Trace.Tag
+}
+
+func cpu_frequency_switch_start(text string, trace *Trace) TraceInterface {
+	obj := common_parse(text, CPU_FREQUENCY_SWITCH_START_CONST, trace)
+	return obj
+}
+
+/* Format: cpu_frequency_switch_end: cpu_id=0 */
+var CPU_FREQUENCY_SWITCH_END_PATTERN = regexp.MustCompile(`` +
+	`\s*cpu_id=(?P<cpu_id>\d+)`)
+
+// CpuFrequencySwitchEnd is logged once the clock driver has switched a CPU.
+// A switch that failed has no end.
+type CpuFrequencySwitchEnd struct {
+	Trace *Trace
+	CpuId int
+}
+
+func (cfse *CpuFrequencySwitchEnd) Tag() string {
+	return cfse.Trace.Tag
+}
+
+func cpu_frequency_switch_end(text string, trace *Trace) TraceInterface {
+	obj := common_parse(text, CPU_FREQUENCY_SWITCH_END_CONST, trace)
+	return obj
+}
+
 /* Format: phonelab_num_online_cpus: num_online_cpus=4 */
 var PHONELAB_NUM_ONLINE_CPUS_PATTERN = regexp.MustCompile(`` +
 	`\s*num_online_cpus=(?P<num_online_cpus>\d+)`)
@@ -486,15 +567,46 @@ func (ti *PhonelabPeriodicCtxSwitchInfo) Tag() string {
 	return ti.Trace.Tag
 }
 
+// IsIdle is true for a CPU's idle task. Idle tasks are named swapper/N on
+// most kernels, but only their pid of 0 is reliable.
+func (ti *PhonelabPeriodicCtxSwitchInfo) IsIdle() bool {
+	return ti.Pid == 0
+}
+
 func phonelab_periodic_ctx_switch_info(text string, trace *Trace) TraceInterface {
 	obj := common_parse(text, PHONELAB_PERIODIC_CTX_SWITCH_INFO_CONST, trace)
 	return obj
 }
 
+type CtxSwitchWindowFlags int
+
+const (
+	// The window has no END marker; it was closed by the next BEGIN or by the
+	// end of the boot
+	CTX_SWITCH_WINDOW_INCOMPLETE CtxSwitchWindowFlags = 1 << iota
+	// The number of info lines or the END marker's count differs from the
+	// BEGIN marker's count
+	CTX_SWITCH_WINDOW_COUNT_MISMATCH
+	// An info line or the END marker carries another window's log_idx, so the
+	// window holds lines of more than one window
+	CTX_SWITCH_WINDOW_MERGED
+	// The log_idx of the CPU's previous window is not one less than this
+	// window's; windows were lost in between
+	CTX_SWITCH_WINDOW_LOG_IDX_GAP
+	// A line reports a CPU other than the one it was logged on
+	CTX_SWITCH_WINDOW_CPU_MISMATCH
+)
+
 type PeriodicCtxSwitchInfo struct {
 	Start *PhonelabPeriodicCtxSwitchMarker
 	Info  []*PhonelabPeriodicCtxSwitchInfo
 	End   *PhonelabPeriodicCtxSwitchMarker
+	Flags CtxSwitchWindowFlags
+}
+
+// Complete is true if the window has both markers and only its own info lines
+func (pcsi *PeriodicCtxSwitchInfo) Complete() bool {
+	return pcsi.Flags&(CTX_SWITCH_WINDOW_INCOMPLETE|CTX_SWITCH_WINDOW_MERGED) == 0
 }
 
 func (pcsi *PeriodicCtxSwitchInfo) TotalTime() int64 {
@@ -514,7 +626,7 @@ func (pcsi *PeriodicCtxSwitchInfo) Busyness() float64 {
 	}
 
 	for _, info := range pcsi.Info {
-		if !strings.Contains(info.Comm, "swapper") {
+		if !info.IsIdle() {
 			busy_time += info.Rtime
 		}
 	}
@@ -530,7 +642,7 @@ func (pcsi *PeriodicCtxSwitchInfo) FgBusyness() float64 {
 	}
 
 	for _, info := range pcsi.Info {
-		if !strings.Contains(info.Comm, "swapper") {
+		if !info.IsIdle() {
 			busy_time += info.Rtime
 			busy_time -= info.BgRtime
 		}
@@ -547,7 +659,7 @@ func (pcsi *PeriodicCtxSwitchInfo) BgBusyness() float64 {
 	}
 
 	for _, info := range pcsi.Info {
-		if !strings.Contains(info.Comm, "swapper") {
+		if !info.IsIdle() {
 			busy_time += info.BgRtime
 		}
 	}
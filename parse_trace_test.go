@@ -188,6 +188,41 @@ func TestParseCpuFrequency(t *testing.T) {
 	assert.NotEqual("cpu_frequency", trace.Tag(), "Found cpu_frequency payload with non-cpu_frequency logline?")
 }
 
+func TestParseCpuFrequencySwitch(t *testing.T) {
+	assert := assert.New(t)
+
+	str := "aeea32238ddb516568b10685a5f38089a6450252        1462470077472   1462470077472.3 29b2b79e-1a97-4f96-8070-7a26f952e92b    14698   1833.830711     2016-05-05 17:41:17.472984      216     216     D       Kernel-Trace    kworker/0:1H-17    [000] ...1  1833.830512: cpu_frequency_switch_start: start=300000 end=1728000 cpu_id=0"
+	logline := ParseLogline(str)
+	trace := ParseTraceFromLoglinePayload(logline)
+	assert.NotNil(trace, "Parsing failed")
+	assert.Equal("cpu_frequency_switch_start", trace.Tag(), "Tag does not match")
+	cfss := trace.(*CpuFrequencySwitchStart)
+	assert.Equal(300000, cfss.Start, "Start parsing failed")
+	assert.Equal(1728000, cfss.End, "End parsing failed")
+	assert.Equal(0, cfss.CpuId, "CpuId failed")
+
+	str = "aeea32238ddb516568b10685a5f38089a6450252        1462470077472   1462470077472.3 29b2b79e-1a97-4f96-8070-7a26f952e92b    14699   1833.830722     2016-05-05 17:41:17.472995      216     216     D       Kernel-Trace    kworker/0:1H-17    [000] ...1  1833.830601: cpu_frequency_switch_end: cpu_id=2"
+	logline = ParseLogline(str)
+	trace = ParseTraceFromLoglinePayload(logline)
+	assert.NotNil(trace, "Parsing failed")
+	assert.Equal("cpu_frequency_switch_end", trace.Tag(), "Tag does not match")
+	cfse := trace.(*CpuFrequencySwitchEnd)
+	assert.Equal(2, cfse.CpuId, "CpuId failed")
+	assert.Equal(1833.830601, cfse.Trace.Timestamp, "Timestamp failed")
+
+	str = "aeea32238ddb516568b10685a5f38089a6450252        1462470077472   1462470077472.3 29b2b79e-1a97-4f96-8070-7a26f952e92b    14698   1833.830711     2016-05-05 17:41:17.472984      216     216     D       Kernel-Trace    kworker/0:1H-17    [000] ...1  1833.830512: cpu_frequency_switch_start: start=300000 end=1728000000000 cpu_id=0"
+	logline = ParseLogline(str)
+	assert.NotNil(logline, "Failed to parse valid line")
+	trace = ParseTraceFromLoglinePayload(logline)
+	assert.Nil(trace, "Parsed invalid line correctly")
+
+	str = "aeea32238ddb516568b10685a5f38089a6450252        1462470077472   1462470077472.3 29b2b79e-1a97-4f96-8070-7a26f952e92b    14699   1833.830722     2016-05-05 17:41:17.472995      216     216     D       Kernel-Trace    kworker/0:1H-17    [000] ...1  1833.830601: cpu_frequency_switch_end: cpu=2"
+	logline = ParseLogline(str)
+	assert.NotNil(logline, "Failed to parse valid line")
+	trace = ParseTraceFromLoglinePayload(logline)
+	assert.Nil(trace, "Parsed invalid line correctly")
+}
+
 func TestParsePhonelabNumOnlineCpus(t *testing.T) {
 	assert := assert.New(t)
 
@@ -3,6 +3,7 @@ package post_processing
 import (
 	"fmt"
 	"os"
+	"regexp"
 	"strings"
 
 	"github.com/alecthomas/kingpin"
@@ -27,6 +28,8 @@ var (
 	Load    bool
 	save    *bool
 	Save    bool
+
+	device_pattern *regexp.Regexp
 )
 
 func SetupParser() *kingpin.Application {
@@ -36,6 +39,7 @@ func SetupParser() *kingpin.Application {
 	device = App.Flag("device", "").Short('d').String()
 	load = App.Flag("load", "Load data from dump").Default("false").Bool()
 	save = App.Flag("save", "Save data to dump").Default("false").Bool()
+	App.Flag("device-pattern", "Regex matching device directory names").Default(DEFAULT_DEVICE_PATTERN).RegexpVar(&device_pattern)
 	return App
 }
 
@@ -47,6 +51,9 @@ func ParseArgs(parser *kingpin.Application, args []string) {
 	Regex = *regex
 	Load = *load
 	Save = *save
+	if device_pattern != nil {
+		DevicePattern = device_pattern
+	}
 
 	if device != nil && strings.Compare(*device, "") != 0 {
 		Devices = strings.Split(*device, " ")
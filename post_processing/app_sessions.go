@@ -0,0 +1,321 @@
+package post_processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gurupras/go_cpuprof"
+	"github.com/gurupras/go_cpuprof/post_processing/filters"
+	"github.com/gurupras/gocommons/gsync"
+)
+
+const (
+	APP_SESSIONS_FILE = "app-sessions.json"
+)
+
+// AppSessionStats is a foreground session of an app joined with the state of
+// the CPUs and thermal sensors during it. Start and End are TraceTimes. The
+// means are weighted by time and only cover the part of the session during
+// which the state was known.
+type AppSessionStats struct {
+	BootId string
+	// Empty if the process could not be resolved to a package
+	Package string
+	Uid     int
+	Pid     int
+	Comm    string
+	Start   float64
+	End     float64
+	// Mean frequency of every CPU that was online during the session
+	Frequency map[int]float64
+	// Mean number of CPUs online
+	OnlineCpus float64
+	// Mean temperature of every sensor
+	Temperature map[int]float64
+}
+
+func (s *AppSessionStats) Duration() float64 {
+	return s.End - s.Start
+}
+
+// App is the package of the session, or its comm if it was not resolved
+func (s *AppSessionStats) App() string {
+	if s.Package != "" {
+		return s.Package
+	}
+	return s.Comm
+}
+
+// BootAppSessions is every app session and screen-off period of a boot
+type BootAppSessions struct {
+	BootId    string
+	Sessions  []*AppSessionStats
+	ScreenOff filters.Intervals
+}
+
+func newAppSessionStats(bootid string, session *filters.AppSession, cpuTracker *filters.CpuTracker, thermalTracker *filters.ThermalTracker, resolver *ProcessResolver) *AppSessionStats {
+	stats := new(AppSessionStats)
+	stats.BootId = bootid
+	stats.Uid = cpuprof.UID_UNKNOWN
+	stats.Pid = session.Proc.Pid
+	stats.Comm = session.Proc.Comm
+	stats.Start = session.Start
+	stats.End = session.End
+	stats.Frequency = make(map[int]float64)
+	stats.Temperature = make(map[int]float64)
+
+	if resolver != nil {
+		comm := ""
+		if session.Proc.Pid == session.Proc.Tgid {
+			comm = session.Proc.Comm
+		}
+		if pi := resolver.Resolve(session.Proc.Tgid, comm, session.StartLogline.LogcatToken); pi != nil {
+			stats.Package = pi.Package()
+			stats.Uid = pi.Uid
+		}
+	}
+
+	mask := filters.Intervals{session.Interval()}
+	for cpu := range cpuTracker.CurrentState {
+		if frequencies := cpuTracker.FrequencyIntervals(cpu).Intersect(mask); frequencies.Duration() > 0 {
+			stats.Frequency[cpu] = frequencies.Mean()
+		}
+		// Fraction of the time the CPU's state was known that it was online
+		states := cpuTracker.CpuStateIntervals(cpu).Intersect(mask)
+		if known := states.Duration(); known > 0 {
+			stats.OnlineCpus += states.Select(int(filters.CPU_ONLINE)).Duration() / known
+		}
+	}
+	for _, sensor := range thermalTracker.Sensors() {
+		if temps := thermalTracker.TemperatureIntervals(sensor).Intersect(mask); temps.Duration() > 0 {
+			stats.Temperature[sensor] = temps.Mean()
+		}
+	}
+	return stats
+}
+
+// ExtractBootAppSessions finds the foreground app sessions and screen-off
+// periods of boot. If resolver is not nil, sessions are resolved to packages.
+func ExtractBootAppSessions(ctx context.Context, boot *Boot, resolver *ProcessResolver) (*BootAppSessions, error) {
+	filter := filters.New()
+	cpuTracker := filters.NewCpuTracker(filter)
+	cpuTracker.RecordIntervals = true
+	thermalTracker := filters.NewThermalTracker(filter)
+	thermalTracker.RecordIntervals = true
+	fgbgTracker := filters.NewFgBgTracker(filter)
+	sessionTracker := filters.NewAppSessionTracker(filter, fgbgTracker)
+
+	patterns := []string{"phonelab_proc_foreground", "cpu_frequency", "sched_cpu_hotplug", "thermal_temp"}
+	opts := ReadOptions{Filters: []filters.LineFilter{func(line string) bool {
+		for _, pattern := range patterns {
+			if strings.Contains(line, pattern) {
+				return true
+			}
+		}
+		return false
+	}}}
+	err := boot.ScanFrom(ctx, opts, func(logline *cpuprof.Logline) error {
+		filter.ApplyLogline(logline)
+		return nil
+	})
+	filter.Finish()
+
+	bas := new(BootAppSessions)
+	bas.BootId = boot.BootId
+	bas.Sessions = make([]*AppSessionStats, 0, len(sessionTracker.Sessions))
+	for _, session := range sessionTracker.Sessions {
+		bas.Sessions = append(bas.Sessions, newAppSessionStats(boot.BootId, session, cpuTracker, thermalTracker, resolver))
+	}
+	bas.ScreenOff = sessionTracker.ScreenOffIntervals()
+	return bas, err
+}
+
+// AppUsageSummary is the sessions of an app across boots. The means are
+// weighted by session duration.
+type AppUsageSummary struct {
+	App         string
+	Uid         int
+	Sessions    int
+	Duration    float64
+	Frequency   map[int]float64
+	OnlineCpus  float64
+	Temperature map[int]float64
+	// Total session time for which each mean was known
+	frequencyWeight   map[int]float64
+	temperatureWeight map[int]float64
+}
+
+func newAppUsageSummary(app string) *AppUsageSummary {
+	aus := new(AppUsageSummary)
+	aus.App = app
+	aus.Uid = cpuprof.UID_UNKNOWN
+	aus.Frequency = make(map[int]float64)
+	aus.Temperature = make(map[int]float64)
+	aus.frequencyWeight = make(map[int]float64)
+	aus.temperatureWeight = make(map[int]float64)
+	return aus
+}
+
+func (aus *AppUsageSummary) add(s *AppSessionStats) {
+	if aus.Uid == cpuprof.UID_UNKNOWN {
+		aus.Uid = s.Uid
+	}
+	duration := s.Duration()
+	weighted := func(mean float64, weight float64, value float64) float64 {
+		if weight+duration == 0 {
+			return mean
+		}
+		return (mean*weight + value*duration) / (weight + duration)
+	}
+	aus.OnlineCpus = weighted(aus.OnlineCpus, aus.Duration, s.OnlineCpus)
+	for cpu, frequency := range s.Frequency {
+		aus.Frequency[cpu] = weighted(aus.Frequency[cpu], aus.frequencyWeight[cpu], frequency)
+		aus.frequencyWeight[cpu] += duration
+	}
+	for sensor, temp := range s.Temperature {
+		aus.Temperature[sensor] = weighted(aus.Temperature[sensor], aus.temperatureWeight[sensor], temp)
+		aus.temperatureWeight[sensor] += duration
+	}
+	aus.Sessions++
+	aus.Duration += duration
+}
+
+// Sorts by Duration, longest first
+type appUsageSummarySlice []*AppUsageSummary
+
+func (s appUsageSummarySlice) Len() int {
+	return len(s)
+}
+
+func (s appUsageSummarySlice) Less(i, j int) bool {
+	if s[i].Duration != s[j].Duration {
+		return s[i].Duration > s[j].Duration
+	}
+	return strings.Compare(s[i].App, s[j].App) < 0
+}
+
+func (s appUsageSummarySlice) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// ScreenOffPeriod is a period of a boot during which no app was in the
+// foreground. Start and End are TraceTimes.
+type ScreenOffPeriod struct {
+	BootId string
+	Start  float64
+	End    float64
+}
+
+// DeviceAppUsage is the output of AppSessionsMain for one device. The
+// sessions and screen-off periods themselves are only kept if asked for.
+type DeviceAppUsage struct {
+	Sessions       int
+	ForegroundTime float64
+	ScreenOffTime  float64
+	Apps           []*AppUsageSummary
+	SessionList    []*AppSessionStats `json:",omitempty"`
+	ScreenOffList  []*ScreenOffPeriod `json:",omitempty"`
+}
+
+// SummarizeAppSessions aggregates the sessions of every boot of a device by
+// app. If keep is true, every session and screen-off period is kept as well.
+func SummarizeAppSessions(boots []*BootAppSessions, keep bool) *DeviceAppUsage {
+	dau := new(DeviceAppUsage)
+	apps := make(map[string]*AppUsageSummary)
+	for _, bas := range boots {
+		for _, s := range bas.Sessions {
+			aus, ok := apps[s.App()]
+			if !ok {
+				aus = newAppUsageSummary(s.App())
+				apps[s.App()] = aus
+			}
+			aus.add(s)
+			dau.Sessions++
+			dau.ForegroundTime += s.Duration()
+			if keep {
+				dau.SessionList = append(dau.SessionList, s)
+			}
+		}
+		dau.ScreenOffTime += bas.ScreenOff.Duration()
+		if keep {
+			for _, iv := range bas.ScreenOff {
+				dau.ScreenOffList = append(dau.ScreenOffList, &ScreenOffPeriod{bas.BootId, iv.Start, iv.End})
+			}
+		}
+	}
+	dau.Apps = make(appUsageSummarySlice, 0, len(apps))
+	for _, aus := range apps {
+		dau.Apps = append(dau.Apps, aus)
+	}
+	sort.Sort(appUsageSummarySlice(dau.Apps))
+	return dau
+}
+
+func AppSessionsMain(args []string) {
+	parser := SetupParser()
+	keep := parser.Flag("sessions", "Also write every session and screen-off period").Default("false").Bool()
+	ParseArgs(parser, args)
+
+	ds := NewDataset(Path)
+	devices := Devices
+	if len(devices) == 0 {
+		var err error
+		if devices, err = ds.Devices(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+	}
+
+	mutex := new(sync.Mutex)
+	result := make(map[string]*DeviceAppUsage)
+
+	deviceWg := new(sync.WaitGroup)
+	deviceSem := gsync.NewSem(20)
+	processDevice := func(device string) {
+		defer deviceWg.Done()
+		defer deviceSem.V()
+
+		boots, err := ds.Boots(device)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		sessions := make([]*BootAppSessions, 0, len(boots))
+		for _, boot := range boots {
+			resolver, err := ResolveBootProcesses(context.Background(), boot)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, fmt.Sprintf("%v -> %v: %v", device, boot.BootId, err))
+				continue
+			}
+			bas, err := ExtractBootAppSessions(context.Background(), boot, resolver)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, fmt.Sprintf("%v -> %v: %v", device, boot.BootId, err))
+				continue
+			}
+			sessions = append(sessions, bas)
+		}
+		mutex.Lock()
+		result[device] = SummarizeAppSessions(sessions, *keep)
+		mutex.Unlock()
+		fmt.Println("Finished processing Device:", device)
+	}
+
+	for _, device := range devices {
+		deviceWg.Add(1)
+		deviceSem.P()
+		go processDevice(device)
+	}
+	deviceWg.Wait()
+
+	if b, err := json.MarshalIndent(result, "", "  "); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	} else {
+		ioutil.WriteFile(APP_SESSIONS_FILE, b, 0664)
+	}
+}
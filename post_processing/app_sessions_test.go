@@ -0,0 +1,86 @@
+package post_processing
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func kernelTraceLine(bootid string, token int, payload string) string {
+	return catalogueLine(bootid, 10, token, fmt.Sprintf("Kernel-Trace: kworker/0:1-17 [000] ...1     %d.000000: %s", token, payload))
+}
+
+func TestAppSessions(t *testing.T) {
+	assert := assert.New(t)
+
+	path, err := ioutil.TempDir("", "app_sessions")
+	assert.Nil(err)
+	defer os.RemoveAll(path)
+
+	bootid := "453fea81-57cc-43e0-9693-91f63b0433b9"
+	writeShard(t, filepath.Join(path, testDeviceA, bootid, "00000000.gz"), []string{
+		catalogueLine(bootid, 10, 1, "ActivityManager: Start proc 100:com.android.dialer/u0a12 for activity com.android.dialer/.DialtactsActivity"),
+		kernelTraceLine(bootid, 2, "cpu_frequency: state=300000 cpu_id=0"),
+		kernelTraceLine(bootid, 2, "cpu_frequency: state=300000 cpu_id=1"),
+		kernelTraceLine(bootid, 2, "thermal_temp: sensor_id=5 temp=40"),
+		foregroundLine(bootid, 4, 100, ".android.dialer"),
+		kernelTraceLine(bootid, 6, "cpu_frequency: state=1200000 cpu_id=0"),
+		kernelTraceLine(bootid, 7, "sched_cpu_hotplug: cpu 1 offline error=0"),
+		kernelTraceLine(bootid, 8, "thermal_temp: sensor_id=5 temp=50"),
+		foregroundLine(bootid, 12, 200, "ndroid.systemui"),
+		foregroundLine(bootid, 14, 0, "swapper/0"),
+		kernelTraceLine(bootid, 16, "thermal_temp: sensor_id=5 temp=45"),
+		foregroundLine(bootid, 20, 100, ".android.dialer"),
+		kernelTraceLine(bootid, 22, "thermal_temp: sensor_id=5 temp=48"),
+		kernelTraceLine(bootid, 24, "cpu_frequency: state=1200000 cpu_id=0"),
+	})
+
+	boot, err := NewBoot(path, testDeviceA, bootid)
+	assert.Nil(err)
+	resolver, err := ResolveBootProcesses(context.Background(), boot)
+	assert.Nil(err)
+	bas, err := ExtractBootAppSessions(context.Background(), boot, resolver)
+	assert.Nil(err)
+
+	assert.Equal(3, len(bas.Sessions))
+	dialer := bas.Sessions[0]
+	assert.Equal("com.android.dialer", dialer.Package)
+	assert.Equal(10012, dialer.Uid)
+	assert.Equal(4.0, dialer.Start)
+	assert.Equal(12.0, dialer.End)
+	// 300MHz for 2s and 1.2GHz for 6s
+	assert.Equal(975000.0, dialer.Frequency[0])
+	assert.Equal(300000.0, dialer.Frequency[1])
+	// CPU 1 went offline at 7
+	assert.Equal(1.0+3.0/8, dialer.OnlineCpus)
+	assert.Equal(45.0, dialer.Temperature[5])
+
+	systemui := bas.Sessions[1]
+	assert.Equal("", systemui.Package)
+	assert.Equal("ndroid.systemui", systemui.App())
+	// The switch to the background is confirmed BgDelaySec after the pid=0
+	// logline and dated back to it
+	assert.Equal(14.0, systemui.End)
+	assert.Equal([][2]float64{{14, 20}}, [][2]float64{{bas.ScreenOff[0].Start, bas.ScreenOff[0].End}})
+	assert.Equal(1, len(bas.ScreenOff))
+
+	dau := SummarizeAppSessions([]*BootAppSessions{bas}, false)
+	assert.Equal(3, dau.Sessions)
+	assert.Equal(14.0, dau.ForegroundTime)
+	assert.Equal(6.0, dau.ScreenOffTime)
+	assert.Equal(2, len(dau.Apps))
+	assert.Equal("com.android.dialer", dau.Apps[0].App)
+	assert.Equal(2, dau.Apps[0].Sessions)
+	assert.Equal(12.0, dau.Apps[0].Duration)
+	assert.Equal(10012, dau.Apps[0].Uid)
+	// 45 for 8s and 46.5 for 4s
+	assert.Equal(45.5, dau.Apps[0].Temperature[5])
+	assert.Nil(dau.SessionList)
+
+	assert.Equal(3, len(SummarizeAppSessions([]*BootAppSessions{bas}, true).SessionList))
+}
@@ -0,0 +1,446 @@
+package post_processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gurupras/go_cpuprof"
+	"github.com/gurupras/go_cpuprof/post_processing/filters"
+	"github.com/gurupras/gocommons/gsync"
+)
+
+const (
+	BATTERY_DRAIN_FILE = "battery-drain.json"
+)
+
+// ChunkDrain is the battery drained over a TbcChunk, from one 1% drop of the
+// battery level to the next, and what the phone was doing meanwhile. Start and
+// End are TraceTimes, which stop while the phone is suspended, so what the
+// phone was doing is over the time it was awake. The drain itself is over the
+// wall time.
+type ChunkDrain struct {
+	BootId     string
+	Start      float64
+	End        float64
+	StartLevel int
+	EndLevel   int
+	// Wall time from the start to the end of the chunk
+	Hours float64
+	// Levels drained per hour
+	PercentPerHour float64
+	// Means of the healthd samples of the chunk weighted by wall time, in mA
+	// and mV. The sign of the current depends on the fuel gauge driver, so
+	// MeanCurrent is its magnitude.
+	MeanCurrent float64
+	MeanVoltage float64
+	// MeanCurrent over Hours
+	MAh float64
+	// Time-weighted mean of voltage times current, in mW
+	MeanPower float64
+	Samples   int
+	// How often the phone suspended during the chunk, and the share of Hours
+	// it spent suspended
+	Suspends       int
+	SuspendedShare float64
+	// Residency of every core seen during the chunk. AwakeTime is the length
+	// of the chunk and TotalTime its wall time.
+	Residency      *CpuResidency
+	MeanOnlineCpus float64
+	// Seconds awake in each foreground state
+	Foreground map[string]float64
+	// Time-weighted mean and highest temperature of every sensor
+	MeanTemp map[int]float64
+	MaxTemp  map[int]int
+	// Mean busyness of the complete context switch windows that ended during
+	// the chunk, and how many there were
+	Busyness    float64
+	BusyWindows int
+}
+
+// Duration is the length of the chunk in seconds, leaving out the time the
+// phone was suspended
+func (cd *ChunkDrain) Duration() float64 {
+	return cd.End - cd.Start
+}
+
+// DominantForeground returns the foreground state the phone spent most of the
+// chunk in, or "unknown" if it was never known
+func (cd *ChunkDrain) DominantForeground() string {
+	dominant := fgbgName(filters.FgBgUnknown)
+	longest := 0.0
+	for fg, duration := range cd.Foreground {
+		if duration > longest {
+			dominant = fg
+			longest = duration
+		}
+	}
+	return dominant
+}
+
+// HottestTemp returns the highest mean temperature of any sensor, or
+// filters.TEMPERATURE_UNKNOWN if no sensor reported during the chunk
+func (cd *ChunkDrain) HottestTemp() float64 {
+	hottest := float64(filters.TEMPERATURE_UNKNOWN)
+	for _, temp := range cd.MeanTemp {
+		if hottest == float64(filters.TEMPERATURE_UNKNOWN) || temp > hottest {
+			hottest = temp
+		}
+	}
+	return hottest
+}
+
+// drainChunk is what is kept of a TbcChunk: its healthd samples, from the
+// start to the end, and how often the phone suspended during it
+type drainChunk struct {
+	start    *cpuprof.Healthd
+	end      *cpuprof.Healthd
+	samples  []*cpuprof.Healthd
+	suspends int
+}
+
+// drainChunker splits a boot into drainChunks the same way tbcBootConsumer
+// splits it into TbcChunks, without keeping the loglines. Chunks are handed to
+// done as they end rather than kept.
+type drainChunker struct {
+	recent_event  bool
+	healthd_level int
+	current       *drainChunk
+	last          *cpuprof.Logline
+	// Called whenever a chunk starts at start, with the chunk that ended there
+	// or nil
+	done func(dc *drainChunk, start *cpuprof.Healthd)
+}
+
+func newDrainChunker(done func(dc *drainChunk, start *cpuprof.Healthd)) *drainChunker {
+	dcr := new(drainChunker)
+	dcr.recent_event = true
+	dcr.healthd_level = -1
+	dcr.done = done
+	return dcr
+}
+
+// next ends the current chunk at healthd, if there is one, and starts the
+// next one there
+func (dcr *drainChunker) next(healthd *cpuprof.Healthd) {
+	dc := dcr.current
+	if dc != nil {
+		dc.end = healthd
+		dc.samples = append(dc.samples, healthd)
+	}
+	dcr.current = &drainChunk{start: healthd, samples: []*cpuprof.Healthd{healthd}}
+	dcr.done(dc, healthd)
+}
+
+// add feeds the next logline of the boot. Loglines must come in the order of
+// their tokens.
+func (dcr *drainChunker) add(logline *cpuprof.Logline) error {
+	if dcr.last != nil && dcr.last.LogcatToken > logline.LogcatToken {
+		return fmt.Errorf("Lines going backwards:\n%s\n%s", dcr.last.Line, logline.Line)
+	}
+	dcr.last = logline
+
+	if strings.Compare(logline.Tag, "KernelPrintk") != 0 ||
+		!strings.Contains(logline.Payload, "healthd") ||
+		!strings.Contains(logline.Payload, "chg") {
+		if dcr.current != nil && strings.Contains(logline.Line, SUSPEND_STRING) {
+			dcr.current.suspends++
+		}
+		return nil
+	}
+	healthd := cpuprof.ParseHealthdPrintk(logline)
+	if healthd == nil {
+		return nil
+	}
+
+	if dcr.recent_event {
+		dcr.healthd_level = healthd.L
+		dcr.recent_event = false
+	}
+	if strings.Compare(healthd.Chg, "") != 0 {
+		// On charge; start over once it is unplugged
+		dcr.healthd_level = healthd.L
+		dcr.current = nil
+	} else if dcr.healthd_level != -1 {
+		// Wait for the level to drop after a charge event
+		if healthd.L <= dcr.healthd_level-1 {
+			dcr.healthd_level = -1
+			dcr.next(healthd)
+		}
+	} else if dcr.current == nil || healthd.L == dcr.current.start.L-1 {
+		dcr.next(healthd)
+	} else if healthd.L == dcr.current.start.L {
+		dcr.current.samples = append(dcr.current.samples, healthd)
+	}
+	return nil
+}
+
+// busynessSample is the busyness of a CPU over a context switch window ending
+// at Time
+type busynessSample struct {
+	Time     float64
+	Busyness float64
+}
+
+// newChunkDrain computes the drain of dc and attributes it to the state the
+// trackers were in during the chunk. The trackers' intervals must be closed up
+// to the end of dc.
+func newChunkDrain(bootid string, dc *drainChunk, cpuTracker *filters.CpuTracker, fgbgTracker *filters.FgBgTracker, thermalTracker *filters.ThermalTracker, busyness []busynessSample) *ChunkDrain {
+	cd := new(ChunkDrain)
+	cd.BootId = bootid
+	cd.Start = dc.start.Logline.TraceTime
+	cd.End = dc.end.Logline.TraceTime
+	cd.StartLevel = dc.start.L
+	cd.EndLevel = dc.end.L
+	cd.Samples = len(dc.samples)
+	cd.Suspends = dc.suspends
+	cd.Foreground = make(map[string]float64)
+	cd.MeanTemp = make(map[int]float64)
+	cd.MaxTemp = make(map[int]int)
+	cd.Residency = NewCpuResidency()
+
+	duration := cd.Duration()
+	wall := dc.end.Logline.Datetime.Sub(dc.start.Logline.Datetime).Seconds()
+	if duration <= 0 || wall <= 0 {
+		return cd
+	}
+	cd.Hours = wall / 3600
+	cd.PercentPerHour = float64(cd.StartLevel-cd.EndLevel) / cd.Hours
+	if cd.SuspendedShare = 1 - duration/wall; cd.SuspendedShare < 0 {
+		cd.SuspendedShare = 0
+	}
+
+	// Every sample holds until the next one, including while suspended
+	for idx := 0; idx < len(dc.samples)-1; idx++ {
+		sample := dc.samples[idx]
+		weight := dc.samples[idx+1].Logline.Datetime.Sub(sample.Logline.Datetime).Seconds() / wall
+		cd.MeanCurrent += math.Abs(float64(sample.C)) * weight
+		cd.MeanVoltage += float64(sample.V) * weight
+		cd.MeanPower += math.Abs(float64(sample.C)) * float64(sample.V) / 1000 * weight
+	}
+	cd.MAh = cd.MeanCurrent * cd.Hours
+
+	mask := filters.Intervals{&filters.Interval{Start: cd.Start, End: cd.End, StartLogline: dc.start.Logline, EndLogline: dc.end.Logline}}
+	cd.Residency.AwakeTime = duration
+	cd.Residency.TotalTime = wall
+	online := 0.0
+	for cpu := range cpuTracker.CurrentState {
+		core := cd.Residency.core(cpu)
+		for frequency, d := range cpuTracker.FrequencyIntervals(cpu).Intersect(mask).DurationByState() {
+			core.Frequency[frequency] += d
+		}
+		states := cpuTracker.CpuStateIntervals(cpu).Intersect(mask)
+		core.Offline = states.Select(int(filters.CPU_OFFLINE)).Duration()
+		online += states.Select(int(filters.CPU_ONLINE)).Duration()
+		known := core.Offline
+		for _, d := range core.Frequency {
+			known += d
+		}
+		if core.Unknown = duration - known; core.Unknown < 0 {
+			core.Unknown = 0
+		}
+	}
+	cd.MeanOnlineCpus = online / duration
+
+	for state, d := range fgbgTracker.Intervals().Intersect(mask).DurationByState() {
+		cd.Foreground[fgbgName(filters.FgBgState(state))] += d
+	}
+	for _, sensor := range thermalTracker.Sensors() {
+		ivs := thermalTracker.TemperatureIntervals(sensor).Intersect(mask)
+		if ivs.Duration() > 0 {
+			cd.MeanTemp[sensor] = ivs.Mean()
+			for _, iv := range ivs {
+				if max, ok := cd.MaxTemp[sensor]; !ok || iv.State > max {
+					cd.MaxTemp[sensor] = iv.State
+				}
+			}
+		}
+	}
+	total := 0.0
+	for _, sample := range busyness {
+		if sample.Time > cd.Start && sample.Time <= cd.End {
+			total += sample.Busyness
+			cd.BusyWindows++
+		}
+	}
+	if cd.BusyWindows > 0 {
+		cd.Busyness = total / float64(cd.BusyWindows)
+	}
+	return cd
+}
+
+// BootBatteryDrain computes the drain of every TbcChunk of boot. Charging
+// never makes it into a chunk. suspended is how many of the chunks the phone
+// suspended during. Each chunk is computed as soon as it ends, and the trackers
+// forget everything before the next chunk, so a long boot is not held in
+// memory.
+func BootBatteryDrain(ctx context.Context, boot *Boot) (chunks []*ChunkDrain, suspended int, err error) {
+	filter := filters.New()
+	cpuTracker := filters.NewCpuTracker(filter)
+	cpuTracker.RecordIntervals = true
+	fgbgTracker := filters.NewFgBgTracker(filter)
+	fgbgTracker.RecordIntervals = true
+	thermalTracker := filters.NewThermalTracker(filter)
+	thermalTracker.RecordIntervals = true
+	filters.NewPeriodicCtxSwitchInfoTracker(filter)
+	busyness := make([]busynessSample, 0)
+	filter.Bus.OnCtxSwitchInfoCollected(func(event *filters.CtxSwitchInfoCollected) {
+		if event.Info.Complete() {
+			busyness = append(busyness, busynessSample{event.Logline.TraceTime, event.Info.Busyness()})
+		}
+	})
+
+	chunks = make([]*ChunkDrain, 0)
+	// The filter has already been applied to the healthd logline of start
+	dcr := newDrainChunker(func(dc *drainChunk, start *cpuprof.Healthd) {
+		filter.Split()
+		if dc != nil {
+			if dc.suspends > 0 {
+				suspended++
+			}
+			chunks = append(chunks, newChunkDrain(boot.BootId, dc, cpuTracker, fgbgTracker, thermalTracker, busyness))
+		}
+		filter.DropIntervals(start.Logline.TraceTime)
+		idx := 0
+		for idx < len(busyness) && busyness[idx].Time <= start.Logline.TraceTime {
+			idx++
+		}
+		busyness = append(make([]busynessSample, 0, len(busyness)-idx), busyness[idx:]...)
+	})
+	err = boot.Scan(ctx, func(logline *cpuprof.Logline) error {
+		filter.ApplyLogline(logline)
+		return dcr.add(logline)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return chunks, suspended, nil
+}
+
+// DrainSummary is the drain of a group of chunks
+type DrainSummary struct {
+	Chunks int
+	Hours  float64
+	Levels int
+	MAh    float64
+	// Levels and MAh over Hours
+	PercentPerHour float64
+	MeanCurrent    float64
+}
+
+func (s *DrainSummary) add(cd *ChunkDrain) {
+	s.Chunks++
+	s.Hours += cd.Hours
+	s.Levels += cd.StartLevel - cd.EndLevel
+	s.MAh += cd.MAh
+	if s.Hours > 0 {
+		s.PercentPerHour = float64(s.Levels) / s.Hours
+		s.MeanCurrent = s.MAh / s.Hours
+	}
+}
+
+// DeviceBatteryDrain is the output of BatteryDrainMain for one device
+type DeviceBatteryDrain struct {
+	Total *DrainSummary
+	// By the foreground state the phone spent most of the chunk in
+	ByForeground map[string]*DrainSummary
+	// By the mean temperature of the hottest sensor, rounded down to the
+	// bucket size, or filters.TEMPERATURE_UNKNOWN
+	ByTemp map[int]*DrainSummary
+	// Chunks during which the phone suspended
+	Suspended int
+	Chunks    []*ChunkDrain
+}
+
+func SummarizeBatteryDrain(chunks []*ChunkDrain, suspended int, tempBucketSize int) *DeviceBatteryDrain {
+	dbd := new(DeviceBatteryDrain)
+	dbd.Total = new(DrainSummary)
+	dbd.ByForeground = make(map[string]*DrainSummary)
+	dbd.ByTemp = make(map[int]*DrainSummary)
+	dbd.Suspended = suspended
+	dbd.Chunks = chunks
+	for _, cd := range chunks {
+		dbd.Total.add(cd)
+
+		fg := cd.DominantForeground()
+		if _, ok := dbd.ByForeground[fg]; !ok {
+			dbd.ByForeground[fg] = new(DrainSummary)
+		}
+		dbd.ByForeground[fg].add(cd)
+
+		temp := filters.TEMPERATURE_UNKNOWN
+		if hottest := cd.HottestTemp(); hottest != float64(filters.TEMPERATURE_UNKNOWN) {
+			temp = int(math.Floor(hottest/float64(tempBucketSize))) * tempBucketSize
+		}
+		if _, ok := dbd.ByTemp[temp]; !ok {
+			dbd.ByTemp[temp] = new(DrainSummary)
+		}
+		dbd.ByTemp[temp].add(cd)
+	}
+	return dbd
+}
+
+func BatteryDrainMain(args []string) {
+	parser := SetupParser()
+	tempBucketSize := parser.Flag("temp-bucket", "Degrees per temperature bucket").Default("5").Int()
+	ParseArgs(parser, args)
+
+	ds := NewDataset(Path)
+	devices := Devices
+	if len(devices) == 0 {
+		var err error
+		if devices, err = ds.Devices(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+	}
+
+	mutex := new(sync.Mutex)
+	result := make(map[string]*DeviceBatteryDrain)
+
+	deviceWg := new(sync.WaitGroup)
+	deviceSem := gsync.NewSem(20)
+	processDevice := func(device string) {
+		defer deviceWg.Done()
+		defer deviceSem.V()
+
+		boots, err := ds.Boots(device)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		chunks := make([]*ChunkDrain, 0)
+		suspended := 0
+		for _, boot := range boots {
+			bootChunks, bootSuspended, err := BootBatteryDrain(context.Background(), boot)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, fmt.Sprintf("%v -> %v: %v", device, boot.BootId, err))
+				continue
+			}
+			chunks = append(chunks, bootChunks...)
+			suspended += bootSuspended
+		}
+		mutex.Lock()
+		result[device] = SummarizeBatteryDrain(chunks, suspended, *tempBucketSize)
+		mutex.Unlock()
+		fmt.Println("Finished processing Device:", device)
+	}
+
+	for _, device := range devices {
+		deviceWg.Add(1)
+		deviceSem.P()
+		go processDevice(device)
+	}
+	deviceWg.Wait()
+
+	if b, err := json.MarshalIndent(result, "", "  "); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	} else {
+		ioutil.WriteFile(BATTERY_DRAIN_FILE, b, 0664)
+	}
+}
@@ -0,0 +1,138 @@
+package post_processing
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gurupras/go_cpuprof"
+	"github.com/stretchr/testify/assert"
+)
+
+func healthdLine(bootid string, token int, level int, voltage int, current int, chg string) string {
+	return catalogueLine(bootid, 10, token, fmt.Sprintf("KernelPrintk: <6>[   %d.000000] healthd: battery l=%d v=%d t=30.0 h=2 st=3 c=%d chg=%s", token, level, voltage, current, chg))
+}
+
+func TestBatteryDrain(t *testing.T) {
+	assert := assert.New(t)
+
+	path, err := ioutil.TempDir("", "battery_drain")
+	assert.Nil(err)
+	defer os.RemoveAll(path)
+
+	bootid := "5b1e35e2-4e6c-4a6e-9b0f-0cb7a2e3c8d1"
+	lines := []string{
+		healthdLine(bootid, 1, 90, 4000, 300, ""),
+		foregroundLine(bootid, 2, 100, ".android.dialer"),
+		kernelTraceLine(bootid, 3, "cpu_frequency: state=300000 cpu_id=0"),
+		kernelTraceLine(bootid, 4, "thermal_temp: sensor_id=5 temp=40"),
+		// The first drop starts a chunk
+		healthdLine(bootid, 10, 89, 4000, 300, ""),
+		healthdLine(bootid, 20, 89, 3900, 500, ""),
+		// Not a sample
+		catalogueLine(bootid, 10, 22, "KernelPrintk: <6>[   22.000000] healthd: battery chg= truncated"),
+		kernelTraceLine(bootid, 25, "cpu_frequency: state=960000 cpu_id=0"),
+		healthdLine(bootid, 30, 88, 3900, 400, ""),
+		kernelTraceLine(bootid, 32, "cpu_frequency: state=300000 cpu_id=0"),
+		catalogueLine(bootid, 10, 35, fmt.Sprintf("KernelPrintk: <6>[   35.000000] %s after 10.000 msecs", SUSPEND_STRING)),
+		healthdLine(bootid, 40, 87, 3900, 400, ""),
+		// Charging drops the chunk in progress
+		healthdLine(bootid, 45, 87, 3900, -800, "u"),
+		healthdLine(bootid, 50, 86, 3800, 200, ""),
+		kernelTraceLine(bootid, 52, "thermal_temp: sensor_id=5 temp=50"),
+		healthdLine(bootid, 60, 85, 3800, 200, ""),
+	}
+	// The wall time runs with the TraceTime, except for the 100s the phone
+	// was suspended at 35
+	for idx, line := range lines {
+		token := int(cpuprof.ParseLogline(line).LogcatToken)
+		wall := token
+		if token > 35 {
+			wall += 100
+		}
+		datetime := time.Date(2016, 6, 25, 10, 0, 0, 0, time.UTC).Add(time.Duration(wall) * time.Second)
+		lines[idx] = strings.Replace(line, "10:00:00", datetime.Format("15:04:05"), 1)
+	}
+	writeShard(t, filepath.Join(path, testDeviceA, bootid, "00000000.gz"), lines)
+
+	boot, err := NewBoot(path, testDeviceA, bootid)
+	assert.Nil(err)
+	chunks, suspended, err := BootBatteryDrain(context.Background(), boot)
+	assert.Nil(err)
+	assert.Equal(1, suspended)
+	assert.Equal(3, len(chunks))
+
+	cd := chunks[0]
+	assert.Equal(10.0, cd.Start)
+	assert.Equal(30.0, cd.End)
+	assert.Equal(89, cd.StartLevel)
+	assert.Equal(88, cd.EndLevel)
+	assert.Equal(3, cd.Samples)
+	assert.InDelta(180.0, cd.PercentPerHour, 1e-9)
+	assert.InDelta(400.0, cd.MeanCurrent, 1e-9)
+	assert.InDelta(3950.0, cd.MeanVoltage, 1e-9)
+	assert.InDelta(400.0*20/3600, cd.MAh, 1e-9)
+	assert.InDelta(1575.0, cd.MeanPower, 1e-9)
+	assert.Equal(map[int]float64{300000: 15, 960000: 5}, cd.Residency.Cores[0].Frequency)
+	assert.Equal(map[string]float64{"foreground": 20}, cd.Foreground)
+	assert.Equal(map[int]float64{5: 40}, cd.MeanTemp)
+	assert.Equal(0, cd.Suspends)
+	assert.Equal(0.0, cd.SuspendedShare)
+
+	// The drain is over the wall time, the rest over the 10s awake
+	cd = chunks[1]
+	assert.Equal(30.0, cd.Start)
+	assert.Equal(40.0, cd.End)
+	assert.Equal(1, cd.Suspends)
+	assert.InDelta(110.0/3600, cd.Hours, 1e-9)
+	assert.InDelta(100.0/110, cd.SuspendedShare, 1e-9)
+	assert.InDelta(3600.0/110, cd.PercentPerHour, 1e-9)
+	assert.InDelta(400.0*110/3600, cd.MAh, 1e-9)
+	assert.Equal(10.0, cd.Residency.AwakeTime)
+	assert.Equal(110.0, cd.Residency.TotalTime)
+	assert.Equal(map[int]float64{960000: 2, 300000: 8}, cd.Residency.Cores[0].Frequency)
+	assert.Equal(map[string]float64{"foreground": 10}, cd.Foreground)
+	assert.Equal(map[int]float64{5: 40}, cd.MeanTemp)
+
+	cd = chunks[2]
+	assert.Equal(50.0, cd.Start)
+	assert.Equal(60.0, cd.End)
+	assert.InDelta(200.0, cd.MeanCurrent, 1e-9)
+	assert.Equal(map[int]float64{300000: 10}, cd.Residency.Cores[0].Frequency)
+	assert.InDelta(48.0, cd.MeanTemp[5], 1e-9)
+	assert.Equal(map[int]int{5: 50}, cd.MaxTemp)
+
+	dbd := SummarizeBatteryDrain(chunks, suspended, 5)
+	assert.Equal(3, dbd.Total.Chunks)
+	assert.Equal(3, dbd.Total.Levels)
+	assert.InDelta(3*3600.0/140, dbd.Total.PercentPerHour, 1e-9)
+	assert.Equal(3, dbd.ByForeground["foreground"].Chunks)
+	assert.Equal(2, dbd.ByTemp[40].Chunks)
+	assert.Equal(1, dbd.ByTemp[45].Chunks)
+	assert.Equal(1, dbd.Suspended)
+}
+
+func TestBatteryDrainBackwards(t *testing.T) {
+	assert := assert.New(t)
+
+	path, err := ioutil.TempDir("", "battery_drain")
+	assert.Nil(err)
+	defer os.RemoveAll(path)
+
+	bootid := "5b1e35e2-4e6c-4a6e-9b0f-0cb7a2e3c8d1"
+	writeShard(t, filepath.Join(path, testDeviceA, bootid, "00000000.gz"), []string{
+		healthdLine(bootid, 10, 89, 4000, 300, ""),
+		healthdLine(bootid, 5, 88, 4000, 300, ""),
+	})
+
+	boot, err := NewBoot(path, testDeviceA, bootid)
+	assert.Nil(err)
+	chunks, _, err := BootBatteryDrain(context.Background(), boot)
+	assert.NotNil(err)
+	assert.Nil(chunks)
+}
@@ -2,87 +2,451 @@ package post_processing
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
 
+	"github.com/gurupras/go_cpuprof"
 	"github.com/gurupras/go_cpuprof/post_processing/filters"
 	"github.com/gurupras/gocommons"
 )
 
 type Boot struct {
-	Path       string
-	DeviceId   string
-	BootId     string
-	Files      []string
-	CurrentIdx int
-	ReadLock   sync.Mutex
+	Path     string
+	DeviceId string
+	BootId   string
+	Files    []string
+	// Shards decoded concurrently by a LineIterator. 1 reads them one after
+	// another on the caller's goroutine.
+	Workers   int
+	index     *BootIndex
+	indexLock sync.Mutex
 }
 
-func NewBoot(path, deviceid, bootid string) *Boot {
+func NewBoot(path, deviceid, bootid string) (*Boot, error) {
 	b := Boot{}
 	b.Path = path
 	b.DeviceId = deviceid
 	b.BootId = bootid
+	b.Workers = 1
 
 	fpath := b.GetBootPath()
+	// Directory walks do not descend into a symlinked root
+	if resolved, err := filepath.EvalSymlinks(fpath); err == nil {
+		fpath = resolved
+	}
 	if files, err := gocommons.ListFiles(fpath, []string{"*.gz"}); err != nil {
-		os.Exit(-1)
+		return nil, fmt.Errorf("Failed to list shards: %v: %v", fpath, err)
 	} else {
 		b.Files = files
 	}
-	b.CurrentIdx = -1
-	return &b
+	return &b, nil
 }
 
 func (b *Boot) GetBootPath() string {
 	return filepath.Join(b.Path, b.DeviceId, b.BootId)
 }
 
-/* Expected to be executed in a go-routine */
-func (b *Boot) AsyncFilterRead(channel chan string, filters []filters.LineFilter) {
-	b.ReadLock.Lock()
-	var file_raw *gocommons.File
-	var reader *bufio.Scanner
-	var err error
-
-	// Initialization
-	b.CurrentIdx = 0
-	for b.CurrentIdx = 0; b.CurrentIdx < len(b.Files); b.CurrentIdx++ {
-		file := b.Files[b.CurrentIdx]
-		//fmt.Println("Reading file:", file)
-		if file_raw, err = gocommons.Open(file, os.O_RDONLY, gocommons.GZ_TRUE); err != nil {
-			fmt.Fprintln(os.Stderr, fmt.Sprintf("Failed to open file:", err))
-			os.Exit(-1)
-		}
-		if reader, err = file_raw.Reader(1048576); err != nil {
-			fmt.Fprintln(os.Stderr, fmt.Sprintf("Failed to read file:", err))
-			os.Exit(-1)
-		}
-		reader.Split(bufio.ScanLines)
-		for reader.Scan() {
-			line := reader.Text()
-			// Filter
-			pass := true
-			if len(filters) > 0 {
-				for _, filter := range filters {
-					pass = pass && filter(line)
-					if pass == false {
-						break
-					}
+type ReadOptions struct {
+	// Index into Files of the first shard to read
+	StartShard int
+	// Loglines with a smaller LogcatToken are skipped
+	StartToken int64
+	// Applied to the raw line before it is parsed. Every filter must pass.
+	Filters []filters.LineFilter
+	// Hand out the lines that pass Filters without parsing them, including
+	// those that would not parse. Use Line instead of Logline. Lines are
+	// still parsed, and dropped if they do not parse, when StartToken is set
+	// or for range reads. Scan and ScanFrom ignore Raw.
+	Raw bool
+}
+
+// LineIterator reads the loglines of a boot in order. Lines that do not parse
+// are skipped. Iterators are independent of each other; a boot can be read by
+// several at once. If the boot has more than one worker, shards are decoded,
+// filtered and parsed concurrently and handed back in shard order.
+//
+//	it := boot.Lines(ctx)
+//	defer it.Close()
+//	for it.Next() {
+//		logline := it.Logline()
+//	}
+//	if err := it.Err(); err != nil {
+//	}
+type LineIterator struct {
+	boot     *Boot
+	ctx      context.Context
+	opts     ReadOptions
+	shard    int
+	file_raw *gocommons.File
+	reader   *bufio.Scanner
+	line     string
+	logline  *cpuprof.Logline
+	err      error
+	closed   bool
+	// Range reads: shards from end_shard on are not read, the first skip
+	// lines of the first shard are not parsed and only lines in rng are kept
+	rng       *Range
+	end_shard int
+	skip      int64
+	line_no   int64
+	// Parallel decoding. Workers stop once decode_ctx is done.
+	decode_ctx context.Context
+	cancel     context.CancelFunc
+	pending    chan *shardDecode
+	cur        *shardDecode
+	batch      []decodedLine
+}
+
+func (b *Boot) Lines(ctx context.Context) *LineIterator {
+	return b.LinesFrom(ctx, ReadOptions{})
+}
+
+func (b *Boot) LinesFrom(ctx context.Context, opts ReadOptions) *LineIterator {
+	return b.linesFrom(ctx, opts, nil, len(b.Files), 0)
+}
+
+func (b *Boot) linesFrom(ctx context.Context, opts ReadOptions, rng *Range, end_shard int, skip int64) *LineIterator {
+	it := new(LineIterator)
+	it.boot = b
+	it.ctx = ctx
+	it.opts = opts
+	it.shard = opts.StartShard
+	if it.shard < 0 {
+		it.shard = 0
+	}
+	it.rng = rng
+	it.end_shard = end_shard
+	it.skip = skip
+	if b.Workers > 1 {
+		it.decode_ctx, it.cancel = context.WithCancel(ctx)
+		it.pending = make(chan *shardDecode, b.Workers)
+		go it.dispatch(it.shard, b.Workers)
+	}
+	return it
+}
+
+// Whether line number line_no of shard should be skipped without parsing
+func (it *LineIterator) skipLine(shard int, line_no int64) bool {
+	return shard == it.opts.StartShard && line_no < it.skip
+}
+
+// Index into Files of the shard being read
+func (it *LineIterator) Shard() int {
+	return it.shard
+}
+
+func openShard(file string) (file_raw *gocommons.File, reader *bufio.Scanner, err error) {
+	if file_raw, err = gocommons.Open(file, os.O_RDONLY, gocommons.GZ_TRUE); err != nil {
+		return nil, nil, fmt.Errorf("Failed to open file: %v: %v", file, err)
+	}
+	if reader, err = file_raw.Reader(1048576); err != nil {
+		file_raw.Close()
+		return nil, nil, fmt.Errorf("Failed to read file: %v: %v", file, err)
+	}
+	reader.Split(bufio.ScanLines)
+	return
+}
+
+// Loglines are handed from decoding workers to the iterator in batches
+const DECODE_BATCH_SIZE = 1024
+
+// Batches buffered per shard in flight. Together with Workers this bounds
+// how far decoding can run ahead of the consumer.
+const DECODE_BATCHES_PER_SHARD = 16
+
+// decodedLine is a line that passed the options. logline is nil for raw
+// lines that were not parsed.
+type decodedLine struct {
+	line    string
+	logline *cpuprof.Logline
+}
+
+type shardDecode struct {
+	shard   int
+	batches chan []decodedLine
+	// Only read once batches is closed
+	err error
+}
+
+// Starts a decoder per shard, at most workers at a time, and queues them in
+// shard order on it.pending
+func (it *LineIterator) dispatch(start int, workers int) {
+	defer close(it.pending)
+	slots := make(chan struct{}, workers)
+	for shard := start; shard < it.end_shard; shard++ {
+		select {
+		case slots <- struct{}{}:
+		case <-it.decode_ctx.Done():
+			return
+		}
+		sd := &shardDecode{shard, make(chan []decodedLine, DECODE_BATCHES_PER_SHARD), nil}
+		go func() {
+			defer func() { <-slots }()
+			defer close(sd.batches)
+			sd.err = it.decode(sd)
+		}()
+		select {
+		case it.pending <- sd:
+		case <-it.decode_ctx.Done():
+			return
+		}
+	}
+}
+
+func (it *LineIterator) decode(sd *shardDecode) error {
+	file_raw, reader, err := openShard(it.boot.Files[sd.shard])
+	if err != nil {
+		return err
+	}
+	defer file_raw.Close()
+
+	send := func(batch []decodedLine) bool {
+		select {
+		case sd.batches <- batch:
+			return true
+		case <-it.decode_ctx.Done():
+			return false
+		}
+	}
+	batch := make([]decodedLine, 0, DECODE_BATCH_SIZE)
+	for line_no := int64(0); reader.Scan(); line_no++ {
+		dl, keep, stop := it.decodeLine(sd.shard, line_no, reader)
+		if stop {
+			break
+		}
+		if !keep {
+			continue
+		}
+		batch = append(batch, dl)
+		if len(batch) == DECODE_BATCH_SIZE {
+			if !send(batch) {
+				return it.decode_ctx.Err()
+			}
+			batch = make([]decodedLine, 0, DECODE_BATCH_SIZE)
+		}
+	}
+	if err = reader.Err(); err != nil {
+		return fmt.Errorf("Failed to read file: %v: %v", it.boot.Files[sd.shard], err)
+	}
+	if len(batch) > 0 && !send(batch) {
+		return it.decode_ctx.Err()
+	}
+	return nil
+}
+
+func (it *LineIterator) nextParallel() bool {
+	select {
+	case <-it.ctx.Done():
+		it.err = it.ctx.Err()
+		it.cancel()
+		return false
+	default:
+	}
+	for len(it.batch) == 0 {
+		if it.cur == nil {
+			select {
+			case sd, ok := <-it.pending:
+				if !ok {
+					// Every shard has been read unless the caller cancelled
+					it.err = it.ctx.Err()
+					it.cancel()
+					return false
+				}
+				it.cur = sd
+				it.shard = sd.shard
+			case <-it.decode_ctx.Done():
+				it.err = it.ctx.Err()
+				return false
+			}
+		}
+		select {
+		case batch, ok := <-it.cur.batches:
+			if !ok {
+				if it.err = it.cur.err; it.err != nil {
+					it.cancel()
+					return false
 				}
+				it.cur = nil
+				it.shard++
+				continue
+			}
+			it.batch = batch
+		case <-it.decode_ctx.Done():
+			it.err = it.ctx.Err()
+			return false
+		}
+	}
+	it.line = it.batch[0].line
+	it.logline = it.batch[0].logline
+	it.batch = it.batch[1:]
+	return true
+}
+
+func (it *LineIterator) closeShard() {
+	if it.file_raw != nil {
+		it.file_raw.Close()
+	}
+	it.file_raw = nil
+	it.reader = nil
+}
+
+func (it *LineIterator) pass(line string) bool {
+	for _, filter := range it.opts.Filters {
+		if !filter(line) {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeLine applies the options to line number line_no of shard, which
+// reader has just scanned. It returns whether the line is kept and whether
+// no line after it can be.
+func (it *LineIterator) decodeLine(shard int, line_no int64, reader *bufio.Scanner) (dl decodedLine, keep bool, stop bool) {
+	if it.skipLine(shard, line_no) {
+		return
+	}
+	dl.line = reader.Text()
+	if !it.pass(dl.line) {
+		return
+	}
+	if it.opts.Raw && it.opts.StartToken == 0 && it.rng == nil {
+		keep = true
+		return
+	}
+	dl.logline = cpuprof.ParseLogline(dl.line)
+	if dl.logline == nil || dl.logline.LogcatToken < it.opts.StartToken {
+		return
+	}
+	if it.rng != nil {
+		point := newIndexPoint(line_no, dl.logline)
+		if it.rng.after(point) {
+			stop = true
+			return
+		}
+		if it.rng.before(point) {
+			return
+		}
+	}
+	keep = true
+	return
+}
+
+// Next advances to the next logline. It returns false once the boot has been
+// read, ctx has been cancelled or an error occurred; check Err to tell apart.
+func (it *LineIterator) Next() bool {
+	it.line = ""
+	it.logline = nil
+	if it.err != nil || it.closed {
+		return false
+	}
+	if it.pending != nil {
+		return it.nextParallel()
+	}
+	for {
+		select {
+		case <-it.ctx.Done():
+			it.err = it.ctx.Err()
+			it.closeShard()
+			return false
+		default:
+		}
+		if it.reader == nil {
+			if it.shard >= it.end_shard {
+				return false
 			}
-			if pass {
-				channel <- line
+			if it.file_raw, it.reader, it.err = openShard(it.boot.Files[it.shard]); it.err != nil {
+				return false
 			}
+			it.line_no = 0
 		}
-		file_raw.Close()
+		if it.reader.Scan() {
+			line_no := it.line_no
+			it.line_no++
+			dl, keep, stop := it.decodeLine(it.shard, line_no, it.reader)
+			if stop {
+				// Nothing further can be in range
+				it.closeShard()
+				it.shard = it.end_shard
+				return false
+			}
+			if !keep {
+				continue
+			}
+			it.line = dl.line
+			it.logline = dl.logline
+			return true
+		}
+		if err := it.reader.Err(); err != nil {
+			it.err = fmt.Errorf("Failed to read file: %v: %v", it.boot.Files[it.shard], err)
+			it.closeShard()
+			return false
+		}
+		it.closeShard()
+		it.shard++
+	}
+}
+
+// Logline returns the logline Next advanced to. It is nil for Raw reads
+// that did not need to parse the line.
+func (it *LineIterator) Logline() *cpuprof.Logline {
+	return it.logline
+}
+
+// Line returns the raw line Next advanced to
+func (it *LineIterator) Line() string {
+	return it.line
+}
+
+func (it *LineIterator) Err() error {
+	return it.err
+}
+
+// Close releases the shard being read. It is safe to call more than once.
+func (it *LineIterator) Close() error {
+	it.closed = true
+	it.closeShard()
+	if it.cancel != nil {
+		it.cancel()
+	}
+	return nil
+}
+
+// Scan calls fn with every logline of the boot in order. It stops at the first
+// error returned by fn, an I/O error or cancellation of ctx and returns it.
+func (b *Boot) Scan(ctx context.Context, fn func(*cpuprof.Logline) error) error {
+	return b.ScanFrom(ctx, ReadOptions{}, fn)
+}
+
+func (b *Boot) ScanFrom(ctx context.Context, opts ReadOptions, fn func(*cpuprof.Logline) error) error {
+	opts.Raw = false
+	it := b.LinesFrom(ctx, opts)
+	defer it.Close()
+	for it.Next() {
+		if err := fn(it.Logline()); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+/* Expected to be executed in a go-routine */
+// Every raw line that passes filters is sent, whether or not it parses; the
+// consumers parse the lines themselves.
+func (b *Boot) AsyncFilterRead(channel chan string, filters []filters.LineFilter) {
+	it := b.LinesFrom(context.Background(), ReadOptions{Filters: filters, Raw: true})
+	for it.Next() {
+		channel <- it.Line()
+	}
+	it.Close()
+	if err := it.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("%v: %v", b.BootId, err))
 	}
 	// Signal done
 	close(channel)
-	b.CurrentIdx = -1
-	b.ReadLock.Unlock()
 }
 
 func (b *Boot) AsyncRead(channel chan string) {
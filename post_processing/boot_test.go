@@ -1,10 +1,17 @@
 package post_processing
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/gurupras/go_cpuprof"
+	"github.com/gurupras/go_cpuprof/post_processing/filters"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -13,7 +20,8 @@ func TestBoot(t *testing.T) {
 
 	assert := assert.New(t)
 
-	boot := NewBoot("/android/cpuprof-data/", "0c037a6e55da4e024d9e64d97114c642695c5434", "453fea81-57cc-43e0-9693-91f63b0433b9")
+	boot, err := NewBoot("/android/cpuprof-data/", "0c037a6e55da4e024d9e64d97114c642695c5434", "453fea81-57cc-43e0-9693-91f63b0433b9")
+	assert.Nil(err, "Failed to open boot")
 	channel := make(chan string, 100000)
 	go boot.AsyncRead(channel)
 
@@ -38,3 +46,207 @@ func TestBoot(t *testing.T) {
 		}
 	}
 }
+
+// Boot with tokens 1..3 in the first shard and 4..5 in the second
+func setupIteratorBoot(t *testing.T) *Boot {
+	path := setupCatalogueTree(t)
+	bootid := "453fea81-57cc-43e0-9693-91f63b0433b9"
+	writeShard(t, filepath.Join(path, testDeviceA, bootid, "00000000.gz"), []string{
+		catalogueLine(bootid, 10, 1, "KernelPrintk: one"),
+		catalogueLine(bootid, 10, 2, "Kernel-Trace: two"),
+		"garbage",
+		catalogueLine(bootid, 10, 3, "KernelPrintk: three"),
+	})
+	writeShard(t, filepath.Join(path, testDeviceA, bootid, "00000001.gz"), []string{
+		catalogueLine(bootid, 10, 4, "Kernel-Trace: four"),
+		catalogueLine(bootid, 10, 5, "KernelPrintk: five"),
+	})
+	boot, err := NewBoot(path, testDeviceA, bootid)
+	assert.Nil(t, err, "Failed to open boot")
+	return boot
+}
+
+func scanTokens(boot *Boot, ctx context.Context, opts ReadOptions) (tokens []int64, err error) {
+	tokens = make([]int64, 0)
+	err = boot.ScanFrom(ctx, opts, func(logline *cpuprof.Logline) error {
+		tokens = append(tokens, logline.LogcatToken)
+		return nil
+	})
+	return
+}
+
+func TestBootIterator(t *testing.T) {
+	assert := assert.New(t)
+
+	boot := setupIteratorBoot(t)
+	defer os.RemoveAll(boot.Path)
+
+	tests := []struct {
+		name     string
+		opts     ReadOptions
+		expected []int64
+	}{
+		{"all", ReadOptions{}, []int64{1, 2, 3, 4, 5}},
+		{"start shard", ReadOptions{StartShard: 1}, []int64{4, 5}},
+		{"start token", ReadOptions{StartToken: 3}, []int64{3, 4, 5}},
+		{"past the end", ReadOptions{StartShard: 2}, []int64{}},
+		{"filters", ReadOptions{Filters: []filters.LineFilter{func(line string) bool {
+			return strings.Contains(line, "Kernel-Trace")
+		}}}, []int64{2, 4}},
+	}
+	for _, workers := range []int{1, 3} {
+		boot.Workers = workers
+		for _, test := range tests {
+			tokens, err := scanTokens(boot, context.Background(), test.opts)
+			assert.Nil(err, fmt.Sprintf("%v (%d workers)", test.name, workers))
+			assert.Equal(test.expected, tokens, fmt.Sprintf("%v (%d workers)", test.name, workers))
+		}
+	}
+	boot.Workers = 1
+
+	// Stopping early
+	it := boot.Lines(context.Background())
+	assert.True(it.Next())
+	assert.Equal(int64(1), it.Logline().LogcatToken)
+	assert.Nil(it.Close())
+	assert.False(it.Next())
+	assert.Nil(it.Err())
+
+	// Errors from fn are returned as is
+	stop := errors.New("stop")
+	err := boot.Scan(context.Background(), func(logline *cpuprof.Logline) error {
+		if logline.LogcatToken == 2 {
+			return stop
+		}
+		return nil
+	})
+	assert.Equal(stop, err)
+}
+
+func TestBootIteratorRaw(t *testing.T) {
+	assert := assert.New(t)
+
+	boot := setupIteratorBoot(t)
+	defer os.RemoveAll(boot.Path)
+
+	for _, workers := range []int{1, 3} {
+		boot.Workers = workers
+		// Lines that don't parse are handed out as well
+		it := boot.LinesFrom(context.Background(), ReadOptions{Raw: true})
+		lines := make([]string, 0)
+		for it.Next() {
+			assert.Nil(it.Logline())
+			lines = append(lines, it.Line())
+		}
+		assert.Nil(it.Err())
+		assert.Equal(6, len(lines), fmt.Sprintf("%d workers", workers))
+		assert.Equal("garbage", lines[2], fmt.Sprintf("%d workers", workers))
+
+		// StartToken still needs the lines parsed
+		it = boot.LinesFrom(context.Background(), ReadOptions{Raw: true, StartToken: 4})
+		lines = make([]string, 0)
+		for it.Next() {
+			assert.Equal(it.Logline().Line, it.Line())
+			lines = append(lines, it.Line())
+		}
+		assert.Equal(2, len(lines), fmt.Sprintf("%d workers", workers))
+	}
+	boot.Workers = 1
+
+	// AsyncFilterRead forwards every line that passes the filters
+	channel := make(chan string, 10)
+	boot.AsyncFilterRead(channel, []filters.LineFilter{func(line string) bool {
+		return !strings.Contains(line, "Kernel-Trace")
+	}})
+	lines := make([]string, 0)
+	for line := range channel {
+		lines = append(lines, line)
+	}
+	assert.Equal(4, len(lines))
+	assert.Equal("garbage", lines[1])
+}
+
+func TestBootIteratorCancel(t *testing.T) {
+	assert := assert.New(t)
+
+	boot := setupIteratorBoot(t)
+	defer os.RemoveAll(boot.Path)
+
+	for _, workers := range []int{1, 3} {
+		boot.Workers = workers
+		ctx, cancel := context.WithCancel(context.Background())
+		tokens := make([]int64, 0)
+		err := boot.Scan(ctx, func(logline *cpuprof.Logline) error {
+			tokens = append(tokens, logline.LogcatToken)
+			cancel()
+			return nil
+		})
+		assert.Equal(context.Canceled, err)
+		// Lines already decoded are not handed out in parallel mode either
+		assert.Equal([]int64{1}, tokens)
+	}
+}
+
+func TestBootIteratorError(t *testing.T) {
+	assert := assert.New(t)
+
+	boot := setupIteratorBoot(t)
+	defer os.RemoveAll(boot.Path)
+
+	// Second shard disappears after the boot was listed
+	os.Remove(boot.Files[1])
+	for _, workers := range []int{1, 3} {
+		boot.Workers = workers
+		tokens, err := scanTokens(boot, context.Background(), ReadOptions{})
+		assert.NotNil(err)
+		assert.Equal([]int64{1, 2, 3}, tokens)
+	}
+	boot.Workers = 1
+
+	// AsyncRead reports the error and still closes the channel
+	channel := make(chan string, 10)
+	boot.AsyncRead(channel)
+	lines := 0
+	for _ = range channel {
+		lines++
+	}
+	// Raw lines, including the one that doesn't parse
+	assert.Equal(4, lines)
+}
+
+func TestBootParallelOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	path, err := ioutil.TempDir("", "boot")
+	assert.Nil(err, "Failed to create temp dir")
+	defer os.RemoveAll(path)
+
+	// Several batches per shard and more shards than workers
+	bootid := "453fea81-57cc-43e0-9693-91f63b0433b9"
+	token := 0
+	for shard := 0; shard < 6; shard++ {
+		lines := make([]string, 0)
+		for idx := 0; idx < 2*DECODE_BATCH_SIZE+7; idx++ {
+			token++
+			lines = append(lines, catalogueLine(bootid, 10, token, "KernelPrintk: line"))
+		}
+		writeShard(t, filepath.Join(path, testDeviceA, bootid, fmt.Sprintf("%08d.gz", shard)), lines)
+	}
+	boot, err := NewBoot(path, testDeviceA, bootid)
+	assert.Nil(err, "Failed to open boot")
+	boot.Workers = 4
+
+	tokens, err := scanTokens(boot, context.Background(), ReadOptions{StartShard: 1})
+	assert.Nil(err)
+	assert.Equal(5*(2*DECODE_BATCH_SIZE+7), len(tokens))
+	for idx, token := range tokens {
+		if !assert.Equal(int64(2*DECODE_BATCH_SIZE+7+idx+1), token) {
+			break
+		}
+	}
+
+	// Stopping early releases the workers
+	it := boot.Lines(context.Background())
+	assert.True(it.Next())
+	it.Close()
+}
@@ -0,0 +1,398 @@
+package post_processing
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gurupras/go_cpuprof"
+	"github.com/gurupras/gocommons"
+	"github.com/gurupras/gocommons/gsync"
+)
+
+const (
+	CATALOGUE_FILE = "catalogue.json"
+	// Optional map of device-id to phone model
+	MODELS_FILE = "models.json"
+)
+
+// BootInfo describes one boot without having to read its shards
+type BootInfo struct {
+	DeviceId string   `json:"device_id"`
+	BootId   string   `json:"boot_id"`
+	Shards   []string `json:"shards"`
+	// Size and modification time of every shard when it was scanned
+	ShardStats     []ShardStat `json:"shard_stats"`
+	Lines          int64       `json:"lines"`
+	FirstTime      time.Time   `json:"first_time"`
+	LastTime       time.Time   `json:"last_time"`
+	FirstTraceTime float64     `json:"first_trace_time"`
+	LastTraceTime  float64     `json:"last_trace_time"`
+	// -1 if the boot did not log its PVS bin
+	PvsBin int `json:"pvs_bin"`
+	// Number of CPUs seen in kernel traces, 0 if none were seen
+	Ncpus int `json:"ncpus"`
+}
+
+type ShardStat struct {
+	Size    int64 `json:"size"`
+	ModTime int64 `json:"mod_time"`
+}
+
+func (bi *BootInfo) Duration() time.Duration {
+	return bi.LastTime.Sub(bi.FirstTime)
+}
+
+type DeviceInfo struct {
+	DeviceId string `json:"device_id"`
+	Model    string `json:"model"`
+	// First PVS bin found across the device's boots, -1 if none was found
+	PvsBin int         `json:"pvs_bin"`
+	Ncpus  int         `json:"ncpus"`
+	Boots  []*BootInfo `json:"boots"`
+	// Boot-id to the error that kept the boot out of Boots. Skipped boots are
+	// scanned again the next time the catalogue is built.
+	Skipped map[string]string `json:"skipped,omitempty"`
+}
+
+type Catalogue struct {
+	Devices map[string]*DeviceInfo `json:"devices"`
+}
+
+func NewCatalogue() *Catalogue {
+	c := new(Catalogue)
+	c.Devices = make(map[string]*DeviceInfo)
+	return c
+}
+
+// Basenames of the shards of boot, in order
+func shardNames(boot *Boot) []string {
+	names := make([]string, len(boot.Files))
+	for idx, file := range boot.Files {
+		names[idx] = filepath.Base(file)
+	}
+	return names
+}
+
+// bootInfoCurrent is true if the shards of boot have the same names, sizes
+// and modification times as when bi was scanned
+func bootInfoCurrent(bi *BootInfo, boot *Boot) bool {
+	if len(bi.Shards) != len(boot.Files) || len(bi.ShardStats) != len(boot.Files) {
+		return false
+	}
+	for idx, file := range boot.Files {
+		fi, err := os.Stat(file)
+		if err != nil || strings.Compare(bi.Shards[idx], filepath.Base(file)) != 0 ||
+			bi.ShardStats[idx].Size != fi.Size() || bi.ShardStats[idx].ModTime != fi.ModTime().UnixNano() {
+			return false
+		}
+	}
+	return true
+}
+
+// ScanBoot reads every shard of boot to build its BootInfo
+func ScanBoot(boot *Boot) (bi *BootInfo, err error) {
+	var file_raw *gocommons.File
+	var reader *bufio.Scanner
+
+	bi = new(BootInfo)
+	bi.DeviceId = boot.DeviceId
+	bi.BootId = boot.BootId
+	bi.Shards = shardNames(boot)
+	bi.ShardStats = make([]ShardStat, 0, len(boot.Files))
+	bi.PvsBin = -1
+
+	first := true
+	for _, file := range boot.Files {
+		var fi os.FileInfo
+		if fi, err = os.Stat(file); err != nil {
+			return nil, err
+		}
+		bi.ShardStats = append(bi.ShardStats, ShardStat{fi.Size(), fi.ModTime().UnixNano()})
+		if file_raw, err = gocommons.Open(file, os.O_RDONLY, gocommons.GZ_TRUE); err != nil {
+			return nil, fmt.Errorf("Failed to open file: %v: %v", file, err)
+		}
+		if reader, err = file_raw.Reader(1048576); err != nil {
+			file_raw.Close()
+			return nil, fmt.Errorf("Failed to read file: %v: %v", file, err)
+		}
+		reader.Split(bufio.ScanLines)
+		for reader.Scan() {
+			line := reader.Text()
+			logline := cpuprof.ParseLogline(line)
+			if logline == nil {
+				continue
+			}
+			bi.Lines++
+			if first {
+				bi.FirstTime = logline.Datetime
+				bi.FirstTraceTime = logline.TraceTime
+				first = false
+			}
+			bi.LastTime = logline.Datetime
+			bi.LastTraceTime = logline.TraceTime
+
+			if bi.PvsBin == -1 && strings.Contains(line, "ACPU PVS:") && cpuprof.PVS_BIN_PATTERN.MatchString(logline.Payload) {
+				bi.PvsBin = cpuprof.ParsePvsBin(logline).PvsBin
+			}
+			if strings.Contains(line, "Kernel-Trace") && (strings.Contains(line, "cpu_frequency:") || strings.Contains(line, "sched_cpu_hotplug:")) {
+				cpu := -1
+				switch t := cpuprof.ParseTraceFromLoglinePayload(logline).(type) {
+				case *cpuprof.CpuFrequency:
+					cpu = t.CpuId
+				case *cpuprof.SchedCpuHotplug:
+					cpu = t.Cpu
+				}
+				if cpu+1 > bi.Ncpus {
+					bi.Ncpus = cpu + 1
+				}
+			}
+		}
+		err = reader.Err()
+		file_raw.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read file: %v: %v", file, err)
+		}
+	}
+	return
+}
+
+func (ds *Dataset) cataloguePath() string {
+	return filepath.Join(ds.Path, CATALOGUE_FILE)
+}
+
+// Device-id to model as listed in <path>/models.json, if it exists
+func (ds *Dataset) loadModels() (models map[string]string, err error) {
+	var bytes []byte
+
+	models = make(map[string]string)
+	if bytes, err = ioutil.ReadFile(filepath.Join(ds.Path, MODELS_FILE)); err != nil {
+		if os.IsNotExist(err) {
+			return models, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(bytes, &models); err != nil {
+		return nil, fmt.Errorf("Failed to parse %v: %v", MODELS_FILE, err)
+	}
+	return
+}
+
+// LoadCatalogue reads <path>/catalogue.json without checking it against the
+// data on disk
+func (ds *Dataset) LoadCatalogue() (catalogue *Catalogue, err error) {
+	var bytes []byte
+
+	if bytes, err = ioutil.ReadFile(ds.cataloguePath()); err != nil {
+		return nil, err
+	}
+	catalogue = NewCatalogue()
+	if err = json.Unmarshal(bytes, catalogue); err != nil {
+		return nil, fmt.Errorf("Failed to parse %v: %v", ds.cataloguePath(), err)
+	}
+	return
+}
+
+func (ds *Dataset) SaveCatalogue(catalogue *Catalogue) (err error) {
+	var bytes []byte
+
+	if bytes, err = json.MarshalIndent(catalogue, "", "    "); err != nil {
+		return fmt.Errorf("Failed to marshal catalogue: %v", err)
+	}
+	return ioutil.WriteFile(ds.cataloguePath(), bytes, 0664)
+}
+
+// BuildCatalogue brings the catalogue up to date with the data on disk.
+// Boots already described by catalogue.json with the same shards are reused;
+// every other boot is scanned. Boots that fail to scan are left out and
+// listed in DeviceInfo.Skipped. The result is saved back to catalogue.json.
+func (ds *Dataset) BuildCatalogue() (catalogue *Catalogue, err error) {
+	var devices []string
+	var models map[string]string
+
+	old, load_err := ds.LoadCatalogue()
+	if load_err != nil {
+		old = NewCatalogue()
+	}
+	if models, err = ds.loadModels(); err != nil {
+		return nil, err
+	}
+	if devices, err = ds.Devices(); err != nil {
+		return nil, err
+	}
+
+	catalogue = NewCatalogue()
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	bootSem := gsync.NewSem(8)
+
+	for _, device := range devices {
+		boots, boots_err := ds.Boots(device)
+		if boots_err != nil {
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("Warning: %v...skipping", boots_err))
+			continue
+		}
+		di := new(DeviceInfo)
+		di.DeviceId = device
+		di.Model = models[device]
+		di.PvsBin = -1
+		di.Boots = make([]*BootInfo, len(boots))
+		di.Skipped = make(map[string]string)
+		catalogue.Devices[device] = di
+
+		cached := make(map[string]*BootInfo)
+		if old_di, ok := old.Devices[device]; ok {
+			for _, bi := range old_di.Boots {
+				cached[bi.BootId] = bi
+			}
+		}
+		for idx, boot := range boots {
+			if bi, ok := cached[boot.BootId]; ok && bootInfoCurrent(bi, boot) {
+				di.Boots[idx] = bi
+				continue
+			}
+			wg.Add(1)
+			bootSem.P()
+			go func(di *DeviceInfo, idx int, boot *Boot) {
+				defer wg.Done()
+				defer bootSem.V()
+				bi, scan_err := ScanBoot(boot)
+				mutex.Lock()
+				defer mutex.Unlock()
+				if scan_err != nil {
+					fmt.Fprintln(os.Stderr, fmt.Sprintf("Warning: %v -> %v: %v...skipping", boot.DeviceId, boot.BootId, scan_err))
+					di.Skipped[boot.BootId] = scan_err.Error()
+					return
+				}
+				di.Boots[idx] = bi
+			}(di, idx, boot)
+		}
+	}
+	wg.Wait()
+
+	for _, di := range catalogue.Devices {
+		// Drop the boots that were skipped
+		scanned := make([]*BootInfo, 0, len(di.Boots))
+		for _, bi := range di.Boots {
+			if bi != nil {
+				scanned = append(scanned, bi)
+			}
+		}
+		di.Boots = scanned
+		for _, bi := range di.Boots {
+			if di.PvsBin == -1 {
+				di.PvsBin = bi.PvsBin
+			}
+			if bi.Ncpus > di.Ncpus {
+				di.Ncpus = bi.Ncpus
+			}
+		}
+	}
+	if err = ds.SaveCatalogue(catalogue); err != nil {
+		return nil, err
+	}
+	ds.mutex.Lock()
+	ds.catalogue = catalogue
+	ds.mutex.Unlock()
+	return
+}
+
+// Catalogue returns the catalogue, building it on first use
+func (ds *Dataset) Catalogue() (*Catalogue, error) {
+	ds.mutex.Lock()
+	catalogue := ds.catalogue
+	ds.mutex.Unlock()
+	if catalogue != nil {
+		return catalogue, nil
+	}
+	return ds.BuildCatalogue()
+}
+
+// BootQuery selects boots from the catalogue. Zero-valued fields match everything.
+type BootQuery struct {
+	Devices []string
+	Model   string
+	// -1 matches boots with an unknown PVS bin; nil matches any
+	PvsBin *int
+	Ncpus  int
+	// Boots overlapping [From, To]
+	From        time.Time
+	To          time.Time
+	MinDuration time.Duration
+}
+
+func (q *BootQuery) matches(di *DeviceInfo, bi *BootInfo) bool {
+	if len(q.Devices) > 0 {
+		found := false
+		for _, device := range q.Devices {
+			if strings.Compare(device, di.DeviceId) == 0 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(q.Model) > 0 && strings.Compare(q.Model, di.Model) != 0 {
+		return false
+	}
+	if q.PvsBin != nil && *q.PvsBin != di.PvsBin {
+		return false
+	}
+	if q.Ncpus > 0 && q.Ncpus != di.Ncpus {
+		return false
+	}
+	if !q.From.IsZero() && bi.LastTime.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && bi.FirstTime.After(q.To) {
+		return false
+	}
+	if bi.Duration() < q.MinDuration {
+		return false
+	}
+	return true
+}
+
+// Select returns the boots matching q ordered by device and start time
+func (ds *Dataset) Select(q BootQuery) (boots []*BootInfo, err error) {
+	var catalogue *Catalogue
+
+	if catalogue, err = ds.Catalogue(); err != nil {
+		return nil, err
+	}
+	boots = make([]*BootInfo, 0)
+	for _, di := range catalogue.Devices {
+		for _, bi := range di.Boots {
+			if q.matches(di, bi) {
+				boots = append(boots, bi)
+			}
+		}
+	}
+	sort.Sort(bootInfoSlice(boots))
+	return
+}
+
+type bootInfoSlice []*BootInfo
+
+func (b bootInfoSlice) Len() int      { return len(b) }
+func (b bootInfoSlice) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b bootInfoSlice) Less(i, j int) bool {
+	if b[i].DeviceId != b[j].DeviceId {
+		return b[i].DeviceId < b[j].DeviceId
+	}
+	return b[i].FirstTime.Before(b[j].FirstTime)
+}
+
+// Boot opens the boot described by bi
+func (ds *Dataset) Boot(bi *BootInfo) (*Boot, error) {
+	return NewBoot(ds.Path, bi.DeviceId, bi.BootId)
+}
@@ -0,0 +1,181 @@
+package post_processing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gurupras/gocommons"
+	"github.com/stretchr/testify/assert"
+)
+
+func catalogueLine(bootid string, hour int, token int, payload string) string {
+	return fmt.Sprintf("%s 2016-06-25 %02d:00:00.000000000 %d [   %d.000000]   200   200 D %s", bootid, hour, token, token, payload)
+}
+
+func writeShard(t *testing.T, file string, lines []string) {
+	assert.Nil(t, os.MkdirAll(filepath.Dir(file), 0775))
+	fstruct, err := gocommons.Open(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, gocommons.GZ_TRUE)
+	assert.Nil(t, err, "Failed to open:", file)
+	defer fstruct.Close()
+	writer, err := fstruct.Writer(0)
+	assert.Nil(t, err, "Failed to get writer:", file)
+	defer writer.Close()
+	defer writer.Flush()
+	for _, line := range lines {
+		writer.Write([]byte(line + "\n"))
+	}
+}
+
+// Device A has two boots: the first logs its PVS bin and frequencies of 4
+// CPUs, the second is a short boot with nothing of note
+func setupCatalogueTree(t *testing.T) string {
+	path, err := ioutil.TempDir("", "catalogue")
+	assert.Nil(t, err, "Failed to create temp dir")
+
+	boot1 := "453fea81-57cc-43e0-9693-91f63b0433b9"
+	boot2 := "29b2b79e-1a97-4f96-8070-7a26f952e92b"
+	writeShard(t, filepath.Join(path, testDeviceA, boot1, "00000000.gz"), []string{
+		catalogueLine(boot1, 10, 1, "KernelPrintk: <6>[    1.000000] acpuclk-8974 qcom,acpuclk.30: ACPU PVS: 2"),
+		catalogueLine(boot1, 11, 2, "Kernel-Trace: kworker/0:1H-17 [000] ...1     2.000000: cpu_frequency: state=1728000 cpu_id=0"),
+	})
+	writeShard(t, filepath.Join(path, testDeviceA, boot1, "00000001.gz"), []string{
+		catalogueLine(boot1, 12, 3, "Kernel-Trace: kworker/3:1H-17 [003] ...1     3.000000: cpu_frequency: state=1728000 cpu_id=3"),
+		"garbage",
+		catalogueLine(boot1, 13, 4, "KernelPrintk: nothing"),
+	})
+	writeShard(t, filepath.Join(path, testDeviceA, boot2, "00000000.gz"), []string{
+		catalogueLine(boot2, 20, 1, "KernelPrintk: nothing"),
+	})
+	info := fmt.Sprintf(`{"bootids": ["%s", "%s"], "files": []}`, boot1, boot2)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(path, testDeviceA, "info.json"), []byte(info), 0664))
+	models := fmt.Sprintf(`{"%s": "Nexus 5"}`, testDeviceA)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(path, MODELS_FILE), []byte(models), 0664))
+	return path
+}
+
+func TestCatalogue(t *testing.T) {
+	assert := assert.New(t)
+
+	path := setupCatalogueTree(t)
+	defer os.RemoveAll(path)
+
+	ds := NewDataset(path)
+	catalogue, err := ds.Catalogue()
+	assert.Nil(err, "Failed to build catalogue")
+
+	di := catalogue.Devices[testDeviceA]
+	assert.Equal("Nexus 5", di.Model)
+	assert.Equal(2, di.PvsBin)
+	assert.Equal(4, di.Ncpus)
+	assert.Equal(2, len(di.Boots))
+
+	bi := di.Boots[0]
+	assert.Equal([]string{"00000000.gz", "00000001.gz"}, bi.Shards)
+	assert.Equal(int64(4), bi.Lines)
+	assert.Equal(10, bi.FirstTime.Hour())
+	assert.Equal(13, bi.LastTime.Hour())
+	assert.Equal(3*time.Hour, bi.Duration())
+	assert.Equal(1.0, bi.FirstTraceTime)
+	assert.Equal(4.0, bi.LastTraceTime)
+	assert.Equal(-1, di.Boots[1].PvsBin)
+	assert.Equal(0, di.Boots[1].Ncpus)
+
+	// Boots whose shards are unchanged are taken from catalogue.json
+	bi.Lines = 1000
+	assert.Nil(ds.SaveCatalogue(catalogue))
+	catalogue, err = NewDataset(path).Catalogue()
+	assert.Nil(err)
+	assert.Equal(int64(1000), catalogue.Devices[testDeviceA].Boots[0].Lines)
+
+	// ...and rescanned once they change
+	writeShard(t, filepath.Join(path, testDeviceA, bi.BootId, "00000002.gz"), []string{
+		catalogueLine(bi.BootId, 14, 5, "KernelPrintk: nothing"),
+	})
+	catalogue, err = NewDataset(path).Catalogue()
+	assert.Nil(err)
+	assert.Equal(int64(5), catalogue.Devices[testDeviceA].Boots[0].Lines)
+
+	// ...or are rewritten in place under the same names
+	catalogue.Devices[testDeviceA].Boots[0].Lines = 1000
+	assert.Nil(ds.SaveCatalogue(catalogue))
+	writeShard(t, filepath.Join(path, testDeviceA, bi.BootId, "00000002.gz"), []string{
+		catalogueLine(bi.BootId, 14, 5, "KernelPrintk: nothing"),
+		catalogueLine(bi.BootId, 15, 6, "KernelPrintk: nothing"),
+	})
+	catalogue, err = NewDataset(path).Catalogue()
+	assert.Nil(err)
+	assert.Equal(int64(6), catalogue.Devices[testDeviceA].Boots[0].Lines)
+
+	bytes, err := ioutil.ReadFile(filepath.Join(path, CATALOGUE_FILE))
+	assert.Nil(err)
+	saved := NewCatalogue()
+	assert.Nil(json.Unmarshal(bytes, saved))
+	assert.Equal(int64(6), saved.Devices[testDeviceA].Boots[0].Lines)
+}
+
+func TestCatalogueSkipsBrokenBoots(t *testing.T) {
+	assert := assert.New(t)
+
+	path := setupCatalogueTree(t)
+	defer os.RemoveAll(path)
+
+	// The second boot's shard is not gzip
+	boot2 := "29b2b79e-1a97-4f96-8070-7a26f952e92b"
+	assert.Nil(ioutil.WriteFile(filepath.Join(path, testDeviceA, boot2, "00000000.gz"), []byte("corrupt"), 0664))
+
+	catalogue, err := NewDataset(path).Catalogue()
+	assert.Nil(err)
+	di := catalogue.Devices[testDeviceA]
+	assert.Equal(1, len(di.Boots))
+	assert.Equal("453fea81-57cc-43e0-9693-91f63b0433b9", di.Boots[0].BootId)
+	assert.Equal(4, di.Ncpus)
+	assert.Equal(1, len(di.Skipped))
+	assert.Contains(di.Skipped, boot2)
+
+	// Once the boot is readable again it is scanned
+	writeShard(t, filepath.Join(path, testDeviceA, boot2, "00000000.gz"), []string{
+		catalogueLine(boot2, 20, 1, "KernelPrintk: nothing"),
+	})
+	catalogue, err = NewDataset(path).Catalogue()
+	assert.Nil(err)
+	di = catalogue.Devices[testDeviceA]
+	assert.Equal(2, len(di.Boots))
+	assert.Equal(0, len(di.Skipped))
+}
+
+func TestSelect(t *testing.T) {
+	assert := assert.New(t)
+
+	path := setupCatalogueTree(t)
+	defer os.RemoveAll(path)
+	ds := NewDataset(path)
+
+	boots, err := ds.Select(BootQuery{})
+	assert.Nil(err)
+	assert.Equal(2, len(boots))
+
+	boots, _ = ds.Select(BootQuery{MinDuration: time.Hour})
+	assert.Equal(1, len(boots))
+	assert.Equal(int64(4), boots[0].Lines)
+
+	from := time.Date(2016, 6, 25, 15, 0, 0, 0, time.UTC)
+	boots, _ = ds.Select(BootQuery{From: from})
+	assert.Equal(1, len(boots))
+	assert.Equal(int64(1), boots[0].Lines)
+
+	boots, _ = ds.Select(BootQuery{Model: "Nexus 6"})
+	assert.Equal(0, len(boots))
+
+	pvs := 2
+	boots, _ = ds.Select(BootQuery{Model: "Nexus 5", PvsBin: &pvs, Ncpus: 4})
+	assert.Equal(2, len(boots))
+
+	boot, err := ds.Boot(boots[0])
+	assert.Nil(err)
+	assert.Equal(2, len(boot.Files))
+}
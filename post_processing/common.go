@@ -1,79 +1,52 @@
 package post_processing
 
 import (
-	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strings"
-
-	"github.com/fatih/set"
-	"github.com/google/shlex"
-	"github.com/gurupras/go_cpuprof"
-	"github.com/gurupras/gocommons"
+	"regexp"
+	"sort"
 )
 
-func GetDevices(path string) (devices []string, err error) {
-	cmd := fmt.Sprintf("ls -d %s/*/ | grep -P '%s/[a-f0-9]{40}/'", path, path)
-	args, _ := shlex.Split(cmd)
-	if ret, stdout, stderr := gocommons.Execv(args[0], args[1:], true); ret != 0 {
-		err = errors.New(fmt.Sprintf("Failed to run program:%v", stderr))
-		return
-	} else {
-		dirs := strings.Split(stdout, "\n")
-		for _, dir := range dirs {
-			if len(strings.TrimSpace(dir)) == 0 {
-				continue
-			}
-			basename := filepath.Base(dir)
-			devices = append(devices, basename)
-		}
-	}
-	return
-}
-
-func GetDeviceFiles(path string, filter []string) map[string][]*Boot {
-	devices, _ := GetDevices(path)
+const DEFAULT_DEVICE_PATTERN = "^[a-f0-9]{40}$"
 
-	device_files := make(map[string][]*Boot)
+// Directories under the data path whose names match DevicePattern are devices
+var DevicePattern = regexp.MustCompile(DEFAULT_DEVICE_PATTERN)
 
-	if len(filter) > 0 {
-		ds := set.NewNonTS()
-		for _, d := range devices {
-			ds.Add(d)
-		}
+// ListDevices returns the sorted names of the directories in path that match
+// pattern. Symlinks to directories are followed; broken symlinks are skipped.
+func ListDevices(path string, pattern *regexp.Regexp) (devices []string, err error) {
+	var entries []os.FileInfo
 
-		dfs := set.NewNonTS()
-		for _, d := range filter {
-			dfs.Add(d)
-		}
-
-		devices = set.StringSlice(set.Intersection(ds, dfs))
+	if entries, err = ioutil.ReadDir(path); err != nil {
+		return nil, fmt.Errorf("Failed to list devices: %v: %v", path, err)
 	}
-
-	skipped := 0
-	for _, d := range devices {
-		if _, ok := device_files[d]; !ok {
-			device_files[d] = make([]*Boot, 0)
-		}
-		dpath := filepath.Join(path, d)
-		info := make(map[string][]string)
-		var err error
-
-		if info, err = cpuprof.GetInfo(dpath); err != nil {
-			fmt.Fprintln(os.Stderr, fmt.Sprintf("Warning: No info found for device:%v...skipping", d))
-			skipped++
+	devices = make([]string, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !pattern.MatchString(name) {
 			continue
-			//os.Exit(-1)
 		}
-		bootids := info["bootids"]
-		for _, bootidStr := range bootids {
-			boot := NewBoot(path, d, bootidStr)
-			device_files[d] = append(device_files[d], boot)
+		if entry.Mode()&os.ModeSymlink != 0 {
+			if entry, err = os.Stat(filepath.Join(path, name)); err != nil {
+				fmt.Fprintln(os.Stderr, "Warning: Skipping broken symlink:", filepath.Join(path, name))
+				err = nil
+				continue
+			}
+		}
+		if entry.IsDir() {
+			devices = append(devices, name)
 		}
 	}
-	if skipped > 0 {
-		fmt.Fprintln(os.Stderr, "Skipped devices: ", skipped)
-	}
-	return device_files
+	sort.Strings(devices)
+	return
+}
+
+func GetDevices(path string) (devices []string, err error) {
+	return ListDevices(path, DevicePattern)
+}
+
+func GetDeviceFiles(path string, filter []string) map[string][]*Boot {
+	return NewDataset(path).DeviceFiles(filter)
 }
@@ -2,10 +2,95 @@ package post_processing
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testDeviceA = "0c037a6e55da4e024d9e64d97114c642695c5434"
+	testDeviceB = "6f3cdb988ff27b78ca2df7e32268c74fc54925dc"
+	testDeviceC = "8d0376587d6091bed78e081b614ca485fb098c23"
 )
 
 func TestGetDevices(t *testing.T) {
 	dirs, _ := GetDevices("/android/cpuprof-data")
 	fmt.Println(dirs)
 }
+
+// Creates a data directory with spaces in its path containing devices A and
+// B, a symlink C pointing at B and a few entries that are not devices
+func setupDeviceTree(t *testing.T) string {
+	root, err := ioutil.TempDir("", "devices")
+	assert.Nil(t, err, "Failed to create temp dir")
+	path := filepath.Join(root, "data with spaces")
+
+	for _, device := range []string{testDeviceA, testDeviceB, "not-a-device"} {
+		assert.Nil(t, os.MkdirAll(filepath.Join(path, device), 0775))
+	}
+	assert.Nil(t, os.Symlink(filepath.Join(path, testDeviceB), filepath.Join(path, testDeviceC)))
+	// Broken symlink and a regular file with a device-like name
+	assert.Nil(t, os.Symlink(filepath.Join(path, "missing"), filepath.Join(path, "1111111111111111111111111111111111111111")))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(path, "2222222222222222222222222222222222222222"), []byte{}, 0664))
+	return root
+}
+
+func TestListDevices(t *testing.T) {
+	assert := assert.New(t)
+
+	root := setupDeviceTree(t)
+	defer os.RemoveAll(root)
+	path := filepath.Join(root, "data with spaces")
+
+	devices, err := GetDevices(path)
+	assert.Nil(err)
+	assert.Equal([]string{testDeviceA, testDeviceB, testDeviceC}, devices)
+
+	devices, err = ListDevices(path, regexp.MustCompile("^not-"))
+	assert.Nil(err)
+	assert.Equal([]string{"not-a-device"}, devices)
+
+	_, err = GetDevices(filepath.Join(root, "missing"))
+	assert.NotNil(err)
+}
+
+func TestDataset(t *testing.T) {
+	assert := assert.New(t)
+
+	root := setupDeviceTree(t)
+	defer os.RemoveAll(root)
+	path := filepath.Join(root, "data with spaces")
+
+	bootid := "453fea81-57cc-43e0-9693-91f63b0433b9"
+	bpath := filepath.Join(path, testDeviceB, bootid)
+	assert.Nil(os.MkdirAll(bpath, 0775))
+	for _, shard := range []string{"00000000.gz", "00000001.gz"} {
+		assert.Nil(ioutil.WriteFile(filepath.Join(bpath, shard), []byte{}, 0664))
+	}
+	info := fmt.Sprintf(`{"bootids": ["%s"], "files": []}`, bootid)
+	assert.Nil(ioutil.WriteFile(filepath.Join(path, testDeviceB, "info.json"), []byte(info), 0664))
+
+	ds := NewDataset(path)
+	device_files := ds.DeviceFiles([]string{testDeviceA, testDeviceC, "unknown"})
+	// A has no info.json
+	assert.Equal(2, len(device_files))
+	assert.Equal(0, len(device_files[testDeviceA]))
+	assert.Equal(1, len(device_files[testDeviceC]))
+	boot := device_files[testDeviceC][0]
+	assert.Equal(bootid, boot.BootId)
+	assert.Equal(2, len(boot.Files))
+
+	// Cached until refreshed
+	assert.Nil(os.MkdirAll(filepath.Join(path, "3333333333333333333333333333333333333333"), 0775))
+	devices, _ := ds.Devices()
+	assert.Equal(3, len(devices))
+	boots, _ := ds.Boots(testDeviceC)
+	assert.True(boot == boots[0])
+	ds.Refresh()
+	devices, _ = ds.Devices()
+	assert.Equal(4, len(devices))
+}
@@ -0,0 +1,336 @@
+package post_processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gurupras/go_cpuprof"
+	"github.com/gurupras/go_cpuprof/post_processing/filters"
+	"github.com/gurupras/gocommons/gsync"
+)
+
+const (
+	CPU_RESIDENCY_FILE = "cpu-residency.json"
+)
+
+// CoreResidency is the time a core spent at each frequency and offline, in
+// seconds of TraceTime
+type CoreResidency struct {
+	Cpu       int
+	Frequency map[int]float64
+	Offline   float64
+	// Awake time during which the core's frequency and state were not known
+	Unknown float64
+}
+
+func newCoreResidency(cpu int) *CoreResidency {
+	cr := new(CoreResidency)
+	cr.Cpu = cpu
+	cr.Frequency = make(map[int]float64)
+	return cr
+}
+
+func (cr *CoreResidency) add(other *CoreResidency) {
+	for frequency, duration := range other.Frequency {
+		cr.Frequency[frequency] += duration
+	}
+	cr.Offline += other.Offline
+	cr.Unknown += other.Unknown
+}
+
+// ResidencyShares is a core's residency as fractions of a base time.
+// Suspended is only set for shares of total time.
+type ResidencyShares struct {
+	Frequency map[int]float64
+	Offline   float64
+	Unknown   float64
+	Suspended float64
+}
+
+// CpuResidency is the residency of every core of one or more boots. Cores are
+// kept apart, so cores of different clusters keep their own frequencies.
+type CpuResidency struct {
+	// Seconds of TraceTime. The kernel clock stops while the phone is
+	// suspended, so this is the time the phone was awake.
+	AwakeTime float64
+	// Seconds of wall time
+	TotalTime float64
+	Cores     map[int]*CoreResidency
+}
+
+func NewCpuResidency() *CpuResidency {
+	cr := new(CpuResidency)
+	cr.Cores = make(map[int]*CoreResidency)
+	return cr
+}
+
+// core returns the residency of cpu, adding it as unknown for the awake time
+// so far if it has not been seen before
+func (cr *CpuResidency) core(cpu int) *CoreResidency {
+	core, ok := cr.Cores[cpu]
+	if !ok {
+		core = newCoreResidency(cpu)
+		core.Unknown = cr.AwakeTime
+		cr.Cores[cpu] = core
+	}
+	return core
+}
+
+// Add adds the residency in other, such as that of another boot. A core that
+// only one of them has is unknown for the other's awake time.
+func (cr *CpuResidency) Add(other *CpuResidency) {
+	for cpu := range other.Cores {
+		cr.core(cpu)
+	}
+	for cpu, core := range cr.Cores {
+		if oc, ok := other.Cores[cpu]; ok {
+			core.add(oc)
+		} else {
+			core.Unknown += other.AwakeTime
+		}
+	}
+	cr.AwakeTime += other.AwakeTime
+	cr.TotalTime += other.TotalTime
+}
+
+// Shares returns the residency of every core as fractions of the awake time,
+// or of the total time if total is true. The fractions of a core add up to 1.
+func (cr *CpuResidency) Shares(total bool) map[int]*ResidencyShares {
+	base := cr.AwakeTime
+	if total {
+		base = cr.TotalTime
+	}
+	shares := make(map[int]*ResidencyShares)
+	if base <= 0 {
+		return shares
+	}
+	for cpu, core := range cr.Cores {
+		rs := new(ResidencyShares)
+		rs.Frequency = make(map[int]float64)
+		for frequency, duration := range core.Frequency {
+			rs.Frequency[frequency] = duration / base
+		}
+		rs.Offline = core.Offline / base
+		rs.Unknown = core.Unknown / base
+		if total {
+			rs.Suspended = (cr.TotalTime - cr.AwakeTime) / base
+		}
+		shares[cpu] = rs
+	}
+	return shares
+}
+
+// Frequencies returns the frequencies every core was seen at, for
+// cpuprof.InferTopology
+func (cr *CpuResidency) Frequencies() map[int][]int {
+	frequencies := make(map[int][]int)
+	for cpu, core := range cr.Cores {
+		frequencies[cpu] = make([]int, 0, len(core.Frequency))
+		for frequency := range core.Frequency {
+			frequencies[cpu] = append(frequencies[cpu], frequency)
+		}
+		sort.Ints(frequencies[cpu])
+	}
+	return frequencies
+}
+
+// ClusterResidency is the residency of the cores of a cluster, in core-seconds
+type ClusterResidency struct {
+	Cluster   *cpuprof.Cluster
+	Frequency map[int]float64
+	Offline   float64
+	Unknown   float64
+	// Shares of the awake time of every core of the cluster
+	ByAwakeTime *ResidencyShares
+}
+
+// Clusters returns the residency of every cluster of topology. Cores that
+// are not in topology are left out.
+func (cr *CpuResidency) Clusters(topology *cpuprof.Topology) []*ClusterResidency {
+	clusters := make([]*ClusterResidency, 0, len(topology.Clusters))
+	for _, c := range topology.Clusters {
+		cluster := &ClusterResidency{Cluster: c, Frequency: make(map[int]float64)}
+		for _, cpu := range c.Cpus {
+			core, ok := cr.Cores[cpu]
+			if !ok {
+				cluster.Unknown += cr.AwakeTime
+				continue
+			}
+			for frequency, duration := range core.Frequency {
+				cluster.Frequency[frequency] += duration
+			}
+			cluster.Offline += core.Offline
+			cluster.Unknown += core.Unknown
+		}
+		cluster.ByAwakeTime = &ResidencyShares{Frequency: make(map[int]float64)}
+		if base := cr.AwakeTime * float64(len(c.Cpus)); base > 0 {
+			for frequency, duration := range cluster.Frequency {
+				cluster.ByAwakeTime.Frequency[frequency] = duration / base
+			}
+			cluster.ByAwakeTime.Offline = cluster.Offline / base
+			cluster.ByAwakeTime.Unknown = cluster.Unknown / base
+		}
+		clusters = append(clusters, cluster)
+	}
+	return clusters
+}
+
+// Utilization is the capacity-weighted utilization of the cores of topology
+// while the phone was awake: the work the cores could do at the frequencies
+// they ran at, as a fraction of the work every core could do at its highest
+// frequency. Time offline or at an unknown frequency counts as no capacity.
+func (cr *CpuResidency) Utilization(topology *cpuprof.Topology) float64 {
+	base := cr.AwakeTime * topology.TotalCapacity()
+	if base <= 0 {
+		return 0
+	}
+	work := 0.0
+	for cpu, core := range cr.Cores {
+		for frequency, duration := range core.Frequency {
+			work += topology.Capacity(cpu, frequency) * duration
+		}
+	}
+	return work / base
+}
+
+// BootCpuResidency finds the residency of every core of the boot bi
+// describes. Every core up to bi.Ncpus is reported, even if it was never
+// seen. A core's last state lasts until the end of the boot.
+func (ds *Dataset) BootCpuResidency(ctx context.Context, bi *BootInfo) (*CpuResidency, error) {
+	boot, err := ds.Boot(bi)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := filters.New()
+	cpuTracker := filters.NewCpuTracker(filter)
+	opts := ReadOptions{Filters: []filters.LineFilter{func(line string) bool {
+		return strings.Contains(line, "Kernel-Trace") && (strings.Contains(line, "cpu_frequency:") || strings.Contains(line, "sched_cpu_hotplug:"))
+	}}}
+	err = boot.ScanFrom(ctx, opts, func(logline *cpuprof.Logline) error {
+		filter.ApplyLogline(logline)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Only the filtered loglines were read; the boot ends at its last logline
+	cpuTracker.Finish(&cpuprof.Logline{BootId: bi.BootId, Datetime: bi.LastTime, TraceTime: bi.LastTraceTime})
+
+	cr := NewCpuResidency()
+	cr.AwakeTime = bi.LastTraceTime - bi.FirstTraceTime
+	cr.TotalTime = bi.Duration().Seconds()
+	for cpu := 0; cpu < bi.Ncpus; cpu++ {
+		cr.core(cpu)
+	}
+	for cpu := range cpuTracker.CurrentState {
+		core := cr.core(cpu)
+		for frequency, duration := range cpuTracker.FrequencyResidency(cpu) {
+			core.Frequency[frequency] += duration
+		}
+		core.Offline = cpuTracker.CpuStateResidency(cpu)[int(filters.CPU_OFFLINE)]
+	}
+	for _, core := range cr.Cores {
+		known := core.Offline
+		for _, duration := range core.Frequency {
+			known += duration
+		}
+		if core.Unknown = cr.AwakeTime - known; core.Unknown < 0 {
+			core.Unknown = 0
+		}
+	}
+	return cr, nil
+}
+
+// DeviceCpuResidency is the output of CpuResidencyMain for one device
+type DeviceCpuResidency struct {
+	*CpuResidency
+	ByAwakeTime map[int]*ResidencyShares
+	ByTotalTime map[int]*ResidencyShares
+	// Declared for the device's model, or inferred from the frequencies seen
+	Topology    *cpuprof.Topology
+	Clusters    []*ClusterResidency
+	Utilization float64
+}
+
+// DeviceTopology returns the topology declared for model, or else one
+// inferred from the frequencies seen in cr
+func DeviceTopology(model string, cr *CpuResidency) *cpuprof.Topology {
+	return ModelTopology(model, cr.Frequencies())
+}
+
+// ModelTopology returns the topology declared for model, or else one inferred
+// from frequencies, given as cpu to the frequencies seen on it
+func ModelTopology(model string, frequencies map[int][]int) *cpuprof.Topology {
+	if topology, ok := cpuprof.Topologies[model]; ok {
+		return topology
+	}
+	return cpuprof.InferTopology(frequencies)
+}
+
+func CpuResidencyMain(args []string) {
+	parser := SetupParser()
+	ParseArgs(parser, args)
+
+	ds := NewDataset(Path)
+	catalogue, err := ds.Catalogue()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	devices := Devices
+	if len(devices) == 0 {
+		for device := range catalogue.Devices {
+			devices = append(devices, device)
+		}
+	}
+
+	mutex := new(sync.Mutex)
+	result := make(map[string]*DeviceCpuResidency)
+
+	deviceWg := new(sync.WaitGroup)
+	deviceSem := gsync.NewSem(20)
+	processDevice := func(device string) {
+		defer deviceWg.Done()
+		defer deviceSem.V()
+
+		di, ok := catalogue.Devices[device]
+		if !ok {
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("Unknown device: %v", device))
+			return
+		}
+		cr := NewCpuResidency()
+		for _, bi := range di.Boots {
+			bcr, err := ds.BootCpuResidency(context.Background(), bi)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, fmt.Sprintf("%v -> %v: %v", device, bi.BootId, err))
+				continue
+			}
+			cr.Add(bcr)
+		}
+		mutex.Lock()
+		topology := DeviceTopology(di.Model, cr)
+		result[device] = &DeviceCpuResidency{cr, cr.Shares(false), cr.Shares(true), topology, cr.Clusters(topology), cr.Utilization(topology)}
+		mutex.Unlock()
+		fmt.Println("Finished processing Device:", device)
+	}
+
+	for _, device := range devices {
+		deviceWg.Add(1)
+		deviceSem.P()
+		go processDevice(device)
+	}
+	deviceWg.Wait()
+
+	if b, err := json.MarshalIndent(result, "", "  "); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	} else {
+		ioutil.WriteFile(CPU_RESIDENCY_FILE, b, 0664)
+	}
+}
@@ -0,0 +1,109 @@
+package post_processing
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gurupras/go_cpuprof"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCpuResidency(t *testing.T) {
+	assert := assert.New(t)
+
+	path, err := ioutil.TempDir("", "cpu_residency")
+	assert.Nil(err)
+	defer os.RemoveAll(path)
+
+	bootid := "453fea81-57cc-43e0-9693-91f63b0433b9"
+	start := time.Date(2016, 6, 25, 10, 0, 0, 0, time.UTC)
+	line := func(token int, wall int, payload string) string {
+		return fmt.Sprintf("%s %s %d [   %d.000000]   200   200 D %s", bootid, start.Add(time.Duration(wall)*time.Second).Format("2006-01-02 15:04:05.000000000"), token, token, payload)
+	}
+	trace := func(token int, payload string) string {
+		return line(token, token-1, fmt.Sprintf("Kernel-Trace: kworker/0:1-17 [000] ...1     %d.000000: %s", token, payload))
+	}
+	writeShard(t, filepath.Join(path, testDeviceA, bootid, "00000000.gz"), []string{
+		trace(1, "cpu_frequency: state=300000 cpu_id=0"),
+		trace(2, "cpu_frequency: state=300000 cpu_id=1"),
+		trace(5, "cpu_frequency: state=1200000 cpu_id=0"),
+		trace(6, "sched_cpu_hotplug: cpu 1 offline error=0"),
+		trace(9, "sched_cpu_hotplug: cpu 1 online error=0"),
+		// Suspended for 20s of wall time before this
+		line(11, 30, "KernelPrintk: last"),
+	})
+
+	ds := NewDataset(path)
+	boot, err := NewBoot(path, testDeviceA, bootid)
+	assert.Nil(err)
+	bi, err := ScanBoot(boot)
+	assert.Nil(err)
+	assert.Equal(2, bi.Ncpus)
+
+	cr, err := ds.BootCpuResidency(context.Background(), bi)
+	assert.Nil(err)
+	assert.Equal(10.0, cr.AwakeTime)
+	assert.Equal(30.0, cr.TotalTime)
+	assert.Equal(&CoreResidency{0, map[int]float64{300000: 4, 1200000: 6}, 0, 0}, cr.Cores[0])
+	// Online at 9 but no frequency until the end of the boot
+	assert.Equal(&CoreResidency{1, map[int]float64{300000: 4}, 3, 3}, cr.Cores[1])
+
+	byAwake := cr.Shares(false)
+	assert.Equal(&ResidencyShares{map[int]float64{300000: 0.4}, 0.3, 0.3, 0}, byAwake[1])
+	byTotal := cr.Shares(true)
+	assert.InDelta(0.2, byTotal[0].Frequency[1200000], 1e-9)
+	assert.InDelta(2.0/3, byTotal[0].Suspended, 1e-9)
+
+	// A boot of a device with more cores
+	other := NewCpuResidency()
+	other.core(2).Frequency[300000] = 5
+	other.AwakeTime = 5
+	other.TotalTime = 5
+
+	total := NewCpuResidency()
+	total.Add(cr)
+	total.Add(other)
+	assert.Equal(15.0, total.AwakeTime)
+	assert.Equal(3, len(total.Cores))
+	assert.Equal(5.0, total.Cores[0].Unknown)
+	assert.Equal(&CoreResidency{2, map[int]float64{300000: 5}, 0, 10}, total.Cores[2])
+	for _, rs := range total.Shares(false) {
+		sum := rs.Offline + rs.Unknown
+		for _, share := range rs.Frequency {
+			sum += share
+		}
+		assert.InDelta(1.0, sum, 1e-9)
+	}
+}
+
+func TestCpuResidencyTopology(t *testing.T) {
+	assert := assert.New(t)
+
+	cr := NewCpuResidency()
+	cr.core(0).Frequency = map[int]float64{400000: 6, 800000: 4}
+	cr.core(1).Frequency = map[int]float64{400000: 4, 800000: 1}
+	cr.core(1).Offline = 5
+	cr.core(2).Frequency = map[int]float64{800000: 2, 1600000: 8}
+	cr.AwakeTime = 10
+	cr.TotalTime = 20
+
+	topology := DeviceTopology("Unknown model", cr)
+	assert.True(topology.Inferred)
+	assert.Equal(2, len(topology.Clusters))
+	assert.Equal(cpuprof.Topologies["Nexus 5"], DeviceTopology("Nexus 5", cr))
+
+	clusters := cr.Clusters(topology)
+	assert.Equal([]int{0, 1}, clusters[0].Cluster.Cpus)
+	assert.Equal(map[int]float64{400000: 10, 800000: 5}, clusters[0].Frequency)
+	assert.Equal(5.0, clusters[0].Offline)
+	assert.Equal(0.5, clusters[0].ByAwakeTime.Frequency[400000])
+	assert.Equal(0.25, clusters[0].ByAwakeTime.Offline)
+
+	// Core-seconds at full capacity: 0.25*6 + 0.5*4, 0.25*4 + 0.5*1, 0.5*2 + 1*8
+	assert.InDelta((3.5+1.5+9)/(10*(0.5+0.5+1)), cr.Utilization(topology), 1e-9)
+}
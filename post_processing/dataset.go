@@ -0,0 +1,115 @@
+package post_processing
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/fatih/set"
+	"github.com/gurupras/go_cpuprof"
+)
+
+// Dataset is a data directory laid out as <path>/<device>/<bootid>/%08d.gz
+// with an info.json per device. Devices and boots are discovered once and
+// cached; call Refresh to pick up changes on disk.
+type Dataset struct {
+	Path          string
+	DevicePattern *regexp.Regexp
+	mutex         sync.Mutex
+	devices       []string
+	boots         map[string][]*Boot
+	catalogue     *Catalogue
+}
+
+func NewDataset(path string) *Dataset {
+	ds := new(Dataset)
+	ds.Path = path
+	ds.DevicePattern = DevicePattern
+	ds.boots = make(map[string][]*Boot)
+	return ds
+}
+
+// Refresh drops everything discovered so far
+func (ds *Dataset) Refresh() {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	ds.devices = nil
+	ds.boots = make(map[string][]*Boot)
+	ds.catalogue = nil
+}
+
+// Devices returns the sorted device-ids in the dataset
+func (ds *Dataset) Devices() (devices []string, err error) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	if ds.devices == nil {
+		if ds.devices, err = ListDevices(ds.Path, ds.DevicePattern); err != nil {
+			return nil, err
+		}
+	}
+	return ds.devices, nil
+}
+
+// Boots returns the boots of device in the order listed in its info.json
+func (ds *Dataset) Boots(device string) (boots []*Boot, err error) {
+	var info map[string][]string
+
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	if boots, ok := ds.boots[device]; ok {
+		return boots, nil
+	}
+	if info, err = cpuprof.GetInfo(filepath.Join(ds.Path, device)); err != nil {
+		return nil, fmt.Errorf("No info found for device: %v: %v", device, err)
+	}
+	boots = make([]*Boot, 0)
+	for _, bootid := range info["bootids"] {
+		var boot *Boot
+		if boot, err = NewBoot(ds.Path, device, bootid); err != nil {
+			return nil, err
+		}
+		boots = append(boots, boot)
+	}
+	ds.boots[device] = boots
+	return
+}
+
+// DeviceFiles returns the boots of every device, restricted to the devices in
+// filter if it is not empty. Devices without an info.json are skipped.
+func (ds *Dataset) DeviceFiles(filter []string) map[string][]*Boot {
+	devices, err := ds.Devices()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	if len(filter) > 0 {
+		devices_set := set.NewNonTS()
+		for _, d := range devices {
+			devices_set.Add(d)
+		}
+		filter_set := set.NewNonTS()
+		for _, d := range filter {
+			filter_set.Add(d)
+		}
+		devices = set.StringSlice(set.Intersection(devices_set, filter_set))
+	}
+
+	device_files := make(map[string][]*Boot)
+	skipped := 0
+	for _, d := range devices {
+		boots, err := ds.Boots(d)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("Warning: %v...skipping", err))
+			skipped++
+			device_files[d] = make([]*Boot, 0)
+			continue
+		}
+		device_files[d] = boots
+	}
+	if skipped > 0 {
+		fmt.Fprintln(os.Stderr, "Skipped devices: ", skipped)
+	}
+	return device_files
+}
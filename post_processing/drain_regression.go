@@ -0,0 +1,479 @@
+package post_processing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/gurupras/go_cpuprof"
+	"github.com/gurupras/go_cpuprof/post_processing/filters"
+	"github.com/gurupras/gocommons/gsync"
+)
+
+const (
+	DRAIN_REGRESSION_FILE = "drain-regression.json"
+	INTERCEPT             = "intercept"
+)
+
+// DrainSample is one chunk of battery drain and the features that are meant
+// to explain it
+type DrainSample struct {
+	Device   string
+	BootId   string
+	Start    float64
+	Drain    float64
+	Features map[string]float64
+}
+
+// ChunkFeatures returns the features of cd: the mean and highest temperature
+// of every sensor, named by labels, the CPU busyness, the mean frequency and
+// number of online cores, the share of the chunk spent in the foreground, and
+// the share of its wall time spent suspended. Busyness is left out if no
+// context switch window ended during the chunk.
+func ChunkFeatures(cd *ChunkDrain, labels cpuprof.SensorLabels) map[string]float64 {
+	features := make(map[string]float64)
+	duration := cd.Duration()
+	if duration <= 0 {
+		return features
+	}
+	for sensor, temp := range cd.MeanTemp {
+		features["mean_temp_"+labels.Label(sensor)] = temp
+	}
+	for sensor, temp := range cd.MaxTemp {
+		features["max_temp_"+labels.Label(sensor)] = float64(temp)
+	}
+	if cd.BusyWindows > 0 {
+		features["busyness"] = cd.Busyness
+	}
+	total := 0.0
+	known := 0.0
+	for _, core := range cd.Residency.Cores {
+		for frequency, d := range core.Frequency {
+			total += float64(frequency) * d
+			known += d
+		}
+	}
+	if known > 0 {
+		features["mean_frequency_mhz"] = total / known / 1000
+	}
+	features["online_cpus"] = cd.MeanOnlineCpus
+	features["foreground_share"] = cd.Foreground[fgbgName(filters.Foreground)] / duration
+	features["suspended_share"] = cd.SuspendedShare
+	return features
+}
+
+// RegressionCoefficient is the fitted coefficient of a feature with its
+// confidence interval
+type RegressionCoefficient struct {
+	Feature  string
+	Estimate float64
+	StdErr   float64
+	TValue   float64
+	PValue   float64
+	Lower    float64
+	Upper    float64
+}
+
+// DrainResidual is the fit of one sample, for residual plots
+type DrainResidual struct {
+	Device   string
+	BootId   string
+	Start    float64
+	Drain    float64
+	Fitted   float64
+	Residual float64
+}
+
+// DrainRegression is an ordinary least squares fit of drain on the features
+// of the samples
+type DrainRegression struct {
+	Samples int
+	// Samples left out for lacking one of the features
+	Skipped          int
+	DegreesOfFreedom int
+	RSquared         float64
+	AdjustedRSquared float64
+	ResidualStdErr   float64
+	// Level of the confidence intervals of the coefficients
+	Confidence   float64
+	Coefficients []*RegressionCoefficient
+	// Features left out for covering too few samples or for being a linear
+	// combination of the features before them
+	Dropped   []string
+	Residuals []*DrainResidual
+}
+
+// FitDrainRegression fits drain on the features that at least minCoverage of
+// the samples have. Samples without all of these features are skipped.
+// Features are added in order of name after the intercept and dropped if they
+// add nothing to the ones already added, such as a sensor that never changed.
+func FitDrainRegression(samples []*DrainSample, minCoverage float64, confidence float64) (*DrainRegression, error) {
+	dr := new(DrainRegression)
+	dr.Confidence = confidence
+	dr.Coefficients = make([]*RegressionCoefficient, 0)
+	dr.Dropped = make([]string, 0)
+	dr.Residuals = make([]*DrainResidual, 0)
+
+	coverage := make(map[string]int)
+	for _, sample := range samples {
+		for feature := range sample.Features {
+			coverage[feature]++
+		}
+	}
+	candidates := make([]string, 0)
+	for feature, count := range coverage {
+		if float64(count) >= minCoverage*float64(len(samples)) {
+			candidates = append(candidates, feature)
+		} else {
+			dr.Dropped = append(dr.Dropped, feature)
+		}
+	}
+	sort.Strings(candidates)
+	sort.Strings(dr.Dropped)
+
+	rows := make([]*DrainSample, 0, len(samples))
+	for _, sample := range samples {
+		complete := true
+		for _, feature := range candidates {
+			if _, ok := sample.Features[feature]; !ok {
+				complete = false
+				break
+			}
+		}
+		if complete {
+			rows = append(rows, sample)
+		} else {
+			dr.Skipped++
+		}
+	}
+	dr.Samples = len(rows)
+
+	columns := append([]string{INTERCEPT}, candidates...)
+	x := make([][]float64, len(rows))
+	for idx, sample := range rows {
+		x[idx] = make([]float64, len(columns))
+		x[idx][0] = 1
+		for col, feature := range candidates {
+			x[idx][col+1] = sample.Features[feature]
+		}
+	}
+	xtx := make([][]float64, len(columns))
+	for i := range columns {
+		xtx[i] = make([]float64, len(columns))
+		for j := range columns {
+			for _, row := range x {
+				xtx[i][j] += row[i] * row[j]
+			}
+		}
+	}
+
+	// Cholesky decomposition of X'X over the columns that are kept
+	kept := make([]int, 0, len(columns))
+	l := make([][]float64, 0, len(columns))
+	for col := range columns {
+		z := make([]float64, len(kept)+1)
+		d := xtx[col][col]
+		for i, ki := range kept {
+			sum := xtx[ki][col]
+			for k := 0; k < i; k++ {
+				sum -= l[i][k] * z[k]
+			}
+			z[i] = sum / l[i][i]
+			d -= z[i] * z[i]
+		}
+		if xtx[col][col] == 0 || d <= 1e-10*xtx[col][col] {
+			if col == 0 {
+				return nil, errors.New("No samples to fit")
+			}
+			dr.Dropped = append(dr.Dropped, columns[col])
+			continue
+		}
+		z[len(kept)] = math.Sqrt(d)
+		l = append(l, z)
+		kept = append(kept, col)
+	}
+	p := len(kept)
+	dr.DegreesOfFreedom = len(rows) - p
+	if dr.DegreesOfFreedom <= 0 {
+		return nil, errors.New(fmt.Sprintf("Too few samples to fit %d coefficients: %d", p, len(rows)))
+	}
+
+	// (X'X)^-1 = L^-T L^-1
+	linv := make([][]float64, p)
+	for i := 0; i < p; i++ {
+		linv[i] = make([]float64, p)
+		linv[i][i] = 1 / l[i][i]
+		for j := 0; j < i; j++ {
+			sum := 0.0
+			for k := j; k < i; k++ {
+				sum -= l[i][k] * linv[k][j]
+			}
+			linv[i][j] = sum / l[i][i]
+		}
+	}
+	inv := make([][]float64, p)
+	for i := 0; i < p; i++ {
+		inv[i] = make([]float64, p)
+		for j := 0; j < p; j++ {
+			for k := 0; k < p; k++ {
+				inv[i][j] += linv[k][i] * linv[k][j]
+			}
+		}
+	}
+
+	xty := make([]float64, p)
+	mean := 0.0
+	for idx, row := range x {
+		for i, col := range kept {
+			xty[i] += row[col] * rows[idx].Drain
+		}
+		mean += rows[idx].Drain
+	}
+	mean /= float64(len(rows))
+	beta := make([]float64, p)
+	for i := 0; i < p; i++ {
+		for j := 0; j < p; j++ {
+			beta[i] += inv[i][j] * xty[j]
+		}
+	}
+
+	rss := 0.0
+	tss := 0.0
+	for idx, row := range x {
+		fitted := 0.0
+		for i, col := range kept {
+			fitted += beta[i] * row[col]
+		}
+		sample := rows[idx]
+		residual := sample.Drain - fitted
+		rss += residual * residual
+		tss += (sample.Drain - mean) * (sample.Drain - mean)
+		dr.Residuals = append(dr.Residuals, &DrainResidual{sample.Device, sample.BootId, sample.Start, sample.Drain, fitted, residual})
+	}
+	if tss > 0 {
+		dr.RSquared = 1 - rss/tss
+		dr.AdjustedRSquared = 1 - (1-dr.RSquared)*float64(len(rows)-1)/float64(dr.DegreesOfFreedom)
+	}
+	variance := rss / float64(dr.DegreesOfFreedom)
+	dr.ResidualStdErr = math.Sqrt(variance)
+
+	t := studentTQuantile((1+confidence)/2, float64(dr.DegreesOfFreedom))
+	for i, col := range kept {
+		rc := new(RegressionCoefficient)
+		rc.Feature = columns[col]
+		rc.Estimate = beta[i]
+		rc.StdErr = math.Sqrt(variance * inv[i][i])
+		if rc.StdErr > 0 {
+			rc.TValue = rc.Estimate / rc.StdErr
+			rc.PValue = 2 * (1 - studentTCdf(math.Abs(rc.TValue), float64(dr.DegreesOfFreedom)))
+		}
+		rc.Lower = rc.Estimate - t*rc.StdErr
+		rc.Upper = rc.Estimate + t*rc.StdErr
+		dr.Coefficients = append(dr.Coefficients, rc)
+	}
+	return dr, nil
+}
+
+// studentTCdf is the CDF of Student's t distribution with df degrees of
+// freedom
+func studentTCdf(t float64, df float64) float64 {
+	tail := 0.5 * incompleteBeta(df/2, 0.5, df/(df+t*t))
+	if t > 0 {
+		return 1 - tail
+	}
+	return tail
+}
+
+// studentTQuantile inverts studentTCdf by bisection
+func studentTQuantile(p float64, df float64) float64 {
+	low, high := -1e3, 1e3
+	for i := 0; i < 200; i++ {
+		mid := (low + high) / 2
+		if studentTCdf(mid, df) < p {
+			low = mid
+		} else {
+			high = mid
+		}
+	}
+	return (low + high) / 2
+}
+
+// incompleteBeta is the regularized incomplete beta function I_x(a, b),
+// evaluated by its continued fraction
+func incompleteBeta(a float64, b float64, x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+	lga, _ := math.Lgamma(a)
+	lgb, _ := math.Lgamma(b)
+	lgab, _ := math.Lgamma(a + b)
+	front := math.Exp(lgab - lga - lgb + a*math.Log(x) + b*math.Log(1-x))
+	// The continued fraction converges quickly only below this point
+	if x > (a+1)/(a+b+2) {
+		return 1 - front*betaContinuedFraction(b, a, 1-x)/b
+	}
+	return front * betaContinuedFraction(a, b, x) / a
+}
+
+func betaContinuedFraction(a float64, b float64, x float64) float64 {
+	const tiny = 1e-300
+	c := 1.0
+	d := 1 - (a+b)*x/(a+1)
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	h := d
+	for m := 1; m <= 300; m++ {
+		fm := float64(m)
+		// Even step
+		num := fm * (b - fm) * x / ((a + 2*fm - 1) * (a + 2*fm))
+		d = 1 + num*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + num/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		h *= d * c
+		// Odd step
+		num = -(a + fm) * (a + b + fm) * x / ((a + 2*fm) * (a + 2*fm + 1))
+		d = 1 + num*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + num/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < 1e-15 {
+			break
+		}
+	}
+	return h
+}
+
+// DrainRegressionResult is the output of DrainRegressionMain
+type DrainRegressionResult struct {
+	// What was fit: "percent" for levels per hour or "current" for mA
+	Response string
+	Devices  map[string]*DrainRegression
+	// Fit over the samples of every device
+	Fleet *DrainRegression
+}
+
+// DrainRegressionMain is the statistical stage of the temperature-battery
+// correlation that TBCMain leads up to. It fits the drain of the chunks of
+// every device, and of all of them together, on their features.
+func DrainRegressionMain(args []string) {
+	parser := SetupParser()
+	labelsFile := parser.Flag("sensor-labels", "JSON file of device model to sensor id to label").String()
+	response := parser.Flag("response", "Drain to fit").Default("percent").Enum("percent", "current")
+	minCoverage := parser.Flag("min-coverage", "Share of the samples a feature has to be in to be fit").Default("0.9").Float64()
+	confidence := parser.Flag("confidence", "Level of the confidence intervals").Default("0.95").Float64()
+	ParseArgs(parser, args)
+
+	labels := cpuprof.ThermalSensorLabels
+	if *labelsFile != "" {
+		var err error
+		if labels, err = LoadSensorLabels(*labelsFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+	}
+
+	ds := NewDataset(Path)
+	catalogue, err := ds.Catalogue()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	devices := Devices
+	if len(devices) == 0 {
+		for device := range catalogue.Devices {
+			devices = append(devices, device)
+		}
+	}
+
+	mutex := new(sync.Mutex)
+	deviceSamples := make(map[string][]*DrainSample)
+
+	deviceWg := new(sync.WaitGroup)
+	deviceSem := gsync.NewSem(20)
+	processDevice := func(device string) {
+		defer deviceWg.Done()
+		defer deviceSem.V()
+
+		di, ok := catalogue.Devices[device]
+		if !ok {
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("Unknown device: %v", device))
+			return
+		}
+		samples := make([]*DrainSample, 0)
+		for _, bi := range di.Boots {
+			boot, err := ds.Boot(bi)
+			if err == nil {
+				var chunks []*ChunkDrain
+				if chunks, _, err = BootBatteryDrain(context.Background(), boot); err == nil {
+					for _, cd := range chunks {
+						drain := cd.PercentPerHour
+						if *response == "current" {
+							drain = cd.MeanCurrent
+						}
+						samples = append(samples, &DrainSample{device, bi.BootId, cd.Start, drain, ChunkFeatures(cd, labels[di.Model])})
+					}
+				}
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, fmt.Sprintf("%v -> %v: %v", device, bi.BootId, err))
+			}
+		}
+		mutex.Lock()
+		deviceSamples[device] = samples
+		mutex.Unlock()
+		fmt.Println("Finished processing Device:", device)
+	}
+
+	for _, device := range devices {
+		deviceWg.Add(1)
+		deviceSem.P()
+		go processDevice(device)
+	}
+	deviceWg.Wait()
+
+	result := new(DrainRegressionResult)
+	result.Response = *response
+	result.Devices = make(map[string]*DrainRegression)
+	fleet := make([]*DrainSample, 0)
+	for device, samples := range deviceSamples {
+		fleet = append(fleet, samples...)
+		if dr, err := FitDrainRegression(samples, *minCoverage, *confidence); err != nil {
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("%v: %v", device, err))
+		} else {
+			result.Devices[device] = dr
+		}
+	}
+	if result.Fleet, err = FitDrainRegression(fleet, *minCoverage, *confidence); err != nil {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Fleet: %v", err))
+	}
+
+	if b, err := json.MarshalIndent(result, "", "  "); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	} else {
+		ioutil.WriteFile(DRAIN_REGRESSION_FILE, b, 0664)
+	}
+}
@@ -0,0 +1,86 @@
+package post_processing
+
+import (
+	"testing"
+
+	"github.com/gurupras/go_cpuprof"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChunkFeatures(t *testing.T) {
+	assert := assert.New(t)
+
+	cd := new(ChunkDrain)
+	cd.Start = 10
+	cd.End = 30
+	cd.Residency = NewCpuResidency()
+	cd.Residency.core(0).Frequency = map[int]float64{300000: 15, 960000: 5}
+	cd.MeanOnlineCpus = 1
+	cd.Foreground = map[string]float64{"foreground": 5, "background": 15}
+	cd.MeanTemp = map[int]float64{5: 40, 9: 31}
+	cd.MaxTemp = map[int]int{5: 42, 9: 31}
+
+	features := ChunkFeatures(cd, cpuprof.NEXUS_5_SENSOR_LABELS)
+	assert.Equal(map[string]float64{
+		"mean_temp_cpu0":     40,
+		"mean_temp_sensor9":  31,
+		"max_temp_cpu0":      42,
+		"max_temp_sensor9":   31,
+		"mean_frequency_mhz": 465,
+		"online_cpus":        1,
+		"foreground_share":   0.25,
+		"suspended_share":    0,
+	}, features)
+
+	cd.Busyness = 0.5
+	cd.BusyWindows = 2
+	assert.Equal(0.5, ChunkFeatures(cd, nil)["busyness"])
+}
+
+func TestFitDrainRegression(t *testing.T) {
+	assert := assert.New(t)
+
+	samples := make([]*DrainSample, 0)
+	for idx, y := range []float64{2, 4, 5, 4, 5} {
+		x := float64(idx + 1)
+		samples = append(samples, &DrainSample{Drain: y, Features: map[string]float64{
+			"x": x,
+			// Dropped for being a multiple of x and for never changing
+			"y": 2 * x,
+			"z": 1,
+		}})
+	}
+	samples[0].Features["sparse"] = 1
+	// Skipped for lacking x, y and z
+	samples = append(samples, &DrainSample{Drain: 10, Features: map[string]float64{}})
+
+	dr, err := FitDrainRegression(samples, 0.5, 0.95)
+	assert.Nil(err)
+	assert.Equal(5, dr.Samples)
+	assert.Equal(1, dr.Skipped)
+	assert.Equal(3, dr.DegreesOfFreedom)
+	assert.Equal([]string{"sparse", "y", "z"}, dr.Dropped)
+	assert.InDelta(0.6, dr.RSquared, 1e-9)
+	assert.InDelta(0.4666666667, dr.AdjustedRSquared, 1e-9)
+
+	assert.Equal(2, len(dr.Coefficients))
+	intercept := dr.Coefficients[0]
+	assert.Equal(INTERCEPT, intercept.Feature)
+	assert.InDelta(2.2, intercept.Estimate, 1e-9)
+	assert.InDelta(0.9380831520, intercept.StdErr, 1e-9)
+	slope := dr.Coefficients[1]
+	assert.Equal("x", slope.Feature)
+	assert.InDelta(0.6, slope.Estimate, 1e-9)
+	assert.InDelta(0.2828427125, slope.StdErr, 1e-9)
+	// t(0.975, 3) = 3.182446
+	assert.InDelta(0.6-3.182446*0.2828427125, slope.Lower, 1e-5)
+	assert.InDelta(0.6+3.182446*0.2828427125, slope.Upper, 1e-5)
+	assert.InDelta(0.1240, slope.PValue, 1e-4)
+
+	assert.Equal(5, len(dr.Residuals))
+	assert.InDelta(2.8, dr.Residuals[0].Fitted, 1e-9)
+	assert.InDelta(-0.8, dr.Residuals[0].Residual, 1e-9)
+
+	_, err = FitDrainRegression(samples[:2], 0.5, 0.95)
+	assert.NotNil(err)
+}
@@ -0,0 +1,306 @@
+package post_processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gurupras/go_cpuprof"
+	"github.com/gurupras/go_cpuprof/post_processing/filters"
+	"github.com/gurupras/gocommons/gsync"
+)
+
+const (
+	DVFS_TRANSITIONS_FILE = "dvfs-transitions.json"
+)
+
+// Upper edges of the latency histogram bins in microseconds. The last bin
+// holds every latency above the last edge.
+var LATENCY_BINS_US = []float64{50, 100, 200, 500, 1000, 2000, 5000, 10000}
+
+// LatencyDistribution is a histogram of switch latencies. Mean, Min and Max
+// are in seconds.
+type LatencyDistribution struct {
+	Count     int
+	Mean      float64
+	Min       float64
+	Max       float64
+	Histogram []int
+}
+
+func NewLatencyDistribution() *LatencyDistribution {
+	ld := new(LatencyDistribution)
+	ld.Histogram = make([]int, len(LATENCY_BINS_US)+1)
+	return ld
+}
+
+func (ld *LatencyDistribution) Add(latency float64) {
+	bin := len(LATENCY_BINS_US)
+	for idx, edge := range LATENCY_BINS_US {
+		if latency*1e6 <= edge {
+			bin = idx
+			break
+		}
+	}
+	ld.Histogram[bin]++
+	if ld.Count == 0 || latency < ld.Min {
+		ld.Min = latency
+	}
+	if ld.Count == 0 || latency > ld.Max {
+		ld.Max = latency
+	}
+	ld.Mean = (ld.Mean*float64(ld.Count) + latency) / float64(ld.Count+1)
+	ld.Count++
+}
+
+func (ld *LatencyDistribution) merge(other *LatencyDistribution) {
+	if other.Count == 0 {
+		return
+	}
+	for idx, count := range other.Histogram {
+		ld.Histogram[idx] += count
+	}
+	if ld.Count == 0 || other.Min < ld.Min {
+		ld.Min = other.Min
+	}
+	if ld.Count == 0 || other.Max > ld.Max {
+		ld.Max = other.Max
+	}
+	ld.Mean = (ld.Mean*float64(ld.Count) + other.Mean*float64(other.Count)) / float64(ld.Count+other.Count)
+	ld.Count += other.Count
+}
+
+func fgbgName(state filters.FgBgState) string {
+	switch state {
+	case filters.Foreground:
+		return "foreground"
+	case filters.Background:
+		return "background"
+	}
+	return "unknown"
+}
+
+// DvfsBucketStats is the frequency transitions of every CPU while the phone
+// was in one foreground state and temperature bucket. Temp is the lower bound
+// of the bucket, or filters.TEMPERATURE_UNKNOWN.
+type DvfsBucketStats struct {
+	Foreground string
+	Temp       int
+	// Seconds of TraceTime spent in the bucket
+	Time        float64
+	Transitions int
+	// Transitions of any CPU per second in the bucket
+	PerSecond  float64
+	PingPongs  int
+	Overshoots int
+	// Mean distance in kHz the governor went past where it settled
+	MeanOvershoot float64
+	Latency       *LatencyDistribution
+}
+
+func newDvfsBucketStats(fg string, temp int) *DvfsBucketStats {
+	bs := new(DvfsBucketStats)
+	bs.Foreground = fg
+	bs.Temp = temp
+	bs.Latency = NewLatencyDistribution()
+	return bs
+}
+
+func (bs *DvfsBucketStats) add(t *filters.DvfsTransition) {
+	bs.Transitions++
+	switch t.Pattern {
+	case filters.DVFS_PATTERN_PING_PONG:
+		bs.PingPongs++
+	case filters.DVFS_PATTERN_OVERSHOOT:
+		bs.MeanOvershoot = (bs.MeanOvershoot*float64(bs.Overshoots) + float64(t.Overshoot)) / float64(bs.Overshoots+1)
+		bs.Overshoots++
+	}
+	if t.Latency != filters.LATENCY_UNKNOWN {
+		bs.Latency.Add(t.Latency)
+	}
+}
+
+func (bs *DvfsBucketStats) merge(other *DvfsBucketStats) {
+	if bs.Overshoots+other.Overshoots > 0 {
+		bs.MeanOvershoot = (bs.MeanOvershoot*float64(bs.Overshoots) + other.MeanOvershoot*float64(other.Overshoots)) / float64(bs.Overshoots+other.Overshoots)
+	}
+	bs.Time += other.Time
+	bs.Transitions += other.Transitions
+	bs.PingPongs += other.PingPongs
+	bs.Overshoots += other.Overshoots
+	bs.Latency.merge(other.Latency)
+	bs.rate()
+}
+
+func (bs *DvfsBucketStats) rate() {
+	if bs.Time > 0 {
+		bs.PerSecond = float64(bs.Transitions) / bs.Time
+	}
+}
+
+// Sorts by Foreground and then by Temp
+type dvfsBucketStatsSlice []*DvfsBucketStats
+
+func (s dvfsBucketStatsSlice) Len() int {
+	return len(s)
+}
+
+func (s dvfsBucketStatsSlice) Less(i, j int) bool {
+	if s[i].Foreground != s[j].Foreground {
+		return strings.Compare(s[i].Foreground, s[j].Foreground) < 0
+	}
+	return s[i].Temp < s[j].Temp
+}
+
+func (s dvfsBucketStatsSlice) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// DvfsTransitionStats is the frequency transitions of one or more boots, in
+// total and by bucket
+type DvfsTransitionStats struct {
+	Total   *DvfsBucketStats
+	Buckets []*DvfsBucketStats
+	// Switches that started but never ended, and ends without a start
+	Aborted   int
+	Unmatched int
+}
+
+func NewDvfsTransitionStats() *DvfsTransitionStats {
+	dts := new(DvfsTransitionStats)
+	dts.Total = newDvfsBucketStats("all", filters.TEMPERATURE_UNKNOWN)
+	dts.Buckets = make([]*DvfsBucketStats, 0)
+	return dts
+}
+
+func (dts *DvfsTransitionStats) bucket(fg string, temp int) *DvfsBucketStats {
+	for _, bs := range dts.Buckets {
+		if bs.Foreground == fg && bs.Temp == temp {
+			return bs
+		}
+	}
+	bs := newDvfsBucketStats(fg, temp)
+	dts.Buckets = append(dts.Buckets, bs)
+	sort.Sort(dvfsBucketStatsSlice(dts.Buckets))
+	return bs
+}
+
+// Add adds the transitions of other, such as those of another boot
+func (dts *DvfsTransitionStats) Add(other *DvfsTransitionStats) {
+	for _, obs := range other.Buckets {
+		dts.bucket(obs.Foreground, obs.Temp).merge(obs)
+	}
+	dts.Total.merge(other.Total)
+	dts.Aborted += other.Aborted
+	dts.Unmatched += other.Unmatched
+}
+
+// SummarizeDvfsTransitions buckets the transitions dvfsTracker has seen
+func SummarizeDvfsTransitions(dvfsTracker *filters.DvfsTracker) *DvfsTransitionStats {
+	dts := NewDvfsTransitionStats()
+	for b, duration := range dvfsTracker.BucketTime {
+		dts.bucket(fgbgName(b.Fg), b.Temp).Time += duration
+		dts.Total.Time += duration
+	}
+	for _, t := range dvfsTracker.Transitions {
+		dts.bucket(fgbgName(t.Bucket.Fg), t.Bucket.Temp).add(t)
+		dts.Total.add(t)
+	}
+	for _, bs := range dts.Buckets {
+		bs.rate()
+	}
+	dts.Total.rate()
+	dts.Aborted = dvfsTracker.Aborted
+	dts.Unmatched = dvfsTracker.Unmatched
+	return dts
+}
+
+// BootDvfsTransitions finds the frequency transitions of every CPU of boot
+func BootDvfsTransitions(ctx context.Context, boot *Boot) (*DvfsTransitionStats, error) {
+	filter := filters.New()
+	cpuTracker := filters.NewCpuTracker(filter)
+	fgbgTracker := filters.NewFgBgTracker(filter)
+	thermalTracker := filters.NewThermalTracker(filter)
+	dvfsTracker := filters.NewDvfsTracker(filter, cpuTracker, fgbgTracker, thermalTracker)
+
+	patterns := []string{"cpu_frequency", "sched_cpu_hotplug", "phonelab_proc_foreground", "thermal_temp"}
+	opts := ReadOptions{Filters: []filters.LineFilter{func(line string) bool {
+		if !strings.Contains(line, "Kernel-Trace") {
+			return false
+		}
+		for _, pattern := range patterns {
+			if strings.Contains(line, pattern) {
+				return true
+			}
+		}
+		return false
+	}}}
+	err := boot.ScanFrom(ctx, opts, func(logline *cpuprof.Logline) error {
+		filter.ApplyLogline(logline)
+		return nil
+	})
+	filter.Finish()
+	return SummarizeDvfsTransitions(dvfsTracker), err
+}
+
+func DvfsTransitionsMain(args []string) {
+	parser := SetupParser()
+	ParseArgs(parser, args)
+
+	ds := NewDataset(Path)
+	devices := Devices
+	if len(devices) == 0 {
+		var err error
+		if devices, err = ds.Devices(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+	}
+
+	mutex := new(sync.Mutex)
+	result := make(map[string]*DvfsTransitionStats)
+
+	deviceWg := new(sync.WaitGroup)
+	deviceSem := gsync.NewSem(20)
+	processDevice := func(device string) {
+		defer deviceWg.Done()
+		defer deviceSem.V()
+
+		boots, err := ds.Boots(device)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		dts := NewDvfsTransitionStats()
+		for _, boot := range boots {
+			bdts, err := BootDvfsTransitions(context.Background(), boot)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, fmt.Sprintf("%v -> %v: %v", device, boot.BootId, err))
+				continue
+			}
+			dts.Add(bdts)
+		}
+		mutex.Lock()
+		result[device] = dts
+		mutex.Unlock()
+		fmt.Println("Finished processing Device:", device)
+	}
+
+	for _, device := range devices {
+		deviceWg.Add(1)
+		deviceSem.P()
+		go processDevice(device)
+	}
+	deviceWg.Wait()
+
+	if b, err := json.MarshalIndent(result, "", "  "); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	} else {
+		ioutil.WriteFile(DVFS_TRANSITIONS_FILE, b, 0664)
+	}
+}
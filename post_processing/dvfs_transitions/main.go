@@ -0,0 +1,11 @@
+package main
+
+import (
+	"os"
+
+	"github.com/gurupras/go_cpuprof/post_processing"
+)
+
+func main() {
+	post_processing.DvfsTransitionsMain(os.Args)
+}
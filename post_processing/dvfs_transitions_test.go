@@ -0,0 +1,63 @@
+package post_processing
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDvfsTransitions(t *testing.T) {
+	assert := assert.New(t)
+
+	path, err := ioutil.TempDir("", "dvfs_transitions")
+	assert.Nil(err)
+	defer os.RemoveAll(path)
+
+	bootid := "453fea81-57cc-43e0-9693-91f63b0433b9"
+	writeShard(t, filepath.Join(path, testDeviceA, bootid, "00000000.gz"), []string{
+		kernelTraceLine(bootid, 2, "thermal_temp: sensor_id=5 temp=41"),
+		foregroundLine(bootid, 3, 100, ".android.dialer"),
+		kernelTraceLine(bootid, 4, "cpu_frequency: state=300000 cpu_id=0"),
+		kernelTraceLine(bootid, 5, "cpu_frequency_switch_start: start=300000 end=1728000 cpu_id=0"),
+		kernelTraceLine(bootid, 6, "cpu_frequency_switch_end: cpu_id=0"),
+		kernelTraceLine(bootid, 6, "cpu_frequency: state=1728000 cpu_id=0"),
+		kernelTraceLine(bootid, 8, "cpu_frequency: state=300000 cpu_id=0"),
+		kernelTraceLine(bootid, 10, "cpu_frequency: state=300000 cpu_id=1"),
+	})
+
+	boot, err := NewBoot(path, testDeviceA, bootid)
+	assert.Nil(err)
+	dts, err := BootDvfsTransitions(context.Background(), boot)
+	assert.Nil(err)
+
+	assert.Equal(8.0, dts.Total.Time)
+	assert.Equal(2, dts.Total.Transitions)
+	assert.Equal(2, len(dts.Buckets))
+	fg := dts.Buckets[0]
+	assert.Equal("foreground", fg.Foreground)
+	assert.Equal(40, fg.Temp)
+	assert.Equal(7.0, fg.Time)
+	assert.Equal(2.0/7, fg.PerSecond)
+	assert.Equal(0, fg.PingPongs)
+	assert.Equal(1, fg.Latency.Count)
+	assert.Equal(1.0, fg.Latency.Mean)
+	// A second is well past the last bin
+	assert.Equal(1, fg.Latency.Histogram[len(LATENCY_BINS_US)])
+	assert.Equal("unknown", dts.Buckets[1].Foreground)
+	assert.Equal(1.0, dts.Buckets[1].Time)
+	assert.Equal(0, dts.Buckets[1].Transitions)
+
+	total := NewDvfsTransitionStats()
+	total.Add(dts)
+	total.Add(dts)
+	assert.Equal(2, len(total.Buckets))
+	assert.Equal(4, total.Buckets[0].Transitions)
+	assert.Equal(14.0, total.Buckets[0].Time)
+	assert.Equal(2.0/7, total.Buckets[0].PerSecond)
+	assert.Equal(2, total.Total.Latency.Count)
+	assert.Equal(16.0, total.Total.Time)
+}
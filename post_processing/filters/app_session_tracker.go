@@ -0,0 +1,83 @@
+package filters
+
+import (
+	"github.com/gurupras/go_cpuprof"
+)
+
+// AppSession is a period during which one app was in the foreground. Start
+// and End are TraceTimes.
+type AppSession struct {
+	Proc         *cpuprof.PhonelabProcForeground
+	Start        float64
+	End          float64
+	StartLogline *cpuprof.Logline
+	EndLogline   *cpuprof.Logline
+}
+
+func (s *AppSession) Duration() float64 {
+	return s.End - s.Start
+}
+
+// Interval returns the session as an interval so it can be intersected with
+// the intervals of other trackers
+func (s *AppSession) Interval() *Interval {
+	return &Interval{int(Foreground), s.Start, s.End, s.StartLogline, s.EndLogline}
+}
+
+// AppSessionTracker splits the foreground time of FgBgTracker into sessions of
+// the app in the foreground. A session ends when another app comes to the
+// foreground, when the phone goes to the background or at the end of the
+// boot.
+type AppSessionTracker struct {
+	*Filter
+	FgBgTracker *FgBgTracker
+	Sessions    []*AppSession
+	current     *AppSession
+}
+
+func NewAppSessionTracker(filter *Filter, fgbgTracker *FgBgTracker) (sessionTracker *AppSessionTracker) {
+	sessionTracker = new(AppSessionTracker)
+	sessionTracker.Filter = filter
+	sessionTracker.FgBgTracker = fgbgTracker
+	// For ScreenOffIntervals; there are only as many as the screen went off
+	fgbgTracker.RecordIntervals = true
+	sessionTracker.Sessions = make([]*AppSession, 0)
+
+	filter.Bus.OnForegroundChanged(func(event *ForegroundChanged) {
+		if sessionTracker.current != nil && event.Proc != nil && event.Proc.Pid == sessionTracker.current.Proc.Pid {
+			// The same app again
+			return
+		}
+		sessionTracker.stop(event.Logline)
+		if event.Proc != nil {
+			sessionTracker.current = &AppSession{Proc: event.Proc, Start: event.Logline.TraceTime, StartLogline: event.Logline}
+		}
+	})
+	filter.AddTracker(sessionTracker)
+	return sessionTracker
+}
+
+func (sessionTracker *AppSessionTracker) stop(logline *cpuprof.Logline) {
+	if sessionTracker.current == nil {
+		return
+	}
+	sessionTracker.current.End = logline.TraceTime
+	sessionTracker.current.EndLogline = logline
+	sessionTracker.Sessions = append(sessionTracker.Sessions, sessionTracker.current)
+	sessionTracker.current = nil
+}
+
+// Sessions are kept up to date by FgBgTracker's events
+func (sessionTracker *AppSessionTracker) Update(logline *cpuprof.Logline) {
+}
+
+// ScreenOffIntervals returns the closed intervals during which no app was in
+// the foreground. PhoneLab logs a foreground pid of 0 when the screen turns
+// off.
+func (sessionTracker *AppSessionTracker) ScreenOffIntervals() Intervals {
+	return sessionTracker.FgBgTracker.Intervals().Select(int(Background))
+}
+
+func (sessionTracker *AppSessionTracker) Finish(last *cpuprof.Logline) {
+	sessionTracker.stop(last)
+}
@@ -0,0 +1,69 @@
+package filters
+
+import (
+	"testing"
+
+	"github.com/gurupras/go_cpuprof"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppSessionTracker(t *testing.T) {
+	assert := assert.New(t)
+
+	f := New()
+	fgbgTracker := NewFgBgTracker(f)
+	sessionTracker := NewAppSessionTracker(f, fgbgTracker)
+
+	for _, logline := range []*cpuprof.Logline{
+		traceTestLogline(1, "phonelab_proc_foreground: pid=100 tgid=100 comm=.android.dialer"),
+		traceTestLogline(3, "phonelab_proc_foreground: pid=100 tgid=100 comm=.android.dialer"),
+		traceTestLogline(4, "phonelab_proc_foreground: pid=200 tgid=200 comm=ndroid.systemui"),
+		traceTestLogline(6, "phonelab_proc_foreground: pid=0 tgid=0 comm=swapper/0"),
+		traceTestLogline(7, "phonelab_proc_foreground: pid=0 tgid=0 comm=swapper/0"),
+		// Confirmed after BgDelaySec; the screen went off at the first pid=0
+		traceTestLogline(9, "cpu_frequency: state=300000 cpu_id=0"),
+		traceTestLogline(10, "phonelab_proc_foreground: pid=100 tgid=100 comm=.android.dialer"),
+		traceTestLogline(15, "cpu_frequency: state=300000 cpu_id=0"),
+	} {
+		f.ApplyLogline(logline)
+	}
+	f.Finish()
+
+	spans := make([][2]float64, 0)
+	comms := make([]string, 0)
+	for _, s := range sessionTracker.Sessions {
+		spans = append(spans, [2]float64{s.Start, s.End})
+		comms = append(comms, s.Proc.Comm)
+	}
+	assert.Equal([][2]float64{{1, 4}, {4, 6}, {10, 15}}, spans)
+	assert.Equal([]string{".android.dialer", "ndroid.systemui", ".android.dialer"}, comms)
+	assert.Equal(2.0, sessionTracker.Sessions[1].Interval().Duration())
+	assert.Equal([][3]float64{{float64(Background), 6, 10}}, intervalSpans(sessionTracker.ScreenOffIntervals()))
+}
+
+func TestAppSessionTrackerPendingBackground(t *testing.T) {
+	assert := assert.New(t)
+
+	f := New()
+	fgbgTracker := NewFgBgTracker(f)
+	fgbgTracker.RecordIntervals = true
+	fgbgTracker.BgDelaySec = 2.0
+	sessionTracker := NewAppSessionTracker(f, fgbgTracker)
+
+	for _, logline := range []*cpuprof.Logline{
+		traceTestLogline(1, "phonelab_proc_foreground: pid=100 tgid=100 comm=.android.dialer"),
+		traceTestLogline(4, "phonelab_proc_foreground: pid=0 tgid=0 comm=swapper/0"),
+		// The boot ends within BgDelaySec of the pid=0 logline
+		traceTestLogline(5, "cpu_frequency: state=300000 cpu_id=0"),
+	} {
+		f.ApplyLogline(logline)
+	}
+	assert.Equal(Foreground, fgbgTracker.CurrentState)
+	f.Finish()
+
+	assert.Equal(Background, fgbgTracker.CurrentState)
+	assert.Equal(1, len(sessionTracker.Sessions))
+	assert.Equal(4.0, sessionTracker.Sessions[0].End)
+	assert.Equal([][3]float64{{float64(Foreground), 1, 4}, {float64(Background), 4, 5}}, intervalSpans(fgbgTracker.Intervals()))
+	assert.Equal([][3]float64{{float64(Background), 4, 5}}, intervalSpans(sessionTracker.ScreenOffIntervals()))
+}
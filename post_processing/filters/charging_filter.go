@@ -19,11 +19,14 @@ const (
 
 type ChargingStateFilter struct {
 	*Filter
-	CurrentState        ChargingState
-	FilterState         ChargingState
-	Exclusive           bool
-	StateChangeCallback func(line string)
-	FilterFunc          LoglineFilter
+	CurrentState     ChargingState
+	FilterState      ChargingState
+	Exclusive        bool
+	FilterFunc       LoglineFilter
+	lastStateLogline *cpuprof.Logline
+	// Keep the closed intervals for Intervals
+	RecordIntervals bool
+	intervals       *intervalRecorder
 }
 
 func NewChargingStateFilter(filter *Filter) *ChargingStateFilter {
@@ -33,40 +36,69 @@ func NewChargingStateFilter(filter *Filter) *ChargingStateFilter {
 	// By default only unplugged
 	csf.FilterState = HEALTHD_CHARGE_STATE_UNPLUGGED
 	csf.Exclusive = false
-	csf.StateChangeCallback = nil
-
-	filterFunc := func(logline *cpuprof.Logline) bool {
-		result := false
-		if strings.Contains(logline.Line, "healthd:") {
-			result = true
-
-			healthd := cpuprof.ParseHealthdPrintk(logline)
-			if healthd == nil {
-				fmt.Fprintln(os.Stderr, "Failed to parse line to healthd:", logline.Line)
-				return true
-			}
-
-			if strings.Compare(healthd.Chg, "") == 0 {
-				csf.CurrentState = HEALTHD_CHARGE_STATE_CHARGING
-			} else {
-				csf.CurrentState = HEALTHD_CHARGE_STATE_UNPLUGGED
-			}
-			if csf.StateChangeCallback != nil {
-				csf.StateChangeCallback(logline.Line)
-			}
-		}
-
-		if csf.Exclusive {
-			return result
-		}
-
-		if csf.CurrentState&csf.FilterState != 0 {
-			return true
-		} else {
-			return false
-		}
+	csf.intervals = newIntervalRecorder(&csf.RecordIntervals)
+
+	csf.FilterFunc = func(logline *cpuprof.Logline) bool {
+		return stateResult(csf.Exclusive, logline == csf.lastStateLogline, csf.CurrentState&csf.FilterState != 0)
 	}
-	csf.FilterFunc = filterFunc
-	filter.AddFilter(filterFunc)
+	filter.AddTracker(csf)
+	filter.AddNamedFilter("charging", csf.FilterFunc)
 	return csf
 }
+
+func (csf *ChargingStateFilter) Update(logline *cpuprof.Logline) {
+	if !strings.Contains(logline.Line, "healthd:") {
+		return
+	}
+	csf.lastStateLogline = logline
+
+	healthd := cpuprof.ParseHealthdPrintk(logline)
+	if healthd == nil {
+		fmt.Fprintln(os.Stderr, "Failed to parse line to healthd:", logline.Line)
+		return
+	}
+
+	oldState := csf.CurrentState
+	// chg names the charger (a, u or w) and is empty when unplugged
+	if strings.Compare(healthd.Chg, "") == 0 {
+		csf.CurrentState = HEALTHD_CHARGE_STATE_UNPLUGGED
+	} else {
+		csf.CurrentState = HEALTHD_CHARGE_STATE_CHARGING
+	}
+	csf.intervals.change(int(csf.CurrentState), logline)
+	if csf.CurrentState != oldState {
+		csf.Bus.Publish(&ChargerChanged{eventSource{logline}, oldState, csf.CurrentState, healthd})
+	}
+}
+
+// In passes loglines logged while the charging state is one of states
+func (csf *ChargingStateFilter) In(states ChargingState) LoglineFilter {
+	return func(logline *cpuprof.Logline) bool {
+		return csf.CurrentState&states != 0
+	}
+}
+
+// IsStateLine passes the healthd loglines that report the charging state
+func (csf *ChargingStateFilter) IsStateLine() LoglineFilter {
+	return func(logline *cpuprof.Logline) bool {
+		return logline == csf.lastStateLogline
+	}
+}
+
+// Intervals returns the closed intervals spent in each charging state,
+// starting at the first healthd logline
+func (csf *ChargingStateFilter) Intervals() Intervals {
+	return csf.intervals.intervals
+}
+
+func (csf *ChargingStateFilter) Split(logline *cpuprof.Logline) {
+	csf.intervals.split(logline)
+}
+
+func (csf *ChargingStateFilter) DropIntervals(before float64) {
+	csf.intervals.drop(before)
+}
+
+func (csf *ChargingStateFilter) Finish(last *cpuprof.Logline) {
+	csf.intervals.stop(last)
+}
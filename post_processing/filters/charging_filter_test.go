@@ -0,0 +1,35 @@
+package filters
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChargingStateFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	f := New()
+	csf := NewChargingStateFilter(f)
+	events := make([][2]ChargingState, 0)
+	f.Bus.OnChargerChanged(func(event *ChargerChanged) {
+		events = append(events, [2]ChargingState{event.OldState, event.State})
+	})
+
+	assert.Equal(HEALTHD_CHARGE_STATE_UNKNOWN, csf.CurrentState)
+	// An empty chg means no charger is connected
+	f.ApplyLogline(filterTestLogline(1, healthdPayload(50, "")))
+	assert.Equal(HEALTHD_CHARGE_STATE_UNPLUGGED, csf.CurrentState)
+	// chg names the charger that is connected
+	f.ApplyLogline(filterTestLogline(2, healthdPayload(50, "u")))
+	assert.Equal(HEALTHD_CHARGE_STATE_CHARGING, csf.CurrentState)
+	f.ApplyLogline(filterTestLogline(3, healthdPayload(51, "u")))
+	f.ApplyLogline(filterTestLogline(4, healthdPayload(51, "")))
+	assert.Equal(HEALTHD_CHARGE_STATE_UNPLUGGED, csf.CurrentState)
+
+	assert.Equal([][2]ChargingState{
+		{HEALTHD_CHARGE_STATE_UNKNOWN, HEALTHD_CHARGE_STATE_UNPLUGGED},
+		{HEALTHD_CHARGE_STATE_UNPLUGGED, HEALTHD_CHARGE_STATE_CHARGING},
+		{HEALTHD_CHARGE_STATE_CHARGING, HEALTHD_CHARGE_STATE_UNPLUGGED},
+	}, events)
+}
@@ -2,36 +2,28 @@ package filters
 
 import "github.com/gurupras/go_cpuprof"
 
-// Filter to provide callback every 24 hours
-// Can be tweaked to provide callback after arbitrary durations of time
+// Tracker to publish DayRolled every 24 hours
+// Can be tweaked to publish after arbitrary durations of time
 
 type DayFilter struct {
 	*Filter
-	Callback        func(line string)
-	FilterFunc      LoglineFilter
 	DayStartLogline *cpuprof.Logline
 }
 
+// NewDayFilter adds a tracker to filter. It never drops loglines; it is only
+// used for its DayRolled events.
 func NewDayFilter(filter *Filter) *DayFilter {
 	df := new(DayFilter)
 	df.Filter = filter
-	df.Callback = nil
+	filter.AddTracker(df)
+	return df
+}
 
-	filterFunc := func(logline *cpuprof.Logline) bool {
-		// Always returns true. This is only used for the callback
-		if df.DayStartLogline == nil {
-			df.DayStartLogline = logline
-			goto done
-		} else {
-			if logline.Datetime.YearDay() != df.DayStartLogline.Datetime.YearDay() && df.Callback != nil {
-				df.Callback(logline.Line)
-				df.DayStartLogline = logline
-			}
-		}
-	done:
-		return true
+func (df *DayFilter) Update(logline *cpuprof.Logline) {
+	if df.DayStartLogline == nil {
+		df.DayStartLogline = logline
+	} else if logline.Datetime.YearDay() != df.DayStartLogline.Datetime.YearDay() {
+		df.Bus.Publish(&DayRolled{eventSource{logline}, df.DayStartLogline})
+		df.DayStartLogline = logline
 	}
-	df.FilterFunc = filterFunc
-	filter.AddFilter(filterFunc)
-	return df
 }
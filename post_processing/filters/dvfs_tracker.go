@@ -0,0 +1,224 @@
+package filters
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gurupras/go_cpuprof"
+)
+
+const (
+	LATENCY_UNKNOWN float64 = -1
+)
+
+type DvfsPattern int
+
+const (
+	DVFS_PATTERN_NONE DvfsPattern = iota
+	// The CPU went straight back to the frequency it just left
+	DVFS_PATTERN_PING_PONG DvfsPattern = iota
+	// The CPU went up and then partway back down; the governor overshot
+	DVFS_PATTERN_OVERSHOOT DvfsPattern = iota
+)
+
+var DvfsPatterns = [...]string{
+	"DVFS_PATTERN_NONE",
+	"DVFS_PATTERN_PING_PONG",
+	"DVFS_PATTERN_OVERSHOOT",
+}
+
+// DvfsBucket is the foreground state and temperature a CPU was in. Temp is
+// the lower bound of a bucket of the hottest sensor's temperature, or
+// TEMPERATURE_UNKNOWN.
+type DvfsBucket struct {
+	Fg   FgBgState
+	Temp int
+}
+
+// DvfsTransition is a change of a CPU's frequency seen by CpuTracker. Time is
+// the TraceTime of the cpu_frequency logline.
+type DvfsTransition struct {
+	Cpu     int
+	From    int
+	To      int
+	Time    float64
+	Logline *cpuprof.Logline
+	// Seconds from cpu_frequency_switch_start to cpu_frequency_switch_end,
+	// or LATENCY_UNKNOWN if the switch was not traced
+	Latency float64
+	Pattern DvfsPattern
+	// For DVFS_PATTERN_OVERSHOOT, how far above To the CPU went, in kHz
+	Overshoot int
+	Bucket    DvfsBucket
+}
+
+// dvfsSwitch is a cpu_frequency_switch_start waiting for its end and for the
+// cpu_frequency of the new frequency, which drivers log in either order
+type dvfsSwitch struct {
+	From       int
+	To         int
+	Start      float64
+	End        float64
+	transition *DvfsTransition
+}
+
+// DvfsTracker follows the frequency transitions of every CPU on top of
+// CpuTracker. It pairs cpu_frequency_switch_start and _end to time each
+// switch, marks ping-pongs and overshoots and buckets every transition, and
+// the awake time, by the foreground state and temperature at the time.
+type DvfsTracker struct {
+	*Filter
+	CpuTracker     *CpuTracker
+	FgBgTracker    *FgBgTracker
+	ThermalTracker *ThermalTracker
+	// Transitions at most this far apart can form a ping-pong or overshoot
+	PatternWindowSec float64
+	// Width of the temperature buckets in degrees
+	TempBucketSize int
+	Transitions    []*DvfsTransition
+	// Seconds of TraceTime spent in each bucket
+	BucketTime map[DvfsBucket]float64
+	// Switches that started but never ended, and ends without a start
+	Aborted   int
+	Unmatched int
+	pending   map[int]*dvfsSwitch
+	// Last transition of every CPU since it came online
+	last map[int]*DvfsTransition
+	// CPUs that went offline, whose frequency is stale until they are
+	// seen again
+	stale       map[int]bool
+	lastLogline *cpuprof.Logline
+	// Bucket the phone was in at lastLogline
+	bucket DvfsBucket
+}
+
+func NewDvfsTracker(filter *Filter, cpuTracker *CpuTracker, fgbgTracker *FgBgTracker, thermalTracker *ThermalTracker) (dvfsTracker *DvfsTracker) {
+	dvfsTracker = new(DvfsTracker)
+	dvfsTracker.Filter = filter
+	dvfsTracker.CpuTracker = cpuTracker
+	dvfsTracker.FgBgTracker = fgbgTracker
+	dvfsTracker.ThermalTracker = thermalTracker
+	dvfsTracker.PatternWindowSec = 0.1
+	dvfsTracker.TempBucketSize = 5
+	dvfsTracker.Transitions = make([]*DvfsTransition, 0)
+	dvfsTracker.BucketTime = make(map[DvfsBucket]float64)
+	dvfsTracker.pending = make(map[int]*dvfsSwitch)
+	dvfsTracker.last = make(map[int]*DvfsTransition)
+	dvfsTracker.stale = make(map[int]bool)
+
+	filter.Bus.OnFrequencyChanged(func(event *FrequencyChanged) {
+		dvfsTracker.transition(event)
+	})
+	filter.Bus.OnCpuHotplugged(func(event *CpuHotplugged) {
+		if event.State == CPU_OFFLINE {
+			// Whatever the CPU was doing, it is not going to finish it
+			if sw, ok := dvfsTracker.pending[event.Cpu]; ok && sw.End == LATENCY_UNKNOWN {
+				dvfsTracker.Aborted++
+			}
+			delete(dvfsTracker.pending, event.Cpu)
+			delete(dvfsTracker.last, event.Cpu)
+			dvfsTracker.stale[event.Cpu] = true
+		}
+	})
+	filter.AddTracker(dvfsTracker)
+	return dvfsTracker
+}
+
+// Bucket returns the bucket the phone is in now
+func (dvfsTracker *DvfsTracker) Bucket() DvfsBucket {
+	bucket := DvfsBucket{FgBgUnknown, TEMPERATURE_UNKNOWN}
+	if dvfsTracker.FgBgTracker != nil {
+		bucket.Fg = dvfsTracker.FgBgTracker.CurrentState
+	}
+	if dvfsTracker.ThermalTracker != nil {
+		for _, ttd := range dvfsTracker.ThermalTracker.CurrentState {
+			if ttd.Temp > bucket.Temp {
+				bucket.Temp = ttd.Temp
+			}
+		}
+	}
+	if bucket.Temp != TEMPERATURE_UNKNOWN && dvfsTracker.TempBucketSize > 0 {
+		bucket.Temp -= bucket.Temp % dvfsTracker.TempBucketSize
+	}
+	return bucket
+}
+
+func (dvfsTracker *DvfsTracker) transition(event *FrequencyChanged) {
+	sw := dvfsTracker.pending[event.Cpu]
+	from := event.OldFrequency
+	if dvfsTracker.stale[event.Cpu] {
+		// The CPU is back online. Only a traced switch says where from.
+		delete(dvfsTracker.stale, event.Cpu)
+		from = FREQUENCY_STATE_UNKNOWN
+		if sw != nil && sw.To == event.Frequency {
+			from = sw.From
+		}
+	}
+	if from == FREQUENCY_STATE_UNKNOWN || from == event.Frequency {
+		return
+	}
+	t := &DvfsTransition{Cpu: event.Cpu, From: from, To: event.Frequency, Time: event.Logline.TraceTime, Logline: event.Logline, Latency: LATENCY_UNKNOWN}
+	t.Bucket = dvfsTracker.Bucket()
+
+	if sw != nil && sw.To == t.To && sw.transition == nil {
+		if sw.End != LATENCY_UNKNOWN {
+			t.Latency = sw.End - sw.Start
+			delete(dvfsTracker.pending, event.Cpu)
+		} else {
+			sw.transition = t
+		}
+	}
+
+	if prev := dvfsTracker.last[event.Cpu]; prev != nil && prev.To == t.From && t.Time-prev.Time <= dvfsTracker.PatternWindowSec {
+		if t.To == prev.From {
+			t.Pattern = DVFS_PATTERN_PING_PONG
+		} else if prev.To > prev.From && t.To < t.From && t.To > prev.From {
+			t.Pattern = DVFS_PATTERN_OVERSHOOT
+			t.Overshoot = t.From - t.To
+		}
+	}
+	dvfsTracker.last[event.Cpu] = t
+	dvfsTracker.Transitions = append(dvfsTracker.Transitions, t)
+}
+
+func (dvfsTracker *DvfsTracker) Update(logline *cpuprof.Logline) {
+	if dvfsTracker.lastLogline != nil {
+		// The time since the last logline was spent in the bucket the
+		// phone was in then, which no logline since has changed
+		if elapsed := logline.TraceTime - dvfsTracker.lastLogline.TraceTime; elapsed > 0 {
+			dvfsTracker.BucketTime[dvfsTracker.bucket] += elapsed
+		}
+	}
+	dvfsTracker.lastLogline = logline
+	dvfsTracker.bucket = dvfsTracker.Bucket()
+
+	if !strings.Contains(logline.Line, "cpu_frequency_switch_") {
+		return
+	}
+	trace := cpuprof.ParseTraceFromLoglinePayload(logline)
+	if trace == nil {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Trace is nil: %v", logline.Line))
+		return
+	}
+	switch trace.Tag() {
+	case "cpu_frequency_switch_start":
+		cfss := trace.(*cpuprof.CpuFrequencySwitchStart)
+		if sw, ok := dvfsTracker.pending[cfss.CpuId]; ok && sw.End == LATENCY_UNKNOWN {
+			dvfsTracker.Aborted++
+		}
+		dvfsTracker.pending[cfss.CpuId] = &dvfsSwitch{cfss.Start, cfss.End, logline.TraceTime, LATENCY_UNKNOWN, nil}
+	case "cpu_frequency_switch_end":
+		cfse := trace.(*cpuprof.CpuFrequencySwitchEnd)
+		sw, ok := dvfsTracker.pending[cfse.CpuId]
+		if !ok || sw.End != LATENCY_UNKNOWN {
+			dvfsTracker.Unmatched++
+			return
+		}
+		sw.End = logline.TraceTime
+		if sw.transition != nil {
+			sw.transition.Latency = sw.End - sw.Start
+			delete(dvfsTracker.pending, cfse.CpuId)
+		}
+	}
+}
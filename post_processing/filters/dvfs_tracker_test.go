@@ -0,0 +1,80 @@
+package filters
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDvfsTracker(t *testing.T) {
+	assert := assert.New(t)
+
+	f := New()
+	cpuTracker := NewCpuTracker(f)
+	fgbgTracker := NewFgBgTracker(f)
+	thermalTracker := NewThermalTracker(f)
+	dvfsTracker := NewDvfsTracker(f, cpuTracker, fgbgTracker, thermalTracker)
+	// The test loglines are a second apart
+	dvfsTracker.PatternWindowSec = 2
+
+	for _, line := range []struct {
+		token   int
+		payload string
+	}{
+		{1, "thermal_temp: sensor_id=0 temp=42"},
+		{2, "phonelab_proc_foreground: pid=100 tgid=100 comm=.android.dialer"},
+		{3, "cpu_frequency: state=300000 cpu_id=0"},
+		{4, "cpu_frequency_switch_start: start=300000 end=1728000 cpu_id=0"},
+		{5, "cpu_frequency_switch_end: cpu_id=0"},
+		{6, "cpu_frequency: state=1728000 cpu_id=0"},
+		{7, "cpu_frequency: state=300000 cpu_id=0"},
+		{10, "cpu_frequency: state=1958400 cpu_id=0"},
+		{11, "cpu_frequency: state=960000 cpu_id=0"},
+		{12, "thermal_temp: sensor_id=5 temp=47"},
+		{13, "cpu_frequency_switch_start: start=960000 end=300000 cpu_id=0"},
+		// The new frequency is logged before the switch ends
+		{14, "cpu_frequency: state=300000 cpu_id=0"},
+		{15, "cpu_frequency_switch_end: cpu_id=0"},
+		{16, "cpu_frequency_switch_end: cpu_id=0"},
+		{17, "cpu_frequency_switch_start: start=300000 end=960000 cpu_id=0"},
+		{18, "sched_cpu_hotplug: cpu 0 offline error=0"},
+		{19, "cpu_frequency: state=960000 cpu_id=0"},
+		{20, "cpu_frequency: state=300000 cpu_id=0"},
+	} {
+		f.ApplyLogline(traceTestLogline(line.token, line.payload))
+	}
+	f.Finish()
+
+	transitions := make([][3]int, 0)
+	latencies := make([]float64, 0)
+	patterns := make([]DvfsPattern, 0)
+	buckets := make([]DvfsBucket, 0)
+	for _, tr := range dvfsTracker.Transitions {
+		transitions = append(transitions, [3]int{int(tr.Time), tr.From, tr.To})
+		latencies = append(latencies, tr.Latency)
+		patterns = append(patterns, tr.Pattern)
+		buckets = append(buckets, tr.Bucket)
+	}
+	assert.Equal([][3]int{
+		{6, 300000, 1728000},
+		{7, 1728000, 300000},
+		{10, 300000, 1958400},
+		{11, 1958400, 960000},
+		{14, 960000, 300000},
+		// The first frequency once back online is not a transition
+		{20, 960000, 300000},
+	}, transitions)
+	assert.Equal([]float64{1, LATENCY_UNKNOWN, LATENCY_UNKNOWN, LATENCY_UNKNOWN, 2, LATENCY_UNKNOWN}, latencies)
+	assert.Equal([]DvfsPattern{DVFS_PATTERN_NONE, DVFS_PATTERN_PING_PONG, DVFS_PATTERN_NONE, DVFS_PATTERN_OVERSHOOT, DVFS_PATTERN_NONE, DVFS_PATTERN_NONE}, patterns)
+	assert.Equal(1958400-960000, dvfsTracker.Transitions[3].Overshoot)
+	assert.Equal(DvfsBucket{Foreground, 40}, buckets[0])
+	assert.Equal(DvfsBucket{Foreground, 45}, buckets[4])
+
+	assert.Equal(1, dvfsTracker.Aborted)
+	assert.Equal(1, dvfsTracker.Unmatched)
+	assert.Equal(map[DvfsBucket]float64{
+		{FgBgUnknown, 40}: 1,
+		{Foreground, 40}:  10,
+		{Foreground, 45}:  8,
+	}, dvfsTracker.BucketTime)
+}
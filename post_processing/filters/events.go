@@ -0,0 +1,206 @@
+package filters
+
+import "github.com/gurupras/go_cpuprof"
+
+// Event is published by a tracker when the state it follows changes.
+// Source is the logline that caused the event.
+type Event interface {
+	Source() *cpuprof.Logline
+}
+
+type eventSource struct {
+	Logline *cpuprof.Logline
+}
+
+func (e *eventSource) Source() *cpuprof.Logline {
+	return e.Logline
+}
+
+// FrequencyChanged is published by CpuTracker for every cpu_frequency logline
+type FrequencyChanged struct {
+	eventSource
+	Cpu int
+	// Frequency before this logline and the logline that set it. These are
+	// FREQUENCY_STATE_UNKNOWN and nil for the first cpu_frequency of a CPU.
+	OldFrequency int
+	Since        *cpuprof.Logline
+	Frequency    int
+}
+
+// CpuHotplugged is published by CpuTracker for every sched_cpu_hotplug
+// logline. State is OldState if the hotplug failed.
+type CpuHotplugged struct {
+	eventSource
+	Cpu      int
+	OldState CpuState
+	State    CpuState
+	Error    int
+}
+
+// ForegroundChanged is published by FgBgTracker when an app comes to the
+// foreground or once the phone has been in the background for BgDelaySec. The
+// source of a switch to the background is the pid=0 logline it started at.
+type ForegroundChanged struct {
+	eventSource
+	OldState FgBgState
+	State    FgBgState
+	// The process that came to the foreground; nil for Background
+	Proc *cpuprof.PhonelabProcForeground
+}
+
+// TemperatureChanged is published by ThermalTracker for every thermal_temp
+// logline
+type TemperatureChanged struct {
+	eventSource
+	Sensor int
+	// Temperature before this logline and the logline that set it. These are
+	// TEMPERATURE_UNKNOWN and nil for the first thermal_temp of a sensor.
+	OldTemp int
+	Since   *cpuprof.Logline
+	Temp    int
+}
+
+// Suspended is published by SleepFilter for every suspend entry
+type Suspended struct {
+	eventSource
+	Entry *cpuprof.PowerManagementPrintk
+}
+
+// Resumed is published by SleepFilter for every suspend exit. Entry is nil
+// if the suspend entry was not seen.
+type Resumed struct {
+	eventSource
+	Entry *cpuprof.PowerManagementPrintk
+	Exit  *cpuprof.PowerManagementPrintk
+}
+
+// ChargerChanged is published by ChargingStateFilter when the phone is
+// plugged in or unplugged
+type ChargerChanged struct {
+	eventSource
+	OldState ChargingState
+	State    ChargingState
+	Healthd  *cpuprof.Healthd
+}
+
+// DayRolled is published by DayFilter on the first logline of a new day
+type DayRolled struct {
+	eventSource
+	// First logline of the previous day
+	DayStart *cpuprof.Logline
+}
+
+// CtxSwitchInfoCollected is published by PeriodicCtxSwitchInfoTracker for
+// every context switch info window: at its END marker, or flagged incomplete
+// when the next BEGIN or the end of the boot is seen first
+type CtxSwitchInfoCollected struct {
+	eventSource
+	Cpu  int
+	Info *cpuprof.PeriodicCtxSwitchInfo
+}
+
+// EventBus delivers the events published by trackers to every subscriber of
+// that event, in the order they subscribed. Subscribers are called
+// synchronously from the tracker's Update.
+type EventBus struct {
+	frequencyChanged       []func(*FrequencyChanged)
+	cpuHotplugged          []func(*CpuHotplugged)
+	foregroundChanged      []func(*ForegroundChanged)
+	suspended              []func(*Suspended)
+	resumed                []func(*Resumed)
+	chargerChanged         []func(*ChargerChanged)
+	dayRolled              []func(*DayRolled)
+	ctxSwitchInfoCollected []func(*CtxSwitchInfoCollected)
+	temperatureChanged     []func(*TemperatureChanged)
+	all                    []func(Event)
+}
+
+func NewEventBus() *EventBus {
+	return new(EventBus)
+}
+
+func (bus *EventBus) OnFrequencyChanged(fn func(*FrequencyChanged)) {
+	bus.frequencyChanged = append(bus.frequencyChanged, fn)
+}
+
+func (bus *EventBus) OnCpuHotplugged(fn func(*CpuHotplugged)) {
+	bus.cpuHotplugged = append(bus.cpuHotplugged, fn)
+}
+
+func (bus *EventBus) OnForegroundChanged(fn func(*ForegroundChanged)) {
+	bus.foregroundChanged = append(bus.foregroundChanged, fn)
+}
+
+func (bus *EventBus) OnSuspended(fn func(*Suspended)) {
+	bus.suspended = append(bus.suspended, fn)
+}
+
+func (bus *EventBus) OnResumed(fn func(*Resumed)) {
+	bus.resumed = append(bus.resumed, fn)
+}
+
+func (bus *EventBus) OnChargerChanged(fn func(*ChargerChanged)) {
+	bus.chargerChanged = append(bus.chargerChanged, fn)
+}
+
+func (bus *EventBus) OnDayRolled(fn func(*DayRolled)) {
+	bus.dayRolled = append(bus.dayRolled, fn)
+}
+
+func (bus *EventBus) OnCtxSwitchInfoCollected(fn func(*CtxSwitchInfoCollected)) {
+	bus.ctxSwitchInfoCollected = append(bus.ctxSwitchInfoCollected, fn)
+}
+
+func (bus *EventBus) OnTemperatureChanged(fn func(*TemperatureChanged)) {
+	bus.temperatureChanged = append(bus.temperatureChanged, fn)
+}
+
+// OnEvent subscribes fn to every event. It is called after the subscribers
+// of the event's own type.
+func (bus *EventBus) OnEvent(fn func(Event)) {
+	bus.all = append(bus.all, fn)
+}
+
+func (bus *EventBus) Publish(event Event) {
+	switch e := event.(type) {
+	case *FrequencyChanged:
+		for _, fn := range bus.frequencyChanged {
+			fn(e)
+		}
+	case *CpuHotplugged:
+		for _, fn := range bus.cpuHotplugged {
+			fn(e)
+		}
+	case *ForegroundChanged:
+		for _, fn := range bus.foregroundChanged {
+			fn(e)
+		}
+	case *Suspended:
+		for _, fn := range bus.suspended {
+			fn(e)
+		}
+	case *Resumed:
+		for _, fn := range bus.resumed {
+			fn(e)
+		}
+	case *ChargerChanged:
+		for _, fn := range bus.chargerChanged {
+			fn(e)
+		}
+	case *DayRolled:
+		for _, fn := range bus.dayRolled {
+			fn(e)
+		}
+	case *CtxSwitchInfoCollected:
+		for _, fn := range bus.ctxSwitchInfoCollected {
+			fn(e)
+		}
+	case *TemperatureChanged:
+		for _, fn := range bus.temperatureChanged {
+			fn(e)
+		}
+	}
+	for _, fn := range bus.all {
+		fn(event)
+	}
+}
@@ -0,0 +1,92 @@
+package filters
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gurupras/go_cpuprof"
+	"github.com/stretchr/testify/assert"
+)
+
+func traceTestLogline(token int, payload string) *cpuprof.Logline {
+	line := fmt.Sprintf("6890aa2f-9895-47bf-9c37-79a2e3a34703 2016-06-25 13:24:%02d.000000000 %d [   %d.000000]   200   200 D Kernel-Trace: kworker/0:1H-17 [000] ...1     %d.000000: %s", token, token, token, token, payload)
+	logline := cpuprof.ParseLogline(line)
+	if logline == nil {
+		panic("Failed to parse: " + line)
+	}
+	return logline
+}
+
+func TestEventBusCpu(t *testing.T) {
+	assert := assert.New(t)
+
+	f := New()
+	NewCpuTracker(f)
+
+	frequencies := make([]*FrequencyChanged, 0)
+	hotplugs := make([]*CpuHotplugged, 0)
+	all := 0
+	f.Bus.OnFrequencyChanged(func(event *FrequencyChanged) {
+		frequencies = append(frequencies, event)
+	})
+	f.Bus.OnCpuHotplugged(func(event *CpuHotplugged) {
+		hotplugs = append(hotplugs, event)
+	})
+	// Any number of subscribers
+	f.Bus.OnEvent(func(event Event) {
+		all++
+	})
+
+	loglines := []*cpuprof.Logline{
+		traceTestLogline(1, "cpu_frequency: state=300000 cpu_id=1"),
+		traceTestLogline(2, "cpu_frequency: state=1728000 cpu_id=1"),
+		traceTestLogline(3, "sched_cpu_hotplug: cpu 1 offline error=0"),
+		traceTestLogline(4, "sched_cpu_hotplug: cpu 1 online error=-16"),
+	}
+	for _, logline := range loglines {
+		f.ApplyLogline(logline)
+	}
+
+	assert.Equal(2, len(frequencies))
+	assert.Equal(FREQUENCY_STATE_UNKNOWN, frequencies[0].OldFrequency)
+	assert.Nil(frequencies[0].Since)
+	assert.Equal(300000, frequencies[1].OldFrequency)
+	assert.Equal(loglines[0], frequencies[1].Since)
+	assert.Equal(1728000, frequencies[1].Frequency)
+	assert.Equal(loglines[1], frequencies[1].Source())
+
+	assert.Equal(2, len(hotplugs))
+	assert.Equal(CpuHotplugged{eventSource{loglines[2]}, 1, CPU_ONLINE, CPU_OFFLINE, 0}, *hotplugs[0])
+	// A failed hotplug does not change the state
+	assert.Equal(CpuHotplugged{eventSource{loglines[3]}, 1, CPU_OFFLINE, CPU_OFFLINE, -16}, *hotplugs[1])
+	assert.Equal(4, all)
+}
+
+func TestEventBusState(t *testing.T) {
+	assert := assert.New(t)
+
+	f := New()
+	NewChargingStateFilter(f)
+	NewSleepFilter(f)
+
+	events := make([]string, 0)
+	f.Bus.OnChargerChanged(func(event *ChargerChanged) {
+		events = append(events, fmt.Sprintf("charger %v->%v at %v", event.OldState, event.State, event.Logline.LogcatToken))
+	})
+	f.Bus.OnSuspended(func(event *Suspended) {
+		events = append(events, fmt.Sprintf("suspended at %v", event.Logline.LogcatToken))
+	})
+	f.Bus.OnResumed(func(event *Resumed) {
+		events = append(events, fmt.Sprintf("resumed at %v after %v", event.Logline.LogcatToken, event.Exit.Datetime.Sub(event.Entry.Datetime)))
+	})
+	applyTokens(f)
+
+	unknown, charging, unplugged := HEALTHD_CHARGE_STATE_UNKNOWN, HEALTHD_CHARGE_STATE_CHARGING, HEALTHD_CHARGE_STATE_UNPLUGGED
+	assert.Equal([]string{
+		fmt.Sprintf("charger %v->%v at 2", unknown, unplugged),
+		"suspended at 4",
+		"resumed at 6 after 2s",
+		fmt.Sprintf("charger %v->%v at 7", unplugged, charging),
+		"suspended at 9",
+	}, events)
+}
@@ -13,22 +13,34 @@ const (
 	FgBgUnknown FgBgState = 1 << iota
 	Foreground  FgBgState = 1 << iota
 	Background  FgBgState = 1 << iota
+	FgBgAll     FgBgState = FgBgUnknown | Foreground | Background
 )
 
+// FgBgTracker follows whether an app is in the foreground. A pid=0
+// phonelab_proc_foreground logline only switches to the background once no
+// app has come to the foreground for BgDelaySec after it. The switch is then
+// dated back to the pid=0 logline in Intervals and in the ForegroundChanged
+// event, but CurrentState, and so In and the trackers that read it, stays
+// Foreground until the switch is confirmed.
 type FgBgTracker struct {
 	*Filter
 	CurrentState          FgBgState
-	TrackerState          FgBgState
+	FilterState           FgBgState
 	LastForegroundLogline *cpuprof.Logline
 	LastBackgroundLogline *cpuprof.Logline
 	LastStateLogline      *cpuprof.Logline
 	lastBgTime            float64
+	bgLogline             *cpuprof.Logline
 	Exclusive             bool
 	BgDelaySec            float64
-	Callback              func(line string, oldState FgBgState, newState FgBgState)
-	TrackerFunc           LoglineFilter
+	FilterFunc            LoglineFilter
 	ForegroundTime        float64
 	BackgroundTime        float64
+	lastForegroundLine    *cpuprof.Logline
+	switchToBg            bool
+	// Keep the closed intervals for Intervals
+	RecordIntervals bool
+	intervals       *intervalRecorder
 }
 
 func NewFgBgTracker(filter *Filter) (fgbgTracker *FgBgTracker) {
@@ -36,69 +48,118 @@ func NewFgBgTracker(filter *Filter) (fgbgTracker *FgBgTracker) {
 	fgbgTracker.Filter = filter
 	fgbgTracker.Exclusive = false
 	fgbgTracker.CurrentState = FgBgUnknown
+	// By default pass every line; the tracker is mostly used for its state
+	fgbgTracker.FilterState = FgBgAll
 	fgbgTracker.lastBgTime = 0.0
 	fgbgTracker.BgDelaySec = 1.0
-	shouldSwitchToBg := false
+	fgbgTracker.switchToBg = false
+	fgbgTracker.intervals = newIntervalRecorder(&fgbgTracker.RecordIntervals)
 
 	fgbgTracker.ForegroundTime = 0.0
 	fgbgTracker.BackgroundTime = 0.0
 
-	filterFunc := func(logline *cpuprof.Logline) bool {
-		result := false
-
-		oldState := fgbgTracker.CurrentState
-		if strings.Contains(logline.Line, "phonelab_proc_foreground:") {
-			trace := cpuprof.ParseTraceFromLoglinePayload(logline)
-			if trace == nil {
-				panic(fmt.Sprintf("Trace is nil: %v", logline.Line))
-			}
+	fgbgTracker.FilterFunc = func(logline *cpuprof.Logline) bool {
+		return stateResult(fgbgTracker.Exclusive, logline == fgbgTracker.lastForegroundLine, fgbgTracker.FilterState&fgbgTracker.CurrentState != 0)
+	}
+	filter.AddTracker(fgbgTracker)
+	filter.AddNamedFilter("fgbg", fgbgTracker.FilterFunc)
+	return fgbgTracker
+}
 
-			switch trace.Tag() {
-			case "phonelab_proc_foreground":
-				ppf := trace.(*cpuprof.PhonelabProcForeground)
-				if ppf.Pid != 0 {
-					oldState = fgbgTracker.CurrentState
-					fgbgTracker.CurrentState = Foreground
-					shouldSwitchToBg = false
-					if fgbgTracker.Callback != nil {
-						fgbgTracker.Callback(logline.Line, oldState, fgbgTracker.CurrentState)
-					}
-					// Update last state only after callback
-					fgbgTracker.LastForegroundLogline = logline
-					fgbgTracker.LastStateLogline = logline
-				} else {
-					// Just store the time. Once enough time has elapsed,
-					// we will change state to background
-					fgbgTracker.lastBgTime = logline.TraceTime
-					shouldSwitchToBg = true
-				}
-			}
-			result = true
+func (fgbgTracker *FgBgTracker) Update(logline *cpuprof.Logline) {
+	oldState := fgbgTracker.CurrentState
+	if strings.Contains(logline.Line, "phonelab_proc_foreground:") {
+		trace := cpuprof.ParseTraceFromLoglinePayload(logline)
+		if trace == nil {
+			panic(fmt.Sprintf("Trace is nil: %v", logline.Line))
 		}
-		// If current state is background and time elapsed is > BgDelaySec, then set background
-		if shouldSwitchToBg {
-			if logline.TraceTime-fgbgTracker.lastBgTime > fgbgTracker.BgDelaySec {
+
+		switch trace.Tag() {
+		case "phonelab_proc_foreground":
+			ppf := trace.(*cpuprof.PhonelabProcForeground)
+			if ppf.Pid != 0 {
 				oldState = fgbgTracker.CurrentState
-				fgbgTracker.CurrentState = Background
-				shouldSwitchToBg = false
-				if fgbgTracker.Callback != nil {
-					fgbgTracker.Callback(logline.Line, oldState, fgbgTracker.CurrentState)
-				}
-				fgbgTracker.LastBackgroundLogline = logline
+				fgbgTracker.CurrentState = Foreground
+				fgbgTracker.switchToBg = false
+				fgbgTracker.intervals.change(int(fgbgTracker.CurrentState), logline)
+				// Update last state only after subscribers have seen the event
+				fgbgTracker.Bus.Publish(&ForegroundChanged{eventSource{logline}, oldState, fgbgTracker.CurrentState, ppf})
+				fgbgTracker.LastForegroundLogline = logline
 				fgbgTracker.LastStateLogline = logline
+			} else {
+				// Just store the time. Once enough time has elapsed,
+				// we will change state to background as of the first
+				// pid=0 logline
+				if !fgbgTracker.switchToBg {
+					fgbgTracker.bgLogline = logline
+				}
+				fgbgTracker.lastBgTime = logline.TraceTime
+				fgbgTracker.switchToBg = true
 			}
 		}
-
-		if fgbgTracker.Exclusive {
-			return result
+		fgbgTracker.lastForegroundLine = logline
+	}
+	// If current state is background and time elapsed is > BgDelaySec, then set background
+	if fgbgTracker.switchToBg {
+		if logline.TraceTime-fgbgTracker.lastBgTime > fgbgTracker.BgDelaySec {
+			fgbgTracker.switchToBackground()
 		}
+	}
+}
 
-		if fgbgTracker.TrackerState&fgbgTracker.CurrentState != 0 {
-			return true
-		}
-		return false
+// switchToBackground commits the pending switch to the background as of the
+// first pid=0 logline
+func (fgbgTracker *FgBgTracker) switchToBackground() {
+	bgLogline := fgbgTracker.bgLogline
+	oldState := fgbgTracker.CurrentState
+	fgbgTracker.CurrentState = Background
+	fgbgTracker.switchToBg = false
+	fgbgTracker.bgLogline = nil
+	fgbgTracker.intervals.change(int(fgbgTracker.CurrentState), bgLogline)
+	fgbgTracker.Bus.Publish(&ForegroundChanged{eventSource{bgLogline}, oldState, fgbgTracker.CurrentState, nil})
+	fgbgTracker.LastBackgroundLogline = bgLogline
+	fgbgTracker.LastStateLogline = bgLogline
+}
+
+// In passes loglines logged while the foreground state is one of states
+func (fgbgTracker *FgBgTracker) In(states FgBgState) LoglineFilter {
+	return func(logline *cpuprof.Logline) bool {
+		return fgbgTracker.CurrentState&states != 0
 	}
-	fgbgTracker.TrackerFunc = filterFunc
-	filter.AddFilter(filterFunc)
-	return fgbgTracker
+}
+
+// IsStateLine passes the phonelab_proc_foreground loglines
+func (fgbgTracker *FgBgTracker) IsStateLine() LoglineFilter {
+	return func(logline *cpuprof.Logline) bool {
+		return logline == fgbgTracker.lastForegroundLine
+	}
+}
+
+// Intervals returns the closed intervals spent in the foreground and the
+// background, starting at the first change of state
+func (fgbgTracker *FgBgTracker) Intervals() Intervals {
+	return fgbgTracker.intervals.intervals
+}
+
+// Split splits the current interval at the first pid=0 logline instead while
+// a switch to the background is pending, since the switch would be dated back
+// to it
+func (fgbgTracker *FgBgTracker) Split(logline *cpuprof.Logline) {
+	if fgbgTracker.switchToBg {
+		logline = fgbgTracker.bgLogline
+	}
+	fgbgTracker.intervals.split(logline)
+}
+
+func (fgbgTracker *FgBgTracker) DropIntervals(before float64) {
+	fgbgTracker.intervals.drop(before)
+}
+
+// Finish commits a switch to the background that was still waiting for
+// BgDelaySec to pass, since no app came to the foreground before the end
+func (fgbgTracker *FgBgTracker) Finish(last *cpuprof.Logline) {
+	if fgbgTracker.switchToBg {
+		fgbgTracker.switchToBackground()
+	}
+	fgbgTracker.intervals.stop(last)
 }
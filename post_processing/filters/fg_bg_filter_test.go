@@ -6,7 +6,6 @@ import (
 	"path/filepath"
 	"testing"
 
-	"github.com/gurupras/go_cpuprof"
 	"github.com/gurupras/gocommons"
 	"github.com/stretchr/testify/assert"
 )
@@ -24,34 +23,19 @@ func testFgBgTracker(fgbgTracker *FgBgTracker, assert *assert.Assertions) int64
 
 	reader.Split(bufio.ScanLines)
 
-	filters := fgbgTracker.Filter.AsLineFilterArray()
-
 	count := 0
 	for reader.Scan() {
-		line := reader.Text()
-		logline := cpuprof.ParseLogline(line)
-		//if fgbgFilter.CurrentState&Background != 0 {
-		//fmt.Println(line)
-		//}
-		valid := true
-		for _, f := range filters {
-			valid = valid && f(logline)
-			if !valid {
-				break
-			}
-		}
-		if !valid {
-			continue
+		if fgbgTracker.Filter.Apply(reader.Text()) {
+			count++
 		}
-		_ = line
-		count++
 	}
+	assert.Equal(int64(count), fgbgTracker.Filter.Passed)
 	return int64(count)
 }
 
 func testFgBgState(state FgBgState, filter *Filter, assert *assert.Assertions) int64 {
 	fgbgTracker := NewFgBgTracker(filter)
-	fgbgTracker.TrackerState = state
+	fgbgTracker.FilterState = state
 	return testFgBgTracker(fgbgTracker, assert)
 
 }
@@ -1,34 +1,225 @@
 package filters
 
-import "github.com/gurupras/go_cpuprof"
+import (
+	"fmt"
+	"io"
+
+	"github.com/gurupras/go_cpuprof"
+)
 
 type LineFilter func(line string) bool
 type LoglineFilter func(logline *cpuprof.Logline) bool
 
+// FilterStats counts how often a filter was evaluated and how often it passed
+type FilterStats struct {
+	Name      string
+	Evaluated int64
+	Passed    int64
+}
+
+// Tracker follows some state across loglines, such as whether the phone is
+// charging or the frequency of each CPU. Trackers never drop loglines; they
+// expose their state for filters to read.
+type Tracker interface {
+	Update(logline *cpuprof.Logline)
+}
+
+// Finisher is implemented by trackers that hold something open until the
+// next state change, such as an interval. Finish closes it at the last logline.
+type Finisher interface {
+	Finish(last *cpuprof.Logline)
+}
+
+// Splitter is implemented by trackers that record intervals, so that a long
+// boot can be processed a piece at a time. Split closes the open intervals at
+// logline and opens them again there, and DropIntervals forgets the closed
+// intervals that ended at or before a TraceTime.
+type Splitter interface {
+	Split(logline *cpuprof.Logline)
+	DropIntervals(before float64)
+}
+
+// Filter updates its trackers with every logline and then evaluates its
+// filters, which are predicates over tracker state. A logline passes if every
+// filter passes. Since every tracker sees every logline before any filter is
+// evaluated, the order in which trackers and filters are added does not change
+// the result.
 type Filter struct {
+	trackers    []Tracker
 	filterFuncs []LoglineFilter
+	stats       []*FilterStats
+	// Trackers publish their events here
+	Bus         *EventBus
+	lastLogline *cpuprof.Logline
+	// Loglines applied and loglines that passed every filter
+	Lines  int64
+	Passed int64
 }
 
 func New() *Filter {
 	f := new(Filter)
+	f.trackers = make([]Tracker, 0)
 	f.filterFuncs = make([]LoglineFilter, 0)
+	f.stats = make([]*FilterStats, 0)
+	f.Bus = NewEventBus()
 	return f
 }
 
+// AddTracker adds a tracker that is updated with every logline, in the order
+// trackers were added
+func (f *Filter) AddTracker(tracker Tracker) {
+	f.trackers = append(f.trackers, tracker)
+}
+
 func (f *Filter) AddFilter(filter LoglineFilter) {
+	f.AddNamedFilter(fmt.Sprintf("filter-%d", len(f.filterFuncs)), filter)
+}
+
+// AddNamedFilter adds filter under a name used in Stats
+func (f *Filter) AddNamedFilter(name string, filter LoglineFilter) {
 	f.filterFuncs = append(f.filterFuncs, filter)
+	f.stats = append(f.stats, &FilterStats{Name: name})
 }
 
 func (f *Filter) AsLineFilterArray() []LoglineFilter {
 	return f.filterFuncs
 }
 
-func (f *Filter) Apply(line string) {
+// Apply parses line and applies it. Lines that do not parse do not pass.
+func (f *Filter) Apply(line string) bool {
 	logline := cpuprof.ParseLogline(line)
 	if logline == nil {
+		return false
+	}
+	return f.ApplyLogline(logline)
+}
+
+// ApplyLogline updates every tracker with logline, then evaluates every
+// filter on it and returns whether all of them passed
+func (f *Filter) ApplyLogline(logline *cpuprof.Logline) bool {
+	for _, tracker := range f.trackers {
+		tracker.Update(logline)
+	}
+	f.lastLogline = logline
+	pass := true
+	for idx, ffunc := range f.filterFuncs {
+		stats := f.stats[idx]
+		stats.Evaluated++
+		if ffunc(logline) {
+			stats.Passed++
+		} else {
+			pass = false
+		}
+	}
+	f.Lines++
+	if pass {
+		f.Passed++
+	}
+	return pass
+}
+
+// Finish tells every tracker that records intervals that there are no more
+// loglines
+func (f *Filter) Finish() {
+	if f.lastLogline == nil {
+		return
+	}
+	for _, tracker := range f.trackers {
+		if finisher, ok := tracker.(Finisher); ok {
+			finisher.Finish(f.lastLogline)
+		}
+	}
+}
+
+// Split closes the intervals of every tracker at the last logline, so that
+// the intervals up to it can be read before Finish
+func (f *Filter) Split() {
+	if f.lastLogline == nil {
 		return
 	}
-	for _, ffunc := range f.filterFuncs {
-		ffunc(logline)
+	for _, tracker := range f.trackers {
+		if splitter, ok := tracker.(Splitter); ok {
+			splitter.Split(f.lastLogline)
+		}
+	}
+}
+
+// DropIntervals makes every tracker forget the intervals that ended at or
+// before the TraceTime before
+func (f *Filter) DropIntervals(before float64) {
+	for _, tracker := range f.trackers {
+		if splitter, ok := tracker.(Splitter); ok {
+			splitter.DropIntervals(before)
+		}
+	}
+}
+
+// Stats returns a copy of the per-filter counts in the order the filters were added
+func (f *Filter) Stats() []FilterStats {
+	stats := make([]FilterStats, len(f.stats))
+	for idx, s := range f.stats {
+		stats[idx] = *s
+	}
+	return stats
+}
+
+func (f *Filter) WriteStats(w io.Writer) {
+	fmt.Fprintf(w, "%v/%v loglines passed\n", f.Passed, f.Lines)
+	for _, s := range f.stats {
+		fmt.Fprintf(w, "  %v: %v/%v\n", s.Name, s.Passed, s.Evaluated)
+	}
+}
+
+// And passes if every filter passes. It stops at the first failure, which is
+// safe because filters only read the state of trackers.
+func And(filters ...LoglineFilter) LoglineFilter {
+	return func(logline *cpuprof.Logline) bool {
+		for _, filter := range filters {
+			if !filter(logline) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Or passes if any filter passes. It stops at the first success.
+func Or(filters ...LoglineFilter) LoglineFilter {
+	return func(logline *cpuprof.Logline) bool {
+		for _, filter := range filters {
+			if filter(logline) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func Not(filter LoglineFilter) LoglineFilter {
+	return func(logline *cpuprof.Logline) bool {
+		return !filter(logline)
+	}
+}
+
+// While passes the loglines that pass filter while condition holds.
+// filter is not evaluated otherwise.
+func While(condition LoglineFilter, filter LoglineFilter) LoglineFilter {
+	return And(condition, filter)
+}
+
+// Tag passes loglines with the given logcat tag
+func Tag(tag string) LoglineFilter {
+	return func(logline *cpuprof.Logline) bool {
+		return logline.Tag == tag
+	}
+}
+
+// stateResult is how the filter of every tracker decides whether a logline
+// passes: in exclusive mode only the lines that report the state pass,
+// otherwise every line logged while the state is in the filter's mask passes.
+func stateResult(exclusive bool, is_state_line bool, in_state bool) bool {
+	if exclusive {
+		return is_state_line
 	}
+	return in_state
 }
@@ -0,0 +1,160 @@
+package filters
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gurupras/go_cpuprof"
+	"github.com/stretchr/testify/assert"
+)
+
+func filterTestLogline(token int, payload string) *cpuprof.Logline {
+	line := fmt.Sprintf("6890aa2f-9895-47bf-9c37-79a2e3a34703 2016-06-25 13:24:%02d.000000000 %d [   %d.000000]   200   200 I KernelPrintk: <6>[    %d.000000] %s", token, token, token, token, payload)
+	logline := cpuprof.ParseLogline(line)
+	if logline == nil {
+		panic("Failed to parse: " + line)
+	}
+	return logline
+}
+
+func healthdPayload(level int, chg string) string {
+	return fmt.Sprintf("healthd: battery l=%d v=4000 t=30.0 h=2 st=3 c=100 chg=%s", level, chg)
+}
+
+// Unplugged, suspended, resumed, plugged in and suspended again
+func filterTestLoglines() []*cpuprof.Logline {
+	return []*cpuprof.Logline{
+		filterTestLogline(1, "unknown state"),
+		filterTestLogline(2, healthdPayload(50, "")),
+		filterTestLogline(3, "unplugged and awake"),
+		filterTestLogline(4, "PM: suspend entry 2016-06-25 13:24:04.000000000 UTC"),
+		filterTestLogline(5, "unplugged and suspended"),
+		filterTestLogline(6, "PM: suspend exit 2016-06-25 13:24:06.000000000 UTC"),
+		filterTestLogline(7, healthdPayload(51, "u")),
+		filterTestLogline(8, "charging and awake"),
+		filterTestLogline(9, "PM: suspend entry 2016-06-25 13:24:09.000000000 UTC"),
+		filterTestLogline(10, "charging and suspended"),
+	}
+}
+
+// Tokens of the loglines that pass f.ApplyLogline
+func applyTokens(f *Filter) []int64 {
+	tokens := make([]int64, 0)
+	for _, logline := range filterTestLoglines() {
+		if f.ApplyLogline(logline) {
+			tokens = append(tokens, logline.LogcatToken)
+		}
+	}
+	return tokens
+}
+
+func TestFilterApply(t *testing.T) {
+	assert := assert.New(t)
+
+	// Defaults: unplugged and awake. Nothing is known to be awake before
+	// the first suspend exit.
+	f := New()
+	NewChargingStateFilter(f)
+	NewSleepFilter(f)
+	assert.Equal([]int64{6}, applyTokens(f))
+
+	assert.Equal(int64(10), f.Lines)
+	assert.Equal(int64(1), f.Passed)
+	stats := f.Stats()
+	assert.Equal(FilterStats{"charging", 10, 5}, stats[0])
+	assert.Equal(FilterStats{"sleep", 10, 3}, stats[1])
+
+	// Unparseable lines never pass
+	assert.False(f.Apply("garbage"))
+	assert.Equal(int64(10), f.Lines)
+}
+
+func TestFilterExclusive(t *testing.T) {
+	assert := assert.New(t)
+
+	f := New()
+	csf := NewChargingStateFilter(f)
+	csf.Exclusive = true
+	assert.Equal([]int64{2, 7}, applyTokens(f))
+
+	f = New()
+	sf := NewSleepFilter(f)
+	sf.Exclusive = true
+	assert.Equal([]int64{4, 6, 9}, applyTokens(f))
+}
+
+func TestFilterAlgebra(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		name     string
+		build    func(csf *ChargingStateFilter, sf *SleepFilter) LoglineFilter
+		expected []int64
+	}{
+		{"and", func(csf *ChargingStateFilter, sf *SleepFilter) LoglineFilter {
+			return And(csf.In(HEALTHD_CHARGE_STATE_CHARGING), sf.In(SUSPEND_STATE_SUSPENDED))
+		}, []int64{9, 10}},
+		{"or", func(csf *ChargingStateFilter, sf *SleepFilter) LoglineFilter {
+			return Or(csf.In(HEALTHD_CHARGE_STATE_CHARGING), sf.In(SUSPEND_STATE_SUSPENDED))
+		}, []int64{4, 5, 7, 8, 9, 10}},
+		{"not", func(csf *ChargingStateFilter, sf *SleepFilter) LoglineFilter {
+			return Not(csf.In(HEALTHD_CHARGE_STATE_UNKNOWN))
+		}, []int64{2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		{"while", func(csf *ChargingStateFilter, sf *SleepFilter) LoglineFilter {
+			return While(csf.In(HEALTHD_CHARGE_STATE_UNPLUGGED), sf.IsStateLine())
+		}, []int64{4, 6}},
+		{"state lines", func(csf *ChargingStateFilter, sf *SleepFilter) LoglineFilter {
+			return Or(csf.IsStateLine(), sf.IsStateLine())
+		}, []int64{2, 4, 6, 7, 9}},
+	}
+	for _, test := range tests {
+		f := New()
+		// Track state only
+		csf := NewChargingStateFilter(f)
+		csf.FilterState = HEALTHD_CHARGE_STATE_ALL
+		sf := NewSleepFilter(f)
+		sf.FilterState = SUSPEND_STATE_ALL
+		f.AddNamedFilter(test.name, test.build(csf, sf))
+		assert.Equal(test.expected, applyTokens(f), test.name)
+	}
+}
+
+func TestTrackerOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	var _ Tracker = &CpuTracker{}
+	var _ Tracker = &DayFilter{}
+	var _ Tracker = &PeriodicCtxSwitchInfoTracker{}
+
+	// A filter that drops every logline does not keep trackers added after
+	// it from seeing them
+	f := New()
+	f.AddNamedFilter("never", func(logline *cpuprof.Logline) bool {
+		return false
+	})
+	csf := NewChargingStateFilter(f)
+	sf := NewSleepFilter(f)
+	assert.Equal([]int64{}, applyTokens(f))
+	assert.Equal(HEALTHD_CHARGE_STATE_CHARGING, csf.CurrentState)
+	assert.Equal(SUSPEND_STATE_SUSPENDED, sf.CurrentState)
+
+	// Filters over tracker state give the same result whichever is added first
+	f = New()
+	csf = NewChargingStateFilter(f)
+	csf.FilterState = HEALTHD_CHARGE_STATE_ALL
+	sf = NewSleepFilter(f)
+	sf.FilterState = SUSPEND_STATE_ALL
+	f.AddFilter(sf.In(SUSPEND_STATE_AWAKE))
+	f.AddFilter(csf.In(HEALTHD_CHARGE_STATE_UNPLUGGED))
+	expected := applyTokens(f)
+	assert.Equal([]int64{6}, expected)
+
+	f = New()
+	sf = NewSleepFilter(f)
+	sf.FilterState = SUSPEND_STATE_ALL
+	f.AddFilter(sf.In(SUSPEND_STATE_AWAKE))
+	csf = NewChargingStateFilter(f)
+	csf.FilterState = HEALTHD_CHARGE_STATE_ALL
+	f.AddFilter(csf.In(HEALTHD_CHARGE_STATE_UNPLUGGED))
+	assert.Equal(expected, applyTokens(f))
+}
@@ -3,6 +3,7 @@ package filters
 import (
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/gurupras/go_cpuprof"
@@ -32,78 +33,197 @@ type CpuTracker struct {
 	*Filter
 	Exclusive    bool
 	CurrentState map[int]*CpuTrackerData
-	Callback     func(trace cpuprof.TraceInterface, cpu int)
 	FilterFunc   LoglineFilter
+	// Keep the closed intervals for FrequencyIntervals and CpuStateIntervals.
+	// Off by default: a long boot has one for every cpu_frequency logline.
+	// The time spent at each frequency and state is summed either way.
+	RecordIntervals bool
+	// Last cpu_frequency or sched_cpu_hotplug logline
+	lastStateLogline   *cpuprof.Logline
+	frequencyIntervals map[int]*intervalRecorder
+	cpuStateIntervals  map[int]*intervalRecorder
 }
 
 func NewCpuTracker(filter *Filter) (cpuTracker *CpuTracker) {
 	cpuTracker = new(CpuTracker)
 	cpuTracker.Filter = filter
 	cpuTracker.CurrentState = make(map[int]*CpuTrackerData)
-	cpuTracker.Callback = nil
-
-	filterFunc := func(logline *cpuprof.Logline) bool {
-		if strings.Contains(logline.Line, "cpu_frequency:") || strings.Contains(logline.Line, "sched_cpu_hotplug:") {
-			trace := cpuprof.ParseTraceFromLoglinePayload(logline)
-			if trace == nil {
-				fmt.Fprintln(os.Stderr, fmt.Sprintf("Trace is nil: %v", logline.Line))
-				return true
-			}
-
-			var cpu int
-			var ctd *CpuTrackerData
-			switch trace.Tag() {
-			case "cpu_frequency":
-				cf := trace.(*cpuprof.CpuFrequency)
-				cpu = cf.CpuId
-				if _, ok := cpuTracker.CurrentState[cpu]; !ok {
-					cpuTracker.CurrentState[cpu] = new(CpuTrackerData)
-					cpuTracker.CurrentState[cpu].Cpu = cpu
-					cpuTracker.CurrentState[cpu].CpuState = CPU_STATE_UNKNOWN
-					cpuTracker.CurrentState[cpu].Frequency = FREQUENCY_STATE_UNKNOWN
-				}
-
-				cf.Trace.Logline = logline
-				if cpuTracker.Callback != nil {
-					cpuTracker.Callback(trace, cpu)
-				}
-
-				ctd = cpuTracker.CurrentState[cpu]
-				if ctd.CpuState != CPU_ONLINE {
-					// This CPU is clearly up
-					ctd.CpuStateLogline = logline
-					ctd.CpuState = CPU_ONLINE
-				}
-
-				ctd.Frequency = cf.State
-				ctd.FrequencyLogline = logline
-			case "sched_cpu_hotplug":
-				sch := trace.(*cpuprof.SchedCpuHotplug)
-				cpu = sch.Cpu
-				if _, ok := cpuTracker.CurrentState[cpu]; !ok {
-					cpuTracker.CurrentState[cpu] = new(CpuTrackerData)
-					cpuTracker.CurrentState[cpu].Cpu = cpu
-					cpuTracker.CurrentState[cpu].CpuState = CPU_STATE_UNKNOWN
-					cpuTracker.CurrentState[cpu].Frequency = FREQUENCY_STATE_UNKNOWN
-				}
-				sch.Trace.Logline = logline
-				if cpuTracker.Callback != nil {
-					cpuTracker.Callback(trace, cpu)
-				}
-				ctd = cpuTracker.CurrentState[cpu]
-				if strings.Compare(sch.State, "offline") == 0 && sch.Error == 0 {
-					// This core just went offline
-					ctd.CpuState = CPU_OFFLINE
-					ctd.CpuStateLogline = logline
-				} else if strings.Compare(sch.State, "online") == 0 && sch.Error == 0 {
-					ctd.CpuState = CPU_ONLINE
-					ctd.CpuStateLogline = logline
-				}
-			}
-		}
-		return true
+	cpuTracker.frequencyIntervals = make(map[int]*intervalRecorder)
+	cpuTracker.cpuStateIntervals = make(map[int]*intervalRecorder)
+
+	// CPU state does not restrict which lines pass
+	cpuTracker.FilterFunc = func(logline *cpuprof.Logline) bool {
+		return stateResult(cpuTracker.Exclusive, logline == cpuTracker.lastStateLogline, true)
 	}
-	cpuTracker.FilterFunc = filterFunc
-	filter.AddFilter(filterFunc)
+	filter.AddTracker(cpuTracker)
+	filter.AddNamedFilter("cpu", cpuTracker.FilterFunc)
 	return cpuTracker
 }
+
+func (cpuTracker *CpuTracker) data(cpu int) *CpuTrackerData {
+	if _, ok := cpuTracker.CurrentState[cpu]; !ok {
+		cpuTracker.CurrentState[cpu] = new(CpuTrackerData)
+		cpuTracker.CurrentState[cpu].Cpu = cpu
+		cpuTracker.CurrentState[cpu].CpuState = CPU_STATE_UNKNOWN
+		cpuTracker.CurrentState[cpu].Frequency = FREQUENCY_STATE_UNKNOWN
+		cpuTracker.frequencyIntervals[cpu] = newIntervalRecorder(&cpuTracker.RecordIntervals)
+		cpuTracker.cpuStateIntervals[cpu] = newIntervalRecorder(&cpuTracker.RecordIntervals)
+	}
+	return cpuTracker.CurrentState[cpu]
+}
+
+func (cpuTracker *CpuTracker) Update(logline *cpuprof.Logline) {
+	if !strings.Contains(logline.Line, "cpu_frequency:") && !strings.Contains(logline.Line, "sched_cpu_hotplug:") {
+		return
+	}
+	trace := cpuprof.ParseTraceFromLoglinePayload(logline)
+	if trace == nil {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Trace is nil: %v", logline.Line))
+		return
+	}
+	cpuTracker.lastStateLogline = logline
+
+	var ctd *CpuTrackerData
+	switch trace.Tag() {
+	case "cpu_frequency":
+		cf := trace.(*cpuprof.CpuFrequency)
+		ctd = cpuTracker.data(cf.CpuId)
+
+		cf.Trace.Logline = logline
+		event := &FrequencyChanged{eventSource{logline}, cf.CpuId, ctd.Frequency, ctd.FrequencyLogline, cf.State}
+
+		if ctd.CpuState != CPU_ONLINE {
+			// This CPU is clearly up
+			ctd.CpuStateLogline = logline
+			ctd.CpuState = CPU_ONLINE
+		}
+
+		ctd.Frequency = cf.State
+		ctd.FrequencyLogline = logline
+		cpuTracker.cpuStateIntervals[cf.CpuId].change(int(CPU_ONLINE), logline)
+		cpuTracker.frequencyIntervals[cf.CpuId].change(cf.State, logline)
+		cpuTracker.Bus.Publish(event)
+	case "sched_cpu_hotplug":
+		sch := trace.(*cpuprof.SchedCpuHotplug)
+		ctd = cpuTracker.data(sch.Cpu)
+		sch.Trace.Logline = logline
+		oldState := ctd.CpuState
+		if strings.Compare(sch.State, "offline") == 0 && sch.Error == 0 {
+			// This core just went offline
+			ctd.CpuState = CPU_OFFLINE
+			ctd.CpuStateLogline = logline
+			cpuTracker.cpuStateIntervals[sch.Cpu].change(int(CPU_OFFLINE), logline)
+			cpuTracker.frequencyIntervals[sch.Cpu].stop(logline)
+		} else if strings.Compare(sch.State, "online") == 0 && sch.Error == 0 {
+			ctd.CpuState = CPU_ONLINE
+			ctd.CpuStateLogline = logline
+			cpuTracker.cpuStateIntervals[sch.Cpu].change(int(CPU_ONLINE), logline)
+		}
+		cpuTracker.Bus.Publish(&CpuHotplugged{eventSource{logline}, sch.Cpu, oldState, ctd.CpuState, sch.Error})
+	}
+}
+
+// FrequencyIntervals returns the closed intervals cpu spent at each frequency,
+// if RecordIntervals is set. An interval starts at a cpu_frequency logline and
+// ends at the next one or when the CPU goes offline.
+func (cpuTracker *CpuTracker) FrequencyIntervals(cpu int) Intervals {
+	if r, ok := cpuTracker.frequencyIntervals[cpu]; ok {
+		return r.intervals
+	}
+	return make(Intervals, 0)
+}
+
+// CpuStateIntervals returns the closed intervals cpu spent online and
+// offline, if RecordIntervals is set
+func (cpuTracker *CpuTracker) CpuStateIntervals(cpu int) Intervals {
+	if r, ok := cpuTracker.cpuStateIntervals[cpu]; ok {
+		return r.intervals
+	}
+	return make(Intervals, 0)
+}
+
+// FrequencyResidency returns the time cpu spent at each frequency in the
+// closed intervals so far
+func (cpuTracker *CpuTracker) FrequencyResidency(cpu int) map[int]float64 {
+	if r, ok := cpuTracker.frequencyIntervals[cpu]; ok {
+		return r.durations
+	}
+	return make(map[int]float64)
+}
+
+// CpuStateResidency returns the time cpu spent online and offline in the
+// closed intervals so far
+func (cpuTracker *CpuTracker) CpuStateResidency(cpu int) map[int]float64 {
+	if r, ok := cpuTracker.cpuStateIntervals[cpu]; ok {
+		return r.durations
+	}
+	return make(map[int]float64)
+}
+
+// ObservedFrequencies returns the frequencies every CPU has been seen at, for
+// cpuprof.InferTopology
+func (cpuTracker *CpuTracker) ObservedFrequencies() map[int][]int {
+	frequencies := make(map[int][]int)
+	for cpu, ctd := range cpuTracker.CurrentState {
+		seen := make(map[int]bool)
+		for frequency := range cpuTracker.FrequencyResidency(cpu) {
+			seen[frequency] = true
+		}
+		if ctd.Frequency != FREQUENCY_STATE_UNKNOWN {
+			seen[ctd.Frequency] = true
+		}
+		frequencies[cpu] = make([]int, 0, len(seen))
+		for frequency := range seen {
+			frequencies[cpu] = append(frequencies[cpu], frequency)
+		}
+		sort.Ints(frequencies[cpu])
+	}
+	return frequencies
+}
+
+// ClusterResidency returns the time the cores of cluster spent at each
+// frequency, summed over the cores
+func (cpuTracker *CpuTracker) ClusterResidency(cluster *cpuprof.Cluster) map[int]float64 {
+	residency := make(map[int]float64)
+	for _, cpu := range cluster.Cpus {
+		for frequency, duration := range cpuTracker.FrequencyResidency(cpu) {
+			residency[frequency] += duration
+		}
+	}
+	return residency
+}
+
+// CapacityTime returns the seconds of work at the capacity of the fastest
+// core of topology that the closed frequency intervals of every CPU add up
+// to. Divided by the time they cover and topology.TotalCapacity(), this is
+// the capacity-weighted utilization of the CPUs.
+func (cpuTracker *CpuTracker) CapacityTime(topology *cpuprof.Topology) float64 {
+	total := 0.0
+	for cpu := range cpuTracker.CurrentState {
+		for frequency, duration := range cpuTracker.FrequencyResidency(cpu) {
+			total += topology.Capacity(cpu, frequency) * duration
+		}
+	}
+	return total
+}
+
+func (cpuTracker *CpuTracker) Split(logline *cpuprof.Logline) {
+	for cpu := range cpuTracker.CurrentState {
+		cpuTracker.frequencyIntervals[cpu].split(logline)
+		cpuTracker.cpuStateIntervals[cpu].split(logline)
+	}
+}
+
+func (cpuTracker *CpuTracker) DropIntervals(before float64) {
+	for cpu := range cpuTracker.CurrentState {
+		cpuTracker.frequencyIntervals[cpu].drop(before)
+		cpuTracker.cpuStateIntervals[cpu].drop(before)
+	}
+}
+
+func (cpuTracker *CpuTracker) Finish(last *cpuprof.Logline) {
+	for cpu := range cpuTracker.CurrentState {
+		cpuTracker.frequencyIntervals[cpu].stop(last)
+		cpuTracker.cpuStateIntervals[cpu].stop(last)
+	}
+}
@@ -0,0 +1,41 @@
+package filters
+
+import (
+	"testing"
+
+	"github.com/gurupras/go_cpuprof"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCpuTrackerTopology(t *testing.T) {
+	assert := assert.New(t)
+
+	f := New()
+	cpuTracker := NewCpuTracker(f)
+	for _, logline := range []*cpuprof.Logline{
+		traceTestLogline(1, "cpu_frequency: state=400000 cpu_id=0"),
+		traceTestLogline(1, "cpu_frequency: state=400000 cpu_id=1"),
+		traceTestLogline(1, "cpu_frequency: state=800000 cpu_id=2"),
+		traceTestLogline(3, "cpu_frequency: state=800000 cpu_id=0"),
+		traceTestLogline(3, "cpu_frequency: state=800000 cpu_id=1"),
+		traceTestLogline(5, "cpu_frequency: state=1600000 cpu_id=2"),
+		traceTestLogline(6, "sched_cpu_hotplug: cpu 1 offline error=0"),
+		traceTestLogline(11, "cpu_frequency: state=400000 cpu_id=0"),
+	} {
+		f.ApplyLogline(logline)
+	}
+	f.Finish()
+
+	assert.Equal(map[int][]int{0: {400000, 800000}, 1: {400000, 800000}, 2: {800000, 1600000}}, cpuTracker.ObservedFrequencies())
+	topology := cpuprof.InferTopology(cpuTracker.ObservedFrequencies())
+	assert.Equal(2, len(topology.Clusters))
+	little := topology.Clusters[0]
+	assert.Equal([]int{0, 1}, little.Cpus)
+	assert.Equal(map[int]float64{400000: 4, 800000: 11}, cpuTracker.ClusterResidency(little))
+	assert.Equal(map[int]float64{800000: 4, 1600000: 6}, cpuTracker.ClusterResidency(topology.Clusters[1]))
+
+	// Little cores run at most at half the capacity of the big core
+	little.Capacity = 0.5
+	expected := (0.125*4 + 0.25*11) + (0.5*4 + 1.0*6)
+	assert.InDelta(expected, cpuTracker.CapacityTime(topology), 1e-9)
+}
@@ -0,0 +1,203 @@
+package filters
+
+import (
+	"sort"
+
+	"github.com/gurupras/go_cpuprof"
+)
+
+// Interval is a closed period during which a tracker's state did not change.
+// Start and End are TraceTimes. The kernel clock stops while the phone is
+// suspended, so use the wall times of StartLogline and EndLogline for how long
+// the phone was suspended.
+type Interval struct {
+	State        int
+	Start        float64
+	End          float64
+	StartLogline *cpuprof.Logline
+	EndLogline   *cpuprof.Logline
+}
+
+func (i *Interval) Duration() float64 {
+	return i.End - i.Start
+}
+
+// Intervals sorts by Start
+type Intervals []*Interval
+
+func (ivs Intervals) Len() int {
+	return len(ivs)
+}
+
+func (ivs Intervals) Less(i, j int) bool {
+	return ivs[i].Start < ivs[j].Start
+}
+
+func (ivs Intervals) Swap(i, j int) {
+	ivs[i], ivs[j] = ivs[j], ivs[i]
+}
+
+func (ivs Intervals) sorted() Intervals {
+	result := make(Intervals, len(ivs))
+	copy(result, ivs)
+	sort.Stable(result)
+	return result
+}
+
+// Select returns the intervals in any of states
+func (ivs Intervals) Select(states ...int) Intervals {
+	result := make(Intervals, 0)
+	for _, iv := range ivs {
+		for _, state := range states {
+			if iv.State == state {
+				result = append(result, iv)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// Union returns the time covered by either ivs or other as sorted, disjoint
+// intervals. Intervals that overlap or touch are merged and keep the State of
+// the one that started first, so Union is meant for combining masks.
+func (ivs Intervals) Union(other Intervals) Intervals {
+	all := append(append(make(Intervals, 0, len(ivs)+len(other)), ivs...), other...)
+	result := make(Intervals, 0)
+	var current *Interval
+	for _, iv := range all.sorted() {
+		if current != nil && iv.Start <= current.End {
+			if iv.End > current.End {
+				current.End = iv.End
+				current.EndLogline = iv.EndLogline
+			}
+			continue
+		}
+		current = &Interval{iv.State, iv.Start, iv.End, iv.StartLogline, iv.EndLogline}
+		result = append(result, current)
+	}
+	return result
+}
+
+// Intersect returns the parts of ivs that overlap other, keeping the State of
+// ivs. This restricts one tracker's intervals to the times another tracker's
+// intervals cover, for example frequency intervals to foreground intervals.
+func (ivs Intervals) Intersect(other Intervals) Intervals {
+	mask := other.Union(nil)
+	result := make(Intervals, 0)
+	for _, iv := range ivs.sorted() {
+		// First mask interval that ends after iv starts
+		idx := sort.Search(len(mask), func(i int) bool {
+			return mask[i].End > iv.Start
+		})
+		for ; idx < len(mask) && mask[idx].Start < iv.End; idx++ {
+			m := mask[idx]
+			clipped := &Interval{iv.State, iv.Start, iv.End, iv.StartLogline, iv.EndLogline}
+			if m.Start > clipped.Start {
+				clipped.Start = m.Start
+				clipped.StartLogline = m.StartLogline
+			}
+			if m.End < clipped.End {
+				clipped.End = m.End
+				clipped.EndLogline = m.EndLogline
+			}
+			result = append(result, clipped)
+		}
+	}
+	return result
+}
+
+func (ivs Intervals) Duration() float64 {
+	duration := 0.0
+	for _, iv := range ivs {
+		duration += iv.Duration()
+	}
+	return duration
+}
+
+func (ivs Intervals) DurationByState() map[int]float64 {
+	durations := make(map[int]float64)
+	for _, iv := range ivs {
+		durations[iv.State] += iv.Duration()
+	}
+	return durations
+}
+
+// Mean returns the mean State of ivs weighted by duration, or 0 if ivs cover
+// no time. This is, for example, the average frequency of frequency intervals.
+func (ivs Intervals) Mean() float64 {
+	total := 0.0
+	duration := 0.0
+	for _, iv := range ivs {
+		total += float64(iv.State) * iv.Duration()
+		duration += iv.Duration()
+	}
+	if duration == 0 {
+		return 0
+	}
+	return total / duration
+}
+
+// intervalRecorder closes the current interval whenever a tracker's state
+// changes. It sums the time spent in every state; the closed intervals
+// themselves are only kept if the tracker's RecordIntervals is set.
+type intervalRecorder struct {
+	record    *bool
+	current   *Interval
+	intervals Intervals
+	durations map[int]float64
+}
+
+func newIntervalRecorder(record *bool) *intervalRecorder {
+	r := new(intervalRecorder)
+	r.record = record
+	r.intervals = make(Intervals, 0)
+	r.durations = make(map[int]float64)
+	return r
+}
+
+// change starts an interval in state at logline, closing the current one if
+// it is in a different state
+func (r *intervalRecorder) change(state int, logline *cpuprof.Logline) {
+	if r.current != nil && r.current.State == state {
+		return
+	}
+	r.stop(logline)
+	r.current = &Interval{State: state, Start: logline.TraceTime, StartLogline: logline}
+}
+
+// stop closes the current interval at logline
+func (r *intervalRecorder) stop(logline *cpuprof.Logline) {
+	if r.current == nil {
+		return
+	}
+	r.current.End = logline.TraceTime
+	r.current.EndLogline = logline
+	r.durations[r.current.State] += r.current.Duration()
+	if *r.record {
+		r.intervals = append(r.intervals, r.current)
+	}
+	r.current = nil
+}
+
+// split closes the current interval at logline and opens another in the same
+// state there
+func (r *intervalRecorder) split(logline *cpuprof.Logline) {
+	if r.current == nil {
+		return
+	}
+	state := r.current.State
+	r.stop(logline)
+	r.current = &Interval{State: state, Start: logline.TraceTime, StartLogline: logline}
+}
+
+// drop forgets the closed intervals that ended at or before before
+func (r *intervalRecorder) drop(before float64) {
+	idx := 0
+	for idx < len(r.intervals) && r.intervals[idx].End <= before {
+		idx++
+	}
+	if idx > 0 {
+		r.intervals = append(make(Intervals, 0, len(r.intervals)-idx), r.intervals[idx:]...)
+	}
+}
@@ -0,0 +1,126 @@
+package filters
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// State, start and end of each interval
+func intervalSpans(ivs Intervals) [][3]float64 {
+	spans := make([][3]float64, 0)
+	for _, iv := range ivs {
+		spans = append(spans, [3]float64{float64(iv.State), iv.Start, iv.End})
+	}
+	return spans
+}
+
+func TestTrackerIntervals(t *testing.T) {
+	assert := assert.New(t)
+
+	f := New()
+	csf := NewChargingStateFilter(f)
+	csf.RecordIntervals = true
+	sf := NewSleepFilter(f)
+	sf.RecordIntervals = true
+	applyTokens(f)
+
+	// The current state stays open until Finish
+	unplugged, charging := float64(HEALTHD_CHARGE_STATE_UNPLUGGED), float64(HEALTHD_CHARGE_STATE_CHARGING)
+	assert.Equal([][3]float64{{unplugged, 2, 7}}, intervalSpans(csf.Intervals()))
+	f.Finish()
+	assert.Equal([][3]float64{{unplugged, 2, 7}, {charging, 7, 10}}, intervalSpans(csf.Intervals()))
+
+	suspended, awake := float64(SUSPEND_STATE_SUSPENDED), float64(SUSPEND_STATE_AWAKE)
+	assert.Equal([][3]float64{{suspended, 4, 6}, {awake, 6, 9}, {suspended, 9, 10}}, intervalSpans(sf.Intervals()))
+	assert.Equal(int64(4), sf.Intervals()[0].StartLogline.LogcatToken)
+	assert.Equal(int64(6), sf.Intervals()[0].EndLogline.LogcatToken)
+
+	payloads := []string{
+		"cpu_frequency: state=300000 cpu_id=1",
+		"cpu_frequency: state=300000 cpu_id=1",
+		"cpu_frequency: state=1728000 cpu_id=1",
+		"sched_cpu_hotplug: cpu 1 offline error=0",
+		"sched_cpu_hotplug: cpu 1 online error=0",
+		"cpu_frequency: state=300000 cpu_id=1",
+		"cpu_frequency: state=300000 cpu_id=0",
+	}
+	newCpuTracker := func(record bool) *CpuTracker {
+		f := New()
+		cpuTracker := NewCpuTracker(f)
+		cpuTracker.RecordIntervals = record
+		for idx, payload := range payloads {
+			f.ApplyLogline(traceTestLogline(idx+1, payload))
+		}
+		f.Finish()
+		return cpuTracker
+	}
+
+	cpuTracker := newCpuTracker(true)
+	assert.Equal([][3]float64{{300000, 1, 3}, {1728000, 3, 4}, {300000, 6, 7}}, intervalSpans(cpuTracker.FrequencyIntervals(1)))
+	online, offline := float64(CPU_ONLINE), float64(CPU_OFFLINE)
+	assert.Equal([][3]float64{{online, 1, 4}, {offline, 4, 5}, {online, 5, 7}}, intervalSpans(cpuTracker.CpuStateIntervals(1)))
+	assert.Equal(0, len(cpuTracker.FrequencyIntervals(2)))
+
+	// Without RecordIntervals only the time in each state is kept
+	cpuTracker = newCpuTracker(false)
+	assert.Equal(0, len(cpuTracker.FrequencyIntervals(1)))
+	assert.Equal(0, len(cpuTracker.CpuStateIntervals(1)))
+	assert.Equal(map[int]float64{300000: 3, 1728000: 1}, cpuTracker.FrequencyResidency(1))
+	assert.Equal(map[int]float64{int(CPU_ONLINE): 5, int(CPU_OFFLINE): 1}, cpuTracker.CpuStateResidency(1))
+}
+
+func TestIntervalAlgebra(t *testing.T) {
+	assert := assert.New(t)
+
+	iv := func(state int, start float64, end float64) *Interval {
+		return &Interval{State: state, Start: start, End: end}
+	}
+	frequencies := Intervals{iv(300, 0, 10), iv(1200, 10, 15), iv(300, 15, 30)}
+	foreground := Intervals{iv(1, 5, 12), iv(2, 12, 20), iv(1, 20, 40)}
+	unplugged := Intervals{iv(4, 0, 25)}
+
+	// Frequency residency while foreground and unplugged
+	residency := frequencies.Intersect(foreground.Select(1)).Intersect(unplugged)
+	assert.Equal([][3]float64{{300, 5, 10}, {1200, 10, 12}, {300, 20, 25}}, intervalSpans(residency))
+	assert.Equal(map[int]float64{300: 10, 1200: 2}, residency.DurationByState())
+	assert.Equal(12.0, residency.Duration())
+	assert.Equal(450.0, residency.Mean())
+	assert.Equal(0.0, Intervals{}.Mean())
+
+	// Overlapping and touching intervals merge, in any order
+	union := Intervals{iv(1, 20, 25), iv(1, 0, 5), iv(2, 3, 8), iv(1, 8, 10)}.Union(Intervals{iv(3, 30, 35)})
+	assert.Equal([][3]float64{{1, 0, 10}, {1, 20, 25}, {3, 30, 35}}, intervalSpans(union))
+
+	// Intersecting with overlapping intervals does not count time twice
+	assert.Equal(10.0, frequencies.Intersect(Intervals{iv(0, 0, 8), iv(0, 5, 10)}).Duration())
+	assert.Equal(0, len(frequencies.Intersect(Intervals{iv(0, 40, 50)})))
+}
+
+func TestTrackerSplit(t *testing.T) {
+	assert := assert.New(t)
+
+	f := New()
+	cpuTracker := NewCpuTracker(f)
+	cpuTracker.RecordIntervals = true
+	for idx, payload := range []string{
+		"cpu_frequency: state=300000 cpu_id=1",
+		"cpu_frequency: state=1728000 cpu_id=1",
+		"cpu_frequency: state=1728000 cpu_id=1",
+		"cpu_frequency: state=300000 cpu_id=1",
+	} {
+		f.ApplyLogline(traceTestLogline(idx+1, payload))
+		if idx == 2 {
+			// The interval open at 3 is read up to 3
+			f.Split()
+			assert.Equal([][3]float64{{300000, 1, 2}, {1728000, 2, 3}}, intervalSpans(cpuTracker.FrequencyIntervals(1)))
+			f.DropIntervals(2)
+			assert.Equal([][3]float64{{1728000, 2, 3}}, intervalSpans(cpuTracker.FrequencyIntervals(1)))
+			f.DropIntervals(3)
+		}
+	}
+	f.Finish()
+	assert.Equal([][3]float64{{1728000, 3, 4}, {300000, 4, 4}}, intervalSpans(cpuTracker.FrequencyIntervals(1)))
+	// Splitting does not change the time in each state
+	assert.Equal(map[int]float64{300000: 1, 1728000: 2}, cpuTracker.FrequencyResidency(1))
+}
@@ -3,71 +3,170 @@ package filters
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/gurupras/go_cpuprof"
 )
 
+// CtxSwitchCompleteness counts the windows a PeriodicCtxSwitchInfoTracker
+// emitted by the problems found in them
+type CtxSwitchCompleteness struct {
+	Windows int64
+	// Windows without any flags
+	Valid         int64
+	Incomplete    int64
+	CountMismatch int64
+	Merged        int64
+	LogIdxGap     int64
+	CpuMismatch   int64
+	// Windows skipped between consecutive windows of a CPU, by log_idx
+	MissedWindows int64
+	// Info lines and END markers seen outside a window
+	OrphanLines int64
+}
+
+func (c *CtxSwitchCompleteness) Add(other *CtxSwitchCompleteness) {
+	c.Windows += other.Windows
+	c.Valid += other.Valid
+	c.Incomplete += other.Incomplete
+	c.CountMismatch += other.CountMismatch
+	c.Merged += other.Merged
+	c.LogIdxGap += other.LogIdxGap
+	c.CpuMismatch += other.CpuMismatch
+	c.MissedWindows += other.MissedWindows
+	c.OrphanLines += other.OrphanLines
+}
+
+func (c *CtxSwitchCompleteness) count(flags cpuprof.CtxSwitchWindowFlags) {
+	c.Windows++
+	if flags == 0 {
+		c.Valid++
+	}
+	if flags&cpuprof.CTX_SWITCH_WINDOW_INCOMPLETE != 0 {
+		c.Incomplete++
+	}
+	if flags&cpuprof.CTX_SWITCH_WINDOW_COUNT_MISMATCH != 0 {
+		c.CountMismatch++
+	}
+	if flags&cpuprof.CTX_SWITCH_WINDOW_MERGED != 0 {
+		c.Merged++
+	}
+	if flags&cpuprof.CTX_SWITCH_WINDOW_LOG_IDX_GAP != 0 {
+		c.LogIdxGap++
+	}
+	if flags&cpuprof.CTX_SWITCH_WINDOW_CPU_MISMATCH != 0 {
+		c.CpuMismatch++
+	}
+}
+
+// PeriodicCtxSwitchInfoTracker assembles the info lines between a BEGIN and
+// an END marker of a CPU into a window and validates it. Every window is
+// published as a CtxSwitchInfoCollected event with its problems flagged.
 type PeriodicCtxSwitchInfoTracker struct {
 	*Filter
 	CtxSwitchInfo map[int]*cpuprof.PeriodicCtxSwitchInfo
-	Callback      func(ctxSwitchInfo *cpuprof.PeriodicCtxSwitchInfo)
-	FilterFunc    LoglineFilter
+	Completeness  CtxSwitchCompleteness
+	lastLogIdx    map[int]int64
 }
 
 func NewPeriodicCtxSwitchInfoTracker(filter *Filter) (pcsiTracker *PeriodicCtxSwitchInfoTracker) {
 	pcsiTracker = new(PeriodicCtxSwitchInfoTracker)
 	pcsiTracker.Filter = filter
 	pcsiTracker.CtxSwitchInfo = make(map[int]*cpuprof.PeriodicCtxSwitchInfo)
-	pcsiTracker.Callback = nil
+	pcsiTracker.lastLogIdx = make(map[int]int64)
 
-	filterFunc := func(logline *cpuprof.Logline) bool {
-		trace := cpuprof.ParseTraceFromLoglinePayload(logline)
-		if trace == nil {
-			fmt.Fprintln(os.Stderr, fmt.Sprintf("Trace is nil: %v", logline.Line))
-			return true
-		}
+	filter.AddTracker(pcsiTracker)
+	return pcsiTracker
+}
 
-		var cpu int
-		switch trace.Tag() {
-		case "phonelab_periodic_ctx_switch_marker":
-			ppcsm := trace.(*cpuprof.PhonelabPeriodicCtxSwitchMarker)
-			cpu = ppcsm.Cpu
-			switch ppcsm.State {
-			case cpuprof.PPCSMBegin:
-				if v, ok := pcsiTracker.CtxSwitchInfo[cpu]; v == nil || !ok {
-					pcsiTracker.CtxSwitchInfo[cpu] = new(cpuprof.PeriodicCtxSwitchInfo)
-					pcsiTracker.CtxSwitchInfo[cpu].Info = make([]*cpuprof.PhonelabPeriodicCtxSwitchInfo, 0)
-				} else if v != nil {
-					//fmt.Fprintln(os.Stderr, "Start logline when already started")
-					//fmt.Fprintln(os.Stderr, logline.Line)
-					//os.Exit(-1)
-					return true
-				}
-				pcsiTracker.CtxSwitchInfo[cpu].Start = ppcsm
-			case cpuprof.PPCSMEnd:
-				if v, ok := pcsiTracker.CtxSwitchInfo[cpu]; !ok || v == nil {
-					// End marker without begin..ignore
-					return true
-				}
-				pcsi := pcsiTracker.CtxSwitchInfo[cpu]
-				pcsi.End = ppcsm
-				if pcsiTracker.Callback != nil {
-					pcsiTracker.Callback(pcsi)
+func (pcsiTracker *PeriodicCtxSwitchInfoTracker) Update(logline *cpuprof.Logline) {
+	if !strings.Contains(logline.Line, "phonelab_periodic_ctx_switch") {
+		return
+	}
+	trace := cpuprof.ParseTraceFromLoglinePayload(logline)
+	if trace == nil {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Trace is nil: %v", logline.Line))
+		return
+	}
+
+	switch trace.Tag() {
+	case "phonelab_periodic_ctx_switch_marker":
+		ppcsm := trace.(*cpuprof.PhonelabPeriodicCtxSwitchMarker)
+		cpu := ppcsm.Cpu
+		pcsi := pcsiTracker.CtxSwitchInfo[cpu]
+		switch ppcsm.State {
+		case cpuprof.PPCSMBegin:
+			if pcsi != nil {
+				// The END marker of the open window was lost
+				pcsi.Flags |= cpuprof.CTX_SWITCH_WINDOW_INCOMPLETE
+				pcsiTracker.emit(cpu, pcsi, logline)
+			}
+			pcsi = new(cpuprof.PeriodicCtxSwitchInfo)
+			pcsi.Info = make([]*cpuprof.PhonelabPeriodicCtxSwitchInfo, 0)
+			pcsi.Start = ppcsm
+			if last, ok := pcsiTracker.lastLogIdx[cpu]; ok && ppcsm.LogIdx != last+1 {
+				pcsi.Flags |= cpuprof.CTX_SWITCH_WINDOW_LOG_IDX_GAP
+				if ppcsm.LogIdx > last {
+					pcsiTracker.Completeness.MissedWindows += ppcsm.LogIdx - last - 1
 				}
-				pcsiTracker.CtxSwitchInfo[cpu] = nil
 			}
-		case "phonelab_periodic_ctx_switch_info":
-			ppcsi := trace.(*cpuprof.PhonelabPeriodicCtxSwitchInfo)
-			cpu = ppcsi.Cpu
-			if v, ok := pcsiTracker.CtxSwitchInfo[cpu]; v == nil || !ok {
-				// Info line without begin marker.. ignore
-				return true
+			pcsiTracker.lastLogIdx[cpu] = ppcsm.LogIdx
+			checkCpu(pcsi, ppcsm.Trace, cpu)
+			pcsiTracker.CtxSwitchInfo[cpu] = pcsi
+		case cpuprof.PPCSMEnd:
+			if pcsi == nil {
+				// End marker without begin
+				pcsiTracker.Completeness.OrphanLines++
+				return
+			}
+			pcsi.End = ppcsm
+			if ppcsm.LogIdx != pcsi.Start.LogIdx {
+				pcsi.Flags |= cpuprof.CTX_SWITCH_WINDOW_MERGED
+			}
+			if ppcsm.Count != pcsi.Start.Count {
+				pcsi.Flags |= cpuprof.CTX_SWITCH_WINDOW_COUNT_MISMATCH
 			}
-			pcsiTracker.CtxSwitchInfo[cpu].Info = append(pcsiTracker.CtxSwitchInfo[cpu].Info, ppcsi)
+			checkCpu(pcsi, ppcsm.Trace, cpu)
+			pcsiTracker.emit(cpu, pcsi, logline)
+		}
+	case "phonelab_periodic_ctx_switch_info":
+		ppcsi := trace.(*cpuprof.PhonelabPeriodicCtxSwitchInfo)
+		pcsi := pcsiTracker.CtxSwitchInfo[ppcsi.Cpu]
+		if pcsi == nil {
+			// Info line without begin marker
+			pcsiTracker.Completeness.OrphanLines++
+			return
+		}
+		if ppcsi.LogIdx != pcsi.Start.LogIdx {
+			pcsi.Flags |= cpuprof.CTX_SWITCH_WINDOW_MERGED
+		}
+		checkCpu(pcsi, ppcsi.Trace, ppcsi.Cpu)
+		pcsi.Info = append(pcsi.Info, ppcsi)
+	}
+}
+
+// checkCpu flags pcsi if a line about cpu was logged on another CPU
+func checkCpu(pcsi *cpuprof.PeriodicCtxSwitchInfo, trace *cpuprof.Trace, cpu int) {
+	if trace.Cpu != cpu {
+		pcsi.Flags |= cpuprof.CTX_SWITCH_WINDOW_CPU_MISMATCH
+	}
+}
+
+func (pcsiTracker *PeriodicCtxSwitchInfoTracker) emit(cpu int, pcsi *cpuprof.PeriodicCtxSwitchInfo, logline *cpuprof.Logline) {
+	if len(pcsi.Info) != pcsi.Start.Count {
+		pcsi.Flags |= cpuprof.CTX_SWITCH_WINDOW_COUNT_MISMATCH
+	}
+	pcsiTracker.Completeness.count(pcsi.Flags)
+	pcsiTracker.CtxSwitchInfo[cpu] = nil
+	pcsiTracker.Bus.Publish(&CtxSwitchInfoCollected{eventSource{logline}, cpu, pcsi})
+}
+
+// Finish emits the windows that are still open as incomplete
+func (pcsiTracker *PeriodicCtxSwitchInfoTracker) Finish(last *cpuprof.Logline) {
+	for cpu, pcsi := range pcsiTracker.CtxSwitchInfo {
+		if pcsi != nil {
+			pcsi.Flags |= cpuprof.CTX_SWITCH_WINDOW_INCOMPLETE
+			pcsiTracker.emit(cpu, pcsi, last)
 		}
-		return true
 	}
-	pcsiTracker.FilterFunc = filterFunc
-	filter.AddFilter(filterFunc)
-	return pcsiTracker
 }
@@ -0,0 +1,100 @@
+package filters
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gurupras/go_cpuprof"
+	"github.com/stretchr/testify/assert"
+)
+
+// on is the CPU the line was logged on
+func ctxSwitchMarker(token int, on int, state string, cpu int, count int, log_idx int) *cpuprof.Logline {
+	return ctxSwitchLogline(token, on, fmt.Sprintf("phonelab_periodic_ctx_switch_marker: %s cpu=%d count=%d log_idx=%d", state, cpu, count, log_idx))
+}
+
+func ctxSwitchInfo(token int, on int, cpu int, pid int, log_idx int) *cpuprof.Logline {
+	return ctxSwitchLogline(token, on, fmt.Sprintf("phonelab_periodic_ctx_switch_info: cpu=%d pid=%d tgid=%d nice=0 comm=proc-%d utime=0 stime=0 rtime=1000 bg_utime=0 bg_stime=0 bg_rtime=0 s_run=0 s_int=1 s_unint=0 s_oth=0 log_idx=%d", cpu, pid, pid, pid, log_idx))
+}
+
+func ctxSwitchLogline(token int, on int, payload string) *cpuprof.Logline {
+	line := fmt.Sprintf("6890aa2f-9895-47bf-9c37-79a2e3a34703 2016-06-25 13:24:%02d.000000000 %d [   %d.000000]   200   200 D Kernel-Trace: kworker/%d:1-17 [00%d] ...2     %d.000000: %s", token, token, token, on, on, token, payload)
+	logline := cpuprof.ParseLogline(line)
+	if logline == nil {
+		panic("Failed to parse: " + line)
+	}
+	return logline
+}
+
+func TestPeriodicCtxSwitchInfoTracker(t *testing.T) {
+	assert := assert.New(t)
+
+	f := New()
+	tracker := NewPeriodicCtxSwitchInfoTracker(f)
+	windows := make([]*cpuprof.PeriodicCtxSwitchInfo, 0)
+	f.Bus.OnCtxSwitchInfoCollected(func(event *CtxSwitchInfoCollected) {
+		windows = append(windows, event.Info)
+	})
+
+	loglines := []*cpuprof.Logline{
+		// Valid
+		ctxSwitchMarker(1, 0, "BEGIN", 0, 2, 10),
+		ctxSwitchInfo(2, 0, 0, 100, 10),
+		ctxSwitchInfo(3, 0, 0, 101, 10),
+		ctxSwitchMarker(4, 0, "END", 0, 2, 10),
+		// One info line short
+		ctxSwitchMarker(5, 0, "BEGIN", 0, 2, 11),
+		ctxSwitchInfo(6, 0, 0, 100, 11),
+		ctxSwitchMarker(7, 0, "END", 0, 2, 11),
+		// Window 12 was lost and window 13 never ends
+		ctxSwitchMarker(8, 0, "BEGIN", 0, 1, 13),
+		ctxSwitchInfo(9, 0, 0, 100, 13),
+		// Holds a line of window 15
+		ctxSwitchMarker(10, 0, "BEGIN", 0, 1, 14),
+		ctxSwitchInfo(11, 0, 0, 100, 15),
+		ctxSwitchMarker(12, 0, "END", 0, 1, 15),
+		// CPU 1's window logged on CPU 0
+		ctxSwitchMarker(13, 1, "BEGIN", 1, 1, 10),
+		ctxSwitchInfo(14, 0, 1, 100, 10),
+		ctxSwitchMarker(15, 1, "END", 1, 1, 10),
+		// Outside a window
+		ctxSwitchInfo(16, 2, 2, 100, 10),
+		ctxSwitchMarker(17, 2, "END", 2, 1, 10),
+		// Open at the end
+		ctxSwitchMarker(18, 3, "BEGIN", 3, 1, 10),
+	}
+	for _, logline := range loglines {
+		f.ApplyLogline(logline)
+	}
+	f.Finish()
+
+	flags := make([]cpuprof.CtxSwitchWindowFlags, 0)
+	for _, w := range windows {
+		flags = append(flags, w.Flags)
+	}
+	assert.Equal([]cpuprof.CtxSwitchWindowFlags{
+		0,
+		cpuprof.CTX_SWITCH_WINDOW_COUNT_MISMATCH,
+		cpuprof.CTX_SWITCH_WINDOW_INCOMPLETE | cpuprof.CTX_SWITCH_WINDOW_LOG_IDX_GAP,
+		cpuprof.CTX_SWITCH_WINDOW_MERGED,
+		cpuprof.CTX_SWITCH_WINDOW_CPU_MISMATCH,
+		cpuprof.CTX_SWITCH_WINDOW_INCOMPLETE | cpuprof.CTX_SWITCH_WINDOW_COUNT_MISMATCH,
+	}, flags)
+	assert.True(windows[0].Complete())
+	assert.True(windows[1].Complete())
+	assert.False(windows[2].Complete())
+	assert.False(windows[3].Complete())
+	assert.Equal(2, len(windows[0].Info))
+
+	assert.Equal(CtxSwitchCompleteness{
+		Windows:       6,
+		Valid:         1,
+		Incomplete:    2,
+		CountMismatch: 2,
+		Merged:        1,
+		LogIdxGap:     1,
+		CpuMismatch:   1,
+		MissedWindows: 1,
+		OrphanLines:   2,
+	}, tracker.Completeness)
+}
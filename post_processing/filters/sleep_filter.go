@@ -14,18 +14,21 @@ const (
 	SUSPEND_STATE_UNKNOWN   SuspendState = 1 << iota
 	SUSPEND_STATE_SUSPENDED SuspendState = 1 << iota
 	SUSPEND_STATE_AWAKE     SuspendState = 1 << iota
+	SUSPEND_STATE_ALL       SuspendState = SUSPEND_STATE_UNKNOWN | SUSPEND_STATE_SUSPENDED | SUSPEND_STATE_AWAKE
 )
 
 type SleepFilter struct {
 	*Filter
-	Exclusive            bool
-	CurrentState         SuspendState
-	FilterState          SuspendState
-	lastSuspendEntry     *cpuprof.PowerManagementPrintk
-	SuspendEntryCallback func(pmp *cpuprof.PowerManagementPrintk)
-	SuspendExitCallback  func(pmp *cpuprof.PowerManagementPrintk)
-	FilterFunc           LineFilter
-	Log                  bool
+	Exclusive        bool
+	CurrentState     SuspendState
+	FilterState      SuspendState
+	lastSuspendEntry *cpuprof.PowerManagementPrintk
+	FilterFunc       LoglineFilter
+	Log              bool
+	lastStateLogline *cpuprof.Logline
+	// Keep the closed intervals for Intervals
+	RecordIntervals bool
+	intervals       *intervalRecorder
 }
 
 func NewSleepFilter(filter *Filter) (sleepFilter *SleepFilter) {
@@ -34,65 +37,90 @@ func NewSleepFilter(filter *Filter) (sleepFilter *SleepFilter) {
 	sleepFilter.CurrentState = SUSPEND_STATE_UNKNOWN
 	sleepFilter.FilterState = SUSPEND_STATE_AWAKE
 	sleepFilter.Exclusive = false
-	sleepFilter.SuspendEntryCallback = nil
-	sleepFilter.SuspendExitCallback = nil
 	sleepFilter.Log = false
+	sleepFilter.intervals = newIntervalRecorder(&sleepFilter.RecordIntervals)
 
-	filterFunc := func(logline *cpuprof.Logline) bool {
-		result := false
+	sleepFilter.FilterFunc = func(logline *cpuprof.Logline) bool {
+		return stateResult(sleepFilter.Exclusive, logline == sleepFilter.lastStateLogline, sleepFilter.CurrentState&sleepFilter.FilterState != 0)
+	}
+	filter.AddTracker(sleepFilter)
+	filter.AddNamedFilter("sleep", sleepFilter.FilterFunc)
+	return sleepFilter
+}
 
-		log := func(message string) {
-			if sleepFilter.Log {
-				fmt.Fprintln(os.Stderr, message)
-			}
+func (sleepFilter *SleepFilter) Update(logline *cpuprof.Logline) {
+	log := func(message string) {
+		if sleepFilter.Log {
+			fmt.Fprintln(os.Stderr, message)
 		}
+	}
 
-		if strings.Contains(logline.Line, "KernelPrintk") &&
-			(strings.Contains(logline.Line, "PM: suspend entry") ||
-				strings.Contains(logline.Line, "PM: suspend exit")) {
-
-			result = true
+	if !strings.Contains(logline.Line, "KernelPrintk") ||
+		!(strings.Contains(logline.Line, "PM: suspend entry") ||
+			strings.Contains(logline.Line, "PM: suspend exit")) {
+		return
+	}
+	sleepFilter.lastStateLogline = logline
 
-			pmp := cpuprof.ParsePowerManagementPrintk(logline)
+	pmp := cpuprof.ParsePowerManagementPrintk(logline)
 
-			if pmp == nil {
-				panic(fmt.Sprintf("Failed to parse: %v", logline.Line))
-			}
+	if pmp == nil {
+		panic(fmt.Sprintf("Failed to parse: %v", logline.Line))
+	}
 
-			switch pmp.State {
-			case cpuprof.PM_SUSPEND_ENTRY:
-				if sleepFilter.CurrentState == SUSPEND_STATE_SUSPENDED {
-					log("Suspend when suspended?")
-				}
-				sleepFilter.CurrentState = SUSPEND_STATE_SUSPENDED
-				if sleepFilter.SuspendEntryCallback != nil {
-					sleepFilter.SuspendEntryCallback(pmp)
-				}
-				sleepFilter.lastSuspendEntry = pmp
-			case cpuprof.PM_SUSPEND_EXIT:
-				if sleepFilter.CurrentState != SUSPEND_STATE_SUSPENDED {
-					log("Suspend exit when not suspended??")
-				} else {
-					if sleepFilter.lastSuspendEntry == nil {
-						log("Suspend exit when lastSuspendEntry is nil??")
-						os.Exit(-1)
-					}
-				}
-				sleepFilter.CurrentState = SUSPEND_STATE_AWAKE
-				if sleepFilter.SuspendExitCallback != nil {
-					sleepFilter.SuspendExitCallback(pmp)
-				}
-			}
+	switch pmp.State {
+	case cpuprof.PM_SUSPEND_ENTRY:
+		if sleepFilter.CurrentState == SUSPEND_STATE_SUSPENDED {
+			log("Suspend when suspended?")
 		}
-		if sleepFilter.Exclusive {
-			return result
+		sleepFilter.CurrentState = SUSPEND_STATE_SUSPENDED
+		sleepFilter.intervals.change(int(sleepFilter.CurrentState), logline)
+		sleepFilter.lastSuspendEntry = pmp
+		sleepFilter.Bus.Publish(&Suspended{eventSource{logline}, pmp})
+	case cpuprof.PM_SUSPEND_EXIT:
+		if sleepFilter.CurrentState != SUSPEND_STATE_SUSPENDED {
+			log("Suspend exit when not suspended??")
+		} else {
+			if sleepFilter.lastSuspendEntry == nil {
+				log("Suspend exit when lastSuspendEntry is nil??")
+				os.Exit(-1)
+			}
 		}
+		sleepFilter.CurrentState = SUSPEND_STATE_AWAKE
+		sleepFilter.intervals.change(int(sleepFilter.CurrentState), logline)
+		sleepFilter.Bus.Publish(&Resumed{eventSource{logline}, sleepFilter.lastSuspendEntry, pmp})
+		sleepFilter.lastSuspendEntry = nil
+	}
+}
 
-		if sleepFilter.CurrentState&sleepFilter.FilterState != 0 {
-			return true
-		}
-		return false
+// In passes loglines logged while the suspend state is one of states
+func (sleepFilter *SleepFilter) In(states SuspendState) LoglineFilter {
+	return func(logline *cpuprof.Logline) bool {
+		return sleepFilter.CurrentState&states != 0
 	}
-	filter.AddFilter(filterFunc)
-	return sleepFilter
+}
+
+// IsStateLine passes the suspend entry and exit loglines
+func (sleepFilter *SleepFilter) IsStateLine() LoglineFilter {
+	return func(logline *cpuprof.Logline) bool {
+		return logline == sleepFilter.lastStateLogline
+	}
+}
+
+// Intervals returns the closed intervals spent suspended and awake, starting
+// at the first suspend entry or exit
+func (sleepFilter *SleepFilter) Intervals() Intervals {
+	return sleepFilter.intervals.intervals
+}
+
+func (sleepFilter *SleepFilter) Split(logline *cpuprof.Logline) {
+	sleepFilter.intervals.split(logline)
+}
+
+func (sleepFilter *SleepFilter) DropIntervals(before float64) {
+	sleepFilter.intervals.drop(before)
+}
+
+func (sleepFilter *SleepFilter) Finish(last *cpuprof.Logline) {
+	sleepFilter.intervals.stop(last)
 }
@@ -0,0 +1,231 @@
+package filters
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gurupras/go_cpuprof"
+)
+
+type ThrottleCause int
+
+const (
+	// msm_thermal took a core offline
+	THROTTLE_HOTPLUG ThrottleCause = 1 << iota
+	// msm_thermal capped the frequency of a core
+	THROTTLE_FREQUENCY_CAP ThrottleCause = 1 << iota
+	// A sensor stayed at or above ThrottleTemp for SustainSec
+	THROTTLE_TEMPERATURE ThrottleCause = 1 << iota
+)
+
+// ThrottleEpisode is a period during which the phone was being throttled for
+// any of its Causes. Start and End are TraceTimes.
+type ThrottleEpisode struct {
+	Start        float64
+	End          float64
+	StartLogline *cpuprof.Logline
+	EndLogline   *cpuprof.Logline
+	Causes       ThrottleCause
+	// Highest temperature of every sensor seen during the episode
+	PeakTemp map[int]int
+	// Highest temperature msm_thermal reported, or TEMPERATURE_UNKNOWN
+	MsmThermalTemp int
+	// Cores msm_thermal took offline
+	OfflineCpus []int
+	// Lowest frequency msm_thermal limited each core to, in kHz
+	Ceiling map[int]int
+	// The process in the foreground at the start; nil if there was none
+	Foreground *cpuprof.PhonelabProcForeground
+}
+
+func (e *ThrottleEpisode) Duration() float64 {
+	return e.End - e.Start
+}
+
+// hotSensor is a sensor at or above ThrottleTemp since a logline
+type hotSensor struct {
+	Since      *cpuprof.Logline
+	Foreground *cpuprof.PhonelabProcForeground
+	Peak       int
+	// Whether the sensor has been hot for SustainSec
+	Sustained bool
+}
+
+// ThermalThrottleTracker finds the episodes during which the phone was
+// throttled, from the msm_thermal printks and sustained thermal_temp
+// readings. An episode lasts until every core msm_thermal took offline is
+// allowed back online, every frequency limit is lifted and no sensor is hot.
+type ThermalThrottleTracker struct {
+	*Filter
+	ThermalTracker *ThermalTracker
+	FgBgTracker    *FgBgTracker
+	// Degrees at which a sensor counts as hot
+	ThrottleTemp int
+	// Seconds a sensor has to stay hot for an episode
+	SustainSec float64
+	Episodes   []*ThrottleEpisode
+	current    *ThrottleEpisode
+	// Cores msm_thermal has taken offline and limited
+	offline    map[int]bool
+	caps       map[int]int
+	hot        map[int]*hotSensor
+	foreground *cpuprof.PhonelabProcForeground
+}
+
+func NewThermalThrottleTracker(filter *Filter, thermalTracker *ThermalTracker, fgbgTracker *FgBgTracker) (throttleTracker *ThermalThrottleTracker) {
+	throttleTracker = new(ThermalThrottleTracker)
+	throttleTracker.Filter = filter
+	throttleTracker.ThermalTracker = thermalTracker
+	throttleTracker.FgBgTracker = fgbgTracker
+	throttleTracker.ThrottleTemp = 60
+	throttleTracker.SustainSec = 5
+	throttleTracker.Episodes = make([]*ThrottleEpisode, 0)
+	throttleTracker.offline = make(map[int]bool)
+	throttleTracker.caps = make(map[int]int)
+	throttleTracker.hot = make(map[int]*hotSensor)
+
+	filter.Bus.OnForegroundChanged(func(event *ForegroundChanged) {
+		throttleTracker.foreground = event.Proc
+	})
+	filter.Bus.OnTemperatureChanged(func(event *TemperatureChanged) {
+		if throttleTracker.current != nil && event.Temp > throttleTracker.current.PeakTemp[event.Sensor] {
+			throttleTracker.current.PeakTemp[event.Sensor] = event.Temp
+		}
+		if event.Temp < throttleTracker.ThrottleTemp {
+			if hs, ok := throttleTracker.hot[event.Sensor]; ok {
+				// The sensor was hot up to this logline
+				throttleTracker.sustainSensor(event.Sensor, hs, event.Logline)
+				delete(throttleTracker.hot, event.Sensor)
+			}
+		} else if hs, ok := throttleTracker.hot[event.Sensor]; !ok {
+			throttleTracker.hot[event.Sensor] = &hotSensor{event.Logline, throttleTracker.foreground, event.Temp, false}
+		} else if event.Temp > hs.Peak {
+			hs.Peak = event.Temp
+		}
+	})
+	filter.AddTracker(throttleTracker)
+	return throttleTracker
+}
+
+// open starts an episode at logline if there is none
+func (throttleTracker *ThermalThrottleTracker) open(logline *cpuprof.Logline, foreground *cpuprof.PhonelabProcForeground) *ThrottleEpisode {
+	if throttleTracker.current == nil {
+		e := new(ThrottleEpisode)
+		e.Start = logline.TraceTime
+		e.StartLogline = logline
+		e.PeakTemp = make(map[int]int)
+		e.MsmThermalTemp = TEMPERATURE_UNKNOWN
+		e.OfflineCpus = make([]int, 0)
+		e.Ceiling = make(map[int]int)
+		e.Foreground = foreground
+		for sensor, ttd := range throttleTracker.ThermalTracker.CurrentState {
+			if ttd.Temp != TEMPERATURE_UNKNOWN {
+				e.PeakTemp[sensor] = ttd.Temp
+			}
+		}
+		throttleTracker.current = e
+	}
+	return throttleTracker.current
+}
+
+func (throttleTracker *ThermalThrottleTracker) close(logline *cpuprof.Logline) {
+	if throttleTracker.current == nil {
+		return
+	}
+	throttleTracker.current.End = logline.TraceTime
+	throttleTracker.current.EndLogline = logline
+	throttleTracker.Episodes = append(throttleTracker.Episodes, throttleTracker.current)
+	throttleTracker.current = nil
+}
+
+func (throttleTracker *ThermalThrottleTracker) msmThermal(logline *cpuprof.Logline) {
+	if mtp := cpuprof.ParseMsmThermalPrintk(logline); mtp != nil {
+		switch mtp.State {
+		case cpuprof.MSM_THERMAL_STATE_OFFLINE:
+			throttleTracker.offline[mtp.Cpu] = true
+			e := throttleTracker.open(logline, throttleTracker.foreground)
+			e.Causes |= THROTTLE_HOTPLUG
+			found := false
+			for _, cpu := range e.OfflineCpus {
+				found = found || cpu == mtp.Cpu
+			}
+			if !found {
+				e.OfflineCpus = append(e.OfflineCpus, mtp.Cpu)
+				sort.Ints(e.OfflineCpus)
+			}
+		case cpuprof.MSM_THERMAL_STATE_ONLINE:
+			delete(throttleTracker.offline, mtp.Cpu)
+		}
+		if e := throttleTracker.current; e != nil && mtp.Temp > e.MsmThermalTemp {
+			e.MsmThermalTemp = mtp.Temp
+		}
+	} else if mtflp := cpuprof.ParseMsmThermalFreqLimitPrintk(logline); mtflp != nil {
+		if mtflp.MaxFrequency >= cpuprof.MSM_THERMAL_NO_LIMIT {
+			delete(throttleTracker.caps, mtflp.Cpu)
+			return
+		}
+		frequency := int(mtflp.MaxFrequency)
+		throttleTracker.caps[mtflp.Cpu] = frequency
+		e := throttleTracker.open(logline, throttleTracker.foreground)
+		e.Causes |= THROTTLE_FREQUENCY_CAP
+		if ceiling, ok := e.Ceiling[mtflp.Cpu]; !ok || frequency < ceiling {
+			e.Ceiling[mtflp.Cpu] = frequency
+		}
+	} else {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Unknown msm_thermal printk: %v", logline.Line))
+	}
+}
+
+// sustainSensor starts or extends an episode if sensor has been hot for
+// SustainSec by logline. The episode goes back to when it became hot.
+func (throttleTracker *ThermalThrottleTracker) sustainSensor(sensor int, hs *hotSensor, logline *cpuprof.Logline) {
+	if hs.Sustained || logline.TraceTime-hs.Since.TraceTime < throttleTracker.SustainSec {
+		return
+	}
+	hs.Sustained = true
+	since := hs.Since
+	if n := len(throttleTracker.Episodes); n > 0 && throttleTracker.Episodes[n-1].End > since.TraceTime {
+		// Episodes do not overlap
+		since = throttleTracker.Episodes[n-1].EndLogline
+	}
+	e := throttleTracker.open(since, hs.Foreground)
+	if since.TraceTime < e.Start {
+		e.Start = since.TraceTime
+		e.StartLogline = since
+		e.Foreground = hs.Foreground
+	}
+	e.Causes |= THROTTLE_TEMPERATURE
+	if hs.Peak > e.PeakTemp[sensor] {
+		e.PeakTemp[sensor] = hs.Peak
+	}
+}
+
+func (throttleTracker *ThermalThrottleTracker) sustain(logline *cpuprof.Logline) {
+	for sensor, hs := range throttleTracker.hot {
+		throttleTracker.sustainSensor(sensor, hs, logline)
+	}
+}
+
+func (throttleTracker *ThermalThrottleTracker) Update(logline *cpuprof.Logline) {
+	if strings.Contains(logline.Line, "KernelPrintk") && strings.Contains(logline.Line, "msm_thermal:") {
+		throttleTracker.msmThermal(logline)
+	}
+	throttleTracker.sustain(logline)
+
+	if throttleTracker.current == nil || len(throttleTracker.offline) > 0 || len(throttleTracker.caps) > 0 {
+		return
+	}
+	for _, hs := range throttleTracker.hot {
+		if hs.Sustained {
+			return
+		}
+	}
+	throttleTracker.close(logline)
+}
+
+func (throttleTracker *ThermalThrottleTracker) Finish(last *cpuprof.Logline) {
+	throttleTracker.sustain(last)
+	throttleTracker.close(last)
+}
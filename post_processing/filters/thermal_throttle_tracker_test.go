@@ -0,0 +1,66 @@
+package filters
+
+import (
+	"testing"
+
+	"github.com/gurupras/go_cpuprof"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThermalThrottleTracker(t *testing.T) {
+	assert := assert.New(t)
+
+	f := New()
+	fgbgTracker := NewFgBgTracker(f)
+	thermalTracker := NewThermalTracker(f)
+	throttleTracker := NewThermalThrottleTracker(f, thermalTracker, fgbgTracker)
+
+	for _, logline := range []*cpuprof.Logline{
+		traceTestLogline(1, "thermal_temp: sensor_id=0 temp=50"),
+		traceTestLogline(2, "phonelab_proc_foreground: pid=100 tgid=100 comm=.android.dialer"),
+		traceTestLogline(3, "thermal_temp: sensor_id=7 temp=62"),
+		traceTestLogline(5, "thermal_temp: sensor_id=7 temp=65"),
+		filterTestLogline(6, "msm_thermal: Limiting cpu0 max frequency to 1728000"),
+		filterTestLogline(7, "msm_thermal: Set Offline: CPU3 Temp: 80"),
+		// Sensor 7 has been hot for SustainSec; the episode goes back to 3
+		traceTestLogline(8, "cpu_frequency: state=1728000 cpu_id=0"),
+		filterTestLogline(9, "msm_thermal: Limiting cpu0 max frequency to 1497600"),
+		traceTestLogline(10, "thermal_temp: sensor_id=7 temp=55"),
+		filterTestLogline(11, "msm_thermal: Allow Online CPU3 Temp: 66"),
+		filterTestLogline(12, "msm_thermal: Limiting cpu0 max frequency to 4294967295"),
+		traceTestLogline(14, "phonelab_proc_foreground: pid=0 tgid=0 comm=swapper/0"),
+		traceTestLogline(16, "thermal_temp: sensor_id=0 temp=61"),
+		traceTestLogline(18, "thermal_temp: sensor_id=0 temp=63"),
+		traceTestLogline(20, "cpu_frequency: state=300000 cpu_id=0"),
+		traceTestLogline(22, "cpu_frequency: state=300000 cpu_id=0"),
+		traceTestLogline(24, "thermal_temp: sensor_id=0 temp=58"),
+		// Not hot for long enough
+		traceTestLogline(26, "thermal_temp: sensor_id=0 temp=61"),
+		traceTestLogline(28, "thermal_temp: sensor_id=0 temp=50"),
+	} {
+		f.ApplyLogline(logline)
+	}
+	f.Finish()
+
+	assert.Equal(2, len(throttleTracker.Episodes))
+
+	e := throttleTracker.Episodes[0]
+	assert.Equal(3.0, e.Start)
+	assert.Equal(12.0, e.End)
+	assert.Equal(9.0, e.Duration())
+	assert.Equal(THROTTLE_HOTPLUG|THROTTLE_FREQUENCY_CAP|THROTTLE_TEMPERATURE, e.Causes)
+	assert.Equal(map[int]int{0: 50, 7: 65}, e.PeakTemp)
+	assert.Equal(80, e.MsmThermalTemp)
+	assert.Equal([]int{3}, e.OfflineCpus)
+	assert.Equal(map[int]int{0: 1497600}, e.Ceiling)
+	assert.Equal(".android.dialer", e.Foreground.Comm)
+
+	e = throttleTracker.Episodes[1]
+	assert.Equal(16.0, e.Start)
+	assert.Equal(24.0, e.End)
+	assert.Equal(THROTTLE_TEMPERATURE, e.Causes)
+	assert.Equal(map[int]int{0: 63, 7: 55}, e.PeakTemp)
+	assert.Equal(TEMPERATURE_UNKNOWN, e.MsmThermalTemp)
+	assert.Equal(0, len(e.Ceiling))
+	assert.Nil(e.Foreground)
+}
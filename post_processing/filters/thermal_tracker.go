@@ -0,0 +1,119 @@
+package filters
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gurupras/go_cpuprof"
+)
+
+const (
+	TEMPERATURE_UNKNOWN int = -1
+)
+
+type ThermalTrackerData struct {
+	Sensor  int
+	Temp    int
+	Logline *cpuprof.Logline
+}
+
+// ThermalTracker follows the temperature of every thermal sensor from the
+// thermal_temp loglines
+type ThermalTracker struct {
+	*Filter
+	Exclusive    bool
+	CurrentState map[int]*ThermalTrackerData
+	FilterFunc   LoglineFilter
+	// Keep the closed intervals for TemperatureIntervals. Sensors report
+	// every few seconds, so this is off by default.
+	RecordIntervals bool
+	// Last thermal_temp logline
+	lastStateLogline *cpuprof.Logline
+	tempIntervals    map[int]*intervalRecorder
+}
+
+func NewThermalTracker(filter *Filter) (thermalTracker *ThermalTracker) {
+	thermalTracker = new(ThermalTracker)
+	thermalTracker.Filter = filter
+	thermalTracker.CurrentState = make(map[int]*ThermalTrackerData)
+	thermalTracker.tempIntervals = make(map[int]*intervalRecorder)
+
+	// Temperature does not restrict which lines pass
+	thermalTracker.FilterFunc = func(logline *cpuprof.Logline) bool {
+		return stateResult(thermalTracker.Exclusive, logline == thermalTracker.lastStateLogline, true)
+	}
+	filter.AddTracker(thermalTracker)
+	filter.AddNamedFilter("thermal", thermalTracker.FilterFunc)
+	return thermalTracker
+}
+
+func (thermalTracker *ThermalTracker) data(sensor int) *ThermalTrackerData {
+	if _, ok := thermalTracker.CurrentState[sensor]; !ok {
+		thermalTracker.CurrentState[sensor] = &ThermalTrackerData{sensor, TEMPERATURE_UNKNOWN, nil}
+		thermalTracker.tempIntervals[sensor] = newIntervalRecorder(&thermalTracker.RecordIntervals)
+	}
+	return thermalTracker.CurrentState[sensor]
+}
+
+func (thermalTracker *ThermalTracker) Update(logline *cpuprof.Logline) {
+	if !strings.Contains(logline.Line, "thermal_temp:") {
+		return
+	}
+	trace := cpuprof.ParseTraceFromLoglinePayload(logline)
+	if trace == nil {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Trace is nil: %v", logline.Line))
+		return
+	}
+	if strings.Compare(trace.Tag(), "thermal_temp") != 0 {
+		return
+	}
+	thermalTracker.lastStateLogline = logline
+
+	tt := trace.(*cpuprof.ThermalTemp)
+	ttd := thermalTracker.data(tt.SensorId)
+	event := &TemperatureChanged{eventSource{logline}, tt.SensorId, ttd.Temp, ttd.Logline, tt.Temp}
+	ttd.Temp = tt.Temp
+	ttd.Logline = logline
+	thermalTracker.tempIntervals[tt.SensorId].change(tt.Temp, logline)
+	thermalTracker.Bus.Publish(event)
+}
+
+// Sensors returns the ids of the sensors seen so far in increasing order
+func (thermalTracker *ThermalTracker) Sensors() []int {
+	sensors := make([]int, 0, len(thermalTracker.CurrentState))
+	for sensor := range thermalTracker.CurrentState {
+		sensors = append(sensors, sensor)
+	}
+	sort.Ints(sensors)
+	return sensors
+}
+
+// TemperatureIntervals returns the closed intervals sensor spent at each
+// temperature, starting at its first thermal_temp logline, if RecordIntervals
+// is set
+func (thermalTracker *ThermalTracker) TemperatureIntervals(sensor int) Intervals {
+	if r, ok := thermalTracker.tempIntervals[sensor]; ok {
+		return r.intervals
+	}
+	return make(Intervals, 0)
+}
+
+func (thermalTracker *ThermalTracker) Split(logline *cpuprof.Logline) {
+	for _, r := range thermalTracker.tempIntervals {
+		r.split(logline)
+	}
+}
+
+func (thermalTracker *ThermalTracker) DropIntervals(before float64) {
+	for _, r := range thermalTracker.tempIntervals {
+		r.drop(before)
+	}
+}
+
+func (thermalTracker *ThermalTracker) Finish(last *cpuprof.Logline) {
+	for _, r := range thermalTracker.tempIntervals {
+		r.stop(last)
+	}
+}
@@ -0,0 +1,33 @@
+package filters
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThermalTracker(t *testing.T) {
+	assert := assert.New(t)
+
+	f := New()
+	thermalTracker := NewThermalTracker(f)
+	thermalTracker.RecordIntervals = true
+	events := make([][3]int, 0)
+	f.Bus.OnTemperatureChanged(func(event *TemperatureChanged) {
+		events = append(events, [3]int{event.Sensor, event.OldTemp, event.Temp})
+	})
+
+	f.ApplyLogline(traceTestLogline(1, "thermal_temp: sensor_id=5 temp=40"))
+	f.ApplyLogline(traceTestLogline(2, "thermal_temp: sensor_id=0 temp=30"))
+	f.ApplyLogline(traceTestLogline(4, "thermal_temp: sensor_id=5 temp=40"))
+	f.ApplyLogline(traceTestLogline(5, "thermal_temp: sensor_id=5 temp=46"))
+	f.ApplyLogline(traceTestLogline(8, "cpu_frequency: state=300000 cpu_id=0"))
+	f.Finish()
+
+	assert.Equal([][3]int{{5, TEMPERATURE_UNKNOWN, 40}, {0, TEMPERATURE_UNKNOWN, 30}, {5, 40, 40}, {5, 40, 46}}, events)
+	assert.Equal([]int{0, 5}, thermalTracker.Sensors())
+	assert.Equal(46, thermalTracker.CurrentState[5].Temp)
+	assert.Equal([][3]float64{{40, 1, 5}, {46, 5, 8}}, intervalSpans(thermalTracker.TemperatureIntervals(5)))
+	assert.Equal(298.0/7, thermalTracker.TemperatureIntervals(5).Mean())
+	assert.Equal(0, len(thermalTracker.TemperatureIntervals(3)))
+}
@@ -14,6 +14,9 @@ import (
 	"github.com/gurupras/gocommons/gsync"
 )
 
+// CPUs assumed for a boot the catalogue has no CPU count for: the Nexus 5's
+const DEFAULT_NCPUS = 4
+
 type CpuState int
 
 const (
@@ -67,19 +70,31 @@ func NewPhoneStateMachine(ncpus int) *PhoneStateMachine {
 	psm := new(PhoneStateMachine)
 	psm.Ncpus = ncpus
 	psm.NumOnlineCpus = -1
-	psm.CpuStateMachine = make([]*CpuStateMachine, 4)
-	for idx := 0; idx < 4; idx++ {
+	psm.CpuStateMachine = make([]*CpuStateMachine, 0, ncpus)
+	for idx := 0; idx < ncpus; idx++ {
+		psm.Cpu(idx)
+	}
+	return psm
+}
+
+// Cpu returns the state machine of cpu. A CPU beyond Ncpus adds state
+// machines up to it.
+func (psm *PhoneStateMachine) Cpu(cpu int) *CpuStateMachine {
+	for idx := len(psm.CpuStateMachine); idx <= cpu; idx++ {
 		sm := new(CpuStateMachine)
 		sm.Cpu = idx
 		sm.State = CPU_STATE_UNKNOWN
 		sm.Frequency = -1
-		psm.CpuStateMachine[idx] = sm
+		psm.CpuStateMachine = append(psm.CpuStateMachine, sm)
 	}
-	return psm
+	if cpu >= psm.Ncpus {
+		psm.Ncpus = cpu + 1
+	}
+	return psm.CpuStateMachine[cpu]
 }
 
 func (psm *PhoneStateMachine) FullState() bool {
-	fullState := true
+	fullState := psm.Ncpus > 0
 	for idx := 0; idx < psm.Ncpus; idx++ {
 		csm := psm.CpuStateMachine[idx]
 		if csm.State == CPU_STATE_UNKNOWN {
@@ -95,7 +110,9 @@ func (psm *PhoneStateMachine) FullState() bool {
 	return fullState
 }
 
-func bootConsumer(boot *Boot, inChannel chan string, outChannel chan map[string]float64) float64 {
+// bootConsumer starts with ncpus CPUs, so that states are only logged once
+// all of them are known. CPUs beyond ncpus are added as they are seen.
+func bootConsumer(boot *Boot, ncpus int, inChannel chan string, outChannel chan map[string]float64) float64 {
 	var (
 		logline           *cpuprof.Logline
 		firstLogline      *cpuprof.Logline
@@ -103,7 +120,7 @@ func bootConsumer(boot *Boot, inChannel chan string, outChannel chan map[string]
 		stateStartLogline *cpuprof.Logline
 		stateEndLogline   *cpuprof.Logline
 	)
-	psm := NewPhoneStateMachine(4)
+	psm := NewPhoneStateMachine(ncpus)
 
 	frequencyMap := make(map[string]float64)
 
@@ -160,7 +177,7 @@ func bootConsumer(boot *Boot, inChannel chan string, outChannel chan map[string]
 			}
 			cpu := sch.Cpu
 			state := sch.State
-			csm := psm.CpuStateMachine[cpu]
+			csm := psm.Cpu(cpu)
 			// Before we can set state, we need to check if we have fullstate
 			if psm.FullState() {
 				// Log state
@@ -176,7 +193,7 @@ func bootConsumer(boot *Boot, inChannel chan string, outChannel chan map[string]
 			if psm.FullState() {
 				logState()
 			}
-			if err := psm.CpuStateMachine[cpu].ChangeFrequency(cf.State); err != nil {
+			if err := psm.Cpu(cpu).ChangeFrequency(cf.State); err != nil {
 				fmt.Fprintln(os.Stderr, err)
 				fmt.Fprintln(os.Stderr, line)
 				os.Exit(-1)
@@ -223,6 +240,18 @@ func FrequencyDistributionMain(args []string) {
 
 	outChannel := make(chan map[string]float64, 100000)
 
+	// CPUs of every boot, as found when it was catalogued
+	ncpus := make(map[string]int)
+	if catalogue, err := NewDataset(Path).Catalogue(); err != nil {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Failed to load catalogue, assuming %d CPUs: %v", DEFAULT_NCPUS, err))
+	} else {
+		for _, di := range catalogue.Devices {
+			for _, bi := range di.Boots {
+				ncpus[bi.BootId] = bi.Ncpus
+			}
+		}
+	}
+
 	processDevice := func(device string, boots []*Boot) {
 		defer deviceWg.Done()
 		defer deviceSem.V()
@@ -239,7 +268,11 @@ func FrequencyDistributionMain(args []string) {
 			}
 			go boot.AsyncFilterRead(lineChannel, []filters.LineFilter{f})
 
-			bootConsumer(boot, lineChannel, outChannel)
+			n, ok := ncpus[boot.BootId]
+			if !ok || n == 0 {
+				n = DEFAULT_NCPUS
+			}
+			bootConsumer(boot, n, lineChannel, outChannel)
 		}
 
 		for _, boot := range boots {
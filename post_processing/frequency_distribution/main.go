@@ -15,7 +15,47 @@ import (
 	"github.com/gurupras/gocommons/gsync"
 )
 
-func processBoot(deviceId string, boot *post_processing.Boot, outChannel chan map[string]float64, wg *sync.WaitGroup, sem *gsync.Semaphore) {
+// Time spent at each frequency by a boot, summed over every CPU and over the
+// CPUs of each cluster of the device's topology. Clusters are keyed by their
+// CPUs, since inferred topologies can differ from boot to boot.
+type bootFrequencies struct {
+	DeviceId    string
+	Frequencies map[string]float64
+	Clusters    map[string]map[string]float64
+	// Seconds of work of every core at its capacity, over the capacity of
+	// every core at its highest frequency, and the seconds the boot's
+	// frequency traces cover
+	CapacitySeconds float64
+	Seconds         float64
+}
+
+// Capacity-weighted utilization of the CPUs: the work they could do at the
+// frequencies they ran at, as a fraction of the work every core could do at
+// its highest frequency
+type utilization struct {
+	CapacitySeconds float64
+	Seconds         float64
+	Utilization     float64
+}
+
+func (u *utilization) add(bf *bootFrequencies) {
+	u.CapacitySeconds += bf.CapacitySeconds
+	u.Seconds += bf.Seconds
+	if u.Seconds > 0 {
+		u.Utilization = u.CapacitySeconds / u.Seconds
+	}
+}
+
+// clusterKey names a cluster by its CPUs, e.g. "0,1,2,3"
+func clusterKey(cluster *cpuprof.Cluster) string {
+	cpus := make([]string, 0, len(cluster.Cpus))
+	for _, cpu := range cluster.Cpus {
+		cpus = append(cpus, fmt.Sprintf("%v", cpu))
+	}
+	return strings.Join(cpus, ",")
+}
+
+func processBoot(deviceId string, model string, boot *post_processing.Boot, outChannel chan *bootFrequencies, wg *sync.WaitGroup, sem *gsync.Semaphore) {
 	defer sem.V()
 	defer wg.Done()
 	lineChannel := make(chan string, 100000)
@@ -25,52 +65,23 @@ func processBoot(deviceId string, boot *post_processing.Boot, outChannel chan ma
 	}
 	go boot.AsyncFilterRead(lineChannel, []filters.LineFilter{f})
 
-	bootConsumer(boot, lineChannel, outChannel)
+	bf := bootConsumer(boot, model, lineChannel)
+	bf.DeviceId = deviceId
+	outChannel <- bf
 }
 
-func bootConsumer(boot *post_processing.Boot, inChannel chan string, outChannel chan map[string]float64) {
+// bootConsumer uses the topology declared for model, and infers one from the
+// frequencies seen in the boot only for models without one
+func bootConsumer(boot *post_processing.Boot, model string, inChannel chan string) *bootFrequencies {
 
 	frequencyMap := make(map[string]float64)
 
 	filter := filters.New()
 	cpuTracker := filters.NewCpuTracker(filter)
 
-	callback := func(trace cpuprof.TraceInterface, cpu int) {
-		account := func(trace *cpuprof.Trace) {
-			if cpuTracker.CurrentState[cpu].Frequency != filters.FREQUENCY_STATE_UNKNOWN {
-				// There was a legitimate previous frequency. Account time spent in it
-				start := cpuTracker.CurrentState[cpu].FrequencyLogline.TraceTime
-				end := trace.Logline.TraceTime
-
-				freqStr := fmt.Sprintf("%v", cpuTracker.CurrentState[cpu].Frequency)
-				if _, ok := frequencyMap[freqStr]; !ok {
-					frequencyMap[freqStr] = 0.0
-				}
-				frequencyMap[freqStr] += (end - start)
-			}
-		}
-
-		switch trace.Tag() {
-		case "cpu_frequency":
-			cf := trace.(*cpuprof.CpuFrequency)
-			cpu := cf.CpuId
-			// Track time spent in 'current' state
-			if _, ok := cpuTracker.CurrentState[cpu]; !ok {
-				return
-			}
-			account(cf.Trace)
-		case "sched_cpu_hotplug":
-			sch := trace.(*cpuprof.SchedCpuHotplug)
-			if sch.State != "offline" {
-				break
-			}
-			// This CPU just went offline. Account time
-			account(sch.Trace)
-		}
-	}
-	cpuTracker.Callback = callback
 	var line string
 	var ok bool
+	var first, last *cpuprof.Logline
 	lines_processed := 0
 	for {
 		if line, ok = <-inChannel; !ok {
@@ -81,9 +92,40 @@ func bootConsumer(boot *post_processing.Boot, inChannel chan string, outChannel
 		if lines_processed%100000 == 0 {
 			//fmt.Println("bootConsumer: Processed:", lines_processed)
 		}
-		filter.Apply(line)
+		logline := cpuprof.ParseLogline(line)
+		if logline == nil {
+			continue
+		}
+		filter.ApplyLogline(logline)
+		if first == nil {
+			first = logline
+		}
+		last = logline
+	}
+	filter.Finish()
+
+	// Time spent at each frequency, summed over CPUs
+	for cpu := range cpuTracker.CurrentState {
+		for frequency, duration := range cpuTracker.FrequencyResidency(cpu) {
+			frequencyMap[fmt.Sprintf("%v", frequency)] += duration
+		}
+	}
+	clusterMap := make(map[string]map[string]float64)
+	topology := post_processing.ModelTopology(model, cpuTracker.ObservedFrequencies())
+	for _, cluster := range topology.Clusters {
+		key := clusterKey(cluster)
+		clusterMap[key] = make(map[string]float64)
+		for frequency, duration := range cpuTracker.ClusterResidency(cluster) {
+			clusterMap[key][fmt.Sprintf("%v", frequency)] += duration
+		}
 	}
-	outChannel <- frequencyMap
+	bf := &bootFrequencies{Frequencies: frequencyMap, Clusters: clusterMap}
+	if first != nil && topology.TotalCapacity() > 0 {
+		// Time before a core's first frequency counts as no capacity
+		bf.CapacitySeconds = cpuTracker.CapacityTime(topology) / topology.TotalCapacity()
+		bf.Seconds = last.TraceTime - first.TraceTime
+	}
+	return bf
 }
 
 func Main(args []string) {
@@ -93,10 +135,20 @@ func Main(args []string) {
 	deviceWg := new(sync.WaitGroup)
 	deviceSem := gsync.NewSem(20)
 
-	outChannel := make(chan map[string]float64, 100000)
+	outChannel := make(chan *bootFrequencies, 100000)
 
 	device_files := post_processing.GetDeviceFiles(post_processing.Path, post_processing.Devices)
 
+	// Device models pick the declared topologies
+	models := make(map[string]string)
+	if catalogue, err := post_processing.NewDataset(post_processing.Path).Catalogue(); err != nil {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Failed to load catalogue, inferring topologies: %v", err))
+	} else {
+		for device, di := range catalogue.Devices {
+			models[device] = di.Model
+		}
+	}
+
 	var doneDevices int32 = 0
 	processDevice := func(device string, boots []*post_processing.Boot) {
 		defer deviceWg.Done()
@@ -106,7 +158,7 @@ func Main(args []string) {
 
 		doneBoots := int32(0)
 		bootFn := func(boot *post_processing.Boot) {
-			processBoot(device, boot, outChannel, bootWg, bootSem)
+			processBoot(device, models[device], boot, outChannel, bootWg, bootSem)
 			atomic.AddInt32(&doneBoots, 1)
 			fmt.Println(fmt.Sprintf("%v -> %v Done! (%d/%d)", device, boot.BootId, doneBoots, len(boots)))
 		}
@@ -128,22 +180,40 @@ func Main(args []string) {
 	}
 
 	frequencyUsageMap := make(map[string]float64)
+	// Keyed by the CPUs of each cluster
+	clusterUsageMap := make(map[string]map[string]float64)
+	// By device, and over every device under "all"
+	utilizationMap := map[string]*utilization{"all": new(utilization)}
 
 	wg := new(sync.WaitGroup)
 	outChannelConsumer := func() {
 		defer wg.Done()
-		var frequencyMap map[string]float64
+		var bf *bootFrequencies
 		var ok bool
 		for {
-			if frequencyMap, ok = <-outChannel; !ok {
+			if bf, ok = <-outChannel; !ok {
 				break
 			}
+			frequencyMap := bf.Frequencies
 			for k, _ := range frequencyMap {
 				if _, ok := frequencyUsageMap[k]; !ok {
 					frequencyUsageMap[k] = 0.0
 				}
 				frequencyUsageMap[k] += frequencyMap[k]
 			}
+			for cluster, clusterMap := range bf.Clusters {
+				if _, ok := clusterUsageMap[cluster]; !ok {
+					clusterUsageMap[cluster] = make(map[string]float64)
+				}
+				for k, v := range clusterMap {
+					clusterUsageMap[cluster][k] += v
+				}
+			}
+			if _, ok := utilizationMap[bf.DeviceId]; !ok {
+				utilizationMap[bf.DeviceId] = new(utilization)
+			}
+			utilizationMap[bf.DeviceId].add(bf)
+			utilizationMap["all"].add(bf)
 		}
 	}
 	wg.Add(1)
@@ -154,6 +224,10 @@ func Main(args []string) {
 	wg.Wait()
 	b, _ := json.MarshalIndent(frequencyUsageMap, "", "  ")
 	ioutil.WriteFile("output.json", b, 0664)
+	b, _ = json.MarshalIndent(clusterUsageMap, "", "  ")
+	ioutil.WriteFile("output-clusters.json", b, 0664)
+	b, _ = json.MarshalIndent(utilizationMap, "", "  ")
+	ioutil.WriteFile("output-utilization.json", b, 0664)
 }
 
 func main() {
@@ -1,13 +1,57 @@
 package main
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/google/shlex"
 	"github.com/gurupras/go_cpuprof/post_processing"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestFrequencyDistribution(t *testing.T) {
 	cmdline, _ := shlex.Split("./frequency_distribution /android/cpuprof-data -d 6f3cdb988ff27b78ca2df7e32268c74fc54925dc")
 	post_processing.FrequencyDistributionMain(cmdline)
 }
+
+func frequencyLine(token int, cpu int, frequency int) string {
+	return fmt.Sprintf("453fea81-57cc-43e0-9693-91f63b0433b9 2016-06-25 10:00:00.000000000 %d [   %d.000000]   200   200 D Kernel-Trace: kworker/0:1-17 [000] ...1     %d.000000: cpu_frequency: state=%d cpu_id=%d", token, token, token, frequency, cpu)
+}
+
+func TestBootConsumerClusters(t *testing.T) {
+	assert := assert.New(t)
+
+	// CPU 1 never reaches the highest frequency of CPU 0
+	lines := []string{
+		frequencyLine(1, 0, 300000),
+		frequencyLine(1, 1, 300000),
+		frequencyLine(3, 0, 2265600),
+		frequencyLine(4, 1, 960000),
+		frequencyLine(6, 0, 300000),
+		frequencyLine(6, 1, 300000),
+	}
+	consume := func(model string) *bootFrequencies {
+		inChannel := make(chan string, len(lines))
+		for _, line := range lines {
+			inChannel <- line
+		}
+		close(inChannel)
+		return bootConsumer(nil, model, inChannel)
+	}
+
+	// The declared topology has one cluster whatever the boot saw
+	bf := consume("Nexus 5")
+	assert.Equal(map[string]map[string]float64{
+		"0,1,2,3": {"300000": 5, "2265600": 3, "960000": 2},
+	}, bf.Clusters)
+	// Over 5s, of 4 cores at 2265600
+	assert.Equal(5.0, bf.Seconds)
+	assert.InDelta((300000.0*5+2265600*3+960000*2)/2265600/4, bf.CapacitySeconds, 1e-9)
+
+	// Inferred clusters are still keyed by their CPUs
+	bf = consume("Unknown model")
+	assert.Equal(map[string]map[string]float64{
+		"1": {"300000": 3, "960000": 2},
+		"0": {"300000": 2, "2265600": 3},
+	}, bf.Clusters)
+}
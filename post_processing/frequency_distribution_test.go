@@ -0,0 +1,36 @@
+package post_processing
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBootConsumerWaitsForEveryCpu(t *testing.T) {
+	assert := assert.New(t)
+
+	bootid := "453fea81-57cc-43e0-9693-91f63b0433b9"
+	lines := []string{
+		kernelTraceLine(bootid, 1, "cpu_frequency: state=300000 cpu_id=0"),
+		kernelTraceLine(bootid, 2, "cpu_frequency: state=300000 cpu_id=1"),
+		kernelTraceLine(bootid, 3, "cpu_frequency: state=300000 cpu_id=2"),
+		kernelTraceLine(bootid, 4, "cpu_frequency: state=300000 cpu_id=3"),
+		kernelTraceLine(bootid, 6, "cpu_frequency: state=960000 cpu_id=0"),
+		kernelTraceLine(bootid, 8, "cpu_frequency: state=300000 cpu_id=0"),
+	}
+	inChannel := make(chan string, len(lines))
+	for _, line := range lines {
+		inChannel <- line
+	}
+	close(inChannel)
+	outChannel := make(chan map[string]float64, 1)
+
+	boot := &Boot{BootId: bootid}
+	assert.Equal(7.0, bootConsumer(boot, 4, inChannel, outChannel))
+	// No state is logged before all 4 CPUs have a frequency
+	frequencyMap := <-outChannel
+	assert.Equal(2, len(frequencyMap), fmt.Sprintf("%v", frequencyMap))
+	assert.InDelta(5.0/7, frequencyMap["300000-300000-300000-300000"], 1e-9)
+	assert.InDelta(2.0/7, frequencyMap["300000-300000-300000-960000"], 1e-9)
+}
@@ -0,0 +1,279 @@
+package post_processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gurupras/go_cpuprof"
+)
+
+const (
+	// Written next to the shards. It does not end in .gz so NewBoot ignores it.
+	BOOT_INDEX_FILE = "index.json"
+	// Lines between index points within a shard
+	INDEX_STRIDE = 10000
+)
+
+// IndexPoint locates one logline within a shard
+type IndexPoint struct {
+	// Line number within the shard, counting lines that do not parse
+	Line      int64   `json:"line"`
+	Token     int64   `json:"token"`
+	TraceTime float64 `json:"trace_time"`
+	// Wall time in nanoseconds since the epoch
+	Datetime int64 `json:"datetime"`
+}
+
+func newIndexPoint(line int64, logline *cpuprof.Logline) IndexPoint {
+	return IndexPoint{line, logline.LogcatToken, logline.TraceTime, logline.Datetime.UnixNano()}
+}
+
+type ShardIndex struct {
+	Name string `json:"name"`
+	// Size and modification time of the shard when it was indexed
+	Size    int64 `json:"size"`
+	ModTime int64 `json:"mod_time"`
+	Lines   int64 `json:"lines"`
+	// Points at the first line and every INDEX_STRIDE lines after it, plus the
+	// last line. Empty if no line of the shard parses.
+	Points []IndexPoint `json:"points"`
+}
+
+type BootIndex struct {
+	Shards []*ShardIndex `json:"shards"`
+}
+
+func (b *Boot) indexPath() string {
+	return filepath.Join(b.GetBootPath(), BOOT_INDEX_FILE)
+}
+
+func indexShard(file string) (si *ShardIndex, err error) {
+	var fi os.FileInfo
+
+	if fi, err = os.Stat(file); err != nil {
+		return nil, err
+	}
+	file_raw, reader, err := openShard(file)
+	if err != nil {
+		return nil, err
+	}
+	defer file_raw.Close()
+
+	si = new(ShardIndex)
+	si.Name = filepath.Base(file)
+	si.Size = fi.Size()
+	si.ModTime = fi.ModTime().UnixNano()
+	si.Points = make([]IndexPoint, 0)
+
+	// Only lines at stride boundaries are parsed; the last line is parsed once
+	// the shard has been read
+	next_point := int64(0)
+	var last string
+	for reader.Scan() {
+		last = reader.Text()
+		if si.Lines >= next_point {
+			if logline := cpuprof.ParseLogline(last); logline != nil {
+				si.Points = append(si.Points, newIndexPoint(si.Lines, logline))
+				next_point = si.Lines + INDEX_STRIDE
+			}
+		}
+		si.Lines++
+	}
+	if err = reader.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read file: %v: %v", file, err)
+	}
+	if n := len(si.Points); n > 0 && si.Points[n-1].Line != si.Lines-1 {
+		if logline := cpuprof.ParseLogline(last); logline != nil {
+			si.Points = append(si.Points, newIndexPoint(si.Lines-1, logline))
+		}
+	}
+	return
+}
+
+func shardIndexCurrent(si *ShardIndex, file string) bool {
+	fi, err := os.Stat(file)
+	return err == nil && strings.Compare(si.Name, filepath.Base(file)) == 0 &&
+		si.Size == fi.Size() && si.ModTime == fi.ModTime().UnixNano()
+}
+
+// Index returns the index of the boot's shards. It is loaded from
+// <boot>/index.json if present; shards that are missing from it or changed
+// since are indexed and the file is rewritten.
+func (b *Boot) Index() (*BootIndex, error) {
+	b.indexLock.Lock()
+	defer b.indexLock.Unlock()
+
+	if b.index != nil && len(b.index.Shards) == len(b.Files) {
+		return b.index, nil
+	}
+
+	cached := make(map[string]*ShardIndex)
+	if bytes, err := ioutil.ReadFile(b.indexPath()); err == nil {
+		old := new(BootIndex)
+		if err = json.Unmarshal(bytes, old); err == nil {
+			for _, si := range old.Shards {
+				cached[si.Name] = si
+			}
+		}
+	}
+
+	index := new(BootIndex)
+	index.Shards = make([]*ShardIndex, len(b.Files))
+	workers := b.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	slots := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var err error
+	stale := false
+	for idx, file := range b.Files {
+		if si, ok := cached[filepath.Base(file)]; ok && shardIndexCurrent(si, file) {
+			index.Shards[idx] = si
+			continue
+		}
+		stale = true
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(idx int, file string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			si, shard_err := indexShard(file)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if shard_err != nil && err == nil {
+				err = shard_err
+			}
+			index.Shards[idx] = si
+		}(idx, file)
+	}
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	if stale || len(cached) != len(b.Files) {
+		if bytes, err := json.MarshalIndent(index, "", "    "); err == nil {
+			if err = ioutil.WriteFile(b.indexPath(), bytes, 0664); err != nil {
+				// The index still works, it just is not cached
+				fmt.Fprintln(os.Stderr, "Warning: Failed to save index:", err)
+			}
+		}
+	}
+	b.index = index
+	return index, nil
+}
+
+type RangeKey int
+
+const (
+	RANGE_BY_WALL_TIME RangeKey = iota
+	RANGE_BY_TRACE_TIME
+	RANGE_BY_TOKEN
+)
+
+// Range selects loglines whose key lies in [Start, End). Seeking assumes the
+// key never decreases within a boot; LogcatToken and TraceTime do not, but
+// wall time can step back if the clock is changed.
+type Range struct {
+	By RangeKey
+	// Wall time in nanoseconds since the epoch or LogcatToken
+	Start int64
+	End   int64
+	// TraceTime
+	StartTraceTime float64
+	EndTraceTime   float64
+}
+
+func WallTimeRange(start time.Time, end time.Time) Range {
+	return Range{By: RANGE_BY_WALL_TIME, Start: start.UnixNano(), End: end.UnixNano()}
+}
+
+func TraceTimeRange(start float64, end float64) Range {
+	return Range{By: RANGE_BY_TRACE_TIME, StartTraceTime: start, EndTraceTime: end}
+}
+
+func TokenRange(start int64, end int64) Range {
+	return Range{By: RANGE_BY_TOKEN, Start: start, End: end}
+}
+
+// Whether p comes before the start of the range
+func (r *Range) before(p IndexPoint) bool {
+	switch r.By {
+	case RANGE_BY_WALL_TIME:
+		return p.Datetime < r.Start
+	case RANGE_BY_TRACE_TIME:
+		return p.TraceTime < r.StartTraceTime
+	default:
+		return p.Token < r.Start
+	}
+}
+
+// Whether p comes at or after the end of the range
+func (r *Range) after(p IndexPoint) bool {
+	switch r.By {
+	case RANGE_BY_WALL_TIME:
+		return p.Datetime >= r.End
+	case RANGE_BY_TRACE_TIME:
+		return p.TraceTime >= r.EndTraceTime
+	default:
+		return p.Token >= r.End
+	}
+}
+
+// Shards [start, end) may hold lines in r; the first skip lines of shard
+// start come before it
+func (r *Range) seek(index *BootIndex) (start int, end int, skip int64) {
+	start = len(index.Shards)
+	for idx, si := range index.Shards {
+		if n := len(si.Points); n > 0 && !r.before(si.Points[n-1]) {
+			start = idx
+			break
+		}
+	}
+	end = start
+	for ; end < len(index.Shards); end++ {
+		if points := index.Shards[end].Points; len(points) > 0 && r.after(points[0]) {
+			break
+		}
+	}
+	if start == len(index.Shards) {
+		return
+	}
+	// Last point that is still before the range
+	points := index.Shards[start].Points
+	lo, hi := 0, len(points)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if r.before(points[mid]) {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo > 0 {
+		skip = points[lo-1].Line
+	}
+	return
+}
+
+// ReadRange returns an iterator over the loglines of the boot that fall in r.
+// Shards outside r are not opened and the shard r starts in is read from the
+// closest index point before it.
+func (b *Boot) ReadRange(ctx context.Context, r Range) *LineIterator {
+	index, err := b.Index()
+	if err != nil {
+		it := b.LinesFrom(ctx, ReadOptions{StartShard: len(b.Files)})
+		it.err = err
+		return it
+	}
+	start, end, skip := r.seek(index)
+	return b.linesFrom(ctx, ReadOptions{StartShard: start}, &r, end, skip)
+}
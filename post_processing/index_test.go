@@ -0,0 +1,138 @@
+package post_processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const INDEX_TEST_SHARD_LINES = 25000
+
+var indexTestEpoch = time.Date(2016, 6, 25, 0, 0, 0, 0, time.UTC)
+
+// Token n is logged n seconds after the epoch with a TraceTime of n.5
+func indexTestLine(bootid string, token int) string {
+	datetime := indexTestEpoch.Add(time.Duration(token) * time.Second).Format("2006-01-02 15:04:05.000000000")
+	return fmt.Sprintf("%s %s %d [   %d.500000]   200   200 D KernelPrintk: line %d", bootid, datetime, token, token, token)
+}
+
+// Three shards of consecutive tokens starting at 1, with an unparseable line
+// on the first stride boundary of the first shard
+func setupIndexBoot(t *testing.T) *Boot {
+	path, err := ioutil.TempDir("", "index")
+	assert.Nil(t, err, "Failed to create temp dir")
+
+	bootid := "453fea81-57cc-43e0-9693-91f63b0433b9"
+	token := 0
+	for shard := 0; shard < 3; shard++ {
+		lines := make([]string, 0)
+		for idx := 0; idx < INDEX_TEST_SHARD_LINES; idx++ {
+			if shard == 0 && idx == INDEX_STRIDE {
+				lines = append(lines, "garbage")
+			}
+			token++
+			lines = append(lines, indexTestLine(bootid, token))
+		}
+		writeShard(t, filepath.Join(path, testDeviceA, bootid, fmt.Sprintf("%08d.gz", shard)), lines)
+	}
+	boot, err := NewBoot(path, testDeviceA, bootid)
+	assert.Nil(t, err, "Failed to open boot")
+	return boot
+}
+
+func rangeTokens(t *testing.T, boot *Boot, r Range) []int64 {
+	it := boot.ReadRange(context.Background(), r)
+	defer it.Close()
+	tokens := make([]int64, 0)
+	for it.Next() {
+		tokens = append(tokens, it.Logline().LogcatToken)
+	}
+	assert.Nil(t, it.Err())
+	return tokens
+}
+
+func tokenSpan(start int64, end int64) []int64 {
+	tokens := make([]int64, 0)
+	for token := start; token < end; token++ {
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+func TestBootIndex(t *testing.T) {
+	assert := assert.New(t)
+
+	boot := setupIndexBoot(t)
+	defer os.RemoveAll(boot.Path)
+
+	index, err := boot.Index()
+	assert.Nil(err)
+	assert.Equal(3, len(index.Shards))
+	si := index.Shards[0]
+	assert.Equal(int64(INDEX_TEST_SHARD_LINES+1), si.Lines)
+	// First line, the line after the garbage, two more strides and the last line
+	assert.Equal([]int64{0, INDEX_STRIDE + 1, 2*INDEX_STRIDE + 1, INDEX_TEST_SHARD_LINES}, []int64{si.Points[0].Line, si.Points[1].Line, si.Points[2].Line, si.Points[3].Line})
+	assert.Equal(int64(INDEX_TEST_SHARD_LINES), si.Points[3].Token)
+
+	// Saved next to the shards
+	bytes, err := ioutil.ReadFile(filepath.Join(boot.GetBootPath(), BOOT_INDEX_FILE))
+	assert.Nil(err)
+	saved := new(BootIndex)
+	assert.Nil(json.Unmarshal(bytes, saved))
+	assert.Equal(index.Shards[2].Points, saved.Shards[2].Points)
+
+	// A changed shard is indexed again
+	bootid := boot.BootId
+	writeShard(t, boot.Files[2], []string{indexTestLine(bootid, 90000), indexTestLine(bootid, 90001)})
+	reopened, err := NewBoot(boot.Path, boot.DeviceId, bootid)
+	assert.Nil(err)
+	index, err = reopened.Index()
+	assert.Nil(err)
+	assert.Equal(int64(2), index.Shards[2].Lines)
+	assert.Equal(index.Shards[0].Points, saved.Shards[0].Points)
+	assert.Equal([]int64{90001}, rangeTokens(t, reopened, TokenRange(90001, 100000)))
+}
+
+func TestReadRange(t *testing.T) {
+	assert := assert.New(t)
+
+	boot := setupIndexBoot(t)
+	defer os.RemoveAll(boot.Path)
+
+	at := func(token int) time.Time {
+		return indexTestEpoch.Add(time.Duration(token) * time.Second)
+	}
+	tests := []struct {
+		name     string
+		r        Range
+		expected []int64
+	}{
+		{"token", TokenRange(20000, 20010), tokenSpan(20000, 20010)},
+		{"token across shards", TokenRange(24995, 25005), tokenSpan(24995, 25005)},
+		{"around garbage", TokenRange(9998, 10003), tokenSpan(9998, 10003)},
+		{"trace time", TraceTimeRange(30000, 30003), tokenSpan(30000, 30003)},
+		{"wall time", WallTimeRange(at(60000), at(60004)), tokenSpan(60000, 60004)},
+		{"first lines", TokenRange(0, 3), tokenSpan(1, 3)},
+		{"last lines", TokenRange(74998, 80000), tokenSpan(74998, 75001)},
+		{"before", TokenRange(-10, 0), []int64{}},
+		{"after", TokenRange(80000, 90000), []int64{}},
+	}
+	for _, workers := range []int{1, 3} {
+		boot.Workers = workers
+		for _, test := range tests {
+			assert.Equal(test.expected, rangeTokens(t, boot, test.r), fmt.Sprintf("%v (%d workers)", test.name, workers))
+		}
+	}
+
+	// Shards outside the range are never opened
+	boot.Workers = 1
+	assert.Nil(os.Remove(boot.Files[0]))
+	assert.Equal(tokenSpan(60000, 60004), rangeTokens(t, boot, TokenRange(60000, 60004)))
+}
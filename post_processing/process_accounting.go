@@ -0,0 +1,421 @@
+package post_processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gurupras/go_cpuprof"
+	"github.com/gurupras/go_cpuprof/post_processing/filters"
+	"github.com/gurupras/gocommons/gsync"
+)
+
+const (
+	PROCESS_ACCOUNTING_FILE = "process-accounting.json"
+	DEFAULT_TOP_PROCESSES   = 20
+)
+
+// ProcessKey identifies a process. Pids are reused, so comm is part of the
+// key, and pids start over every boot, so the boot is too.
+type ProcessKey struct {
+	BootId string
+	Pid    int
+	Tgid   int
+	Comm   string
+}
+
+// ProcessUsage is the sum of a process's periodic ctx switch info across
+// windows and CPUs. Times are in nanoseconds.
+type ProcessUsage struct {
+	ProcessKey
+	Utime   int64
+	Stime   int64
+	Rtime   int64
+	BgUtime int64
+	BgStime int64
+	BgRtime int64
+	SRun    int64
+	SInt    int64
+	SUnint  int64
+	SOth    int64
+	Rx      int64
+	Tx      int64
+	// Windows the process was seen in, once per CPU
+	Windows int64
+}
+
+func (pu *ProcessUsage) add(other *ProcessUsage) {
+	pu.Utime += other.Utime
+	pu.Stime += other.Stime
+	pu.Rtime += other.Rtime
+	pu.BgUtime += other.BgUtime
+	pu.BgStime += other.BgStime
+	pu.BgRtime += other.BgRtime
+	pu.SRun += other.SRun
+	pu.SInt += other.SInt
+	pu.SUnint += other.SUnint
+	pu.SOth += other.SOth
+	pu.Rx += other.Rx
+	pu.Tx += other.Tx
+	pu.Windows += other.Windows
+}
+
+func (pu *ProcessUsage) addInfo(info *cpuprof.PhonelabPeriodicCtxSwitchInfo) {
+	pu.add(&ProcessUsage{
+		Utime:   info.Utime,
+		Stime:   info.Stime,
+		Rtime:   info.Rtime,
+		BgUtime: info.BgUtime,
+		BgStime: info.BgStime,
+		BgRtime: info.BgRtime,
+		SRun:    info.SRun,
+		SInt:    info.SInt,
+		SUnint:  info.SUnint,
+		SOth:    info.SOth,
+		Rx:      info.Rx,
+		Tx:      info.Tx,
+		Windows: 1,
+	})
+}
+
+// Sorts by Rtime, highest first
+type processUsageSlice []*ProcessUsage
+
+func (s processUsageSlice) Len() int {
+	return len(s)
+}
+
+func (s processUsageSlice) Less(i, j int) bool {
+	if s[i].Rtime != s[j].Rtime {
+		return s[i].Rtime > s[j].Rtime
+	}
+	if s[i].Pid != s[j].Pid {
+		return s[i].Pid < s[j].Pid
+	}
+	return strings.Compare(s[i].Comm, s[j].Comm) < 0
+}
+
+func (s processUsageSlice) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// PackageUsage is the usage of the processes of an app package. Times are in
+// nanoseconds except ForegroundTime, which is in seconds.
+type PackageUsage struct {
+	Package string
+	// Uid of the package's first process with a known uid
+	Uid     int
+	Utime   int64
+	Stime   int64
+	Rtime   int64
+	BgRtime int64
+	Windows int64
+	// Time one of the package's processes was the foreground app
+	ForegroundTime float64
+}
+
+func (pu *PackageUsage) add(other *PackageUsage) {
+	if pu.Uid == cpuprof.UID_UNKNOWN {
+		pu.Uid = other.Uid
+	}
+	pu.Utime += other.Utime
+	pu.Stime += other.Stime
+	pu.Rtime += other.Rtime
+	pu.BgRtime += other.BgRtime
+	pu.Windows += other.Windows
+	pu.ForegroundTime += other.ForegroundTime
+}
+
+// Sorts by Rtime, highest first
+type packageUsageSlice []*PackageUsage
+
+func (s packageUsageSlice) Len() int {
+	return len(s)
+}
+
+func (s packageUsageSlice) Less(i, j int) bool {
+	if s[i].Rtime != s[j].Rtime {
+		return s[i].Rtime > s[j].Rtime
+	}
+	return strings.Compare(s[i].Package, s[j].Package) < 0
+}
+
+func (s packageUsageSlice) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// ProcessAccounting aggregates periodic ctx switch info windows by process.
+// The idle tasks are not processes; their time is counted in IdleRtime.
+// Processes that Resolver maps to an app are also aggregated by package.
+type ProcessAccounting struct {
+	Processes map[ProcessKey]*ProcessUsage
+	Packages  map[string]*PackageUsage
+	// The boot being added, which keys its processes
+	BootId string
+	// Resolves the processes of the boot being added. Nil if packages are not
+	// accounted.
+	Resolver *ProcessResolver
+	// Windows aggregated, once per CPU
+	Windows    int64
+	IdleRtime  int64
+	TotalRtime int64
+	// Every window seen, including those that were not aggregated
+	Completeness filters.CtxSwitchCompleteness
+}
+
+func NewProcessAccounting() *ProcessAccounting {
+	pa := new(ProcessAccounting)
+	pa.Processes = make(map[ProcessKey]*ProcessUsage)
+	pa.Packages = make(map[string]*PackageUsage)
+	return pa
+}
+
+func (pa *ProcessAccounting) usage(key ProcessKey) *ProcessUsage {
+	pu, ok := pa.Processes[key]
+	if !ok {
+		pu = new(ProcessUsage)
+		pu.ProcessKey = key
+		pa.Processes[key] = pu
+	}
+	return pu
+}
+
+func (pa *ProcessAccounting) packageUsage(pi *ProcessIdentity) *PackageUsage {
+	pkg := pi.Package()
+	pu, ok := pa.Packages[pkg]
+	if !ok {
+		pu = new(PackageUsage)
+		pu.Package = pkg
+		pu.Uid = cpuprof.UID_UNKNOWN
+		pa.Packages[pkg] = pu
+	}
+	if pu.Uid == cpuprof.UID_UNKNOWN {
+		pu.Uid = pi.Uid
+	}
+	return pu
+}
+
+// resolve returns the app process of a thread at token, or nil if it is not
+// known
+func (pa *ProcessAccounting) resolve(pid int, tgid int, comm string, token int64) *ProcessIdentity {
+	if pa.Resolver == nil {
+		return nil
+	}
+	// Only the main thread is named after the process
+	if pid != tgid {
+		comm = ""
+	}
+	return pa.Resolver.Resolve(tgid, comm, token)
+}
+
+// AddWindow aggregates a window that ended at LogcatToken token
+func (pa *ProcessAccounting) AddWindow(pcsi *cpuprof.PeriodicCtxSwitchInfo, token int64) {
+	pa.Windows++
+	for _, info := range pcsi.Info {
+		pa.TotalRtime += info.Rtime
+		if info.IsIdle() {
+			pa.IdleRtime += info.Rtime
+			continue
+		}
+		pa.usage(ProcessKey{pa.BootId, info.Pid, info.Tgid, info.Comm}).addInfo(info)
+		if pi := pa.resolve(info.Pid, info.Tgid, info.Comm, token); pi != nil {
+			pa.packageUsage(pi).add(&PackageUsage{
+				Uid:     pi.Uid,
+				Utime:   info.Utime,
+				Stime:   info.Stime,
+				Rtime:   info.Rtime,
+				BgRtime: info.BgRtime,
+				Windows: 1,
+			})
+		}
+	}
+}
+
+// AddForeground adds seconds of foreground time to the app that came to the
+// foreground at LogcatToken token
+func (pa *ProcessAccounting) AddForeground(ppf *cpuprof.PhonelabProcForeground, token int64, seconds float64) {
+	if pi := pa.resolve(ppf.Pid, ppf.Tgid, ppf.Comm, token); pi != nil {
+		pa.packageUsage(pi).ForegroundTime += seconds
+	}
+}
+
+// Merge adds the usage in other, such as that of another boot. Processes of
+// different boots are kept apart; packages are summed.
+func (pa *ProcessAccounting) Merge(other *ProcessAccounting) {
+	pa.Windows += other.Windows
+	pa.IdleRtime += other.IdleRtime
+	pa.TotalRtime += other.TotalRtime
+	pa.Completeness.Add(&other.Completeness)
+	for key, pu := range other.Processes {
+		pa.usage(key).add(pu)
+	}
+	for pkg, pu := range other.Packages {
+		mine, ok := pa.Packages[pkg]
+		if !ok {
+			mine = &PackageUsage{Package: pkg, Uid: cpuprof.UID_UNKNOWN}
+			pa.Packages[pkg] = mine
+		}
+		mine.add(pu)
+	}
+}
+
+// Top returns the n processes with the most Rtime
+func (pa *ProcessAccounting) Top(n int) []*ProcessUsage {
+	all := make(processUsageSlice, 0, len(pa.Processes))
+	for _, pu := range pa.Processes {
+		all = append(all, pu)
+	}
+	sort.Sort(all)
+	if n < len(all) {
+		all = all[:n]
+	}
+	return all
+}
+
+// TopPackages returns the n packages with the most Rtime
+func (pa *ProcessAccounting) TopPackages(n int) []*PackageUsage {
+	all := make(packageUsageSlice, 0, len(pa.Packages))
+	for _, pu := range pa.Packages {
+		all = append(all, pu)
+	}
+	sort.Sort(all)
+	if n < len(all) {
+		all = all[:n]
+	}
+	return all
+}
+
+// AccountBootProcesses aggregates every complete periodic ctx switch info
+// window of boot. Windows that are incomplete or merged are only counted in
+// Completeness. If resolver is not nil, CPU time and foreground time are also
+// aggregated by the package of the processes it resolves.
+func AccountBootProcesses(ctx context.Context, boot *Boot, resolver *ProcessResolver) (*ProcessAccounting, error) {
+	pa := NewProcessAccounting()
+	pa.BootId = boot.BootId
+	pa.Resolver = resolver
+
+	filter := filters.New()
+	pcsiTracker := filters.NewPeriodicCtxSwitchInfoTracker(filter)
+	filter.Bus.OnCtxSwitchInfoCollected(func(event *filters.CtxSwitchInfoCollected) {
+		if event.Info.Complete() {
+			pa.AddWindow(event.Info, event.Source().LogcatToken)
+		}
+	})
+
+	patterns := []string{"phonelab_periodic_ctx_switch"}
+	// The app in the foreground and the logline it came to the foreground on
+	var foreground *filters.ForegroundChanged
+	if resolver != nil {
+		filters.NewFgBgTracker(filter)
+		filter.Bus.OnForegroundChanged(func(event *filters.ForegroundChanged) {
+			if foreground != nil {
+				pa.AddForeground(foreground.Proc, foreground.Logline.LogcatToken, event.Logline.TraceTime-foreground.Logline.TraceTime)
+			}
+			foreground = nil
+			if event.Proc != nil {
+				foreground = event
+			}
+		})
+		patterns = append(patterns, "phonelab_proc_foreground")
+	}
+
+	opts := ReadOptions{Filters: []filters.LineFilter{func(line string) bool {
+		for _, pattern := range patterns {
+			if strings.Contains(line, pattern) {
+				return true
+			}
+		}
+		return false
+	}}}
+	var last *cpuprof.Logline
+	err := boot.ScanFrom(ctx, opts, func(logline *cpuprof.Logline) error {
+		filter.ApplyLogline(logline)
+		last = logline
+		return nil
+	})
+	filter.Finish()
+	if foreground != nil {
+		pa.AddForeground(foreground.Proc, foreground.Logline.LogcatToken, last.TraceTime-foreground.Logline.TraceTime)
+	}
+	pa.Completeness = pcsiTracker.Completeness
+	pa.Resolver = nil
+	return pa, err
+}
+
+// DeviceProcessUsage is the output of ProcessAccountingMain for one device
+type DeviceProcessUsage struct {
+	Windows      int64
+	IdleRtime    int64
+	TotalRtime   int64
+	Completeness filters.CtxSwitchCompleteness
+	Top          []*ProcessUsage
+	TopPackages  []*PackageUsage
+}
+
+func ProcessAccountingMain(args []string) {
+	parser := SetupParser()
+	top := parser.Flag("top", "Number of processes to report per device").Default(fmt.Sprintf("%v", DEFAULT_TOP_PROCESSES)).Int()
+	ParseArgs(parser, args)
+
+	ds := NewDataset(Path)
+	devices := Devices
+	if len(devices) == 0 {
+		var err error
+		if devices, err = ds.Devices(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+	}
+
+	mutex := new(sync.Mutex)
+	result := make(map[string]*DeviceProcessUsage)
+
+	deviceWg := new(sync.WaitGroup)
+	deviceSem := gsync.NewSem(20)
+	processDevice := func(device string) {
+		defer deviceWg.Done()
+		defer deviceSem.V()
+
+		boots, err := ds.Boots(device)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		pa := NewProcessAccounting()
+		for _, boot := range boots {
+			resolver, err := ResolveBootProcesses(context.Background(), boot)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, fmt.Sprintf("%v -> %v: %v", device, boot.BootId, err))
+				continue
+			}
+			bpa, err := AccountBootProcesses(context.Background(), boot, resolver)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, fmt.Sprintf("%v -> %v: %v", device, boot.BootId, err))
+				continue
+			}
+			pa.Merge(bpa)
+		}
+		mutex.Lock()
+		result[device] = &DeviceProcessUsage{pa.Windows, pa.IdleRtime, pa.TotalRtime, pa.Completeness, pa.Top(*top), pa.TopPackages(*top)}
+		mutex.Unlock()
+		fmt.Println("Finished processing Device:", device)
+	}
+
+	for _, device := range devices {
+		deviceWg.Add(1)
+		deviceSem.P()
+		go processDevice(device)
+	}
+	deviceWg.Wait()
+
+	if b, err := json.MarshalIndent(result, "", "  "); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	} else {
+		ioutil.WriteFile(PROCESS_ACCOUNTING_FILE, b, 0664)
+	}
+}
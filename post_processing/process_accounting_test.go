@@ -0,0 +1,147 @@
+package post_processing
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Every window has two info lines. log_idx numbers the windows.
+func ctxSwitchMarkerLine(bootid string, token int, state string, cpu int, log_idx int) string {
+	return catalogueLine(bootid, 10, token, fmt.Sprintf("Kernel-Trace: kworker/%d:1-17 [00%d] ...2     %d.000000: phonelab_periodic_ctx_switch_marker: %s cpu=%d count=2 log_idx=%d", cpu, cpu, token, state, cpu, log_idx))
+}
+
+func ctxSwitchInfoLine(bootid string, token int, cpu int, log_idx int, pid int, comm string, rtime int) string {
+	return catalogueLine(bootid, 10, token, fmt.Sprintf("Kernel-Trace: kworker/%d:1-17 [00%d] ...2     %d.000000: phonelab_periodic_ctx_switch_info: cpu=%d pid=%d tgid=%d nice=0 comm=%s utime=%d stime=%d rtime=%d bg_utime=0 bg_stime=0 bg_rtime=%d s_run=1 s_int=2 s_unint=0 s_oth=0 log_idx=%d rx=10 tx=5", cpu, cpu, token, cpu, pid, pid, comm, rtime/2, rtime/2, rtime, rtime/10, log_idx))
+}
+
+func TestProcessAccounting(t *testing.T) {
+	assert := assert.New(t)
+
+	path, err := ioutil.TempDir("", "process_accounting")
+	assert.Nil(err)
+	defer os.RemoveAll(path)
+
+	boot1 := "453fea81-57cc-43e0-9693-91f63b0433b9"
+	boot2 := "29b2b79e-1a97-4f96-8070-7a26f952e92b"
+	writeShard(t, filepath.Join(path, testDeviceA, boot1, "00000000.gz"), []string{
+		ctxSwitchMarkerLine(boot1, 1, "BEGIN", 0, 7),
+		ctxSwitchInfoLine(boot1, 2, 0, 7, 0, "swapper/0", 500),
+		ctxSwitchInfoLine(boot1, 3, 0, 7, 100, "app", 300),
+		ctxSwitchMarkerLine(boot1, 4, "END", 0, 7),
+		ctxSwitchMarkerLine(boot1, 5, "BEGIN", 1, 7),
+		ctxSwitchInfoLine(boot1, 6, 1, 7, 100, "app", 200),
+		ctxSwitchInfoLine(boot1, 7, 1, 7, 200, "system_server", 400),
+		ctxSwitchMarkerLine(boot1, 8, "END", 1, 7),
+		// Never ends
+		ctxSwitchMarkerLine(boot1, 9, "BEGIN", 2, 7),
+		ctxSwitchInfoLine(boot1, 10, 2, 7, 300, "incomplete", 9000),
+	})
+	writeShard(t, filepath.Join(path, testDeviceA, boot2, "00000000.gz"), []string{
+		ctxSwitchMarkerLine(boot2, 1, "BEGIN", 0, 1),
+		ctxSwitchInfoLine(boot2, 2, 0, 1, 100, "app", 100),
+		ctxSwitchInfoLine(boot2, 3, 0, 1, 0, "swapper/0", 100),
+		ctxSwitchMarkerLine(boot2, 4, "END", 0, 1),
+	})
+
+	b1, err := NewBoot(path, testDeviceA, boot1)
+	assert.Nil(err)
+	pa, err := AccountBootProcesses(context.Background(), b1, nil)
+	assert.Nil(err)
+	assert.Equal(int64(2), pa.Windows)
+	assert.Equal(int64(500), pa.IdleRtime)
+	assert.Equal(int64(1400), pa.TotalRtime)
+	assert.Equal(2, len(pa.Processes))
+	assert.Equal(0, len(pa.Packages))
+	assert.Equal(int64(3), pa.Completeness.Windows)
+	assert.Equal(int64(1), pa.Completeness.Incomplete)
+
+	app := pa.Processes[ProcessKey{boot1, 100, 100, "app"}]
+	assert.Equal(&ProcessUsage{ProcessKey{boot1, 100, 100, "app"}, 250, 250, 500, 0, 0, 50, 2, 4, 0, 0, 20, 10, 2}, app)
+
+	b2, err := NewBoot(path, testDeviceA, boot2)
+	assert.Nil(err)
+	other, err := AccountBootProcesses(context.Background(), b2, nil)
+	assert.Nil(err)
+	pa.Merge(other)
+	assert.Equal(int64(3), pa.Windows)
+
+	// The pid 100 of each boot is a process of its own
+	top := pa.Top(5)
+	assert.Equal(3, len(top))
+	assert.Equal(ProcessKey{boot1, 100, 100, "app"}, top[0].ProcessKey)
+	assert.Equal(int64(500), top[0].Rtime)
+	assert.Equal("system_server", top[1].Comm)
+	assert.Equal(ProcessKey{boot2, 100, 100, "app"}, top[2].ProcessKey)
+	assert.Equal(int64(100), top[2].Rtime)
+	assert.Equal(1, len(pa.Top(1)))
+}
+
+func foregroundLine(bootid string, token int, pid int, comm string) string {
+	return catalogueLine(bootid, 10, token, fmt.Sprintf("Kernel-Trace: %s-%d [000] ...1     %d.000000: phonelab_proc_foreground: pid=%d tgid=%d comm=%s", comm, pid, token, pid, pid, comm))
+}
+
+func TestProcessAccountingPackages(t *testing.T) {
+	assert := assert.New(t)
+
+	path, err := ioutil.TempDir("", "process_accounting")
+	assert.Nil(err)
+	defer os.RemoveAll(path)
+
+	bootid := "453fea81-57cc-43e0-9693-91f63b0433b9"
+	writeShard(t, filepath.Join(path, testDeviceA, bootid, "00000000.gz"), []string{
+		catalogueLine(bootid, 10, 1, "ActivityManager: Start proc 100:com.android.dialer/u0a12 for activity com.android.dialer/.DialtactsActivity"),
+		foregroundLine(bootid, 2, 100, ".android.dialer"),
+		ctxSwitchMarkerLine(bootid, 3, "BEGIN", 0, 1),
+		ctxSwitchInfoLine(bootid, 4, 0, 1, 100, ".android.dialer", 300),
+		ctxSwitchInfoLine(bootid, 5, 0, 1, 0, "swapper/0", 100),
+		ctxSwitchMarkerLine(bootid, 6, "END", 0, 1),
+		catalogueLine(bootid, 10, 7, "ActivityManager: Process com.android.dialer (pid 100) has died"),
+		// The pid is reused by another app
+		catalogueLine(bootid, 10, 8, "ActivityManager: Start proc 100:com.google.android.gms:persistent/u0a15 for service com.google.android.gms/.Service"),
+		foregroundLine(bootid, 10, 100, ".gms:persistent"),
+		ctxSwitchMarkerLine(bootid, 11, "BEGIN", 0, 2),
+		ctxSwitchInfoLine(bootid, 12, 0, 2, 100, ".gms:persistent", 200),
+		// Started before logging began; resolved by its comm
+		ctxSwitchInfoLine(bootid, 13, 0, 2, 300, ".android.dialer", 50),
+		ctxSwitchMarkerLine(bootid, 14, "END", 0, 2),
+		foregroundLine(bootid, 16, 0, "swapper/0"),
+		ctxSwitchMarkerLine(bootid, 20, "BEGIN", 0, 3),
+	})
+
+	boot, err := NewBoot(path, testDeviceA, bootid)
+	assert.Nil(err)
+	resolver, err := ResolveBootProcesses(context.Background(), boot)
+	assert.Nil(err)
+	pa, err := AccountBootProcesses(context.Background(), boot, resolver)
+	assert.Nil(err)
+	assert.Nil(pa.Resolver)
+	assert.Equal(3, len(pa.Processes))
+
+	assert.Equal(2, len(pa.Packages))
+	dialer := pa.Packages["com.android.dialer"]
+	assert.Equal(10012, dialer.Uid)
+	assert.Equal(int64(350), dialer.Rtime)
+	assert.Equal(int64(2), dialer.Windows)
+	assert.Equal(8.0, dialer.ForegroundTime)
+	gms := pa.Packages["com.google.android.gms"]
+	assert.Equal(10015, gms.Uid)
+	assert.Equal(int64(200), gms.Rtime)
+	// In the background from the pid=0 logline at 16
+	assert.Equal(6.0, gms.ForegroundTime)
+
+	top := pa.TopPackages(1)
+	assert.Equal(1, len(top))
+	assert.Equal("com.android.dialer", top[0].Package)
+
+	other := NewProcessAccounting()
+	other.Merge(pa)
+	other.Merge(pa)
+	assert.Equal(int64(700), other.Packages["com.android.dialer"].Rtime)
+	assert.Equal(10012, other.Packages["com.android.dialer"].Uid)
+}
@@ -0,0 +1,154 @@
+package post_processing
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gurupras/go_cpuprof"
+	"github.com/gurupras/go_cpuprof/post_processing/filters"
+)
+
+// EndToken of a process that was still alive at the end of the boot
+const PROCESS_ALIVE int64 = -1
+
+// ProcessIdentity is an app process from the logline that started it to the
+// logline that reported it gone. A process that was started before logging
+// began starts at token 0.
+type ProcessIdentity struct {
+	Pid        int
+	Uid        int
+	Process    string
+	StartToken int64
+	EndToken   int64
+	// Resolved from the comm of the process's main thread rather than from
+	// ActivityManager loglines about its pid
+	Inferred bool
+}
+
+func (pi *ProcessIdentity) Package() string {
+	return cpuprof.ProcessPackage(pi.Process)
+}
+
+func (pi *ProcessIdentity) covers(token int64) bool {
+	return pi.StartToken <= token && (pi.EndToken == PROCESS_ALIVE || token <= pi.EndToken)
+}
+
+// ProcessResolver maps the pids of a boot to app processes using the
+// ActivityManager loglines of the boot. Pids are reused, so a pid maps to
+// different processes at different LogcatTokens. It is a filters.Tracker.
+type ProcessResolver struct {
+	identities map[int][]*ProcessIdentity
+	// Uid of every process name seen; UID_UNKNOWN if never logged
+	processes map[string]int
+	// Process each comm resolves to; empty if none or ambiguous
+	comms map[string]string
+}
+
+func NewProcessResolver() *ProcessResolver {
+	r := new(ProcessResolver)
+	r.identities = make(map[int][]*ProcessIdentity)
+	r.processes = make(map[string]int)
+	r.comms = make(map[string]string)
+	return r
+}
+
+// open returns the identity of pid that has not ended yet
+func (r *ProcessResolver) open(pid int) *ProcessIdentity {
+	identities := r.identities[pid]
+	if len(identities) == 0 {
+		return nil
+	}
+	if last := identities[len(identities)-1]; last.EndToken == PROCESS_ALIVE {
+		return last
+	}
+	return nil
+}
+
+func (r *ProcessResolver) Update(logline *cpuprof.Logline) {
+	amp := cpuprof.ParseActivityManagerProc(logline)
+	if amp == nil {
+		return
+	}
+	if uid, ok := r.processes[amp.Process]; !ok || uid == cpuprof.UID_UNKNOWN {
+		if !ok {
+			// A new name can change what comms resolve to
+			r.comms = make(map[string]string)
+		}
+		r.processes[amp.Process] = amp.Uid
+	}
+	uid := r.processes[amp.Process]
+	token := logline.LogcatToken
+
+	switch amp.State {
+	case cpuprof.AM_PROC_START:
+		if pi := r.open(amp.Pid); pi != nil {
+			// The pid was reused without its death being logged
+			pi.EndToken = token
+		}
+		r.identities[amp.Pid] = append(r.identities[amp.Pid], &ProcessIdentity{amp.Pid, uid, amp.Process, token, PROCESS_ALIVE, false})
+	case cpuprof.AM_PROC_DIED:
+		pi := r.open(amp.Pid)
+		if pi == nil || strings.Compare(pi.Process, amp.Process) != 0 {
+			if pi != nil {
+				pi.EndToken = token
+			}
+			start := int64(0)
+			if identities := r.identities[amp.Pid]; len(identities) > 0 {
+				start = identities[len(identities)-1].EndToken
+			}
+			pi = &ProcessIdentity{amp.Pid, uid, amp.Process, start, PROCESS_ALIVE, false}
+			r.identities[amp.Pid] = append(r.identities[amp.Pid], pi)
+		}
+		pi.EndToken = token
+	}
+}
+
+// Resolve returns the process pid belonged to at token, or nil if it is not
+// known. pid is a process id, the tgid of a thread. comm is the name of the
+// process's main thread, or empty if it is not known; when no ActivityManager
+// logline covers pid at token, a comm that matches the tail of exactly one
+// process name seen in the boot resolves to that process.
+func (r *ProcessResolver) Resolve(pid int, comm string, token int64) *ProcessIdentity {
+	identities := r.identities[pid]
+	for idx := len(identities) - 1; idx >= 0; idx-- {
+		if identities[idx].covers(token) {
+			return identities[idx]
+		}
+	}
+	if comm == "" {
+		return nil
+	}
+	process, ok := r.comms[comm]
+	if !ok {
+		for name := range r.processes {
+			if !cpuprof.CommMatches(comm, name) {
+				continue
+			}
+			if process != "" {
+				// Ambiguous
+				process = ""
+				break
+			}
+			process = name
+		}
+		r.comms[comm] = process
+	}
+	if process == "" {
+		return nil
+	}
+	return &ProcessIdentity{pid, r.processes[process], process, token, token, true}
+}
+
+// ResolveBootProcesses builds a ProcessResolver from the ActivityManager
+// loglines of boot
+func ResolveBootProcesses(ctx context.Context, boot *Boot) (*ProcessResolver, error) {
+	r := NewProcessResolver()
+	opts := ReadOptions{Filters: []filters.LineFilter{func(line string) bool {
+		return strings.Contains(line, "ActivityManager")
+	}}}
+	err := boot.ScanFrom(ctx, opts, func(logline *cpuprof.Logline) error {
+		r.Update(logline)
+		return nil
+	})
+	return r, err
+}
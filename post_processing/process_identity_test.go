@@ -0,0 +1,41 @@
+package post_processing
+
+import (
+	"testing"
+
+	"github.com/gurupras/go_cpuprof"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessResolver(t *testing.T) {
+	assert := assert.New(t)
+
+	bootid := "453fea81-57cc-43e0-9693-91f63b0433b9"
+	r := NewProcessResolver()
+	for _, line := range []string{
+		catalogueLine(bootid, 10, 5, "ActivityManager: Process com.android.chrome (pid 100) has died"),
+		catalogueLine(bootid, 10, 10, "ActivityManager: Start proc 100:com.android.dialer/u0a12 for activity com.android.dialer/.DialtactsActivity"),
+		// Death of the dialer was not logged
+		catalogueLine(bootid, 10, 20, "ActivityManager: Start proc 100:com.google.android.gms/u0a15 for service com.google.android.gms/.Service"),
+		catalogueLine(bootid, 10, 25, "ActivityManager: Start proc 200:com.google.android.gms:persistent/u0a15 for service com.google.android.gms/.Persistent"),
+		catalogueLine(bootid, 10, 30, "ActivityManager: Killing 100:com.google.android.gms/u0a15 (adj 15): empty #17"),
+	} {
+		r.Update(cpuprof.ParseLogline(line))
+	}
+
+	assert.Equal("com.android.chrome", r.Resolve(100, "", 1).Process)
+	assert.Equal(cpuprof.UID_UNKNOWN, r.Resolve(100, "", 1).Uid)
+	assert.Equal("com.android.dialer", r.Resolve(100, "", 15).Process)
+	assert.Equal(10012, r.Resolve(100, "", 15).Uid)
+	assert.Equal("com.google.android.gms", r.Resolve(100, "", 30).Process)
+	assert.Nil(r.Resolve(100, "", 31))
+	assert.Nil(r.Resolve(300, "", 15))
+
+	pi := r.Resolve(300, ".android.dialer", 40)
+	assert.True(pi.Inferred)
+	assert.Equal("com.android.dialer", pi.Package())
+	assert.Equal(10012, pi.Uid)
+	// A truncated comm resolves to the one process whose name ends in it
+	assert.Equal("com.google.android.gms:persistent", r.Resolve(300, ".gms:persistent", 40).Process)
+	assert.Nil(r.Resolve(300, "Binder_1", 40))
+}
@@ -153,15 +153,18 @@ func tbcBootConsumer(bootid string, channel chan string, outChannel chan *TbcChu
 	cpuStateMap := make(map[string]*filters.CpuTrackerData, 0)
 	filter := filters.New()
 	cpuTracker := filters.NewCpuTracker(filter)
-	cpuTrackerCallback := func(trace cpuprof.TraceInterface, cpu int) {
+	trackCpu := func(cpu int) {
 		cpuStateMap[fmt.Sprintf("%v", cpu)] = cpuTracker.CurrentState[cpu]
 	}
-	cpuTracker.Callback = cpuTrackerCallback
+	filter.Bus.OnFrequencyChanged(func(event *filters.FrequencyChanged) {
+		trackCpu(event.Cpu)
+	})
+	filter.Bus.OnCpuHotplugged(func(event *filters.CpuHotplugged) {
+		trackCpu(event.Cpu)
+	})
 
 	fgbgTracker := filters.NewFgBgTracker(filter)
 
-	filterList := filter.AsLineFilterArray()
-
 	for {
 		_ = last_healthd
 		healthd = nil
@@ -177,11 +180,8 @@ func tbcBootConsumer(bootid string, channel chan string, outChannel chan *TbcChu
 			continue
 		}
 
-		for _, f := range filterList {
-			// XXX: Right now, no checks..
-			// just running them through filter functions
-			f(logline)
-		}
+		// The trackers are only used for their state; every line is processed
+		filter.ApplyLogline(logline)
 
 		lines_processed++
 		if lines_processed%100000 == 0 {
@@ -212,8 +212,8 @@ func tbcBootConsumer(bootid string, channel chan string, outChannel chan *TbcChu
 		if strings.Compare(logline.Tag, "KernelPrintk") == 0 &&
 			strings.Contains(logline.Payload, "healthd") &&
 			strings.Contains(logline.Payload, "chg") {
-			is_healthd_line = true
 			healthd = cpuprof.ParseHealthdPrintk(logline)
+			is_healthd_line = healthd != nil
 		}
 		if is_healthd_line {
 			if recent_event {
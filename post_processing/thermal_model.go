@@ -0,0 +1,392 @@
+package post_processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gurupras/go_cpuprof"
+	"github.com/gurupras/go_cpuprof/post_processing/filters"
+	"github.com/gurupras/gocommons/gsync"
+)
+
+const (
+	THERMAL_MODEL_FILE = "thermal-model.json"
+)
+
+// SensorDistribution is the time a sensor spent at each temperature, in
+// seconds of TraceTime
+type SensorDistribution struct {
+	Sensor    int
+	Label     string
+	Time      float64
+	Histogram map[int]float64
+	Mean      float64
+	Min       int
+	Max       int
+}
+
+func newSensorDistribution(sensor int, label string) *SensorDistribution {
+	sd := new(SensorDistribution)
+	sd.Sensor = sensor
+	sd.Label = label
+	sd.Histogram = make(map[int]float64)
+	sd.Min = filters.TEMPERATURE_UNKNOWN
+	sd.Max = filters.TEMPERATURE_UNKNOWN
+	return sd
+}
+
+func (sd *SensorDistribution) add(temp int, duration float64) {
+	if duration <= 0 {
+		return
+	}
+	sd.Histogram[temp] += duration
+	sd.Mean = (sd.Mean*sd.Time + float64(temp)*duration) / (sd.Time + duration)
+	sd.Time += duration
+	if sd.Min == filters.TEMPERATURE_UNKNOWN || temp < sd.Min {
+		sd.Min = temp
+	}
+	if temp > sd.Max {
+		sd.Max = temp
+	}
+}
+
+// Sorts by Sensor
+type sensorDistributionSlice []*SensorDistribution
+
+func (s sensorDistributionSlice) Len() int {
+	return len(s)
+}
+
+func (s sensorDistributionSlice) Less(i, j int) bool {
+	return s[i].Sensor < s[j].Sensor
+}
+
+func (s sensorDistributionSlice) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// correlationSums are the running sums of a Pearson correlation, so that
+// samples of several boots can be added up
+type correlationSums struct {
+	N  int
+	X  float64
+	Y  float64
+	XX float64
+	YY float64
+	XY float64
+}
+
+func (c *correlationSums) add(x float64, y float64) {
+	c.N++
+	c.X += x
+	c.Y += y
+	c.XX += x * x
+	c.YY += y * y
+	c.XY += x * y
+}
+
+// Correlation is 0 if either series is constant
+func (c *correlationSums) Correlation() float64 {
+	n := float64(c.N)
+	cov := n*c.XY - c.X*c.Y
+	vx := n*c.XX - c.X*c.X
+	vy := n*c.YY - c.Y*c.Y
+	if vx <= 0 || vy <= 0 {
+		return 0
+	}
+	return cov / math.Sqrt(vx*vy)
+}
+
+// SensorPair is how closely the temperature of sensor B follows that of A.
+// Lag is the seconds by which B trails A where they correlate best; it is
+// negative if B leads.
+type SensorPair struct {
+	A              int
+	B              int
+	LabelA         string
+	LabelB         string
+	Samples        int
+	Correlation    float64
+	Lag            float64
+	LagCorrelation float64
+}
+
+// ThermalModel is the temperature distribution of every sensor of a device
+// and the correlation of every pair of sensors at lags of up to MaxLagSec.
+// Sensors are sampled every SamplePeriod seconds.
+type ThermalModel struct {
+	Labels       cpuprof.SensorLabels
+	SamplePeriod float64
+	MaxLagSec    float64
+	sensors      map[int]*SensorDistribution
+	// Sums for every pair of sensors, A < B, and every lag in samples from
+	// -maxLag to maxLag
+	pairs map[[2]int][]*correlationSums
+}
+
+func NewThermalModel(labels cpuprof.SensorLabels, samplePeriod float64, maxLagSec float64) *ThermalModel {
+	tm := new(ThermalModel)
+	tm.Labels = labels
+	tm.SamplePeriod = samplePeriod
+	tm.MaxLagSec = maxLagSec
+	tm.sensors = make(map[int]*SensorDistribution)
+	tm.pairs = make(map[[2]int][]*correlationSums)
+	return tm
+}
+
+func (tm *ThermalModel) maxLag() int {
+	return int(tm.MaxLagSec / tm.SamplePeriod)
+}
+
+// sampleIntervals samples ivs every period from start, n times. Samples that
+// fall outside every interval are NaN.
+func sampleIntervals(ivs filters.Intervals, start float64, period float64, n int) []float64 {
+	samples := make([]float64, n)
+	idx := 0
+	for i := 0; i < n; i++ {
+		t := start + float64(i)*period
+		for idx < len(ivs) && ivs[idx].End <= t {
+			idx++
+		}
+		if idx < len(ivs) && ivs[idx].Start <= t {
+			samples[i] = float64(ivs[idx].State)
+		} else {
+			samples[i] = math.NaN()
+		}
+	}
+	return samples
+}
+
+// AddBoot adds the temperatures thermalTracker recorded over a boot. The
+// tracker must be finished.
+func (tm *ThermalModel) AddBoot(thermalTracker *filters.ThermalTracker) {
+	sensors := thermalTracker.Sensors()
+	start := math.Inf(1)
+	end := math.Inf(-1)
+	for _, sensor := range sensors {
+		sd, ok := tm.sensors[sensor]
+		if !ok {
+			sd = newSensorDistribution(sensor, tm.Labels.Label(sensor))
+			tm.sensors[sensor] = sd
+		}
+		ivs := thermalTracker.TemperatureIntervals(sensor)
+		for _, iv := range ivs {
+			sd.add(iv.State, iv.Duration())
+		}
+		if len(ivs) > 0 {
+			start = math.Min(start, ivs[0].Start)
+			end = math.Max(end, ivs[len(ivs)-1].End)
+		}
+	}
+	if end <= start || tm.SamplePeriod <= 0 {
+		return
+	}
+
+	n := int((end-start)/tm.SamplePeriod) + 1
+	samples := make(map[int][]float64)
+	for _, sensor := range sensors {
+		samples[sensor] = sampleIntervals(thermalTracker.TemperatureIntervals(sensor), start, tm.SamplePeriod, n)
+	}
+	maxLag := tm.maxLag()
+	for i, a := range sensors {
+		for _, b := range sensors[i+1:] {
+			key := [2]int{a, b}
+			lags, ok := tm.pairs[key]
+			if !ok {
+				lags = make([]*correlationSums, 2*maxLag+1)
+				for idx := range lags {
+					lags[idx] = new(correlationSums)
+				}
+				tm.pairs[key] = lags
+			}
+			for lag := -maxLag; lag <= maxLag; lag++ {
+				sums := lags[lag+maxLag]
+				// B at t+lag against A at t
+				for t := 0; t < n; t++ {
+					if t+lag < 0 || t+lag >= n {
+						continue
+					}
+					x := samples[a][t]
+					y := samples[b][t+lag]
+					if math.IsNaN(x) || math.IsNaN(y) {
+						continue
+					}
+					sums.add(x, y)
+				}
+			}
+		}
+	}
+}
+
+// Sensors returns the distribution of every sensor, by sensor id
+func (tm *ThermalModel) Sensors() []*SensorDistribution {
+	sensors := make([]*SensorDistribution, 0, len(tm.sensors))
+	for _, sd := range tm.sensors {
+		sensors = append(sensors, sd)
+	}
+	sort.Sort(sensorDistributionSlice(sensors))
+	return sensors
+}
+
+// Pairs returns the correlation and lag of every pair of sensors that were
+// ever known at the same time
+func (tm *ThermalModel) Pairs() []*SensorPair {
+	pairs := make([]*SensorPair, 0, len(tm.pairs))
+	maxLag := tm.maxLag()
+	sensors := tm.Sensors()
+	for _, sd := range sensors {
+		for _, other := range sensors {
+			lags, ok := tm.pairs[[2]int{sd.Sensor, other.Sensor}]
+			if !ok || lags[maxLag].N == 0 {
+				continue
+			}
+			pair := &SensorPair{A: sd.Sensor, B: other.Sensor, LabelA: sd.Label, LabelB: other.Label}
+			pair.Samples = lags[maxLag].N
+			pair.Correlation = lags[maxLag].Correlation()
+			pair.LagCorrelation = pair.Correlation
+			best := 0
+			for idx, sums := range lags {
+				// Ties go to the smallest lag
+				lag := idx - maxLag
+				if c := sums.Correlation(); c > pair.LagCorrelation || (c == pair.LagCorrelation && abs(lag) < abs(best)) {
+					best = lag
+					pair.LagCorrelation = c
+				}
+			}
+			pair.Lag = float64(best) * tm.SamplePeriod
+			pairs = append(pairs, pair)
+		}
+	}
+	return pairs
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// BootThermalModel adds the temperatures of the boot bi describes to tm. The
+// last temperature of a sensor lasts until the end of the boot.
+func (ds *Dataset) BootThermalModel(ctx context.Context, bi *BootInfo, tm *ThermalModel) error {
+	boot, err := ds.Boot(bi)
+	if err != nil {
+		return err
+	}
+
+	filter := filters.New()
+	thermalTracker := filters.NewThermalTracker(filter)
+	thermalTracker.RecordIntervals = true
+	opts := ReadOptions{Filters: []filters.LineFilter{func(line string) bool {
+		return strings.Contains(line, "Kernel-Trace") && strings.Contains(line, "thermal_temp:")
+	}}}
+	err = boot.ScanFrom(ctx, opts, func(logline *cpuprof.Logline) error {
+		filter.ApplyLogline(logline)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	thermalTracker.Finish(&cpuprof.Logline{BootId: bi.BootId, Datetime: bi.LastTime, TraceTime: bi.LastTraceTime})
+	tm.AddBoot(thermalTracker)
+	return nil
+}
+
+// LoadSensorLabels reads the sensor labels of device models from a JSON file
+// of model to sensor id to label. They are used in place of the labels
+// declared in cpuprof.ThermalSensorLabels.
+func LoadSensorLabels(file string) (map[string]cpuprof.SensorLabels, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	labels := make(map[string]cpuprof.SensorLabels)
+	if err = json.Unmarshal(b, &labels); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+// DeviceThermalModel is the output of ThermalModelMain for one device
+type DeviceThermalModel struct {
+	Model   string
+	Sensors []*SensorDistribution
+	Pairs   []*SensorPair
+}
+
+func ThermalModelMain(args []string) {
+	parser := SetupParser()
+	labelsFile := parser.Flag("sensor-labels", "JSON file of device model to sensor id to label").String()
+	samplePeriod := parser.Flag("sample-period", "Seconds between the samples that sensors are correlated over").Default("5").Float64()
+	maxLag := parser.Flag("max-lag", "Largest lag in seconds to look for between sensors").Default("60").Float64()
+	ParseArgs(parser, args)
+
+	labels := cpuprof.ThermalSensorLabels
+	if *labelsFile != "" {
+		var err error
+		if labels, err = LoadSensorLabels(*labelsFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+	}
+
+	ds := NewDataset(Path)
+	catalogue, err := ds.Catalogue()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	devices := Devices
+	if len(devices) == 0 {
+		for device := range catalogue.Devices {
+			devices = append(devices, device)
+		}
+	}
+
+	mutex := new(sync.Mutex)
+	result := make(map[string]*DeviceThermalModel)
+
+	deviceWg := new(sync.WaitGroup)
+	deviceSem := gsync.NewSem(20)
+	processDevice := func(device string) {
+		defer deviceWg.Done()
+		defer deviceSem.V()
+
+		di, ok := catalogue.Devices[device]
+		if !ok {
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("Unknown device: %v", device))
+			return
+		}
+		tm := NewThermalModel(labels[di.Model], *samplePeriod, *maxLag)
+		for _, bi := range di.Boots {
+			if err := ds.BootThermalModel(context.Background(), bi, tm); err != nil {
+				fmt.Fprintln(os.Stderr, fmt.Sprintf("%v -> %v: %v", device, bi.BootId, err))
+			}
+		}
+		mutex.Lock()
+		result[device] = &DeviceThermalModel{di.Model, tm.Sensors(), tm.Pairs()}
+		mutex.Unlock()
+		fmt.Println("Finished processing Device:", device)
+	}
+
+	for _, device := range devices {
+		deviceWg.Add(1)
+		deviceSem.P()
+		go processDevice(device)
+	}
+	deviceWg.Wait()
+
+	if b, err := json.MarshalIndent(result, "", "  "); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	} else {
+		ioutil.WriteFile(THERMAL_MODEL_FILE, b, 0664)
+	}
+}
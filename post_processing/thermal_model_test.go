@@ -0,0 +1,77 @@
+package post_processing
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gurupras/go_cpuprof"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThermalModel(t *testing.T) {
+	assert := assert.New(t)
+
+	path, err := ioutil.TempDir("", "thermal_model")
+	assert.Nil(err)
+	defer os.RemoveAll(path)
+
+	bootid := "453fea81-57cc-43e0-9693-91f63b0433b9"
+	lines := make([]string, 0)
+	// Sensor 5 follows sensor 0 two seconds later
+	for _, sample := range [][2]int{{1, 40}, {3, 50}, {6, 45}, {8, 55}, {11, 42}} {
+		lines = append(lines, kernelTraceLine(bootid, sample[0], fmt.Sprintf("thermal_temp: sensor_id=0 temp=%d", sample[1])))
+		lines = append(lines, kernelTraceLine(bootid, sample[0]+2, fmt.Sprintf("thermal_temp: sensor_id=5 temp=%d", sample[1])))
+	}
+	lines = append(lines, catalogueLine(bootid, 10, 15, "KernelPrintk: last"))
+	writeShard(t, filepath.Join(path, testDeviceA, bootid, "00000000.gz"), lines)
+
+	ds := NewDataset(path)
+	boot, err := NewBoot(path, testDeviceA, bootid)
+	assert.Nil(err)
+	bi, err := ScanBoot(boot)
+	assert.Nil(err)
+
+	tm := NewThermalModel(cpuprof.SensorLabels{5: "cpu0"}, 1, 3)
+	assert.Nil(ds.BootThermalModel(context.Background(), bi, tm))
+
+	sensors := tm.Sensors()
+	assert.Equal(2, len(sensors))
+	assert.Equal("sensor0", sensors[0].Label)
+	assert.Equal(14.0, sensors[0].Time)
+	assert.Equal(map[int]float64{40: 2, 50: 3, 45: 2, 55: 3, 42: 4}, sensors[0].Histogram)
+	assert.InDelta(653.0/14, sensors[0].Mean, 1e-9)
+	assert.Equal(40, sensors[0].Min)
+	assert.Equal(55, sensors[0].Max)
+	assert.Equal("cpu0", sensors[1].Label)
+	assert.Equal(12.0, sensors[1].Time)
+
+	pairs := tm.Pairs()
+	assert.Equal(1, len(pairs))
+	assert.Equal(0, pairs[0].A)
+	assert.Equal(5, pairs[0].B)
+	assert.Equal(12, pairs[0].Samples)
+	assert.True(pairs[0].Correlation < 1)
+	assert.Equal(2.0, pairs[0].Lag)
+	assert.InDelta(1.0, pairs[0].LagCorrelation, 1e-9)
+}
+
+func TestLoadSensorLabels(t *testing.T) {
+	assert := assert.New(t)
+
+	path, err := ioutil.TempDir("", "sensor_labels")
+	assert.Nil(err)
+	defer os.RemoveAll(path)
+
+	file := filepath.Join(path, "labels.json")
+	assert.Nil(ioutil.WriteFile(file, []byte(`{"Nexus 5": {"0": "pa", "5": "cpu0"}}`), 0664))
+	labels, err := LoadSensorLabels(file)
+	assert.Nil(err)
+	assert.Equal(cpuprof.SensorLabels{0: "pa", 5: "cpu0"}, labels["Nexus 5"])
+
+	_, err = LoadSensorLabels(filepath.Join(path, "missing.json"))
+	assert.NotNil(err)
+}
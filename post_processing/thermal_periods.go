@@ -1 +1,218 @@
 package post_processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gurupras/go_cpuprof"
+	"github.com/gurupras/go_cpuprof/post_processing/filters"
+	"github.com/gurupras/gocommons/gsync"
+)
+
+const (
+	THERMAL_PERIODS_FILE = "thermal-periods.json"
+)
+
+var throttleCauseNames = map[filters.ThrottleCause]string{
+	filters.THROTTLE_HOTPLUG:       "hotplug",
+	filters.THROTTLE_FREQUENCY_CAP: "frequency_cap",
+	filters.THROTTLE_TEMPERATURE:   "temperature",
+}
+
+// ThermalPeriod is a throttling episode of a boot. Start and End are
+// TraceTimes.
+type ThermalPeriod struct {
+	BootId string
+	Start  float64
+	End    float64
+	Causes []string
+	// Highest temperature of every sensor during the period
+	PeakTemp map[int]int
+	// Highest temperature msm_thermal reported, or filters.TEMPERATURE_UNKNOWN
+	MsmThermalTemp int
+	OfflineCpus    []int
+	// Lowest frequency limit msm_thermal applied to each core, in kHz
+	Ceiling map[int]int
+	// The app in the foreground at the start. Package is empty if it could
+	// not be resolved and Comm is empty if no app was in the foreground.
+	Package string
+	Uid     int
+	Pid     int
+	Comm    string
+}
+
+func (p *ThermalPeriod) Duration() float64 {
+	return p.End - p.Start
+}
+
+// App is the package of the foreground app, or its comm if it was not
+// resolved, or "" if there was none
+func (p *ThermalPeriod) App() string {
+	if p.Package != "" {
+		return p.Package
+	}
+	return p.Comm
+}
+
+func newThermalPeriod(bootid string, e *filters.ThrottleEpisode, resolver *ProcessResolver) *ThermalPeriod {
+	p := new(ThermalPeriod)
+	p.BootId = bootid
+	p.Start = e.Start
+	p.End = e.End
+	p.Causes = make([]string, 0)
+	for _, cause := range []filters.ThrottleCause{filters.THROTTLE_HOTPLUG, filters.THROTTLE_FREQUENCY_CAP, filters.THROTTLE_TEMPERATURE} {
+		if e.Causes&cause != 0 {
+			p.Causes = append(p.Causes, throttleCauseNames[cause])
+		}
+	}
+	p.PeakTemp = e.PeakTemp
+	p.MsmThermalTemp = e.MsmThermalTemp
+	p.OfflineCpus = e.OfflineCpus
+	p.Ceiling = e.Ceiling
+	p.Uid = cpuprof.UID_UNKNOWN
+	if e.Foreground == nil {
+		return p
+	}
+	p.Pid = e.Foreground.Pid
+	p.Comm = e.Foreground.Comm
+	if resolver != nil {
+		comm := ""
+		if e.Foreground.Pid == e.Foreground.Tgid {
+			comm = e.Foreground.Comm
+		}
+		if pi := resolver.Resolve(e.Foreground.Tgid, comm, e.StartLogline.LogcatToken); pi != nil {
+			p.Package = pi.Package()
+			p.Uid = pi.Uid
+		}
+	}
+	return p
+}
+
+// BootThermalPeriods finds the throttling episodes of boot. A sensor at or
+// above throttleTemp for sustainSec counts as throttling. If resolver is not
+// nil, the foreground apps are resolved to packages.
+func BootThermalPeriods(ctx context.Context, boot *Boot, resolver *ProcessResolver, throttleTemp int, sustainSec float64) ([]*ThermalPeriod, error) {
+	filter := filters.New()
+	fgbgTracker := filters.NewFgBgTracker(filter)
+	thermalTracker := filters.NewThermalTracker(filter)
+	throttleTracker := filters.NewThermalThrottleTracker(filter, thermalTracker, fgbgTracker)
+	throttleTracker.ThrottleTemp = throttleTemp
+	throttleTracker.SustainSec = sustainSec
+
+	patterns := []string{"msm_thermal:", "thermal_temp", "phonelab_proc_foreground"}
+	opts := ReadOptions{Filters: []filters.LineFilter{func(line string) bool {
+		for _, pattern := range patterns {
+			if strings.Contains(line, pattern) {
+				return true
+			}
+		}
+		return false
+	}}}
+	err := boot.ScanFrom(ctx, opts, func(logline *cpuprof.Logline) error {
+		filter.ApplyLogline(logline)
+		return nil
+	})
+	filter.Finish()
+
+	periods := make([]*ThermalPeriod, 0, len(throttleTracker.Episodes))
+	for _, e := range throttleTracker.Episodes {
+		periods = append(periods, newThermalPeriod(boot.BootId, e, resolver))
+	}
+	return periods, err
+}
+
+// DeviceThermalPeriods is the output of ThermalPeriodsMain for one device
+type DeviceThermalPeriods struct {
+	Periods int
+	Time    float64
+	// Periods with each cause
+	ByCause map[string]int
+	// Time throttled with each app in the foreground at the start
+	ByApp      map[string]float64
+	PeriodList []*ThermalPeriod
+}
+
+func SummarizeThermalPeriods(periods []*ThermalPeriod) *DeviceThermalPeriods {
+	dtp := new(DeviceThermalPeriods)
+	dtp.ByCause = make(map[string]int)
+	dtp.ByApp = make(map[string]float64)
+	dtp.PeriodList = periods
+	for _, p := range periods {
+		dtp.Periods++
+		dtp.Time += p.Duration()
+		for _, cause := range p.Causes {
+			dtp.ByCause[cause]++
+		}
+		dtp.ByApp[p.App()] += p.Duration()
+	}
+	return dtp
+}
+
+func ThermalPeriodsMain(args []string) {
+	parser := SetupParser()
+	throttleTemp := parser.Flag("temp", "Temperature a sensor has to stay at to count as throttling").Default("60").Int()
+	sustainSec := parser.Flag("sustain", "Seconds a sensor has to stay at --temp").Default("5").Float64()
+	ParseArgs(parser, args)
+
+	ds := NewDataset(Path)
+	devices := Devices
+	if len(devices) == 0 {
+		var err error
+		if devices, err = ds.Devices(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+	}
+
+	mutex := new(sync.Mutex)
+	result := make(map[string]*DeviceThermalPeriods)
+
+	deviceWg := new(sync.WaitGroup)
+	deviceSem := gsync.NewSem(20)
+	processDevice := func(device string) {
+		defer deviceWg.Done()
+		defer deviceSem.V()
+
+		boots, err := ds.Boots(device)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		periods := make([]*ThermalPeriod, 0)
+		for _, boot := range boots {
+			resolver, err := ResolveBootProcesses(context.Background(), boot)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, fmt.Sprintf("%v -> %v: %v", device, boot.BootId, err))
+				continue
+			}
+			bootPeriods, err := BootThermalPeriods(context.Background(), boot, resolver, *throttleTemp, *sustainSec)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, fmt.Sprintf("%v -> %v: %v", device, boot.BootId, err))
+				continue
+			}
+			periods = append(periods, bootPeriods...)
+		}
+		mutex.Lock()
+		result[device] = SummarizeThermalPeriods(periods)
+		mutex.Unlock()
+		fmt.Println("Finished processing Device:", device)
+	}
+
+	for _, device := range devices {
+		deviceWg.Add(1)
+		deviceSem.P()
+		go processDevice(device)
+	}
+	deviceWg.Wait()
+
+	if b, err := json.MarshalIndent(result, "", "  "); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	} else {
+		ioutil.WriteFile(THERMAL_PERIODS_FILE, b, 0664)
+	}
+}
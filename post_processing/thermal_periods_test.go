@@ -0,0 +1,69 @@
+package post_processing
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func msmThermalLine(bootid string, token int, message string) string {
+	return catalogueLine(bootid, 10, token, fmt.Sprintf("KernelPrintk: <6>[   %d.000000] msm_thermal: %s", token, message))
+}
+
+func TestThermalPeriods(t *testing.T) {
+	assert := assert.New(t)
+
+	path, err := ioutil.TempDir("", "thermal_periods")
+	assert.Nil(err)
+	defer os.RemoveAll(path)
+
+	bootid := "453fea81-57cc-43e0-9693-91f63b0433b9"
+	writeShard(t, filepath.Join(path, testDeviceA, bootid, "00000000.gz"), []string{
+		catalogueLine(bootid, 10, 1, "ActivityManager: Start proc 100:com.android.dialer/u0a12 for activity com.android.dialer/.DialtactsActivity"),
+		foregroundLine(bootid, 2, 100, ".android.dialer"),
+		kernelTraceLine(bootid, 3, "thermal_temp: sensor_id=5 temp=55"),
+		msmThermalLine(bootid, 4, "Limiting cpu0 max frequency to 1728000"),
+		msmThermalLine(bootid, 5, "Set Offline: CPU3 Temp: 80"),
+		kernelTraceLine(bootid, 6, "thermal_temp: sensor_id=5 temp=58"),
+		msmThermalLine(bootid, 7, "Allow Online CPU3 Temp: 66"),
+		msmThermalLine(bootid, 8, "Limiting cpu0 max frequency to 4294967295"),
+		kernelTraceLine(bootid, 10, "thermal_temp: sensor_id=5 temp=62"),
+		kernelTraceLine(bootid, 14, "thermal_temp: sensor_id=5 temp=57"),
+	})
+
+	boot, err := NewBoot(path, testDeviceA, bootid)
+	assert.Nil(err)
+	resolver, err := ResolveBootProcesses(context.Background(), boot)
+	assert.Nil(err)
+	periods, err := BootThermalPeriods(context.Background(), boot, resolver, 60, 3)
+	assert.Nil(err)
+
+	assert.Equal(2, len(periods))
+	p := periods[0]
+	assert.Equal(4.0, p.Start)
+	assert.Equal(8.0, p.End)
+	assert.Equal([]string{"hotplug", "frequency_cap"}, p.Causes)
+	assert.Equal(map[int]int{5: 58}, p.PeakTemp)
+	assert.Equal(80, p.MsmThermalTemp)
+	assert.Equal([]int{3}, p.OfflineCpus)
+	assert.Equal(map[int]int{0: 1728000}, p.Ceiling)
+	assert.Equal("com.android.dialer", p.Package)
+	assert.Equal(10012, p.Uid)
+
+	p = periods[1]
+	assert.Equal(10.0, p.Start)
+	assert.Equal(14.0, p.End)
+	assert.Equal([]string{"temperature"}, p.Causes)
+	assert.Equal(map[int]int{5: 62}, p.PeakTemp)
+
+	dtp := SummarizeThermalPeriods(periods)
+	assert.Equal(2, dtp.Periods)
+	assert.Equal(8.0, dtp.Time)
+	assert.Equal(map[string]int{"hotplug": 1, "frequency_cap": 1, "temperature": 1}, dtp.ByCause)
+	assert.Equal(map[string]float64{"com.android.dialer": 8.0}, dtp.ByApp)
+}
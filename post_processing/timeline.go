@@ -0,0 +1,197 @@
+package post_processing
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gurupras/go_cpuprof"
+)
+
+// Gaps shorter than this between two boots are not reported
+const DEFAULT_TIMELINE_MIN_GAP = time.Minute
+
+// Gap is a period between two boots during which the device was off or not
+// logging
+type Gap struct {
+	Start  time.Time
+	End    time.Time
+	Before *BootInfo
+	After  *BootInfo
+}
+
+func (g *Gap) Duration() time.Duration {
+	return g.End.Sub(g.Start)
+}
+
+// DeviceTimeline is every boot of a device in wall time order
+type DeviceTimeline struct {
+	DeviceId string
+	Boots    []*BootInfo
+	Gaps     []*Gap
+	dataset  *Dataset
+}
+
+// Timeline orders the boots of device by their first wall time and finds the
+// gaps of at least min_gap between them. Boots without loglines are left out.
+func (ds *Dataset) Timeline(device string, min_gap time.Duration) (dt *DeviceTimeline, err error) {
+	var catalogue *Catalogue
+
+	if catalogue, err = ds.Catalogue(); err != nil {
+		return nil, err
+	}
+	di, ok := catalogue.Devices[device]
+	if !ok {
+		return nil, fmt.Errorf("Unknown device: %v", device)
+	}
+
+	dt = new(DeviceTimeline)
+	dt.DeviceId = device
+	dt.dataset = ds
+	dt.Boots = make([]*BootInfo, 0)
+	dt.Gaps = make([]*Gap, 0)
+	for _, bi := range di.Boots {
+		if bi.Lines > 0 {
+			dt.Boots = append(dt.Boots, bi)
+		}
+	}
+	sort.Sort(bootInfoSlice(dt.Boots))
+
+	for idx := 1; idx < len(dt.Boots); idx++ {
+		before := dt.Boots[idx-1]
+		after := dt.Boots[idx]
+		if after.FirstTime.Sub(before.LastTime) >= min_gap {
+			dt.Gaps = append(dt.Gaps, &Gap{before.LastTime, after.FirstTime, before, after})
+		}
+	}
+	return
+}
+
+type TimelineEventKind int
+
+const (
+	TIMELINE_LOGLINE TimelineEventKind = iota
+	TIMELINE_BOOT_START
+	TIMELINE_BOOT_END
+	TIMELINE_GAP
+)
+
+// TimelineEvent is a logline, a boot starting or ending, or a gap between boots.
+// Boot is set for every kind but TIMELINE_GAP, Logline only for TIMELINE_LOGLINE.
+type TimelineEvent struct {
+	Kind    TimelineEventKind
+	Boot    *BootInfo
+	Logline *cpuprof.Logline
+	Gap     *Gap
+}
+
+// Scan calls fn with the loglines of every boot in order. Each boot's
+// loglines are preceded by a TIMELINE_BOOT_START event and followed by a
+// TIMELINE_BOOT_END event; a TIMELINE_GAP event sits between boots that are
+// separated by a gap.
+func (dt *DeviceTimeline) Scan(ctx context.Context, opts ReadOptions, fn func(*TimelineEvent) error) error {
+	return dt.scan(ctx, fn, func(boot *Boot) *LineIterator {
+		return boot.LinesFrom(ctx, opts)
+	}, dt.Boots)
+}
+
+// ScanRange is Scan restricted to the loglines logged in [start, end). Only
+// boots overlapping the range are read.
+func (dt *DeviceTimeline) ScanRange(ctx context.Context, start time.Time, end time.Time, fn func(*TimelineEvent) error) error {
+	boots := make([]*BootInfo, 0)
+	for _, bi := range dt.Boots {
+		if bi.LastTime.Before(start) || !bi.FirstTime.Before(end) {
+			continue
+		}
+		boots = append(boots, bi)
+	}
+	return dt.scan(ctx, fn, func(boot *Boot) *LineIterator {
+		return boot.ReadRange(ctx, WallTimeRange(start, end))
+	}, boots)
+}
+
+func (dt *DeviceTimeline) scan(ctx context.Context, fn func(*TimelineEvent) error, open func(*Boot) *LineIterator, boots []*BootInfo) error {
+	gaps := make(map[*BootInfo]*Gap)
+	for _, gap := range dt.Gaps {
+		gaps[gap.After] = gap
+	}
+	for idx, bi := range boots {
+		if gap, ok := gaps[bi]; ok && idx > 0 && boots[idx-1] == gap.Before {
+			if err := fn(&TimelineEvent{Kind: TIMELINE_GAP, Gap: gap}); err != nil {
+				return err
+			}
+		}
+		boot, err := dt.dataset.Boot(bi)
+		if err != nil {
+			return err
+		}
+		if err = fn(&TimelineEvent{Kind: TIMELINE_BOOT_START, Boot: bi}); err != nil {
+			return err
+		}
+		it := open(boot)
+		for it.Next() {
+			if err = fn(&TimelineEvent{Kind: TIMELINE_LOGLINE, Boot: bi, Logline: it.Logline()}); err != nil {
+				it.Close()
+				return err
+			}
+		}
+		it.Close()
+		if err = it.Err(); err != nil {
+			return err
+		}
+		if err = fn(&TimelineEvent{Kind: TIMELINE_BOOT_END, Boot: bi}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DayCoverage is how much of a calendar day the device was logging
+type DayCoverage struct {
+	// Midnight at the start of the day
+	Day    time.Time
+	Logged time.Duration
+	// Boots that logged during the day
+	BootIds []string
+}
+
+// Days splits the timeline into calendar days in the location of the boots'
+// wall times, from the day of the first boot to the day of the last.
+func (dt *DeviceTimeline) Days() []*DayCoverage {
+	days := make([]*DayCoverage, 0)
+	if len(dt.Boots) == 0 {
+		return days
+	}
+	midnight := func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	}
+	first := midnight(dt.Boots[0].FirstTime)
+	last := dt.Boots[0].LastTime
+	for _, bi := range dt.Boots {
+		if bi.LastTime.After(last) {
+			last = bi.LastTime
+		}
+	}
+	for day := first; !day.After(last); day = day.AddDate(0, 0, 1) {
+		dc := &DayCoverage{day, 0, make([]string, 0)}
+		next := day.AddDate(0, 0, 1)
+		for _, bi := range dt.Boots {
+			if !bi.FirstTime.Before(next) || bi.LastTime.Before(day) {
+				continue
+			}
+			start := bi.FirstTime
+			if start.Before(day) {
+				start = day
+			}
+			end := bi.LastTime
+			if end.After(next) {
+				end = next
+			}
+			dc.Logged += end.Sub(start)
+			dc.BootIds = append(dc.BootIds, bi.BootId)
+		}
+		days = append(days, dc)
+	}
+	return days
+}
@@ -0,0 +1,132 @@
+package post_processing
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gurupras/go_cpuprof/post_processing/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	timelineBoot1 = "11111111-57cc-43e0-9693-91f63b0433b9"
+	timelineBoot2 = "22222222-57cc-43e0-9693-91f63b0433b9"
+	timelineBoot3 = "33333333-57cc-43e0-9693-91f63b0433b9"
+)
+
+func timelineLine(bootid string, t time.Time, token int) string {
+	return fmt.Sprintf("%s %s %d [   %d.000000]   200   200 D KernelPrintk: line %d", bootid, t.Format("2006-01-02 15:04:05.000000000"), token, token, token)
+}
+
+// Boot 2 follows boot 1 within seconds; boot 3 starts the next morning
+func setupTimeline(t *testing.T) (*Dataset, string) {
+	path, err := ioutil.TempDir("", "timeline")
+	assert.Nil(t, err, "Failed to create temp dir")
+
+	day := time.Date(2016, 6, 25, 0, 0, 0, 0, time.UTC)
+	boots := []struct {
+		bootid string
+		times  []time.Duration
+	}{
+		{timelineBoot3, []time.Duration{33 * time.Hour, 34 * time.Hour}},
+		{timelineBoot1, []time.Duration{22 * time.Hour, 23 * time.Hour}},
+		{timelineBoot2, []time.Duration{23*time.Hour + 30*time.Second, 25 * time.Hour}},
+	}
+	bootids := make([]string, 0)
+	for _, boot := range boots {
+		lines := make([]string, 0)
+		for token, offset := range boot.times {
+			lines = append(lines, timelineLine(boot.bootid, day.Add(offset), token+1))
+		}
+		writeShard(t, filepath.Join(path, testDeviceA, boot.bootid, "00000000.gz"), lines)
+		bootids = append(bootids, fmt.Sprintf(`"%s"`, boot.bootid))
+	}
+	info := fmt.Sprintf(`{"bootids": [%s, %s, %s], "files": []}`, bootids[0], bootids[1], bootids[2])
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(path, testDeviceA, "info.json"), []byte(info), 0664))
+	return NewDataset(path), path
+}
+
+func TestDeviceTimeline(t *testing.T) {
+	assert := assert.New(t)
+
+	ds, path := setupTimeline(t)
+	defer os.RemoveAll(path)
+
+	dt, err := ds.Timeline(testDeviceA, DEFAULT_TIMELINE_MIN_GAP)
+	assert.Nil(err)
+	assert.Equal(3, len(dt.Boots))
+	assert.Equal(timelineBoot1, dt.Boots[0].BootId)
+	assert.Equal(timelineBoot2, dt.Boots[1].BootId)
+	assert.Equal(timelineBoot3, dt.Boots[2].BootId)
+	assert.Equal(1, len(dt.Gaps))
+	assert.Equal(8*time.Hour, dt.Gaps[0].Duration())
+	assert.Equal(timelineBoot3, dt.Gaps[0].After.BootId)
+
+	_, err = ds.Timeline("unknown", DEFAULT_TIMELINE_MIN_GAP)
+	assert.NotNil(err)
+
+	days := dt.Days()
+	assert.Equal(2, len(days))
+	assert.Equal(2*time.Hour-30*time.Second, days[0].Logged)
+	assert.Equal([]string{timelineBoot1, timelineBoot2}, days[0].BootIds)
+	assert.Equal(2*time.Hour, days[1].Logged)
+	assert.Equal([]string{timelineBoot2, timelineBoot3}, days[1].BootIds)
+}
+
+func TestDeviceTimelineScan(t *testing.T) {
+	assert := assert.New(t)
+
+	ds, path := setupTimeline(t)
+	defer os.RemoveAll(path)
+	dt, err := ds.Timeline(testDeviceA, DEFAULT_TIMELINE_MIN_GAP)
+	assert.Nil(err)
+
+	// A DayFilter fed from the timeline sees the day roll over inside boot 2
+	f := filters.New()
+	filters.NewDayFilter(f)
+	rollovers := make([]string, 0)
+	f.Bus.OnDayRolled(func(event *filters.DayRolled) {
+		rollovers = append(rollovers, event.Logline.BootId)
+	})
+
+	events := make([]string, 0)
+	err = dt.Scan(context.Background(), ReadOptions{}, func(event *TimelineEvent) error {
+		switch event.Kind {
+		case TIMELINE_BOOT_START:
+			events = append(events, "start "+event.Boot.BootId[:1])
+		case TIMELINE_BOOT_END:
+			events = append(events, "end "+event.Boot.BootId[:1])
+		case TIMELINE_GAP:
+			events = append(events, "gap")
+		case TIMELINE_LOGLINE:
+			events = append(events, fmt.Sprintf("%d", event.Logline.LogcatToken))
+			f.ApplyLogline(event.Logline)
+		}
+		return nil
+	})
+	assert.Nil(err)
+	assert.Equal([]string{"start 1", "1", "2", "end 1", "start 2", "1", "2", "end 2", "gap", "start 3", "1", "2", "end 3"}, events)
+	assert.Equal([]string{timelineBoot2}, rollovers)
+
+	// Only boots 2 and 3 overlap the second day
+	events = make([]string, 0)
+	start := time.Date(2016, 6, 26, 0, 0, 0, 0, time.UTC)
+	err = dt.ScanRange(context.Background(), start, start.AddDate(0, 0, 1), func(event *TimelineEvent) error {
+		switch event.Kind {
+		case TIMELINE_BOOT_START:
+			events = append(events, "start "+event.Boot.BootId[:1])
+		case TIMELINE_GAP:
+			events = append(events, "gap")
+		case TIMELINE_LOGLINE:
+			events = append(events, fmt.Sprintf("%d", event.Logline.LogcatToken))
+		}
+		return nil
+	})
+	assert.Nil(err)
+	assert.Equal([]string{"start 2", "2", "gap", "start 3", "1", "2"}, events)
+}
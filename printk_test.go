@@ -28,3 +28,27 @@ func TestParseMsmThermalPrintk(t *testing.T) {
 	assert.Equal(t, 80, mtp.Temp, "Temperature parsing failed")
 
 }
+
+func TestParseMsmThermalFreqLimitPrintk(t *testing.T) {
+	str := "6890aa2f-9895-47bf-9c37-79a2e3a34703 2016-06-25 13:32:21.291000001 63325 [  512.247780]   200   200 D KernelPrintk: <6>[  512.237802] msm_thermal: Limiting cpu2 max frequency to 1728000"
+
+	logline := ParseLogline(str)
+	mtflp := ParseMsmThermalFreqLimitPrintk(logline)
+
+	assert.NotNil(t, mtflp, "Parsing msm_thermal failed")
+	assert.Equal(t, 2, mtflp.Cpu, "CPU parsing failed")
+	assert.Equal(t, int64(1728000), mtflp.MaxFrequency, "Frequency parsing failed")
+
+	str = "6890aa2f-9895-47bf-9c37-79a2e3a34703 2016-06-25 13:32:41.291000001 63925 [  532.247780]   200   200 D KernelPrintk: <6>[  532.237802] msm_thermal: Limiting cpu2 max frequency to 4294967295"
+
+	logline = ParseLogline(str)
+	mtflp = ParseMsmThermalFreqLimitPrintk(logline)
+
+	assert.NotNil(t, mtflp, "Parsing msm_thermal failed")
+	assert.Equal(t, int64(MSM_THERMAL_NO_LIMIT), mtflp.MaxFrequency, "Frequency parsing failed")
+
+	str = "6890aa2f-9895-47bf-9c37-79a2e3a34703 2016-06-25 13:24:51.291000001 3325 [   21.522780]   200   200 D KernelPrintk: <6>[   21.512807] msm_thermal: Allow Online CPU3 Temp: 66"
+
+	logline = ParseLogline(str)
+	assert.Nil(t, ParseMsmThermalFreqLimitPrintk(logline), "Parsed hotplug printk as a frequency limit")
+}
@@ -0,0 +1,292 @@
+package stitch
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gurupras/cpuprof"
+	"github.com/gurupras/gocommons"
+)
+
+// BootSink is where a BootSplitter writes its shards.
+// Shards of a boot are numbered from 0 and written in order.
+type BootSink interface {
+	// Shards returns the indices of shards that already exist for bootid
+	Shards(bootid string) ([]int, error)
+	// Remove deletes every shard of bootid
+	Remove(bootid string) error
+	// Create returns a writer to shard idx of bootid, truncating it if it exists
+	Create(bootid string, idx int) (io.WriteCloser, error)
+}
+
+// FileSink writes shards as <path>/<bootid>/%08d.gz
+type FileSink struct {
+	Path string
+}
+
+func NewFileSink(path string) *FileSink {
+	fs := new(FileSink)
+	fs.Path = path
+	return fs
+}
+
+func (fs *FileSink) bootPath(bootid string) string {
+	return filepath.Join(fs.Path, bootid)
+}
+
+func (fs *FileSink) Shards(bootid string) (shards []int, err error) {
+	var files []string
+
+	outdir := fs.bootPath(bootid)
+	if _, err = os.Stat(outdir); os.IsNotExist(err) {
+		return []int{}, nil
+	}
+	if files, err = gocommons.ListFiles(outdir, []string{"*.gz"}); err != nil {
+		return nil, err
+	}
+	shards = make([]int, 0)
+	for _, file := range files {
+		var idx int
+		if idx, err = strconv.Atoi(strings.TrimSuffix(filepath.Base(file), ".gz")); err != nil {
+			return nil, fmt.Errorf("Unexpected shard: %v", file)
+		}
+		shards = append(shards, idx)
+	}
+	sort.Ints(shards)
+	return
+}
+
+func (fs *FileSink) Remove(bootid string) error {
+	return os.RemoveAll(fs.bootPath(bootid))
+}
+
+type shardWriter struct {
+	file   *gocommons.File
+	writer gocommons.Writer
+}
+
+func (sw *shardWriter) Write(b []byte) (int, error) {
+	return sw.writer.Write(b)
+}
+
+// Close returns the first error of flushing, closing the writer (which
+// writes the gzip trailer) and closing the file
+func (sw *shardWriter) Close() error {
+	err := sw.writer.Flush()
+	if cerr := sw.writer.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := sw.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (fs *FileSink) Create(bootid string, idx int) (io.WriteCloser, error) {
+	var err error
+
+	outdir := fs.bootPath(bootid)
+	if err = os.MkdirAll(outdir, 0775); err != nil {
+		return nil, fmt.Errorf("Failed to create directory: %v: %v", outdir, err)
+	}
+	sw := new(shardWriter)
+	filename := filepath.Join(outdir, fmt.Sprintf("%08d.gz", idx))
+	if sw.file, err = gocommons.Open(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, gocommons.GZ_TRUE); err != nil {
+		return nil, fmt.Errorf("Could not open: %v: %v", filename, err)
+	}
+	if sw.writer, err = sw.file.Writer(0); err != nil {
+		sw.file.Close()
+		return nil, fmt.Errorf("Could not get writer: %v: %v", filename, err)
+	}
+	return sw, nil
+}
+
+// splitItem is a line for a boot's consumer, or a request to close its open
+// shard if rotated is not nil. Whether a shard was closed is sent on rotated.
+type splitItem struct {
+	line    string
+	rotated chan bool
+}
+
+// bootConsumer is the goroutine writing the shards of one boot
+type bootConsumer struct {
+	channel chan splitItem
+	done    chan struct{}
+}
+
+// BootSplitter distributes sorted loglines into per-boot shards of at most
+// LinesPerFile lines each. Every boot is written by its own goroutine until it
+// is retired or the splitter is closed.
+type BootSplitter struct {
+	Sink         BootSink
+	LinesPerFile int
+	// Remove existing shards of a boot instead of appending after them
+	Delete  bool
+	BootIds []string
+	boots   map[string]*bootConsumer
+	seen    map[string]bool
+	wg      sync.WaitGroup
+	mutex   sync.Mutex
+	err     error
+}
+
+func NewBootSplitter(sink BootSink, lines_per_file int, delete bool) *BootSplitter {
+	bs := new(BootSplitter)
+	bs.Sink = sink
+	bs.LinesPerFile = lines_per_file
+	bs.Delete = delete
+	bs.BootIds = make([]string, 0)
+	bs.boots = make(map[string]*bootConsumer)
+	bs.seen = make(map[string]bool)
+	return bs
+}
+
+func (bs *BootSplitter) setError(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	if bs.err == nil {
+		bs.err = err
+	}
+}
+
+// Index of the first shard to write for bootid. Existing shards are only
+// removed the first time a boot is seen, not when it comes back after being
+// retired.
+func (bs *BootSplitter) startIdx(bootid string, first bool) (int, error) {
+	if bs.Delete && first {
+		return 0, bs.Sink.Remove(bootid)
+	}
+	shards, err := bs.Sink.Shards(bootid)
+	if err != nil || len(shards) == 0 {
+		return 0, err
+	}
+	return shards[len(shards)-1] + 1, nil
+}
+
+func (bs *BootSplitter) consume(bootid string, bc *bootConsumer, first bool) {
+	defer bs.wg.Done()
+	defer close(bc.done)
+
+	var err error
+	var writer io.WriteCloser
+
+	drain := func(err error) {
+		bs.setError(fmt.Errorf("%v: %v", bootid, err))
+		for item := range bc.channel {
+			if item.rotated != nil {
+				item.rotated <- false
+			}
+		}
+	}
+
+	cur_idx, err := bs.startIdx(bootid, first)
+	if err != nil {
+		drain(err)
+		return
+	}
+	cur_line_count := 0
+	for item := range bc.channel {
+		if item.rotated != nil {
+			if writer == nil {
+				item.rotated <- false
+				continue
+			}
+			err = writer.Close()
+			writer = nil
+			cur_idx++
+			cur_line_count = 0
+			item.rotated <- true
+			if err != nil {
+				drain(err)
+				return
+			}
+			continue
+		}
+		if writer == nil {
+			if writer, err = bs.Sink.Create(bootid, cur_idx); err != nil {
+				drain(err)
+				return
+			}
+		}
+		if _, err = writer.Write([]byte(item.line + "\n")); err != nil {
+			writer.Close()
+			drain(err)
+			return
+		}
+		cur_line_count++
+		if cur_line_count == bs.LinesPerFile {
+			// We've reached the allotted lines per file. Rotate.
+			if err = writer.Close(); err != nil {
+				drain(err)
+				return
+			}
+			writer = nil
+			cur_idx++
+			cur_line_count = 0
+		}
+	}
+	if writer != nil {
+		if err = writer.Close(); err != nil {
+			bs.setError(fmt.Errorf("%v: %v", bootid, err))
+		}
+	}
+}
+
+// Add queues logline to be written to its boot. Loglines of a boot must be
+// added in order.
+func (bs *BootSplitter) Add(logline *cpuprof.Logline) {
+	bc, ok := bs.boots[logline.BootId]
+	if !ok {
+		first := !bs.seen[logline.BootId]
+		if first {
+			bs.seen[logline.BootId] = true
+			bs.BootIds = append(bs.BootIds, logline.BootId)
+		}
+		bc = &bootConsumer{make(chan splitItem, 10000), make(chan struct{})}
+		bs.boots[logline.BootId] = bc
+		bs.wg.Add(1)
+		go bs.consume(logline.BootId, bc, first)
+	}
+	bc.channel <- splitItem{line: logline.Line}
+}
+
+// Rotate closes the open shard of bootid once the loglines added before it
+// are written, so that the shard can be read. The next logline of the boot
+// starts a new shard. It returns whether a shard was closed.
+func (bs *BootSplitter) Rotate(bootid string) bool {
+	bc, ok := bs.boots[bootid]
+	if !ok {
+		return false
+	}
+	rotated := make(chan bool, 1)
+	bc.channel <- splitItem{rotated: rotated}
+	return <-rotated
+}
+
+// Retire closes the shard of bootid and stops its goroutine. If the boot is
+// added again, it appends after the shards it already has.
+func (bs *BootSplitter) Retire(bootid string) {
+	bc, ok := bs.boots[bootid]
+	if !ok {
+		return
+	}
+	close(bc.channel)
+	<-bc.done
+	delete(bs.boots, bootid)
+}
+
+// Close flushes every boot and returns the first error encountered
+func (bs *BootSplitter) Close() error {
+	for _, bc := range bs.boots {
+		close(bc.channel)
+	}
+	bs.wg.Wait()
+	return bs.err
+}
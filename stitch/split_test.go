@@ -0,0 +1,213 @@
+package stitch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/gurupras/cpuprof"
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryShard struct {
+	*bytes.Buffer
+	closed bool
+}
+
+func (ms *memoryShard) Close() error {
+	if ms.closed {
+		return errors.New("Shard closed twice")
+	}
+	ms.closed = true
+	return nil
+}
+
+// MemorySink keeps shards in memory
+type MemorySink struct {
+	sync.Mutex
+	boots map[string]map[int]*memoryShard
+}
+
+func NewMemorySink() *MemorySink {
+	ms := new(MemorySink)
+	ms.boots = make(map[string]map[int]*memoryShard)
+	return ms
+}
+
+func (ms *MemorySink) Shards(bootid string) ([]int, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	shards := make([]int, 0)
+	for idx := range ms.boots[bootid] {
+		shards = append(shards, idx)
+	}
+	sort.Ints(shards)
+	return shards, nil
+}
+
+func (ms *MemorySink) Remove(bootid string) error {
+	ms.Lock()
+	defer ms.Unlock()
+	delete(ms.boots, bootid)
+	return nil
+}
+
+func (ms *MemorySink) Create(bootid string, idx int) (io.WriteCloser, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	if _, ok := ms.boots[bootid]; !ok {
+		ms.boots[bootid] = make(map[int]*memoryShard)
+	}
+	shard := &memoryShard{new(bytes.Buffer), false}
+	ms.boots[bootid][idx] = shard
+	return shard, nil
+}
+
+// Contents of every shard of bootid, keyed by index
+func (ms *MemorySink) contents(bootid string) map[int]string {
+	result := make(map[int]string)
+	for idx, shard := range ms.boots[bootid] {
+		result[idx] = shard.String()
+	}
+	return result
+}
+
+func splitLogline(bootid string, token int) *cpuprof.Logline {
+	return &cpuprof.Logline{Line: fmt.Sprintf("%s-%d", bootid, token), BootId: bootid, LogcatToken: int64(token)}
+}
+
+func TestBootSplitter(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		name         string
+		linesPerFile int
+		delete       bool
+		existing     map[string][]int
+		input        []*cpuprof.Logline
+		bootids      []string
+		expected     map[string]map[int]string
+	}{
+		{
+			name:         "first line",
+			linesPerFile: 10,
+			input:        []*cpuprof.Logline{splitLogline("a", 1)},
+			bootids:      []string{"a"},
+			expected:     map[string]map[int]string{"a": {0: "a-1\n"}},
+		},
+		{
+			name:         "rotation",
+			linesPerFile: 2,
+			input:        []*cpuprof.Logline{splitLogline("a", 1), splitLogline("a", 2), splitLogline("a", 3)},
+			bootids:      []string{"a"},
+			expected:     map[string]map[int]string{"a": {0: "a-1\na-2\n", 1: "a-3\n"}},
+		},
+		{
+			name:         "rotation boundary",
+			linesPerFile: 2,
+			input:        []*cpuprof.Logline{splitLogline("a", 1), splitLogline("a", 2), splitLogline("a", 3), splitLogline("a", 4)},
+			bootids:      []string{"a"},
+			expected:     map[string]map[int]string{"a": {0: "a-1\na-2\n", 1: "a-3\na-4\n"}},
+		},
+		{
+			name:         "resume",
+			linesPerFile: 2,
+			existing:     map[string][]int{"a": {0, 1}},
+			input:        []*cpuprof.Logline{splitLogline("a", 5), splitLogline("a", 6), splitLogline("a", 7)},
+			bootids:      []string{"a"},
+			expected:     map[string]map[int]string{"a": {0: "old", 1: "old", 2: "a-5\na-6\n", 3: "a-7\n"}},
+		},
+		{
+			name:         "delete",
+			linesPerFile: 2,
+			delete:       true,
+			existing:     map[string][]int{"a": {0, 1}},
+			input:        []*cpuprof.Logline{splitLogline("a", 5)},
+			bootids:      []string{"a"},
+			expected:     map[string]map[int]string{"a": {0: "a-5\n"}},
+		},
+		{
+			name:         "interleaved",
+			linesPerFile: 2,
+			input: []*cpuprof.Logline{splitLogline("a", 1), splitLogline("b", 1), splitLogline("a", 2),
+				splitLogline("b", 2), splitLogline("a", 3), splitLogline("c", 1)},
+			bootids: []string{"a", "b", "c"},
+			expected: map[string]map[int]string{
+				"a": {0: "a-1\na-2\n", 1: "a-3\n"},
+				"b": {0: "b-1\nb-2\n"},
+				"c": {0: "c-1\n"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		sink := NewMemorySink()
+		for bootid, shards := range test.existing {
+			for _, idx := range shards {
+				w, _ := sink.Create(bootid, idx)
+				w.Write([]byte("old"))
+				w.Close()
+			}
+		}
+		splitter := NewBootSplitter(sink, test.linesPerFile, test.delete)
+		for _, logline := range test.input {
+			splitter.Add(logline)
+		}
+		assert.Nil(splitter.Close(), test.name)
+		assert.Equal(test.bootids, splitter.BootIds, test.name)
+		for bootid, expected := range test.expected {
+			assert.Equal(expected, sink.contents(bootid), fmt.Sprintf("%v: %v", test.name, bootid))
+			for idx, shard := range sink.boots[bootid] {
+				assert.True(shard.closed, fmt.Sprintf("%v: %v: shard %d not closed", test.name, bootid, idx))
+			}
+		}
+		assert.Equal(len(test.expected), len(sink.boots), test.name)
+	}
+}
+
+type failingSink struct {
+	*MemorySink
+}
+
+func (fs *failingSink) Create(bootid string, idx int) (io.WriteCloser, error) {
+	return nil, errors.New("no space left")
+}
+
+func TestBootSplitterError(t *testing.T) {
+	assert := assert.New(t)
+
+	splitter := NewBootSplitter(&failingSink{NewMemorySink()}, 1, false)
+	// More lines than the channel buffer so that a stuck consumer would block Add
+	for token := 0; token < 20000; token++ {
+		splitter.Add(splitLogline("a", token))
+	}
+	assert.NotNil(splitter.Close(), "Expected sink error")
+}
+
+func TestBootSplitterRotate(t *testing.T) {
+	assert := assert.New(t)
+
+	sink := NewMemorySink()
+	splitter := NewBootSplitter(sink, 10, true)
+	splitter.Add(splitLogline("a", 1))
+	splitter.Add(splitLogline("a", 2))
+	assert.True(splitter.Rotate("a"))
+	// Nothing open to close
+	assert.False(splitter.Rotate("a"))
+	assert.False(splitter.Rotate("b"))
+	assert.True(sink.boots["a"][0].closed)
+
+	splitter.Add(splitLogline("a", 3))
+	splitter.Retire("a")
+	assert.True(sink.boots["a"][1].closed)
+	// A retired boot appends after its shards even though Delete is set
+	splitter.Add(splitLogline("a", 4))
+	assert.Nil(splitter.Close())
+
+	assert.Equal([]string{"a"}, splitter.BootIds)
+	assert.Equal(map[int]string{0: "a-1\na-2\n", 1: "a-3\n", 2: "a-4\n"}, sink.contents("a"))
+}
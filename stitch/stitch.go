@@ -1,59 +1,144 @@
-package main
+// Package stitch sorts raw logcat dumps and splits them into per-boot
+// shards laid out as <path>/<bootid>/%08d.gz, with the processed files and
+// boot-ids recorded in <path>/info.json.
+package stitch
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
-	"strconv"
-	"strings"
-	"sync"
+	"time"
 
-	"github.com/alecthomas/kingpin"
 	"github.com/fatih/set"
 	"github.com/gurupras/cpuprof"
 	"github.com/gurupras/gocommons"
 )
 
-var (
-	kpin       = kingpin.New("stitch", "")
-	path       = kpin.Arg("path", "").Required().String()
-	regex      = kpin.Flag("regex", "").Short('r').Default("*.out.gz").String()
-	bufsize    = kpin.Flag("bufsize", "Buffer size per thread").Short('b').Default("104857600").Int()
-	split_only = kpin.Flag("split-only", "Only perform split with existing chunks").Short('s').Default("false").Bool()
-	delete     = kpin.Flag("delete", "Delete intermediate files on exit").Default("false").Bool()
+const (
+	DEFAULT_BUFSIZE        = 104857600
+	DEFAULT_LINES_PER_FILE = 1000000
+	DEFAULT_REORDER_WINDOW = 10000
+	DEFAULT_IDLE_FLUSH     = 30 * time.Second
+	DEFAULT_ROTATE_EVERY   = 5 * time.Minute
+	DEFAULT_RETIRE_IDLE    = 30 * time.Minute
 )
 
+type Config struct {
+	// Directory holding the input files. Output is written here as well.
+	Path string
+	// Patterns of input files within Path
+	Patterns []string
+	// Buffer size per external sort
+	BufSize int
+	// Lines per output shard
+	LinesPerFile int
+	// Only split already sorted chunks (*chunk*.gz) found in Path
+	SplitOnly bool
+	// Delete the sorted chunks once they have been split
+	Delete bool
+	// Streaming only: lines held back per boot to reorder them by LogcatToken
+	ReorderWindow int
+	// Streaming only: a boot that has not seen a line for this long has its
+	// reorder window written out and its shard closed
+	IdleFlush time.Duration
+	// Streaming only: a shard is closed once it has been open this long, so
+	// that busy boots can be read before a shard holds LinesPerFile lines
+	RotateEvery time.Duration
+	// Streaming only: a boot that has not seen a line for this long is closed
+	// and forgotten until it sees one again
+	RetireIdle time.Duration
+	// Progress messages are written here. nil silences them.
+	Log io.Writer
+}
+
+func DefaultConfig(path string) Config {
+	return Config{
+		Path:          path,
+		Patterns:      []string{"*.out.gz"},
+		BufSize:       DEFAULT_BUFSIZE,
+		LinesPerFile:  DEFAULT_LINES_PER_FILE,
+		ReorderWindow: DEFAULT_REORDER_WINDOW,
+		IdleFlush:     DEFAULT_IDLE_FLUSH,
+		RotateEvery:   DEFAULT_ROTATE_EVERY,
+		RetireIdle:    DEFAULT_RETIRE_IDLE,
+		Log:           os.Stdout,
+	}
+}
+
+func (cfg *Config) log() io.Writer {
+	if cfg.Log == nil {
+		return ioutil.Discard
+	}
+	return cfg.Log
+}
+
+type Result struct {
+	// Every input file processed so far, including earlier runs
+	Files []string
+	// Input files processed by this run
+	NewFiles []string
+	// Every boot-id in the tree, including earlier runs
+	BootIds []string
+	// Boot-ids written to by this run
+	NewBootIds []string
+	// Streaming only: lines that arrived after a later line of their boot
+	// had already been written. These are dropped.
+	Late int64
+	// Streaming only: lines that could not be parsed. These are dropped.
+	Unparsed int64
+}
+
 func setAddStrings(s set.Interface, items []string) {
 	for _, item := range items {
 		s.Add(item)
 	}
 }
 
-func Process(path string, regex string, bufsize int) error {
+// Stitch processes the input files in cfg.Path that are not yet listed in
+// its info.json. Cancelling ctx stops the run between stages; boots that were
+// already being written are flushed but info.json is left untouched.
+func Stitch(ctx context.Context, cfg Config) (result Result, err error) {
+	if cfg.LinesPerFile <= 0 {
+		cfg.LinesPerFile = DEFAULT_LINES_PER_FILE
+	}
+	if cfg.SplitOnly {
+		var chunks []string
+		if result.NewFiles, err = gocommons.ListFiles(cfg.Path, cfg.Patterns); err != nil {
+			return result, fmt.Errorf("Could not list files: %v: %v", cfg.Path, err)
+		}
+		if chunks, err = gocommons.ListFiles(cfg.Path, []string{"*chunk*.gz"}); err != nil {
+			return result, fmt.Errorf("Could not list chunks: %v: %v", cfg.Path, err)
+		}
+		sort.Sort(sort.StringSlice(chunks))
+		result.NewBootIds, err = BootIdSplit(ctx, cfg, chunks, true)
+		result.BootIds = result.NewBootIds
+		return
+	}
+	return process(ctx, cfg)
+}
+
+func process(ctx context.Context, cfg Config) (result Result, err error) {
 	var files []string
 	var overall_chunks []string
-	var err error
-	chunk_chan := make(chan []string)
 	var merged_files []string
 	var old_bootids *set.SetNonTS
-	var merged_bootids []string
 	var info map[string][]string
 	delete_boot_ids := true
 
-	// Split regexes by ','
-	patterns := strings.Split(regex, ",")
-	if files, err = gocommons.ListFiles(path, patterns); err != nil {
-		fmt.Fprintln(os.Stderr, fmt.Sprintf("Failed to list files:", path, ":", err))
-		os.Exit(-1)
+	if files, err = gocommons.ListFiles(cfg.Path, cfg.Patterns); err != nil {
+		return result, fmt.Errorf("Failed to list files: %v: %v", cfg.Path, err)
 	}
-	if info, err = cpuprof.GetInfo(path); err != nil {
-		fmt.Println("Did not find info file...Using all files")
+	if info, err = cpuprof.GetInfo(cfg.Path); err != nil {
+		fmt.Fprintln(cfg.log(), "Did not find info file...Using all files")
 		merged_files = files
 		old_bootids = set.NewNonTS()
 	} else {
-		fmt.Println("Found info.json...Finding new files to process")
+		fmt.Fprintln(cfg.log(), "Found info.json...Finding new files to process")
 		old_files := set.NewNonTS()
 		setAddStrings(old_files, info["files"])
 
@@ -66,199 +151,124 @@ func Process(path string, regex string, bufsize int) error {
 
 		old_bootids = set.NewNonTS()
 		setAddStrings(old_bootids, info["bootids"])
-		fmt.Println("New files:", files)
+		fmt.Fprintln(cfg.log(), "New files:", files)
 		delete_boot_ids = false
 	}
+	sort.Strings(files)
+	sort.Strings(merged_files)
+	result.NewFiles = files
 
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	type sortResult struct {
+		chunks []string
+		err    error
+	}
+	chunk_chan := make(chan sortResult, len(files))
 	ext_sort := func(file string) {
-		var chunks []string
-		if chunks, err = gocommons.ExternalSort(file, bufsize, cpuprof.LoglineSortParams); err != nil {
-			return
+		var sr sortResult
+		if err := ctx.Err(); err != nil {
+			sr.err = err
+		} else if sr.chunks, sr.err = gocommons.ExternalSort(file, cfg.BufSize, cpuprof.LoglineSortParams); sr.err != nil {
+			sr.err = fmt.Errorf("Failed to sort: %v: %v", file, sr.err)
 		}
-		chunk_chan <- chunks
+		chunk_chan <- sr
 	}
 
-	fmt.Println("Starting external sort")
+	fmt.Fprintln(cfg.log(), "Starting external sort")
 	for _, file := range files {
 		go ext_sort(file)
 	}
 	// Wait for them to complete
 	for i := 0; i < len(files); i++ {
-		chunk := <-chunk_chan
-		overall_chunks = append(overall_chunks, chunk...)
+		sr := <-chunk_chan
+		overall_chunks = append(overall_chunks, sr.chunks...)
+		if sr.err != nil && err == nil {
+			err = sr.err
+		}
+	}
+	removeChunks := func() {
+		// Delete intermediate files if requested
+		if cfg.Delete {
+			for _, chunk := range overall_chunks {
+				if err := os.Remove(chunk); err != nil {
+					fmt.Fprintln(os.Stderr, "Failed to remove chunk:", chunk)
+				}
+			}
+		}
+	}
+	if err != nil {
+		removeChunks()
+		return
 	}
 
 	sort.Sort(sort.StringSlice(overall_chunks))
 	// Split by boot-id
-	bootids := BootIdSplit(path, files, overall_chunks, delete_boot_ids, 1000000)
-
-	// Delete intermediate files if requested
-	if *delete == true {
-		for _, chunk := range overall_chunks {
-			if err = os.Remove(chunk); err != nil {
-				fmt.Fprintln(os.Stderr, "Failed to remove chunk:", chunk)
-			}
-		}
+	result.NewBootIds, err = BootIdSplit(ctx, cfg, overall_chunks, delete_boot_ids)
+	removeChunks()
+	if err != nil {
+		return
 	}
 
 	new_bootids := set.NewNonTS()
-	setAddStrings(new_bootids, bootids)
-	merged_bootids = set.StringSlice(set.Union(old_bootids, new_bootids))
+	setAddStrings(new_bootids, result.NewBootIds)
+	result.BootIds = set.StringSlice(set.Union(old_bootids, new_bootids))
+	sort.Strings(result.BootIds)
+	result.Files = merged_files
 	// Now write the json stating the various bootids and files processed
-	WriteInfoJson(path, merged_files, merged_bootids)
-	return err
+	err = WriteInfoJson(cfg.Path, result.Files, result.BootIds)
+	return
 }
 
-func BootIdSplit(path string, files []string, chunks []string, delete bool, lines_per_file int) (bootids []string) {
+// BootIdSplit merges the sorted chunks and splits them into per-boot shards
+// under cfg.Path. Existing shards of a boot are removed if delete is set.
+func BootIdSplit(ctx context.Context, cfg Config, chunks []string, delete bool) (bootids []string, err error) {
 	merge_out_channel := make(chan gocommons.SortInterface, 10000)
 
-	var err error
-
-	bootid_channel_map := make(map[string]chan string)
+	splitter := NewBootSplitter(NewFileSink(cfg.Path), cfg.LinesPerFile, delete)
 
 	callback := func(out_channel chan gocommons.SortInterface, quit chan bool) {
-		boot_id_consumer := func(boot_id string, channel chan string, wg *sync.WaitGroup) {
-			defer wg.Done()
-			var err error
-
-			//fmt.Println("Starting consumer for bootid:", boot_id)
-			cur_idx := 0
-			cur_line_count := 0
-			outdir := filepath.Join(path, boot_id)
-			var cur_filename string
-			var cur_file *gocommons.File
-			var cur_file_writer gocommons.Writer
-
-			// Make directory if it doesn't exist
-			if delete {
-				if _, err := os.Stat(outdir); os.IsExist(err) {
-					// Does exit
-					fmt.Println("Attempting to delete existing directory:", outdir)
-					os.RemoveAll(outdir)
-				}
-			}
-			fmt.Printf("Attempting to create directory:%s...", outdir)
-			if err = os.MkdirAll(outdir, 0775); err != nil {
-				fmt.Fprintln(os.Stderr, "Failed to create directory:", outdir)
-				os.Exit(-1)
-			} else {
-				fmt.Printf("Done\n")
-			}
-			if !delete {
-				var files []string
-
-				if files, err = gocommons.ListFiles(outdir, []string{"*.gz"}); err != nil {
-					fmt.Fprintln(os.Stderr, "Failed to list files:", outdir)
-					os.Exit(-1)
-				}
-				sort.Sort(sort.StringSlice(files))
-				if len(files) > 0 {
-					last_file := files[len(files)-1]
-					if cur_idx, err = strconv.Atoi(strings.TrimSuffix(last_file, filepath.Ext(last_file))); err != nil {
-
-					}
-					// Move it ahead by 1
-					cur_idx++
-				}
-			}
-
-			first_file := true
-			for {
-				if cur_line_count == 0 {
-					// Line count is 0. Either this is the first file or we just reset stuff
-					// and so we need to open a new file
-					if !first_file {
-						// Close the old file
-						//fmt.Println("\tClosing old file")
-						cur_file_writer.Flush()
-						cur_file_writer.Close()
-						cur_file.Close()
-					} else {
-						first_file = false
-					}
-					// Open up a new file
-					cur_filename = filepath.Join(outdir, fmt.Sprintf("%08d.gz", cur_idx))
-					//fmt.Println("New File:", cur_filename)
-					if cur_file, err = gocommons.Open(cur_filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, gocommons.GZ_TRUE); err != nil {
-						fmt.Fprintln(os.Stderr, "Could not open:", cur_filename, " :", err)
-						return
-					}
-					if cur_file_writer, err = cur_file.Writer(0); err != nil {
-						fmt.Fprintln(os.Stderr, "Could not get writer:", cur_filename, " :", err)
-						return
-					}
-				}
-				if cur_line_count == lines_per_file {
-					// We've reached the allotted lines per file. Rotate.
-					//fmt.Println("Rotating to new file ...")
-					cur_idx++
-					cur_line_count = 0
-					// We haven't read a line yet. So we can re-enter the loop here
-					continue
-				}
-				// All the file stuff has been set up.
-				// Go ahead and read a line from the channel
-				if line, ok := <-channel; !ok {
-					// Channel was closed. We're finished reading.
-					// Cleanup
-					fmt.Println("Cleaning up:", boot_id)
-					cur_file_writer.Flush()
-					cur_file_writer.Close()
-					cur_file.Close()
-					break
-				} else {
-					cur_line_count++
-					if cur_line_count != lines_per_file {
-						cur_file_writer.Write([]byte(line + "\n"))
-					} else {
-						cur_file_writer.Write([]byte(line))
-					}
-				}
-			}
-		}
-
-		var wg sync.WaitGroup
+		cancelled := false
 		for {
 			si, ok := <-merge_out_channel
 			if !ok {
-				goto done
+				break
+			}
+			if cancelled {
+				// Keep draining so that the merge can finish
+				continue
+			}
+			if ctx.Err() != nil {
+				cancelled = true
+				continue
 			}
 			logline, ok := si.(*cpuprof.Logline)
 			if !ok {
-				fmt.Fprintln(os.Stderr, "Could not convert to logline:", err)
-				os.Exit(-1)
-			}
-
-			boot_id := logline.BootId
-			// Check if the map has this bootid.
-			if _, ok := bootid_channel_map[boot_id]; !ok {
-				// Does not. Add it in and create a consumer
-				bootids = append(bootids, boot_id)
-				bootid_channel_map[boot_id] = make(chan string, 10000)
-				wg.Add(1)
-				go boot_id_consumer(boot_id, bootid_channel_map[boot_id], &wg)
-			} else {
-				// Write line to channel
-				bootid_channel_map[boot_id] <- logline.Line
+				err = fmt.Errorf("Could not convert to logline: %v", si)
+				cancelled = true
+				continue
 			}
+			splitter.Add(logline)
 		}
-	done:
-		fmt.Println("Cleaning up callback")
-		// Done reading the file. Now close the channels
-		for boot_id := range bootid_channel_map {
-			close(bootid_channel_map[boot_id])
+		fmt.Fprintln(cfg.log(), "Cleaning up callback")
+		fmt.Fprintf(cfg.log(), "Waiting for bootid_consumers to complete...")
+		if split_err := splitter.Close(); split_err != nil && err == nil {
+			err = fmt.Errorf("Failed to split by boot-id: %v", split_err)
 		}
-		fmt.Printf("Waiting for bootid_consumers to complete...")
-		wg.Wait()
-		fmt.Printf("Done\n")
+		fmt.Fprintf(cfg.log(), "Done\n")
 		quit <- true
-		fmt.Println("Callback: Done")
 	}
 	// Now start the n-way merge generator
 	gocommons.NWayMergeGenerator(chunks, cpuprof.LoglineSortParams, merge_out_channel, callback)
 
-	fmt.Println("Bootids:", bootids)
-	return bootids
+	bootids = splitter.BootIds
+	if err == nil {
+		err = ctx.Err()
+	}
+	fmt.Fprintln(cfg.log(), "Bootids:", bootids)
+	return
 }
 
 func WriteInfoJson(path string, files []string, bootids []string) (err error) {
@@ -266,13 +276,11 @@ func WriteInfoJson(path string, files []string, bootids []string) (err error) {
 	var bootid_writer gocommons.Writer
 
 	if bootid_file_raw, err = gocommons.Open(filepath.Join(path, "info.json"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, gocommons.GZ_FALSE); err != nil {
-		fmt.Fprintln(os.Stderr, fmt.Sprintf("Failed to open info.json:", err))
-		return
+		return fmt.Errorf("Failed to open info.json: %v", err)
 	}
 	defer bootid_file_raw.Close()
 	if bootid_writer, err = bootid_file_raw.Writer(0); err != nil {
-		fmt.Fprintln(os.Stderr, fmt.Sprintf("Failed to open writer to info.json:", err))
-		return err
+		return fmt.Errorf("Failed to open writer to info.json: %v", err)
 	}
 	defer bootid_writer.Close()
 	defer bootid_writer.Flush()
@@ -282,32 +290,8 @@ func WriteInfoJson(path string, files []string, bootids []string) (err error) {
 	json_map["files"] = files
 	var json_string []byte
 	if json_string, err = json.MarshalIndent(json_map, "", "    "); err != nil {
-		fmt.Fprintln(os.Stderr, fmt.Sprintf("Failed to marshal:", err))
-		return err
+		return fmt.Errorf("Failed to marshal: %v", err)
 	}
-	bootid_writer.Write(json_string)
+	_, err = bootid_writer.Write(json_string)
 	return
 }
-
-func StitchMain(args []string) {
-	kingpin.MustParse(kpin.Parse(args[1:]))
-	if !*split_only {
-		Process(*path, *regex, *bufsize)
-	} else {
-		if files, err := gocommons.ListFiles(*path, []string{"*.out.gz"}); err != nil {
-			fmt.Fprintln(os.Stderr, "Could not list files")
-			os.Exit(-1)
-		} else {
-			if chunks, err := gocommons.ListFiles(*path, []string{"*chunk*.gz"}); err != nil {
-				fmt.Fprintln(os.Stderr, "Could not list chunks")
-				os.Exit(-1)
-			} else {
-				BootIdSplit(*path, files, chunks, true, 1000000)
-			}
-		}
-	}
-}
-
-func main() {
-	StitchMain(os.Args)
-}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/gurupras/cpuprof/stitch"
+)
+
+var (
+	kpin        = kingpin.New("stitch", "")
+	process_cmd = kpin.Command("process", "Stitch files into per-boot shards").Default()
+	path        = process_cmd.Arg("path", "").Required().String()
+	regex       = process_cmd.Flag("regex", "").Short('r').Default("*.out.gz").String()
+	bufsize     = process_cmd.Flag("bufsize", "Buffer size per thread").Short('b').Default("104857600").Int()
+	split_only  = process_cmd.Flag("split-only", "Only perform split with existing chunks").Short('s').Default("false").Bool()
+	delete      = process_cmd.Flag("delete", "Delete intermediate files on exit").Default("false").Bool()
+	verify_cmd  = kpin.Command("verify", "Verify a stitched tree against its inputs")
+	verify_path = verify_cmd.Arg("path", "").Required().String()
+	stream_cmd  = kpin.Command("stream", "Stitch loglines from stdin or a socket as they arrive")
+	stream_path = stream_cmd.Arg("path", "").Required().String()
+	listen      = stream_cmd.Flag("listen", "unix:<socket> or tcp:<address> to listen on instead of reading stdin").Short('l').String()
+	window      = stream_cmd.Flag("window", "Lines held back per boot for reordering").Short('w').Default("10000").Int()
+	idle_flush  = stream_cmd.Flag("idle-flush", "Write out the reorder window and close the shard of boots idle for this long").Default("30s").Duration()
+	rotate      = stream_cmd.Flag("rotate-every", "Close shards that have been open for this long").Default("5m").Duration()
+	retire_idle = stream_cmd.Flag("retire-idle", "Forget boots idle for this long until they see a line again").Default("30m").Duration()
+)
+
+func StreamMain(path string) {
+	cfg := stitch.DefaultConfig(path)
+	cfg.ReorderWindow = *window
+	cfg.IdleFlush = *idle_flush
+	cfg.RotateEvery = *rotate
+	cfg.RetireIdle = *retire_idle
+	// Progress goes to stderr so that nothing mixes with piped output
+	cfg.Log = os.Stderr
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	var result stitch.Result
+	var err error
+	if len(*listen) == 0 {
+		result, err = stitch.Stream(ctx, cfg, os.Stdin)
+	} else {
+		tokens := strings.SplitN(*listen, ":", 2)
+		if len(tokens) != 2 || (tokens[0] != "unix" && tokens[0] != "tcp") {
+			fmt.Fprintln(os.Stderr, "Invalid --listen, expected unix:<socket> or tcp:<address>:", *listen)
+			os.Exit(-1)
+		}
+		result, err = stitch.Listen(ctx, cfg, tokens[0], tokens[1])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(-1)
+	}
+	fmt.Fprintln(os.Stderr, "Bootids:", result.NewBootIds)
+}
+
+func VerifyMain(path string) {
+	report, err := stitch.Verify(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to verify:", path, ":", err)
+		os.Exit(-1)
+	}
+	var json_string []byte
+	if json_string, err = json.MarshalIndent(report, "", "    "); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to marshal:", err)
+		os.Exit(-1)
+	}
+	fmt.Println(string(json_string))
+	if !report.Ok {
+		os.Exit(1)
+	}
+}
+
+func StitchMain(args []string) {
+	cmd := kingpin.MustParse(kpin.Parse(args[1:]))
+	if strings.Compare(cmd, verify_cmd.FullCommand()) == 0 {
+		VerifyMain(*verify_path)
+		return
+	}
+	if strings.Compare(cmd, stream_cmd.FullCommand()) == 0 {
+		StreamMain(*stream_path)
+		return
+	}
+
+	cfg := stitch.DefaultConfig(*path)
+	// Split regexes by ','
+	cfg.Patterns = strings.Split(*regex, ",")
+	cfg.BufSize = *bufsize
+	cfg.SplitOnly = *split_only
+	cfg.Delete = *delete
+	if _, err := stitch.Stitch(context.Background(), cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(-1)
+	}
+}
+
+func main() {
+	StitchMain(os.Args)
+}
@@ -1,7 +1,8 @@
-package main
+package stitch
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -10,7 +11,6 @@ import (
 	"sort"
 	"testing"
 
-	"github.com/google/shlex"
 	"github.com/gurupras/cpuprof"
 	"github.com/gurupras/gocommons"
 	"github.com/stretchr/testify/assert"
@@ -21,9 +21,9 @@ func TestStitch(t *testing.T) {
 	var err error
 
 	result := gocommons.InitResult("TestStitch")
-	//cmdline, err := shlex.Split("stitch_test.go /android/test-cpuprof/1b0676e5fb2d7ab82a2b76887c53e94cf0410826 --regex *.out.gz")
-	cmdline, err := shlex.Split("stitch_test.go /android/cpuprof-data/1a28ea49f4206010fee054f9bdb86f822dc4dd28")
-	StitchMain(cmdline)
+	//cfg := DefaultConfig("/android/test-cpuprof/1b0676e5fb2d7ab82a2b76887c53e94cf0410826")
+	cfg := DefaultConfig("/android/cpuprof-data/1a28ea49f4206010fee054f9bdb86f822dc4dd28")
+	_, err = Stitch(context.Background(), cfg)
 	if err == nil {
 		success = true
 	}
@@ -31,32 +31,42 @@ func TestStitch(t *testing.T) {
 	gocommons.HandleResult(t, success, result)
 }
 
-func TestWriteBootIdsJson(t *testing.T) {
+func TestStitchCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cfg := DefaultConfig("../test_files")
+	cfg.Log = nil
+	_, err := Stitch(ctx, cfg)
+	assert.Equal(t, context.Canceled, err, "Cancelled stitch did not return context.Canceled")
+}
+
+func TestWriteInfoJson(t *testing.T) {
 	var success bool = true
 	var err error
 
-	result := gocommons.InitResult("TestWriteBootIdsJson")
+	result := gocommons.InitResult("TestWriteInfoJson")
 
 	path := "."
-	file := filepath.Join(path, "bootids.json")
+	file := filepath.Join(path, "info.json")
 	bootids := []string{"a", "b", "c", "d"}
-	if err = WriteBootIdsJson(path, bootids); err != nil {
+	if err = WriteInfoJson(path, []string{}, bootids); err != nil {
 		success = false
 	}
 
 	bytes, err := ioutil.ReadFile(file)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, fmt.Sprintf("Failed to read file:", err))
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Failed to read file: %v", err))
 		success = false
 	}
-	var check []string
-	if err := json.Unmarshal(bytes, &check); err != nil {
-		fmt.Fprintln(os.Stderr, fmt.Sprintf("Failed to unmarshal file:", err))
+	var info map[string][]string
+	if err := json.Unmarshal(bytes, &info); err != nil {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Failed to unmarshal file: %v", err))
 		success = false
 	}
 
 	for i := range bootids {
-		if bootids[i] != check[i] {
+		if bootids[i] != info["bootids"][i] {
 			success = false
 			break
 		}
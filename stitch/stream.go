@@ -0,0 +1,360 @@
+package stitch
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fatih/set"
+	"github.com/gurupras/cpuprof"
+)
+
+// Loglines of one boot waiting to be written, ordered by LogcatToken
+type reorderWindow []*cpuprof.Logline
+
+func (rw reorderWindow) Len() int { return len(rw) }
+func (rw reorderWindow) Less(i, j int) bool {
+	if rw[i].LogcatToken == rw[j].LogcatToken {
+		return rw[i].TraceTime < rw[j].TraceTime
+	}
+	return rw[i].LogcatToken < rw[j].LogcatToken
+}
+func (rw reorderWindow) Swap(i, j int) { rw[i], rw[j] = rw[j], rw[i] }
+
+func (rw *reorderWindow) Push(x interface{}) {
+	*rw = append(*rw, x.(*cpuprof.Logline))
+}
+
+func (rw *reorderWindow) Pop() interface{} {
+	old := *rw
+	n := len(old)
+	logline := old[n-1]
+	*rw = old[:n-1]
+	return logline
+}
+
+type bootWindow struct {
+	window     reorderWindow
+	last_token int64
+	written    bool
+	last_seen  time.Time
+	// Whether a shard is open and since when
+	open   bool
+	opened time.Time
+}
+
+// Streamer stitches loglines that arrive in roughly increasing order.
+// Each boot holds back up to cfg.ReorderWindow lines so that lines which
+// arrive slightly out of order are written in order. Lines that arrive after
+// a later line of their boot was written are dropped and counted as late.
+// A Streamer is not safe for concurrent use.
+type Streamer struct {
+	Config   Config
+	Late     int64
+	Unparsed int64
+	splitter *BootSplitter
+	boots    map[string]*bootWindow
+	// Last token written of every retired boot, so that its late lines are
+	// still dropped if it comes back
+	retired map[string]int64
+}
+
+func NewStreamer(cfg Config) *Streamer {
+	if cfg.LinesPerFile <= 0 {
+		cfg.LinesPerFile = DEFAULT_LINES_PER_FILE
+	}
+	if cfg.RotateEvery <= 0 {
+		cfg.RotateEvery = DEFAULT_ROTATE_EVERY
+	}
+	if cfg.RetireIdle <= 0 {
+		cfg.RetireIdle = DEFAULT_RETIRE_IDLE
+	}
+	s := new(Streamer)
+	s.Config = cfg
+	// Never delete: a restarted collector appends after the existing shards
+	s.splitter = NewBootSplitter(NewFileSink(cfg.Path), cfg.LinesPerFile, false)
+	s.boots = make(map[string]*bootWindow)
+	s.retired = make(map[string]int64)
+	return s
+}
+
+// AddLine parses line and adds it. Lines that do not parse are counted and dropped.
+func (s *Streamer) AddLine(line string) {
+	logline := cpuprof.ParseLogline(line)
+	if logline == nil {
+		s.Unparsed++
+		return
+	}
+	s.Add(logline)
+}
+
+func (s *Streamer) Add(logline *cpuprof.Logline) {
+	bw, ok := s.boots[logline.BootId]
+	if !ok {
+		bw = new(bootWindow)
+		bw.window = make(reorderWindow, 0)
+		if last_token, ok := s.retired[logline.BootId]; ok {
+			bw.last_token = last_token
+			bw.written = true
+			delete(s.retired, logline.BootId)
+		}
+		s.boots[logline.BootId] = bw
+	}
+	bw.last_seen = time.Now()
+	if bw.written && logline.LogcatToken <= bw.last_token {
+		s.Late++
+		return
+	}
+	heap.Push(&bw.window, logline)
+	for bw.window.Len() > s.Config.ReorderWindow {
+		s.write(bw, heap.Pop(&bw.window).(*cpuprof.Logline))
+	}
+}
+
+func (s *Streamer) write(bw *bootWindow, logline *cpuprof.Logline) {
+	// Duplicates of a token that is still in the window end up here
+	if bw.written && logline.LogcatToken <= bw.last_token {
+		s.Late++
+		return
+	}
+	s.splitter.Add(logline)
+	bw.last_token = logline.LogcatToken
+	bw.written = true
+	if !bw.open {
+		bw.open = true
+		bw.opened = time.Now()
+	}
+}
+
+func (s *Streamer) flush(bw *bootWindow) {
+	for bw.window.Len() > 0 {
+		s.write(bw, heap.Pop(&bw.window).(*cpuprof.Logline))
+	}
+}
+
+// rotate closes the open shard of bootid and returns whether there was one
+func (s *Streamer) rotate(bootid string, bw *bootWindow) bool {
+	if !bw.open {
+		return false
+	}
+	bw.open = false
+	return s.splitter.Rotate(bootid)
+}
+
+// FlushIdle writes out the reorder window of every boot that has not seen a
+// line for at least idle and closes its shard. Shards that have been open
+// for Config.RotateEvery are closed as well, and boots that have been idle
+// for Config.RetireIdle are retired. If any shard was closed, info.json is
+// updated so that the closed shards can be read.
+func (s *Streamer) FlushIdle(idle time.Duration) error {
+	now := time.Now()
+	closed := false
+	for bootid, bw := range s.boots {
+		if now.Sub(bw.last_seen) >= idle {
+			s.flush(bw)
+			closed = s.rotate(bootid, bw) || closed
+		} else if bw.open && now.Sub(bw.opened) >= s.Config.RotateEvery {
+			closed = s.rotate(bootid, bw) || closed
+		}
+		if now.Sub(bw.last_seen) >= s.Config.RetireIdle {
+			s.flush(bw)
+			s.splitter.Retire(bootid)
+			if bw.written {
+				s.retired[bootid] = bw.last_token
+			}
+			delete(s.boots, bootid)
+			closed = true
+		}
+	}
+	if !closed {
+		return nil
+	}
+	_, err := s.writeInfo()
+	return err
+}
+
+// writeInfo merges the boot-ids written so far into <path>/info.json
+func (s *Streamer) writeInfo() (result Result, err error) {
+	result.NewBootIds = append(make([]string, 0, len(s.splitter.BootIds)), s.splitter.BootIds...)
+	sort.Strings(result.NewBootIds)
+
+	bootids := set.NewNonTS()
+	if info, err := cpuprof.GetInfo(s.Config.Path); err == nil {
+		result.Files = info["files"]
+		setAddStrings(bootids, info["bootids"])
+	}
+	if result.Files == nil {
+		result.Files = make([]string, 0)
+	}
+	setAddStrings(bootids, result.NewBootIds)
+	result.BootIds = set.StringSlice(bootids)
+	sort.Strings(result.BootIds)
+	err = WriteInfoJson(s.Config.Path, result.Files, result.BootIds)
+	return
+}
+
+// Close writes out every reorder window, closes the shards and merges the
+// boot-ids that were written into <path>/info.json.
+func (s *Streamer) Close() (result Result, err error) {
+	for _, bw := range s.boots {
+		s.flush(bw)
+	}
+	if err = s.splitter.Close(); err != nil {
+		result.Late = s.Late
+		result.Unparsed = s.Unparsed
+		return result, fmt.Errorf("Failed to split by boot-id: %v", err)
+	}
+	result, err = s.writeInfo()
+	result.Late = s.Late
+	result.Unparsed = s.Unparsed
+	return
+}
+
+// Feeds lines to a Streamer until lines is closed or ctx is cancelled.
+// Lines already queued when ctx is cancelled are still written.
+func (s *Streamer) run(ctx context.Context, lines chan string) (Result, error) {
+	idle := s.Config.IdleFlush
+	if idle <= 0 {
+		idle = DEFAULT_IDLE_FLUSH
+	}
+	ticker := time.NewTicker(idle)
+	defer ticker.Stop()
+
+loop:
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				break loop
+			}
+			s.AddLine(line)
+		case <-ticker.C:
+			if err := s.FlushIdle(idle); err != nil {
+				fmt.Fprintln(s.Config.log(), "Failed to update info.json:", err)
+			}
+		case <-ctx.Done():
+			for {
+				select {
+				case line, ok := <-lines:
+					if !ok {
+						break loop
+					}
+					s.AddLine(line)
+				default:
+					break loop
+				}
+			}
+		}
+	}
+	fmt.Fprintf(s.Config.log(), "Stream closed: %v late, %v unparsed lines dropped\n", s.Late, s.Unparsed)
+	return s.Close()
+}
+
+// scanLines sends the lines of reader to lines until it is exhausted or ctx
+// is cancelled
+func scanLines(ctx context.Context, reader io.Reader, lines chan string) error {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 65536), 1048576)
+	for scanner.Scan() {
+		select {
+		case lines <- scanner.Text():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return scanner.Err()
+}
+
+// Stream stitches the loglines read from reader until it is exhausted or ctx
+// is cancelled. Use it to stitch from stdin.
+func Stream(ctx context.Context, cfg Config, reader io.Reader) (result Result, err error) {
+	lines := make(chan string, 10000)
+	read_err := make(chan error, 1)
+	go func() {
+		read_err <- scanLines(ctx, reader, lines)
+		close(lines)
+	}()
+	result, err = NewStreamer(cfg).run(ctx, lines)
+	if err == nil && ctx.Err() == nil {
+		// lines was closed, so the reader is done
+		err = <-read_err
+	}
+	return
+}
+
+// Listen accepts connections on network ("unix" or "tcp") and address and
+// stitches the loglines sent over all of them until ctx is cancelled.
+// Every connection is expected to send newline separated loglines.
+func Listen(ctx context.Context, cfg Config, network string, address string) (result Result, err error) {
+	var listener net.Listener
+
+	if listener, err = net.Listen(network, address); err != nil {
+		return result, fmt.Errorf("Failed to listen: %v %v: %v", network, address, err)
+	}
+	fmt.Fprintln(cfg.log(), "Listening on", network, listener.Addr())
+
+	lines := make(chan string, 10000)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	conns := make(map[net.Conn]bool)
+
+	handle := func(conn net.Conn) {
+		defer wg.Done()
+		defer conn.Close()
+		if err := scanLines(ctx, conn, lines); err != nil && ctx.Err() == nil {
+			fmt.Fprintln(cfg.log(), "Connection failed:", conn.RemoteAddr(), ":", err)
+		}
+		mutex.Lock()
+		delete(conns, conn)
+		mutex.Unlock()
+	}
+
+	// Stop accepting and drop every connection once ctx is cancelled
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+		mutex.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		mutex.Unlock()
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					fmt.Fprintln(cfg.log(), "Failed to accept:", err)
+				}
+				return
+			}
+			mutex.Lock()
+			if ctx.Err() != nil {
+				mutex.Unlock()
+				conn.Close()
+				continue
+			}
+			conns[conn] = true
+			wg.Add(1)
+			mutex.Unlock()
+			go handle(conn)
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(lines)
+	}()
+
+	// Every source stops on cancellation so lines is always closed
+	result, err = NewStreamer(cfg).run(context.Background(), lines)
+	return
+}
@@ -0,0 +1,208 @@
+package stitch
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gurupras/cpuprof"
+	"github.com/gurupras/gocommons"
+	"github.com/stretchr/testify/assert"
+)
+
+func readGz(t *testing.T, file string) []string {
+	fstruct, err := gocommons.Open(file, os.O_RDONLY, gocommons.GZ_TRUE)
+	assert.Nil(t, err, "Failed to open:", file)
+	defer fstruct.Close()
+	reader, err := fstruct.Reader(0)
+	assert.Nil(t, err, "Failed to get reader:", file)
+	reader.Split(bufio.ScanLines)
+	lines := make([]string, 0)
+	for reader.Scan() {
+		lines = append(lines, reader.Text())
+	}
+	return lines
+}
+
+func streamConfig(path string, window int) Config {
+	cfg := DefaultConfig(path)
+	cfg.LinesPerFile = 2
+	cfg.ReorderWindow = window
+	cfg.Log = nil
+	return cfg
+}
+
+func TestStream(t *testing.T) {
+	assert := assert.New(t)
+
+	path, err := ioutil.TempDir("", "stitch-stream")
+	assert.Nil(err, "Failed to create temp dir")
+	defer os.RemoveAll(path)
+
+	// Slightly out of order, interleaved across boots
+	input := []string{
+		verifyTestLine(verifyBootA, 2),
+		verifyTestLine(verifyBootA, 1),
+		verifyTestLine(verifyBootB, 1),
+		verifyTestLine(verifyBootA, 4),
+		"garbage that does not parse",
+		verifyTestLine(verifyBootA, 3),
+		verifyTestLine(verifyBootB, 2),
+		verifyTestLine(verifyBootA, 5),
+	}
+	result, err := Stream(context.Background(), streamConfig(path, 2), strings.NewReader(strings.Join(input, "\n")))
+	assert.Nil(err, "Failed to stream")
+	assert.Equal(int64(0), result.Late)
+	assert.Equal(int64(1), result.Unparsed)
+	assert.Equal([]string{verifyBootB, verifyBootA}, result.NewBootIds)
+
+	assert.Equal([]string{verifyTestLine(verifyBootA, 1), verifyTestLine(verifyBootA, 2)}, readGz(t, filepath.Join(path, verifyBootA, "00000000.gz")))
+	assert.Equal([]string{verifyTestLine(verifyBootA, 3), verifyTestLine(verifyBootA, 4)}, readGz(t, filepath.Join(path, verifyBootA, "00000001.gz")))
+	assert.Equal([]string{verifyTestLine(verifyBootA, 5)}, readGz(t, filepath.Join(path, verifyBootA, "00000002.gz")))
+	assert.Equal([]string{verifyTestLine(verifyBootB, 1), verifyTestLine(verifyBootB, 2)}, readGz(t, filepath.Join(path, verifyBootB, "00000000.gz")))
+
+	info, err := cpuprof.GetInfo(path)
+	assert.Nil(err, "Failed to read info.json")
+	assert.Equal([]string{verifyBootB, verifyBootA}, info["bootids"])
+
+	// A second stream appends after the existing shards
+	result, err = Stream(context.Background(), streamConfig(path, 2), strings.NewReader(verifyTestLine(verifyBootA, 6)))
+	assert.Nil(err, "Failed to stream")
+	assert.Equal([]string{verifyTestLine(verifyBootA, 6)}, readGz(t, filepath.Join(path, verifyBootA, "00000003.gz")))
+	assert.Equal([]string{verifyBootB, verifyBootA}, result.BootIds)
+}
+
+func TestStreamLate(t *testing.T) {
+	assert := assert.New(t)
+
+	path, err := ioutil.TempDir("", "stitch-stream")
+	assert.Nil(err, "Failed to create temp dir")
+	defer os.RemoveAll(path)
+
+	// Token 1 arrives after 3 has left the window; the duplicate 4 is dropped too
+	input := []string{
+		verifyTestLine(verifyBootA, 3),
+		verifyTestLine(verifyBootA, 4),
+		verifyTestLine(verifyBootA, 1),
+		verifyTestLine(verifyBootA, 4),
+	}
+	result, err := Stream(context.Background(), streamConfig(path, 1), strings.NewReader(strings.Join(input, "\n")))
+	assert.Nil(err, "Failed to stream")
+	assert.Equal(int64(2), result.Late)
+	assert.Equal([]string{verifyTestLine(verifyBootA, 3), verifyTestLine(verifyBootA, 4)}, readGz(t, filepath.Join(path, verifyBootA, "00000000.gz")))
+}
+
+func TestStreamerRotate(t *testing.T) {
+	assert := assert.New(t)
+
+	path, err := ioutil.TempDir("", "stitch-stream")
+	assert.Nil(err, "Failed to create temp dir")
+	defer os.RemoveAll(path)
+
+	cfg := streamConfig(path, 10)
+	cfg.LinesPerFile = 100
+	s := NewStreamer(cfg)
+	s.Add(cpuprof.ParseLogline(verifyTestLine(verifyBootA, 1)))
+	s.Add(cpuprof.ParseLogline(verifyTestLine(verifyBootA, 2)))
+	// Idle: the window is written out and the shard closed
+	assert.Nil(s.FlushIdle(0))
+	assert.Equal([]string{verifyTestLine(verifyBootA, 1), verifyTestLine(verifyBootA, 2)}, readGz(t, filepath.Join(path, verifyBootA, "00000000.gz")))
+	info, err := cpuprof.GetInfo(path)
+	assert.Nil(err, "Failed to read info.json")
+	assert.Equal([]string{verifyBootA}, info["bootids"])
+
+	// Busy: the shard is closed once it has been open for RotateEvery
+	s.Config.ReorderWindow = 0
+	s.Config.RotateEvery = time.Nanosecond
+	s.Add(cpuprof.ParseLogline(verifyTestLine(verifyBootA, 3)))
+	time.Sleep(time.Millisecond)
+	assert.Nil(s.FlushIdle(time.Hour))
+	assert.Equal([]string{verifyTestLine(verifyBootA, 3)}, readGz(t, filepath.Join(path, verifyBootA, "00000001.gz")))
+
+	s.Config.RetireIdle = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	assert.Nil(s.FlushIdle(time.Hour))
+	assert.Equal(0, len(s.boots))
+	// A retired boot still drops its late lines and appends after its shards
+	s.Config.RetireIdle = time.Hour
+	s.Add(cpuprof.ParseLogline(verifyTestLine(verifyBootA, 2)))
+	s.Add(cpuprof.ParseLogline(verifyTestLine(verifyBootA, 4)))
+	result, err := s.Close()
+	assert.Nil(err, "Failed to close")
+	assert.Equal(int64(1), result.Late)
+	assert.Equal([]string{verifyBootA}, result.NewBootIds)
+	assert.Equal([]string{verifyTestLine(verifyBootA, 4)}, readGz(t, filepath.Join(path, verifyBootA, "00000002.gz")))
+}
+
+func TestScanLinesCancel(t *testing.T) {
+	assert := assert.New(t)
+
+	// Nobody receives, so the line can only be given up on
+	lines := make(chan string)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- scanLines(ctx, strings.NewReader(verifyTestLine(verifyBootA, 1)), lines)
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		assert.Equal(context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		assert.Fail("scanLines did not stop")
+	}
+}
+
+func TestListen(t *testing.T) {
+	assert := assert.New(t)
+
+	path, err := ioutil.TempDir("", "stitch-stream")
+	assert.Nil(err, "Failed to create temp dir")
+	defer os.RemoveAll(path)
+	socket := filepath.Join(path, "stitch.sock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	type listenResult struct {
+		result Result
+		err    error
+	}
+	done := make(chan listenResult)
+	go func() {
+		result, err := Listen(ctx, streamConfig(path, 10), "unix", socket)
+		done <- listenResult{result, err}
+	}()
+
+	var conn net.Conn
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("unix", socket); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Nil(err, "Failed to connect")
+	other, err := net.Dial("unix", socket)
+	assert.Nil(err, "Failed to connect")
+
+	for token := 1; token <= 3; token++ {
+		fmt.Fprintln(conn, verifyTestLine(verifyBootA, token))
+		fmt.Fprintln(other, verifyTestLine(verifyBootB, token))
+	}
+	conn.Close()
+	other.Close()
+	// Give the connections time to be read before shutting down
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	lr := <-done
+	assert.Nil(lr.err, "Failed to listen")
+	assert.Equal([]string{verifyBootB, verifyBootA}, lr.result.BootIds)
+	assert.Equal([]string{verifyTestLine(verifyBootA, 3)}, readGz(t, filepath.Join(path, verifyBootA, "00000001.gz")))
+	assert.Equal([]string{verifyTestLine(verifyBootB, 3)}, readGz(t, filepath.Join(path, verifyBootB, "00000001.gz")))
+}
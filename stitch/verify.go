@@ -0,0 +1,194 @@
+package stitch
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gurupras/cpuprof"
+	"github.com/gurupras/gocommons"
+)
+
+// Maximum number of problems recorded per boot. Past this we only count them.
+const VERIFY_MAX_ERRORS = 10
+
+type BootReport struct {
+	BootId        string   `json:"bootid"`
+	Exists        bool     `json:"exists"`
+	Shards        []string `json:"shards"`
+	Lines         int64    `json:"lines"`
+	ExpectedLines int64    `json:"expected_lines"`
+	BadShards     int      `json:"bad_shards"`
+	Unparsed      int64    `json:"unparsed"`
+	WrongBoot     int64    `json:"wrong_boot"`
+	OutOfOrder    int64    `json:"out_of_order"`
+	Errors        []string `json:"errors"`
+	Ok            bool     `json:"ok"`
+}
+
+func (br *BootReport) addError(format string, args ...interface{}) {
+	if len(br.Errors) < VERIFY_MAX_ERRORS {
+		br.Errors = append(br.Errors, fmt.Sprintf(format, args...))
+	}
+}
+
+type VerifyReport struct {
+	Path   string        `json:"path"`
+	Files  []string      `json:"files"`
+	Boots  []*BootReport `json:"boots"`
+	Errors []string      `json:"errors"`
+	Ok     bool          `json:"ok"`
+}
+
+// Count the parseable loglines per boot-id in the input files.
+// Lines that do not parse are dropped by the stitcher and are not counted.
+func countInputLines(files []string) (counts map[string]int64, err error) {
+	var file_raw *gocommons.File
+	var reader *bufio.Scanner
+
+	counts = make(map[string]int64)
+	for _, file := range files {
+		if file_raw, err = gocommons.Open(file, os.O_RDONLY, gocommons.GZ_UNKNOWN); err != nil {
+			return nil, fmt.Errorf("Failed to open input file: %v: %v", file, err)
+		}
+		if reader, err = file_raw.Reader(1048576); err != nil {
+			file_raw.Close()
+			return nil, fmt.Errorf("Failed to get reader to input file: %v: %v", file, err)
+		}
+		reader.Split(bufio.ScanLines)
+		for reader.Scan() {
+			if logline := cpuprof.ParseLogline(reader.Text()); logline != nil {
+				counts[logline.BootId]++
+			}
+		}
+		err = reader.Err()
+		file_raw.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read input file: %v: %v", file, err)
+		}
+	}
+	return
+}
+
+func verifyBoot(path string, boot_id string, expected int64) *BootReport {
+	var err error
+	var files []string
+
+	br := new(BootReport)
+	br.BootId = boot_id
+	br.ExpectedLines = expected
+	br.Shards = make([]string, 0)
+	br.Errors = make([]string, 0)
+
+	outdir := filepath.Join(path, boot_id)
+	if fi, err := os.Stat(outdir); err != nil || !fi.IsDir() {
+		br.addError("Boot directory does not exist: %v", outdir)
+		return br
+	}
+	br.Exists = true
+
+	if files, err = gocommons.ListFiles(outdir, []string{"*.gz"}); err != nil {
+		br.addError("Failed to list shards: %v", err)
+		return br
+	}
+	sort.Sort(sort.StringSlice(files))
+
+	last_token := int64(-1)
+	for idx, file := range files {
+		br.Shards = append(br.Shards, filepath.Base(file))
+		// Shards are written as %08d.gz starting at 0 with no holes
+		if shard_idx, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(file), ".gz")); err != nil || shard_idx != idx {
+			br.addError("Unexpected shard name: %v (expected %08d.gz)", filepath.Base(file), idx)
+		}
+
+		var file_raw *gocommons.File
+		var reader *bufio.Scanner
+		if file_raw, err = gocommons.Open(file, os.O_RDONLY, gocommons.GZ_TRUE); err != nil {
+			br.BadShards++
+			br.addError("Failed to open shard: %v: %v", file, err)
+			continue
+		}
+		if reader, err = file_raw.Reader(1048576); err != nil {
+			br.BadShards++
+			br.addError("Failed to decompress shard: %v: %v", file, err)
+			file_raw.Close()
+			continue
+		}
+		reader.Split(bufio.ScanLines)
+		for reader.Scan() {
+			line := reader.Text()
+			br.Lines++
+			logline := cpuprof.ParseLogline(line)
+			if logline == nil {
+				br.Unparsed++
+				br.addError("Failed to parse line in %v: %v", file, line)
+				continue
+			}
+			if strings.Compare(logline.BootId, boot_id) != 0 {
+				br.WrongBoot++
+				br.addError("Line from boot %v in %v: %v", logline.BootId, file, line)
+				continue
+			}
+			if logline.LogcatToken <= last_token {
+				br.OutOfOrder++
+				br.addError("Token %v after %v in %v", logline.LogcatToken, last_token, file)
+			}
+			last_token = logline.LogcatToken
+		}
+		if err = reader.Err(); err != nil {
+			br.BadShards++
+			br.addError("Failed to decompress shard: %v: %v", file, err)
+		}
+		file_raw.Close()
+	}
+	if br.Lines != br.ExpectedLines {
+		br.addError("Line count mismatch: found %v expected %v", br.Lines, br.ExpectedLines)
+	}
+	br.Ok = br.Exists && br.Lines == br.ExpectedLines && br.BadShards == 0 &&
+		br.Unparsed == 0 && br.WrongBoot == 0 && br.OutOfOrder == 0 && len(br.Errors) == 0
+	return br
+}
+
+// Verify checks that a stitched tree at path matches the inputs recorded in
+// its info.json. The returned error is only set if the check itself could not
+// be carried out; integrity problems are recorded in the report.
+func Verify(path string) (report *VerifyReport, err error) {
+	var info map[string][]string
+	var counts map[string]int64
+
+	report = new(VerifyReport)
+	report.Path = path
+	report.Boots = make([]*BootReport, 0)
+	report.Errors = make([]string, 0)
+
+	if info, err = cpuprof.GetInfo(path); err != nil {
+		return nil, err
+	}
+	report.Files = info["files"]
+
+	if counts, err = countInputLines(info["files"]); err != nil {
+		return nil, err
+	}
+
+	listed := make(map[string]bool)
+	for _, boot_id := range info["bootids"] {
+		listed[boot_id] = true
+		report.Boots = append(report.Boots, verifyBoot(path, boot_id, counts[boot_id]))
+	}
+	for boot_id, count := range counts {
+		if !listed[boot_id] {
+			report.Errors = append(report.Errors, fmt.Sprintf("Boot %v has %v input lines but is not listed in info.json", boot_id, count))
+		}
+	}
+	sort.Strings(report.Errors)
+
+	report.Ok = len(report.Errors) == 0
+	for _, br := range report.Boots {
+		report.Ok = report.Ok && br.Ok
+	}
+	return
+}
@@ -0,0 +1,109 @@
+package stitch
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gurupras/gocommons"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	verifyBootA = "6890aa2f-9895-47bf-9c37-79a2e3a34703"
+	verifyBootB = "346fb177-c54f-4f8a-9385-124c461fd5cc"
+)
+
+func verifyTestLine(bootid string, token int) string {
+	return fmt.Sprintf("%s 2016-06-25 13:24:51.291000001 %d [   %d.522780]   200   200 D KernelPrintk: line %d", bootid, token, token, token)
+}
+
+func writeGz(t *testing.T, file string, lines []string) {
+	fstruct, err := gocommons.Open(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, gocommons.GZ_TRUE)
+	assert.Nil(t, err, "Failed to open:", file)
+	defer fstruct.Close()
+	writer, err := fstruct.Writer(0)
+	assert.Nil(t, err, "Failed to get writer:", file)
+	defer writer.Close()
+	defer writer.Flush()
+	for _, line := range lines {
+		writer.Write([]byte(line + "\n"))
+	}
+}
+
+// Creates a tree with one input file and a correctly stitched copy of it
+func setupVerifyTree(t *testing.T) string {
+	path, err := ioutil.TempDir("", "stitch-verify")
+	assert.Nil(t, err, "Failed to create temp dir")
+
+	input := make([]string, 0)
+	for token := 1; token <= 5; token++ {
+		input = append(input, verifyTestLine(verifyBootA, token))
+		input = append(input, verifyTestLine(verifyBootB, token))
+	}
+	input = append(input, "garbage that does not parse")
+	inputFile := filepath.Join(path, "input.out.gz")
+	writeGz(t, inputFile, input)
+
+	os.MkdirAll(filepath.Join(path, verifyBootA), 0775)
+	os.MkdirAll(filepath.Join(path, verifyBootB), 0775)
+	writeGz(t, filepath.Join(path, verifyBootA, "00000000.gz"), []string{verifyTestLine(verifyBootA, 1), verifyTestLine(verifyBootA, 2), verifyTestLine(verifyBootA, 3)})
+	writeGz(t, filepath.Join(path, verifyBootA, "00000001.gz"), []string{verifyTestLine(verifyBootA, 4), verifyTestLine(verifyBootA, 5)})
+	writeGz(t, filepath.Join(path, verifyBootB, "00000000.gz"), []string{verifyTestLine(verifyBootB, 1), verifyTestLine(verifyBootB, 2), verifyTestLine(verifyBootB, 3), verifyTestLine(verifyBootB, 4), verifyTestLine(verifyBootB, 5)})
+
+	assert.Nil(t, WriteInfoJson(path, []string{inputFile}, []string{verifyBootA, verifyBootB}))
+	return path
+}
+
+func TestVerify(t *testing.T) {
+	assert := assert.New(t)
+
+	path := setupVerifyTree(t)
+	defer os.RemoveAll(path)
+
+	report, err := Verify(path)
+	assert.Nil(err, "Failed to verify")
+	assert.True(report.Ok, "Valid tree failed verification: %v", report)
+	assert.Equal(2, len(report.Boots))
+	for _, br := range report.Boots {
+		assert.Equal(int64(5), br.Lines)
+		assert.Equal(int64(5), br.ExpectedLines)
+	}
+}
+
+func TestVerifyFailures(t *testing.T) {
+	assert := assert.New(t)
+
+	path := setupVerifyTree(t)
+	defer os.RemoveAll(path)
+
+	// Lose the first line, go backwards across shards and put a line in the wrong boot
+	writeGz(t, filepath.Join(path, verifyBootA, "00000000.gz"), []string{verifyTestLine(verifyBootA, 2), verifyTestLine(verifyBootA, 4)})
+	writeGz(t, filepath.Join(path, verifyBootA, "00000001.gz"), []string{verifyTestLine(verifyBootA, 3), verifyTestLine(verifyBootB, 6), verifyTestLine(verifyBootA, 5)})
+	// Corrupt the other boot's shard
+	ioutil.WriteFile(filepath.Join(path, verifyBootB, "00000000.gz"), []byte("not gzip"), 0664)
+
+	report, err := Verify(path)
+	assert.Nil(err, "Failed to verify")
+	assert.False(report.Ok, "Broken tree passed verification")
+
+	a := report.Boots[0]
+	assert.Equal(verifyBootA, a.BootId)
+	assert.False(a.Ok)
+	assert.Equal(int64(1), a.WrongBoot)
+	assert.Equal(int64(1), a.OutOfOrder)
+
+	b := report.Boots[1]
+	assert.False(b.Ok)
+	assert.Equal(1, b.BadShards)
+
+	// Missing boot directory
+	os.RemoveAll(filepath.Join(path, verifyBootB))
+	report, err = Verify(path)
+	assert.Nil(err, "Failed to verify")
+	assert.False(report.Boots[1].Exists)
+	assert.True(strings.Contains(report.Boots[1].Errors[0], "does not exist"))
+}
@@ -0,0 +1,33 @@
+package cpuprof
+
+import (
+	"fmt"
+)
+
+// SensorLabels names the thermal sensors of a device model by the sensor_id
+// of their thermal_temp loglines, such as "cpu0", "pa", "battery" or "skin"
+type SensorLabels map[int]string
+
+// Label returns the label of sensor, or a name made from its id if it has
+// none
+func (labels SensorLabels) Label(sensor int) string {
+	if label, ok := labels[sensor]; ok {
+		return label
+	}
+	return fmt.Sprintf("sensor%d", sensor)
+}
+
+// Qualcomm MSM8974 (Nexus 5): TSENS sensors 5 to 8 sit on the four cores
+var NEXUS_5_SENSOR_LABELS = SensorLabels{
+	5: "cpu0",
+	6: "cpu1",
+	7: "cpu2",
+	8: "cpu3",
+}
+
+// Sensor labels declared per device model, as listed in the dataset's
+// models.json
+var ThermalSensorLabels = map[string]SensorLabels{
+	"Nexus 5":    NEXUS_5_SENSOR_LABELS,
+	"hammerhead": NEXUS_5_SENSOR_LABELS,
+}
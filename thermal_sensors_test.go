@@ -0,0 +1,18 @@
+package cpuprof
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSensorLabels(t *testing.T) {
+	assert := assert.New(t)
+
+	labels := ThermalSensorLabels["Nexus 5"]
+	assert.Equal("cpu2", labels.Label(7))
+	assert.Equal("sensor0", labels.Label(0))
+
+	var none SensorLabels
+	assert.Equal("sensor5", none.Label(5))
+}
@@ -0,0 +1,161 @@
+package cpuprof
+
+import (
+	"sort"
+)
+
+// Cluster is a group of identical cores with one frequency table. Cores of a
+// cluster usually share a frequency, but some SoCs, such as the MSM8974, scale
+// every core on its own.
+type Cluster struct {
+	Id   int   `json:"id"`
+	Cpus []int `json:"cpus"`
+	// Available frequencies in kHz, lowest first
+	Frequencies []int `json:"frequencies"`
+	// Work a core of the cluster does per cycle relative to the other
+	// clusters of the topology. Cores of one microarchitecture have 1.
+	Capacity float64 `json:"capacity"`
+}
+
+func (c *Cluster) MaxFrequency() int {
+	if len(c.Frequencies) == 0 {
+		return 0
+	}
+	return c.Frequencies[len(c.Frequencies)-1]
+}
+
+// Topology is the clusters of a SoC. Cluster ids are their index in Clusters.
+type Topology struct {
+	Clusters []*Cluster `json:"clusters"`
+	// Whether the topology was inferred from the frequencies seen in a boot
+	// rather than declared for a device model
+	Inferred bool `json:"inferred"`
+}
+
+// Qualcomm MSM8974 (Nexus 5): four Krait 400 cores
+var NEXUS_5_TOPOLOGY = &Topology{Clusters: []*Cluster{
+	{0, []int{0, 1, 2, 3}, []int{300000, 422400, 652800, 729600, 883200, 960000, 1036800, 1190400, 1267200, 1497600, 1574400, 1728000, 1958400, 2265600}, 1.0},
+}}
+
+// Topologies declared per device model, as listed in the dataset's models.json.
+// Only the single-cluster Nexus 5 is declared so far, and there is no way to
+// declare other models, such as a --sensor-labels-style file, short of adding
+// them here. The topologies of models missing from here are inferred per boot.
+var Topologies = map[string]*Topology{
+	"Nexus 5":    NEXUS_5_TOPOLOGY,
+	"hammerhead": NEXUS_5_TOPOLOGY,
+}
+
+func (t *Topology) Ncpus() int {
+	ncpus := 0
+	for _, c := range t.Clusters {
+		for _, cpu := range c.Cpus {
+			if cpu+1 > ncpus {
+				ncpus = cpu + 1
+			}
+		}
+	}
+	return ncpus
+}
+
+// Cluster returns the cluster of cpu, or nil if cpu is not in the topology
+func (t *Topology) Cluster(cpu int) *Cluster {
+	for _, c := range t.Clusters {
+		for _, other := range c.Cpus {
+			if other == cpu {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// maxCapacity is the capacity of the fastest core at its highest frequency
+func (t *Topology) maxCapacity() float64 {
+	max := 0.0
+	for _, c := range t.Clusters {
+		if capacity := c.Capacity * float64(c.MaxFrequency()); capacity > max {
+			max = capacity
+		}
+	}
+	return max
+}
+
+// Capacity is the work cpu does at frequency relative to the fastest core of
+// the topology at its highest frequency. It is 0 if cpu is not in the
+// topology.
+func (t *Topology) Capacity(cpu int, frequency int) float64 {
+	c := t.Cluster(cpu)
+	max := t.maxCapacity()
+	if c == nil || max == 0 {
+		return 0
+	}
+	return c.Capacity * float64(frequency) / max
+}
+
+// TotalCapacity is the summed capacity of every core at its highest frequency
+func (t *Topology) TotalCapacity() float64 {
+	total := 0.0
+	for _, c := range t.Clusters {
+		total += float64(len(c.Cpus)) * t.Capacity(c.Cpus[0], c.MaxFrequency())
+	}
+	return total
+}
+
+// InferTopology groups cpus into clusters by the highest of the frequencies
+// seen on each, given as cpu to frequencies. A cluster's frequency table is
+// every frequency seen on any of its cores. Clusters are numbered from the
+// lowest highest frequency up. Since a core's cycles are all that is known,
+// every cluster has a Capacity of 1. A core that never reached its cluster's
+// highest frequency ends up in a cluster of its own; declare the topology of
+// a model in Topologies where that matters.
+func InferTopology(frequencies map[int][]int) *Topology {
+	byMax := make(map[int]*Cluster)
+	for cpu, cpuFrequencies := range frequencies {
+		if len(cpuFrequencies) == 0 {
+			continue
+		}
+		max := 0
+		for _, frequency := range cpuFrequencies {
+			if frequency > max {
+				max = frequency
+			}
+		}
+		c, ok := byMax[max]
+		if !ok {
+			c = &Cluster{Cpus: make([]int, 0), Frequencies: make([]int, 0), Capacity: 1.0}
+			byMax[max] = c
+		}
+		c.Cpus = append(c.Cpus, cpu)
+		for _, frequency := range cpuFrequencies {
+			found := false
+			for _, other := range c.Frequencies {
+				if other == frequency {
+					found = true
+					break
+				}
+			}
+			if !found {
+				c.Frequencies = append(c.Frequencies, frequency)
+			}
+		}
+	}
+
+	maxes := make([]int, 0, len(byMax))
+	for max := range byMax {
+		maxes = append(maxes, max)
+	}
+	sort.Ints(maxes)
+
+	t := new(Topology)
+	t.Inferred = true
+	t.Clusters = make([]*Cluster, 0, len(maxes))
+	for idx, max := range maxes {
+		c := byMax[max]
+		c.Id = idx
+		sort.Ints(c.Cpus)
+		sort.Ints(c.Frequencies)
+		t.Clusters = append(t.Clusters, c)
+	}
+	return t
+}
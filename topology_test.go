@@ -0,0 +1,37 @@
+package cpuprof
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopology(t *testing.T) {
+	assert := assert.New(t)
+
+	topology := InferTopology(map[int][]int{
+		0: {300000, 600000},
+		1: {600000, 1200000, 300000},
+		2: {400000, 1800000},
+		3: {1800000},
+		4: {},
+	})
+	assert.True(topology.Inferred)
+	assert.Equal(3, len(topology.Clusters))
+	assert.Equal(&Cluster{0, []int{0}, []int{300000, 600000}, 1.0}, topology.Clusters[0])
+	assert.Equal(&Cluster{2, []int{2, 3}, []int{400000, 1800000}, 1.0}, topology.Clusters[2])
+	assert.Equal(4, topology.Ncpus())
+	assert.Equal(1, topology.Cluster(1).Id)
+	assert.Nil(topology.Cluster(4))
+
+	assert.Equal(1.0, topology.Capacity(3, 1800000))
+	assert.Equal(0.5, topology.Capacity(1, 900000))
+	assert.Equal(0.0, topology.Capacity(4, 900000))
+	assert.InDelta(1.0/3+2.0/3+2, topology.TotalCapacity(), 1e-9)
+
+	nexus5 := Topologies["Nexus 5"]
+	assert.False(nexus5.Inferred)
+	assert.Equal(4, nexus5.Ncpus())
+	assert.Equal(2265600, nexus5.Clusters[0].MaxFrequency())
+	assert.Equal(4.0, nexus5.TotalCapacity())
+}